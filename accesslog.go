@@ -0,0 +1,94 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	accessLogEnabled = true
+	// accessLogSkip holds ACCESS_LOG_EXCLUDE patterns, e.g. health checks;
+	// matching requests are still logged when they fail
+	accessLogSkip [][]string
+)
+
+// Middleware writing one access log line per request once it completes:
+// method, route, path, status, latency, response bytes and, when the request
+// authenticated, the caller's sub, username, roles and client ID
+func accessLogMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+		if err != nil {
+			// Render the error now so the logged status is the one sent
+			if herr := c.App().ErrorHandler(c, err); herr != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+		status := c.Response().StatusCode()
+		if status < fiber.StatusBadRequest && skipAccessLog(c.Path()) {
+			return nil
+		}
+
+		logger := requestLogger(c.UserContext())
+		event := logger.Info()
+		switch {
+		case status >= fiber.StatusInternalServerError:
+			event = logger.Error()
+		case status >= fiber.StatusBadRequest:
+			event = logger.Warn()
+		}
+		event.Str("method", c.Method()).
+			Str("route", c.Route().Path).
+			Str("path", c.Path()).
+			Int("status", status).
+			Dur("latency", time.Since(start)).
+			Str("ip", c.IP())
+		// Reading a streamed body, e.g. SSE, would wait for the stream to end
+		if !c.Response().IsBodyStream() {
+			event.Int("bytes", len(c.Response().Body()))
+		}
+		// sub and roles are already on the logger once authenticated
+		if user := userFromCtx(c); user != nil {
+			event.Str("username", user.Username)
+			if client := user.Claims.AuthorizedParty; client != "" {
+				event.Str("client_id", client)
+			} else if client := user.Claims.ServiceAccountClient(); client != "" {
+				event.Str("client_id", client)
+			}
+		}
+		event.Msg("Request completed")
+		return nil
+	}
+}
+
+func skipAccessLog(path string) bool {
+	for _, p := range accessLogSkip {
+		if pathMatches(p, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Load ACCESS_LOG and ACCESS_LOG_EXCLUDE
+func initAccessLog() {
+	if !cfg.Log.Access {
+		accessLogEnabled = false
+		log.Info().Msg("Access log disabled")
+		return
+	}
+	patterns := cfg.Log.AccessExclude
+	for _, p := range patterns {
+		segments, err := compilePathPattern(p)
+		if err != nil {
+			log.Fatal().Err(err).Msg("ACCESS_LOG_EXCLUDE error")
+		}
+		accessLogSkip = append(accessLogSkip, segments)
+	}
+	if len(patterns) > 0 {
+		log.Info().Strs("paths", patterns).Msg("Access log excludes successful requests")
+	}
+}
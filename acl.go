@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// itemACL is set when ITEM_ACL=true: items are private to their owner and
+// those they share them with, and repository.WithACL checks every call
+var itemACL bool
+
+// principalOf returns the ACL principal of user. Groups are listed with
+// their ancestors, as a grant to /staff covers /staff/backend; admins
+// reach every item.
+func principalOf(user *User) *repository.Principal {
+	p := &repository.Principal{Subject: user.Subject, Superuser: user.HasRole("admin")}
+	seen := map[string]bool{}
+	for _, g := range user.Claims.Groups {
+		for g = strings.TrimSuffix(g, "/"); g != "" && !seen[g]; {
+			seen[g] = true
+			p.Groups = append(p.Groups, g)
+			i := strings.LastIndex(g, "/")
+			if i < 0 {
+				break
+			}
+			g = g[:i]
+		}
+	}
+	return p
+}
+
+// withRequestPrincipal carries the principal of c's request into ctx, for
+// work outliving the handler
+func withRequestPrincipal(ctx context.Context, c *fiber.Ctx) context.Context {
+	if p := repository.PrincipalOf(c.UserContext()); p != nil {
+		return repository.WithPrincipal(ctx, p)
+	}
+	return ctx
+}
+
+type grantBody struct {
+	Subject string `json:"sub"`
+	Group   string `json:"group"`
+	Access  string `json:"access"`
+}
+
+// sameGrantee tells whether g is for the subject or group of body
+func (body grantBody) sameGrantee(g repository.Grant) bool {
+	return g.Subject == body.Subject && g.Group == body.Group
+}
+
+// permissionsJSON is the body of the permission routes
+func permissionsJSON(item *repository.Item) fiber.Map {
+	grants := item.ACL
+	if grants == nil {
+		grants = []repository.Grant{}
+	}
+	return fiber.Map{"id": item.ID, "ownerId": item.OwnerID, "grants": grants}
+}
+
+// registerPermissionRoutes mounts /items/:id/permissions, where an item's
+// owner shares it. Anyone who can read the item sees its grants; changing
+// them takes the owner, which the repository enforces.
+func registerPermissionRoutes(app *fiber.App, repos *repository.Repositories) {
+	items := repos.Items
+	auth := requireAnyRole("user", "admin")
+
+	app.Get("/items/:id/permissions", auth, func(c *fiber.Ctx) error {
+		item, err := items.Get(c.UserContext(), c.Params("id"))
+		if err != nil {
+			return itemError(err)
+		}
+		return c.JSON(permissionsJSON(item))
+	})
+
+	// change applies edit to the grants of the item, in a transaction with
+	// its audit entry
+	change := func(c *fiber.Ctx, edit func([]repository.Grant) ([]repository.Grant, error)) error {
+		var item *repository.Item
+		err := repos.Tx.InTx(c.UserContext(), func(ctx context.Context) error {
+			var err error
+			if item, err = items.Get(ctx, c.Params("id")); err != nil {
+				return err
+			}
+			before := item.ACL
+			if item.ACL, err = edit(append([]repository.Grant{}, item.ACL...)); err != nil {
+				return err
+			}
+			if len(item.ACL) == 0 {
+				item.ACL = nil
+			}
+			if err := items.Update(ctx, item); err != nil {
+				return err
+			}
+			changes := []repository.FieldChange{{Field: "acl", From: before, To: item.ACL}}
+			return auditInTx(ctx, c, repos.Audit, fiber.StatusOK, item.ID, changes)
+		})
+		if err != nil {
+			var appErr *apperror.Error
+			if errors.As(err, &appErr) {
+				return err
+			}
+			return itemError(err)
+		}
+		return c.JSON(permissionsJSON(item))
+	}
+
+	// Grants read or write to {"sub"} or {"group"}, replacing the access
+	// it had
+	app.Post("/items/:id/permissions", auth, func(c *fiber.Ctx) error {
+		var body grantBody
+		if err := c.BodyParser(&body); err != nil {
+			return apperror.Validation("Invalid body")
+		}
+		if (body.Subject == "") == (body.Group == "") {
+			return apperror.Validation("Invalid body", fiber.Map{"grantee": "set one of sub and group"})
+		}
+		if !repository.ValidGrantAccess(body.Access) {
+			return apperror.Validation("Invalid body", fiber.Map{"access": "expected read or write"})
+		}
+		body.Group = strings.TrimSuffix(body.Group, "/")
+		return change(c, func(grants []repository.Grant) ([]repository.Grant, error) {
+			grant := repository.Grant{Subject: body.Subject, Group: body.Group, Access: body.Access}
+			for i, g := range grants {
+				if body.sameGrantee(g) {
+					grants[i] = grant
+					return grants, nil
+				}
+			}
+			if len(grants) >= maxItemGrants {
+				return nil, apperror.Validation("Too many grants", fiber.Map{"grants": "an item is shared with 100 subjects and groups at most"})
+			}
+			return append(grants, grant), nil
+		})
+	})
+
+	// Revokes the grant of ?sub or ?group
+	app.Delete("/items/:id/permissions", auth, func(c *fiber.Ctx) error {
+		body := grantBody{Subject: c.Query("sub"), Group: strings.TrimSuffix(c.Query("group"), "/")}
+		if (body.Subject == "") == (body.Group == "") {
+			return apperror.Validation("Invalid parameters", fiber.Map{"grantee": "set one of sub and group"})
+		}
+		return change(c, func(grants []repository.Grant) ([]repository.Grant, error) {
+			for i, g := range grants {
+				if body.sameGrantee(g) {
+					return append(grants[:i], grants[i+1:]...), nil
+				}
+			}
+			return nil, apperror.NotFound("Grant not found")
+		})
+	})
+}
+
+// maxItemGrants bounds the grants of an item, so reads stay cheap
+const maxItemGrants = 100
+
+// Enable item sharing when ITEM_ACL=true
+func initItemACL() {
+	itemACL = cfg.Items.ACL
+	if itemACL {
+		log.Info().Msg("Item ACLs enabled: items are private to their owner and grantees")
+	}
+}
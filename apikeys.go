@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// headerAPIKey carries the key of machine clients that can't do OIDC
+const headerAPIKey = "X-API-Key"
+
+// apiKeyPrefix starts every generated key, so leaked keys are easy to grep for
+const apiKeyPrefix = "fk_"
+
+// apiKeys is set when API_KEYS=true
+var apiKeys *apiKeyStore
+
+// apiKey is a stored key. Only the SHA-256 of the key is kept; keys are 32
+// random bytes, so a slow hash would add nothing.
+type apiKey struct {
+	ID         primitive.ObjectID `bson:"_id" json:"id"`
+	Name       string             `bson:"name" json:"name"`
+	Hash       string             `bson:"hash" json:"-"`
+	Hint       string             `bson:"hint" json:"hint"` // first characters, to tell keys apart
+	Roles      []string           `bson:"roles" json:"roles"`
+	DailyQuota int64              `bson:"dailyQuota" json:"dailyQuota"` // 0 is unlimited
+	ExpiresAt  *time.Time         `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+	CreatedAt  time.Time          `bson:"createdAt" json:"createdAt"`
+	CreatedBy  string             `bson:"createdBy" json:"createdBy"`
+}
+
+func (k *apiKey) expired(now time.Time) bool {
+	return k.ExpiresAt != nil && now.After(*k.ExpiresAt)
+}
+
+// apiKeyParty is the azp of the claims of API keys
+const apiKeyParty = "api-key"
+
+// claims presents the key as a token so role guards and policies apply
+// unchanged. The subject is "apikey:<id>".
+func (k *apiKey) claims() *KeycloakClaims {
+	roles := append([]string{}, k.Roles...)
+	claims := &KeycloakClaims{
+		PreferredUsername: k.Name,
+		AuthorizedParty:   apiKeyParty,
+		Roles:             roles,
+		RealmAccess:       &RoleClaim{Roles: roles},
+	}
+	claims.Subject = "apikey:" + k.ID.Hex()
+	if k.ExpiresAt != nil {
+		claims.ExpiresAt = jwt.NewNumericDate(*k.ExpiresAt)
+	}
+	claims.Raw = jwt.MapClaims{
+		"sub":                claims.Subject,
+		"preferred_username": claims.PreferredUsername,
+		"azp":                claims.AuthorizedParty,
+		"roles":              roles,
+	}
+	return claims
+}
+
+type apiKeyStore struct {
+	keys  *mongo.Collection // apiKey
+	usage *mongo.Collection // {_id: "<id>:<yyyy-mm-dd>", count, expiresAt}
+
+	// cache holds keys by hash so authenticated calls don't hit Mongo every
+	// time; revoked keys may be accepted for its TTL
+	cache *ttlCache[*apiKey]
+	// misses remembers hashes matching no key, apart from cache so callers
+	// sending random keys only evict each other's misses
+	misses *lruCache[bool]
+}
+
+// apiKeyCacheTTL bounds how long a deleted or changed key keeps its old state
+const apiKeyCacheTTL = 30 * time.Second
+
+func newAPIKeyStore(db *mongo.Database) (*apiKeyStore, error) {
+	s := &apiKeyStore{
+		keys:   db.Collection("api_keys"),
+		usage:  db.Collection("api_key_usage"),
+		cache:  newTTLCache[*apiKey](10000),
+		misses: newLRUCache[bool](1000),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := s.keys.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := s.usage.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// create stores a new key and returns it with its plaintext, which is not
+// kept anywhere
+func (s *apiKeyStore) create(ctx context.Context, k *apiKey) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	plaintext := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	k.ID = primitive.NewObjectID()
+	k.Hash = hashAPIKey(plaintext)
+	k.Hint = plaintext[:len(apiKeyPrefix)+6]
+	k.CreatedAt = time.Now()
+	if k.Roles == nil {
+		k.Roles = []string{}
+	}
+	if _, err := s.keys.InsertOne(ctx, k); err != nil {
+		return "", err
+	}
+	return plaintext, nil
+}
+
+// lookup returns the key matching plaintext, or nil when there is none
+func (s *apiKeyStore) lookup(ctx context.Context, plaintext string) (*apiKey, error) {
+	hash := hashAPIKey(plaintext)
+	if k, ok := s.cache.get(hash); ok {
+		return k, nil
+	}
+	if _, ok := s.misses.get(hash); ok {
+		return nil, nil
+	}
+	k := &apiKey{}
+	err := s.keys.FindOne(ctx, bson.M{"hash": hash}).Decode(k)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		s.misses.set(hash, true, time.Now().Add(apiKeyCacheTTL))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.cache.set(hash, k, time.Now().Add(apiKeyCacheTTL))
+	return k, nil
+}
+
+// use counts one request against the key's daily quota and reports whether
+// it is still within it
+func (s *apiKeyStore) use(ctx context.Context, k *apiKey) (bool, error) {
+	if k.DailyQuota <= 0 {
+		return true, nil
+	}
+	now := time.Now().UTC()
+	day := now.Format("2006-01-02")
+	var usage struct {
+		Count int64 `bson:"count"`
+	}
+	err := s.usage.FindOneAndUpdate(ctx,
+		bson.M{"_id": k.ID.Hex() + ":" + day},
+		bson.M{"$inc": bson.M{"count": 1}, "$setOnInsert": bson.M{"expiresAt": now.Add(48 * time.Hour)}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&usage)
+	if err != nil {
+		return false, err
+	}
+	return usage.Count <= k.DailyQuota, nil
+}
+
+// authenticateAPIKey resolves X-API-Key into claims for parseToken
+func authenticateAPIKey(c *fiber.Ctx) (*KeycloakClaims, error) {
+	ctx, cancel := context.WithTimeout(c.UserContext(), 5*time.Second)
+	defer cancel()
+	k, err := apiKeys.lookup(ctx, c.Get(headerAPIKey))
+	if err != nil {
+		requestLogger(ctx).Error().Err(err).Msg("API key lookup error")
+		return nil, fmt.Errorf("cannot check API key")
+	}
+	if k == nil {
+		return nil, fmt.Errorf("invalid API key")
+	}
+	if k.expired(time.Now()) {
+		return nil, fmt.Errorf("API key has expired")
+	}
+	return k.claims(), nil
+}
+
+// Middleware counting API key requests against their daily quota. Unknown
+// keys are passed on for the route's guard to reject.
+func apiKeyQuotaMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		plaintext := c.Get(headerAPIKey)
+		if plaintext == "" {
+			return c.Next()
+		}
+		ctx, cancel := context.WithTimeout(c.UserContext(), 5*time.Second)
+		defer cancel()
+		k, err := apiKeys.lookup(ctx, plaintext)
+		if err != nil || k == nil || k.expired(time.Now()) {
+			return c.Next()
+		}
+		ok, err := apiKeys.use(ctx, k)
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		if !ok {
+			c.Set("X-RateLimit-Limit", strconv.FormatInt(k.DailyQuota, 10))
+			return apperror.RateLimited("API key daily quota exceeded")
+		}
+		return c.Next()
+	}
+}
+
+// Admin endpoints to manage API keys
+func registerAPIKeyRoutes(app *fiber.App) {
+	type keyBody struct {
+		Name       string     `json:"name"`
+		Roles      []string   `json:"roles"`
+		DailyQuota *int64     `json:"dailyQuota"`
+		ExpiresAt  *time.Time `json:"expiresAt"`
+	}
+	keyID := func(c *fiber.Ctx) (primitive.ObjectID, error) {
+		return primitive.ObjectIDFromHex(c.Params("id"))
+	}
+
+	app.Get("/admin/api-keys", requireRole("admin"), func(c *fiber.Ctx) error {
+		cur, err := apiKeys.keys.Find(c.UserContext(), bson.M{}, options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}))
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		keys := []apiKey{}
+		if err := cur.All(c.UserContext(), &keys); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.JSON(fiber.Map{"keys": keys})
+	})
+
+	app.Get("/admin/api-keys/:id", requireRole("admin"), func(c *fiber.Ctx) error {
+		id, err := keyID(c)
+		if err != nil {
+			return apperror.NotFound("Not found")
+		}
+		var k apiKey
+		err = apiKeys.keys.FindOne(c.UserContext(), bson.M{"_id": id}).Decode(&k)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return apperror.NotFound("Not found")
+		}
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.JSON(k)
+	})
+
+	// The response is the only time the plaintext key is shown
+	app.Post("/admin/api-keys", requireRole("admin"), func(c *fiber.Ctx) error {
+		var body keyBody
+		if err := c.BodyParser(&body); err != nil {
+			return apperror.Validation("Invalid body")
+		}
+		if body.Name == "" {
+			return apperror.Validation("name is required")
+		}
+		k := &apiKey{Name: body.Name, Roles: body.Roles, ExpiresAt: body.ExpiresAt, CreatedBy: claimsFromCtx(c).Subject}
+		if body.DailyQuota != nil {
+			k.DailyQuota = *body.DailyQuota
+		}
+		plaintext, err := apiKeys.create(c.UserContext(), k)
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"key": plaintext, "apiKey": k})
+	})
+
+	app.Patch("/admin/api-keys/:id", requireRole("admin"), func(c *fiber.Ctx) error {
+		id, err := keyID(c)
+		if err != nil {
+			return apperror.NotFound("Not found")
+		}
+		var body keyBody
+		if err := c.BodyParser(&body); err != nil {
+			return apperror.Validation("Invalid body")
+		}
+		set := bson.M{}
+		if body.Name != "" {
+			set["name"] = body.Name
+		}
+		if body.Roles != nil {
+			set["roles"] = body.Roles
+		}
+		if body.DailyQuota != nil {
+			set["dailyQuota"] = *body.DailyQuota
+		}
+		if body.ExpiresAt != nil {
+			set["expiresAt"] = *body.ExpiresAt
+		}
+		if len(set) == 0 {
+			return apperror.Validation("Nothing to update")
+		}
+		var k apiKey
+		err = apiKeys.keys.FindOneAndUpdate(c.UserContext(), bson.M{"_id": id}, bson.M{"$set": set},
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&k)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return apperror.NotFound("Not found")
+		}
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		apiKeys.cache.delete(k.Hash)
+		return c.JSON(k)
+	})
+
+	app.Delete("/admin/api-keys/:id", requireRole("admin"), func(c *fiber.Ctx) error {
+		id, err := keyID(c)
+		if err != nil {
+			return apperror.NotFound("Not found")
+		}
+		var k apiKey
+		err = apiKeys.keys.FindOneAndDelete(c.UserContext(), bson.M{"_id": id}).Decode(&k)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return apperror.NotFound("Not found")
+		}
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		apiKeys.cache.delete(k.Hash)
+		return c.JSON(fiber.Map{"deleted": k.ID.Hex()})
+	})
+}
+
+// Enable X-API-Key authentication when API_KEYS=true
+func initAPIKeys() {
+	if !cfg.Auth.APIKeys {
+		return
+	}
+	store, err := newAPIKeyStore(mongoDB)
+	if err != nil {
+		log.Fatal().Err(err).Msg("API key store error")
+	}
+	apiKeys = store
+	log.Info().Str("header", headerAPIKey).Msg("API key authentication enabled")
+}
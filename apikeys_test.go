@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testAPIKeyStore returns a store in a scratch database of the MongoDB
+// server named by MONGO_TEST_URI, skipping t without one
+func testAPIKeyStore(t *testing.T) *apiKeyStore {
+	t.Helper()
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database(fmt.Sprintf("fiber_demo_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		_ = db.Drop(ctx)
+		_ = client.Disconnect(ctx)
+	})
+	s, err := newAPIKeyStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestUnknownAPIKeysDoNotCrowdOutKnownOnes(t *testing.T) {
+	s := testAPIKeyStore(t)
+	s.cache = newTTLCache[*apiKey](10)
+	s.misses = newLRUCache[bool](5)
+	ctx := context.Background()
+
+	for i := 0; i < 50; i++ {
+		k, err := s.lookup(ctx, fmt.Sprintf("fk_random%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k != nil {
+			t.Fatalf("random key %d matched %s", i, k.Name)
+		}
+	}
+
+	plaintext, err := s.create(ctx, &apiKey{Name: "ci"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := s.lookup(ctx, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k == nil || k.Name != "ci" {
+		t.Fatalf("created key: got %+v", k)
+	}
+	if _, ok := s.cache.get(hashAPIKey(plaintext)); !ok {
+		t.Error("created key was not cached after the random ones")
+	}
+}
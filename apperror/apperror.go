@@ -0,0 +1,200 @@
+// Package apperror defines the errors handlers return instead of writing
+// error responses themselves. Handler maps them, and any other error, to a
+// consistent {"error": "...", "code": "...", "requestId": "..."} body.
+package apperror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+// Error is an error with the HTTP status and machine-readable code it is
+// reported with
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	// Details is added to the body as "details" when set, e.g. field errors
+	Details interface{}
+	// Err is the underlying cause; logged, never sent to the client
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// NotFound reports a missing resource (404)
+func NotFound(msg string) *Error {
+	return &Error{Status: fiber.StatusNotFound, Code: "not_found", Message: msg}
+}
+
+// Forbidden reports an authenticated caller lacking access (403)
+func Forbidden(msg string) *Error {
+	return &Error{Status: fiber.StatusForbidden, Code: "forbidden", Message: msg}
+}
+
+// Validation reports a malformed or invalid request (400), optionally with
+// per-field details
+func Validation(msg string, details ...interface{}) *Error {
+	e := &Error{Status: fiber.StatusBadRequest, Code: "validation_failed", Message: msg}
+	if len(details) == 1 {
+		e.Details = details[0]
+	} else if len(details) > 1 {
+		e.Details = details
+	}
+	return e
+}
+
+// Conflict reports a request clashing with the current state (409)
+func Conflict(msg string) *Error {
+	return &Error{Status: fiber.StatusConflict, Code: "conflict", Message: msg}
+}
+
+// TooLarge reports a request body over its size limit (413)
+func TooLarge(msg string) *Error {
+	return &Error{Status: fiber.StatusRequestEntityTooLarge, Code: "too_large", Message: msg}
+}
+
+// Unprocessable reports a well-formed write the database refuses, e.g. one
+// failing its schema validator (422)
+func Unprocessable(msg string) *Error {
+	return &Error{Status: fiber.StatusUnprocessableEntity, Code: "unprocessable", Message: msg}
+}
+
+// PreconditionRequired reports a write missing the If-Match it needs (428)
+func PreconditionRequired(msg string) *Error {
+	return &Error{Status: fiber.StatusPreconditionRequired, Code: "precondition_required", Message: msg}
+}
+
+// FailedDependency reports a part of a batch skipped because an earlier
+// part failed (424)
+func FailedDependency(msg string) *Error {
+	return &Error{Status: fiber.StatusFailedDependency, Code: "not_attempted", Message: msg}
+}
+
+// RateLimited reports a caller over its request limit (429)
+func RateLimited(msg string) *Error {
+	return &Error{Status: fiber.StatusTooManyRequests, Code: "rate_limited", Message: msg}
+}
+
+// Unavailable reports a feature the deployment can't serve right now (503)
+func Unavailable(msg string) *Error {
+	return &Error{Status: fiber.StatusServiceUnavailable, Code: "unavailable", Message: msg}
+}
+
+// Internal reports a server-side failure (500). msg is what the client sees;
+// err is only logged.
+func Internal(msg string, err error) *Error {
+	return &Error{Status: fiber.StatusInternalServerError, Code: "internal", Message: msg, Err: err}
+}
+
+// StatusOf is the status Handler answers err with
+func StatusOf(err error) int {
+	var appErr *Error
+	var fiberErr *fiber.Error
+	status := fiber.StatusInternalServerError
+	switch {
+	case errors.As(err, &appErr):
+		status = appErr.Status
+	case errors.As(err, &fiberErr):
+		status = fiberErr.Code
+	}
+	switch {
+	case status != fiber.StatusInternalServerError:
+	case errors.Is(err, context.DeadlineExceeded):
+		return fiber.StatusGatewayTimeout
+	case temporary(err):
+		return fiber.StatusServiceUnavailable
+	}
+	return status
+}
+
+// temporary tells whether err says it should go away on its own, as the
+// database errors outlasting their retries do
+func temporary(err error) bool {
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && t.Temporary()
+}
+
+// Handler is the app's fiber.Config ErrorHandler
+func Handler(c *fiber.Ctx, err error) error {
+	var appErr *Error
+	var fiberErr *fiber.Error
+	switch {
+	case errors.As(err, &appErr):
+	case errors.As(err, &fiberErr):
+		// Errors raised by Fiber itself, e.g. unknown routes or oversized bodies
+		appErr = &Error{Status: fiberErr.Code, Code: codeForStatus(fiberErr.Code), Message: fiberErr.Message}
+	default:
+		appErr = Internal("Internal server error", err)
+	}
+	// Failures that retrying later should fix, e.g. a database between
+	// primaries
+	if appErr.Status == fiber.StatusInternalServerError && errors.Is(err, context.DeadlineExceeded) {
+		appErr = &Error{Status: fiber.StatusGatewayTimeout, Code: "timeout", Message: "The request took too long", Err: err}
+	} else if appErr.Status == fiber.StatusInternalServerError && temporary(err) {
+		appErr = &Error{Status: fiber.StatusServiceUnavailable, Code: "unavailable", Message: "Temporarily unavailable, retry later", Err: err}
+		c.Set(fiber.HeaderRetryAfter, "1")
+	}
+
+	// Set by the request ID middleware, so clients can quote it in reports
+	requestID := string(c.Response().Header.Peek(fiber.HeaderXRequestID))
+	if appErr.Status >= fiber.StatusInternalServerError {
+		zerolog.Ctx(c.UserContext()).Error().Err(appErr).
+			Str("method", c.Method()).Str("path", c.Path()).Int("status", appErr.Status).
+			Msg("Request failed")
+	}
+	body := fiber.Map{"error": appErr.Message, "code": appErr.Code}
+	if appErr.Details != nil {
+		body["details"] = appErr.Details
+	}
+	if requestID != "" {
+		body["requestId"] = requestID
+	}
+	return c.Status(appErr.Status).JSON(body)
+}
+
+func codeForStatus(status int) string {
+	switch status {
+	case fiber.StatusBadRequest:
+		return "validation_failed"
+	case fiber.StatusUnauthorized:
+		return "unauthorized"
+	case fiber.StatusForbidden:
+		return "forbidden"
+	case fiber.StatusNotFound:
+		return "not_found"
+	case fiber.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case fiber.StatusConflict:
+		return "conflict"
+	case fiber.StatusRequestEntityTooLarge:
+		return "too_large"
+	case fiber.StatusUnprocessableEntity:
+		return "unprocessable"
+	case fiber.StatusFailedDependency:
+		return "not_attempted"
+	case fiber.StatusPreconditionRequired:
+		return "precondition_required"
+	case fiber.StatusTooManyRequests:
+		return "rate_limited"
+	case fiber.StatusServiceUnavailable:
+		return "unavailable"
+	case fiber.StatusGatewayTimeout:
+		return "timeout"
+	}
+	if status >= fiber.StatusInternalServerError {
+		return "internal"
+	}
+	return "error"
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	auditEnabled   = true
+	auditRetention = 90 * 24 * time.Hour
+)
+
+// Locals keys handlers use to annotate their audit entry
+const (
+	auditResourceKey = "auditResource"
+	auditRecordedKey = "auditRecorded"
+)
+
+func isMutating(method string) bool {
+	switch method {
+	case fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// newAuditEntry describes the request c is serving. The resource is the one
+// set by auditInTx, else the route's first parameter.
+func newAuditEntry(c *fiber.Ctx, status int) *repository.AuditEntry {
+	now := time.Now().UTC()
+	entry := &repository.AuditEntry{
+		At:        now,
+		Method:    c.Method(),
+		Route:     c.Route().Path,
+		Path:      c.Path(),
+		Status:    status,
+		RequestID: requestID(c),
+		ExpiresAt: now.Add(auditRetention),
+	}
+	if user := userFromCtx(c); user != nil {
+		entry.Actor = repository.AuditActor{
+			Subject:    user.Subject,
+			Username:   user.Username,
+			Roles:      user.Roles,
+			CallerType: user.Claims.CallerType(),
+		}
+	}
+	if id, ok := c.Locals(auditResourceKey).(string); ok {
+		entry.ResourceID = id
+	} else if params := c.Route().Params; len(params) > 0 {
+		entry.ResourceID = c.Params(params[0])
+	}
+	return entry
+}
+
+// auditInTx records the request's entry with ctx, the transaction of its
+// write, so the two commit or roll back together. auditMiddleware then
+// leaves the request alone unless it fails after all.
+func auditInTx(ctx context.Context, c *fiber.Ctx, audit repository.AuditRepository, status int, resourceID string, changes []repository.FieldChange) error {
+	if !auditEnabled {
+		return nil
+	}
+	c.Locals(auditResourceKey, resourceID)
+	entry := newAuditEntry(c, status)
+	entry.Changes = changes
+	if err := audit.Record(ctx, entry); err != nil {
+		return err
+	}
+	c.Locals(auditRecordedKey, true)
+	return nil
+}
+
+// Middleware recording every mutating request once it has been answered,
+// denied ones included. A failure to record is logged; the response has
+// been decided by then.
+func auditMiddleware(audit repository.AuditRepository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !isMutating(c.Method()) {
+			return c.Next()
+		}
+		err := c.Next()
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = apperror.StatusOf(err)
+		}
+		if recorded, _ := c.Locals(auditRecordedKey).(bool); recorded && status < fiber.StatusBadRequest {
+			return err
+		}
+		if multiTenant() && repository.TenantOf(c.UserContext()) == "" {
+			// Denied before a tenant was known, so no tenant's log takes it
+			requestLogger(c.UserContext()).Warn().Str("method", c.Method()).Str("path", c.Path()).Int("status", status).
+				Msg("Request outside any tenant, not audited")
+			return err
+		}
+		if rerr := audit.Record(c.UserContext(), newAuditEntry(c, status)); rerr != nil {
+			requestLogger(c.UserContext()).Error().Err(rerr).Msg("Cannot record audit entry")
+		}
+		return err
+	}
+}
+
+// auditFilterFields are the fields of ?filter on GET /admin/audit; since
+// and until take RFC 3339 times
+var auditFilterFields = []string{"actor", "method", "route", "resourceId", "since", "until"}
+
+func auditFilter(f map[string]string) (repository.AuditFilter, error) {
+	filter := repository.AuditFilter{
+		Actor:      f["actor"],
+		Method:     strings.ToUpper(f["method"]),
+		Route:      f["route"],
+		ResourceID: f["resourceId"],
+	}
+	for _, bound := range []struct {
+		name string
+		dest *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		v, ok := f[bound.name]
+		if !ok {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, apperror.Validation("Invalid list parameters", fiber.Map{"filter": bound.name + " must be an RFC 3339 time"})
+		}
+		*bound.dest = t
+	}
+	return filter, nil
+}
+
+// registerAuditRoutes mounts the admin query API of the audit log, newest
+// entries first unless ?sort=at
+func registerAuditRoutes(app *fiber.App, audit repository.AuditRepository) {
+	app.Get("/admin/audit", requireRole("admin"), func(c *fiber.Ctx) error {
+		params, err := parseListParams(c, []string{"at"}, auditFilterFields)
+		if err != nil {
+			return err
+		}
+		if params.cursor != "" {
+			return apperror.Validation("Invalid list parameters", fiber.Map{"cursor": "not supported here, use page"})
+		}
+		filter, err := auditFilter(params.filter)
+		if err != nil {
+			return err
+		}
+		entries, total, err := audit.List(c.UserContext(), filter, params.repoPage())
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.JSON(listEnvelope("entries", entries, params, total, ""))
+	})
+}
+
+// Load AUDIT_LOG and AUDIT_RETENTION
+func initAudit() {
+	if !cfg.Audit.Enabled {
+		auditEnabled = false
+		log.Info().Msg("Audit log disabled")
+		return
+	}
+	auditRetention = cfg.Audit.Retention
+	log.Info().Dur("retention", auditRetention).Msg("Audit log enabled")
+}
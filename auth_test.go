@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/example/fiber-demo/tokentest"
+	"github.com/gofiber/fiber/v2"
+)
+
+// authApp serves GET /me to any authenticated caller, with their username,
+// and GET /admin to admins
+func authApp() *fiber.App {
+	app := newTestApp()
+	app.Get("/me", authenticate(), func(c *fiber.Ctx) error {
+		return c.SendString(userFromCtx(c).Username)
+	})
+	app.Get("/admin", requireRole("admin"), func(c *fiber.Ctx) error {
+		return c.SendString("ok")
+	})
+	return app
+}
+
+func TestTokensAreVerified(t *testing.T) {
+	app := authApp()
+	// Signed with a key outside the JWKS
+	other, err := tokentest.NewIssuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	forged, err := other.Sign(map[string]interface{}{"sub": "mallory", "iss": issuer.URL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour)
+	saved := allowedIssuers
+	defer func() { allowedIssuers = saved }()
+	allowedIssuers = []string{issuer.URL()}
+
+	for _, tc := range []struct {
+		name, token string
+		status      int
+	}{
+		{"without a token", "", http.StatusUnauthorized},
+		{"with a malformed token", "not.a.token", http.StatusUnauthorized},
+		{"with a key outside the JWKS", forged, http.StatusUnauthorized},
+		{"of another issuer", sign(t, map[string]interface{}{"sub": "alice", "iss": "https://evil.example.com/realms/demo"}), http.StatusUnauthorized},
+		{"expired", sign(t, map[string]interface{}{"sub": "alice", "iat": past.Unix(), "exp": past.Add(time.Minute).Unix()}), http.StatusUnauthorized},
+		{"without exp", sign(t, map[string]interface{}{"sub": "alice", "exp": nil}), http.StatusUnauthorized},
+		{"valid", token(t, "alice"), http.StatusOK},
+	} {
+		resp := call(t, app, http.MethodGet, "/me", tc.token)
+		if resp.StatusCode != tc.status {
+			t.Errorf("GET /me %s: got %d, want %d", tc.name, resp.StatusCode, tc.status)
+		}
+	}
+
+	body, _ := io.ReadAll(call(t, app, http.MethodGet, "/me", token(t, "alice")).Body)
+	if string(body) != "alice" {
+		t.Errorf("GET /me: got user %q, want alice", body)
+	}
+}
+
+func TestRolesAreEnforced(t *testing.T) {
+	app := authApp()
+	for _, tc := range []struct {
+		name, token string
+		status      int
+	}{
+		{"without a token", "", http.StatusUnauthorized},
+		{"without the role", token(t, "alice", "user"), http.StatusForbidden},
+		{"with the role", token(t, "root", "user", "admin"), http.StatusOK},
+	} {
+		if resp := call(t, app, http.MethodGet, "/admin", tc.token); resp.StatusCode != tc.status {
+			t.Errorf("GET /admin %s: got %d, want %d", tc.name, resp.StatusCode, tc.status)
+		}
+	}
+}
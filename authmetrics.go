@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/gofiber/fiber/v2"
+)
+
+// authFailure tags an authentication error with the reason it is counted
+// under, e.g. "missing_header" or "wrong_audience"
+type authFailure struct {
+	reason string
+	err    error
+}
+
+func (e *authFailure) Error() string { return e.err.Error() }
+func (e *authFailure) Unwrap() error { return e.err }
+
+func failure(reason string, err error) error {
+	return &authFailure{reason: reason, err: err}
+}
+
+// failureReason returns the tagged reason of err, or "invalid_token"
+func failureReason(err error) string {
+	var af *authFailure
+	if errors.As(err, &af) {
+		return af.reason
+	}
+	return "invalid_token"
+}
+
+type authFailureKey struct {
+	route  string
+	status int
+	reason string
+}
+
+// authFailures counts rejected requests by route pattern, status and reason
+// so spikes of 401/403 can be traced to a misconfigured client or an attack
+var authFailures = struct {
+	mu     sync.Mutex
+	counts map[authFailureKey]int64
+}{counts: map[authFailureKey]int64{}}
+
+// failureRoute labels c by its route pattern, keeping counter cardinality
+// bounded; global middleware only knows the request's method
+func failureRoute(c *fiber.Ctx) string {
+	r := c.Route()
+	return r.Method + " " + r.Path
+}
+
+func recordAuthFailure(c *fiber.Ctx, status int, reason string) {
+	key := authFailureKey{route: failureRoute(c), status: status, reason: reason}
+	authFailures.mu.Lock()
+	authFailures.counts[key]++
+	authFailures.mu.Unlock()
+	authFailuresTotal.WithLabelValues(key.route, strconv.Itoa(status), reason).Inc()
+}
+
+// unauthorized counts and answers a 401 for a failed authentication. A
+// failure of the server rather than of the credentials, an apperror,
+// keeps its own status.
+func unauthorized(c *fiber.Ctx, err error) error {
+	var appErr *apperror.Error
+	if errors.As(err, &appErr) {
+		recordAuthFailure(c, appErr.Status, failureReason(err))
+		return appErr
+	}
+	recordAuthFailure(c, fiber.StatusUnauthorized, failureReason(err))
+	return errorJSON(c, fiber.StatusUnauthorized, fiber.Map{"error": err.Error()})
+}
+
+// forbidden counts and answers a 403 with msg
+func forbidden(c *fiber.Ctx, reason, msg string) error {
+	recordAuthFailure(c, fiber.StatusForbidden, reason)
+	return errorJSON(c, fiber.StatusForbidden, fiber.Map{"error": msg})
+}
+
+// authFailureCount is one row of /admin/auth-failures
+type authFailureCount struct {
+	Route  string `json:"route"`
+	Status int    `json:"status"`
+	Reason string `json:"reason"`
+	Count  int64  `json:"count"`
+}
+
+func authFailureCounts() []authFailureCount {
+	authFailures.mu.Lock()
+	rows := make([]authFailureCount, 0, len(authFailures.counts))
+	for k, n := range authFailures.counts {
+		rows = append(rows, authFailureCount{Route: k.route, Status: k.status, Reason: k.reason, Count: n})
+	}
+	authFailures.mu.Unlock()
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Count > rows[j].Count })
+	return rows
+}
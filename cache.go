@@ -0,0 +1,170 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Why ttlCache.add stored nothing
+var (
+	errCacheHit  = errors.New("key already cached")
+	errCacheFull = errors.New("cache full")
+)
+
+// ttlCache is a small size-bounded map whose entries expire. Expired entries
+// are swept when the cache fills; if it is still full, new entries are dropped.
+type ttlCache[V any] struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]ttlEntry[V]
+}
+
+type ttlEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+func newTTLCache[V any](maxEntries int) *ttlCache[V] {
+	return &ttlCache[V]{maxEntries: maxEntries, entries: map[string]ttlEntry[V]{}}
+}
+
+func (c *ttlCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		var zero V
+		return zero, false
+	}
+	return e.value, true
+}
+
+func (c *ttlCache[V]) set(key string, value V, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store(key, value, expires)
+}
+
+// add stores value unless a live entry for key exists, failing with
+// errCacheHit then and with errCacheFull when the cache has no room
+func (c *ttlCache[V]) add(key string, value V, expires time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok && !time.Now().After(e.expires) {
+		return errCacheHit
+	}
+	if !c.store(key, value, expires) {
+		return errCacheFull
+	}
+	return nil
+}
+
+// store must be called with mu held
+func (c *ttlCache[V]) store(key string, value V, expires time.Time) bool {
+	if len(c.entries) >= c.maxEntries {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			return false
+		}
+	}
+	c.entries[key] = ttlEntry[V]{value: value, expires: expires}
+	return true
+}
+
+func (c *ttlCache[V]) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// deleteWhere removes every entry whose value matches
+func (c *ttlCache[V]) deleteWhere(match func(V) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for k, e := range c.entries {
+		if match(e.value) {
+			delete(c.entries, k)
+			n++
+		}
+	}
+	return n
+}
+
+// lruCache is a size-bounded map whose entries expire; when full, the least
+// recently used entry is evicted, so hot keys stay cached under churn
+type lruCache[V any] struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	order   *list.List // front is most recently used; elements hold *lruEntry
+	entries map[string]*list.Element
+}
+
+type lruEntry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+func newLRUCache[V any](maxEntries int) *lruCache[V] {
+	return &lruCache[V]{maxEntries: maxEntries, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *lruCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	e := el.Value.(*lruEntry[V])
+	if time.Now().After(e.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *lruCache[V]) set(key string, value V, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value = &lruEntry[V]{key: key, value: value, expires: expires}
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[V]{key: key, value: value, expires: expires})
+	for len(c.entries) > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[V]).key)
+	}
+}
+
+// deleteWhere removes every entry whose value matches
+func (c *lruCache[V]) deleteWhere(match func(V) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, el := range c.entries {
+		if match(el.Value.(*lruEntry[V]).value) {
+			c.order.Remove(el)
+			delete(c.entries, key)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+	mongodbadapter "github.com/casbin/mongodb-adapter/v3"
+	"github.com/example/fiber-demo/apperror"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// casbinEnforcer is set when CASBIN=true. Policies live in the casbin_rules
+// collection and the model in casbin_model, so both can change at runtime.
+var casbinEnforcer *casbin.SyncedEnforcer
+
+// casbinAnonymous is the subject used for requests without a token
+const casbinAnonymous = "anonymous"
+
+// defaultCasbinModel is RBAC with path resources: subjects are the caller's
+// sub and roles, objects are request paths (keyMatch2 patterns such as
+// /items/:id or /admin/*), actions are HTTP methods or "*".
+const defaultCasbinModel = `
+[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act
+
+[role_definition]
+g = _, _
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = g(r.sub, p.sub) && keyMatch2(r.obj, p.obj) && (r.act == p.act || p.act == "*")
+`
+
+// Seeded into an empty casbin_rules collection so the demo routes keep working
+var defaultCasbinPolicies = [][]string{
+	{casbinAnonymous, "/public", "GET"},
+	{"user", "/profile", "GET"},
+	{"user", "/user", "GET"},
+	{"admin", "/*", "*"},
+}
+
+// Middleware asking Casbin whether the caller's sub or any of its roles may
+// perform the request
+func casbinMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		subjects := []string{casbinAnonymous}
+		if hasCredentials(c) {
+			user, err := currentUser(c)
+			if err != nil {
+				return unauthorized(c, err)
+			}
+			subjects = append([]string{user.Subject}, user.Roles...)
+		}
+
+		for _, sub := range subjects {
+			ok, err := casbinEnforcer.Enforce(sub, c.Path(), c.Method())
+			if err != nil {
+				return apperror.Internal("Authorization error", err)
+			}
+			if ok {
+				return c.Next()
+			}
+		}
+		return forbidden(c, "policy_denied", "Forbidden by policy")
+	}
+}
+
+// Admin endpoints to inspect and change Casbin policies at runtime
+func registerCasbinRoutes(app *fiber.App) {
+	type policyBody struct {
+		Sub string `json:"sub"`
+		Obj string `json:"obj"`
+		Act string `json:"act"`
+	}
+	parse := func(c *fiber.Ctx) (policyBody, error) {
+		var body policyBody
+		if err := c.BodyParser(&body); err != nil {
+			return body, apperror.Validation("Invalid body")
+		}
+		if body.Sub == "" || body.Obj == "" || body.Act == "" {
+			return body, apperror.Validation("sub, obj and act are required")
+		}
+		return body, nil
+	}
+
+	app.Get("/admin/casbin/policies", requireRole("admin"), func(c *fiber.Ctx) error {
+		policies, err := casbinEnforcer.GetPolicy()
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.JSON(fiber.Map{"policies": policies})
+	})
+
+	app.Post("/admin/casbin/policies", requireRole("admin"), func(c *fiber.Ctx) error {
+		body, err := parse(c)
+		if err != nil {
+			return err
+		}
+		added, err := casbinEnforcer.AddPolicy(body.Sub, body.Obj, body.Act)
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"added": added})
+	})
+
+	app.Delete("/admin/casbin/policies", requireRole("admin"), func(c *fiber.Ctx) error {
+		body, err := parse(c)
+		if err != nil {
+			return err
+		}
+		removed, err := casbinEnforcer.RemovePolicy(body.Sub, body.Obj, body.Act)
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.JSON(fiber.Map{"removed": removed})
+	})
+}
+
+// Set up the Casbin enforcer when CASBIN=true
+func initCasbin() {
+	if !cfg.Authz.Casbin {
+		return
+	}
+	m, err := loadCasbinModel()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Casbin model error")
+	}
+	adapter, err := mongodbadapter.NewAdapterByDB(mongoClient, &mongodbadapter.AdapterConfig{
+		DatabaseName:   mongoDB.Name(),
+		CollectionName: "casbin_rules",
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Casbin adapter error")
+	}
+	enforcer, err := casbin.NewSyncedEnforcer(m, adapter)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Casbin enforcer error")
+	}
+	policies, err := enforcer.GetPolicy()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Casbin policy error")
+	}
+	if len(policies) == 0 {
+		if _, err := enforcer.AddPolicies(defaultCasbinPolicies); err != nil {
+			log.Fatal().Err(err).Msg("Casbin policy error")
+		}
+	}
+	// Pick up changes made by other replicas
+	if interval := cfg.Authz.CasbinReloadInterval; interval > 0 {
+		enforcer.StartAutoLoadPolicy(interval)
+	}
+	casbinEnforcer = enforcer
+	log.Info().Msg("Casbin authorization enabled")
+}
+
+// loadCasbinModel reads the model from the casbin_model collection, storing
+// CASBIN_MODEL (a file path) or the default model there on first start
+func loadCasbinModel() (model.Model, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	coll := mongoDB.Collection("casbin_model")
+	var doc struct {
+		Text string `bson:"text"`
+	}
+	err := coll.FindOne(ctx, bson.M{"_id": "model"}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		doc.Text = defaultCasbinModel
+		if path := cfg.Authz.CasbinModel; path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			doc.Text = string(data)
+		}
+		if _, err := coll.InsertOne(ctx, bson.M{"_id": "model", "text": doc.Text}); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return model.NewModelFromString(doc.Text)
+}
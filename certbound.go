@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// clientCertHeader names the header a TLS-terminating proxy forwards the
+// caller's certificate in, URL-encoded PEM (CLIENT_CERT_HEADER). It is only
+// read from requests that passed verifyGateway, and config.Validate requires
+// GATEWAY_SECRET or GATEWAY_CLIENT_CA for that: a certificate is public, so
+// without them anyone holding a stolen bound token could forward it.
+var clientCertHeader string
+
+// checkCertificateBinding rejects certificate-bound tokens (cnf.x5t#S256)
+// unless the caller presents the certificate they were issued to
+func checkCertificateBinding(c *fiber.Ctx, claims *KeycloakClaims) error {
+	if claims.Confirmation == nil || claims.Confirmation.CertThumbprint == "" {
+		return nil
+	}
+	cert, err := clientCertificate(c)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(cert.Raw)
+	got := base64.RawURLEncoding.EncodeToString(sum[:])
+	if subtle.ConstantTimeCompare([]byte(got), []byte(claims.Confirmation.CertThumbprint)) != 1 {
+		return fmt.Errorf("client certificate does not match the token binding")
+	}
+	return nil
+}
+
+// clientCertificate returns the certificate presented on the TLS connection,
+// or else the one forwarded by a trusted proxy
+func clientCertificate(c *fiber.Ctx) (*x509.Certificate, error) {
+	if clientCertHeader != "" {
+		if forwarded := c.Get(clientCertHeader); forwarded != "" {
+			if err := verifyGateway(c); err != nil {
+				return nil, err
+			}
+			return parseForwardedCert(forwarded)
+		}
+	}
+	if state := c.Context().TLSConnectionState(); state != nil && len(state.PeerCertificates) > 0 {
+		return state.PeerCertificates[0], nil
+	}
+	return nil, fmt.Errorf("missing client certificate for certificate-bound token")
+}
+
+func parseForwardedCert(v string) (*x509.Certificate, error) {
+	unescaped, err := url.QueryUnescape(v)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s header: %v", clientCertHeader, err)
+	}
+	block, _ := pem.Decode([]byte(unescaped))
+	if block == nil {
+		return nil, fmt.Errorf("bad %s header: no PEM certificate", clientCertHeader)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s header: %v", clientCertHeader, err)
+	}
+	return cert, nil
+}
+
+// Read CLIENT_CERT_HEADER, once the gateway trust settings are loaded
+func initCertBinding() {
+	clientCertHeader = cfg.Gateway.ClientCertHeader
+	if clientCertHeader != "" {
+		log.Info().Str("header", clientCertHeader).Msg("Reading forwarded client certificates")
+	}
+}
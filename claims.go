@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// KeycloakClaims is the typed view of a Keycloak access token
+type KeycloakClaims struct {
+	jwt.RegisteredClaims
+
+	AuthorizedParty   string               `json:"azp,omitempty"`
+	PreferredUsername string               `json:"preferred_username,omitempty"`
+	Email             string               `json:"email,omitempty"`
+	EmailVerified     bool                 `json:"email_verified,omitempty"`
+	Roles             []string             `json:"roles,omitempty"`
+	RealmAccess       *RoleClaim           `json:"realm_access,omitempty"`
+	ResourceAccess    map[string]RoleClaim `json:"resource_access,omitempty"`
+	Groups            []string             `json:"groups,omitempty"`
+	Scope             string               `json:"scope,omitempty"`
+	Authorization     *AuthorizationClaim  `json:"authorization,omitempty"`
+	SessionID         string               `json:"sid,omitempty"`
+	Confirmation      *ConfirmationClaim   `json:"cnf,omitempty"`
+	ACR               string               `json:"acr,omitempty"`
+	AMR               []string             `json:"amr,omitempty"`
+
+	// Raw holds every claim of the token, including those without a typed field
+	Raw jwt.MapClaims `json:"-"`
+}
+
+// RoleClaim is the {"roles": [...]} shape used by realm_access and resource_access
+type RoleClaim struct {
+	Roles []string `json:"roles"`
+}
+
+// ConfirmationClaim binds a token to a key the caller must prove possession of
+// (RFC 7800)
+type ConfirmationClaim struct {
+	// JWKThumbprint is the RFC 7638 thumbprint of the DPoP key (RFC 9449)
+	JWKThumbprint string `json:"jkt,omitempty"`
+	// CertThumbprint is the SHA-256 thumbprint of the client certificate the
+	// token was issued to (RFC 8705)
+	CertThumbprint string `json:"x5t#S256,omitempty"`
+}
+
+// AuthorizationClaim carries the permissions granted in a UMA requesting
+// party token (RPT) by Keycloak Authorization Services
+type AuthorizationClaim struct {
+	Permissions []Permission `json:"permissions"`
+}
+
+// Permission is one granted resource with its scopes
+type Permission struct {
+	ResourceID   string   `json:"rsid"`
+	ResourceName string   `json:"rsname"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
+
+// UnmarshalJSON fills the typed fields and keeps a copy of all claims in Raw
+func (k *KeycloakClaims) UnmarshalJSON(data []byte) error {
+	type plain KeycloakClaims
+	if err := json.Unmarshal(data, (*plain)(k)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &k.Raw)
+}
+
+// Username returns preferred_username
+func (k *KeycloakClaims) Username() string {
+	return k.PreferredUsername
+}
+
+// RealmRoles returns realm_access.roles
+func (k *KeycloakClaims) RealmRoles() []string {
+	if k.RealmAccess == nil {
+		return nil
+	}
+	return k.RealmAccess.Roles
+}
+
+// ClientRoles returns resource_access.<clientID>.roles
+func (k *KeycloakClaims) ClientRoles(clientID string) []string {
+	return k.ResourceAccess[clientID].Roles
+}
+
+// IsServiceAccount reports whether the token was obtained with the
+// client_credentials grant, which Keycloak marks with a client ID claim
+func (k *KeycloakClaims) IsServiceAccount() bool {
+	return k.ServiceAccountClient() != ""
+}
+
+// ServiceAccountClient returns the client ID of a service-account token, or
+// "" for tokens of human users. The "service-account-<client>" username
+// proves nothing, as users who pick their username can choose it too.
+func (k *KeycloakClaims) ServiceAccountClient() string {
+	for _, name := range []string{"client_id", "clientId"} {
+		if id, ok := k.Raw[name].(string); ok && id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// IsAPIKey reports whether the claims are those of an API key, which has
+// no email or profile
+func (k *KeycloakClaims) IsAPIKey() bool {
+	return k.AuthorizedParty == apiKeyParty
+}
+
+// CallerType labels the caller for logs and audit records, so machine and
+// human activity can be told apart
+func (k *KeycloakClaims) CallerType() string {
+	if k.IsServiceAccount() {
+		return "service-account"
+	}
+	return "user"
+}
+
+// Scopes splits the space-delimited scope claim
+func (k *KeycloakClaims) Scopes() []string {
+	return strings.Fields(k.Scope)
+}
+
+// HasScope reports whether the token was granted scope
+func (k *KeycloakClaims) HasScope(scope string) bool {
+	return containsString(k.Scopes(), scope)
+}
+
+// InGroup reports whether the token is a member of group or one of its
+// subgroups. Paths are compared as Keycloak's "Full group path" mapper emits
+// them, e.g. "/staff/backend".
+func (k *KeycloakClaims) InGroup(group string) bool {
+	group = strings.TrimSuffix(group, "/")
+	for _, g := range k.Groups {
+		if g == group || strings.HasPrefix(g, group+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission reports whether the RPT grants scope on resource (matched by
+// name or ID). An empty scope only requires access to the resource.
+func (k *KeycloakClaims) HasPermission(resource, scope string) bool {
+	if k.Authorization == nil {
+		return false
+	}
+	for _, p := range k.Authorization.Permissions {
+		if p.ResourceName != resource && p.ResourceID != resource {
+			continue
+		}
+		if scope == "" || containsString(p.Scopes, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// Claim returns an arbitrary claim by name, or nil when absent
+func (k *KeycloakClaims) Claim(name string) interface{} {
+	return k.Raw[name]
+}
+
+// claimsFromCtx returns the claims stored by the auth middleware, or nil
+func claimsFromCtx(c *fiber.Ctx) *KeycloakClaims {
+	claims, _ := c.Locals("claims").(*KeycloakClaims)
+	return claims
+}
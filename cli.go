@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/example/fiber-demo/config"
+	"github.com/rs/zerolog/log"
+)
+
+// command is a subcommand of the binary; run gets the arguments after its
+// name and returns the exit status
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands = []command{
+	{"serve", "run the API server (the default)", runServe},
+	{"migrate", "apply database migrations", runMigrate},
+	{"seed", "load demo fixtures into the database", runSeed},
+	{"decode-token", "print the header and claims of a JWT", runDecodeToken},
+	{"config", "config check: validate and print the effective configuration", runConfig},
+}
+
+// configArgs are the flags the configuration was loaded from, kept so a
+// reload reads the same sources
+var configArgs []string
+
+// loadConfig is the loader shared by every command touching the service's
+// dependencies: it reads and validates the configuration into cfg, then
+// sets up logging
+func loadConfig(args []string) {
+	loaded, err := config.Load(args)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Config error")
+	}
+	if err := loaded.Validate(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid configuration")
+	}
+	cfg, configArgs = loaded, args
+	initLogging()
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: fiber-demo [command] [flags]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-13s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nEvery command reads the configuration from -config/CONFIG_FILE, the environment and flags.")
+}
+
+// main dispatches to a command; without one, or with only flags, it serves
+func main() {
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage()
+		return
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			os.Exit(cmd.run(args))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "usage: fiber-demo config check [flags]")
+		return 2
+	}
+	return configCheck(args[1:])
+}
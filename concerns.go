@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/example/fiber-demo/config"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// mongoConcerns maps validated concerns to the driver's; settings left empty
+// stay nil, inheriting from the client
+func mongoConcerns(c config.Concerns) (*readpref.ReadPref, *readconcern.ReadConcern, *writeconcern.WriteConcern) {
+	var (
+		rp *readpref.ReadPref
+		rc *readconcern.ReadConcern
+		wc *writeconcern.WriteConcern
+	)
+	if c.ReadPreference != "" {
+		mode, err := readpref.ModeFromString(c.ReadPreference)
+		if err == nil {
+			rp, err = readpref.New(mode)
+		}
+		if err != nil {
+			log.Fatal().Err(err).Str("readPreference", c.ReadPreference).Msg("Invalid read preference")
+		}
+	}
+	if c.ReadConcern != "" {
+		rc = &readconcern.ReadConcern{Level: c.ReadConcern}
+	}
+	switch c.WriteConcern {
+	case "":
+	case "majority":
+		wc = writeconcern.Majority()
+	default:
+		n, _ := strconv.Atoi(c.WriteConcern)
+		wc = &writeconcern.WriteConcern{W: n}
+	}
+	return rp, rc, wc
+}
+
+// mongoRepositoryOptions returns the database options of the repositories
+// with concerns of their own, MONGO_REPOSITORY_CONCERNS. Analytics, stats
+// and search by default, read from secondaries to spare the primary.
+func mongoRepositoryOptions() map[string]*options.DatabaseOptions {
+	concerns, err := cfg.Mongo.ForRepositories()
+	if err != nil {
+		log.Fatal().Err(err).Msg("MONGO_REPOSITORY_CONCERNS")
+	}
+	out := map[string]*options.DatabaseOptions{}
+	for repo, c := range concerns {
+		rp, rc, wc := mongoConcerns(c)
+		opts := options.Database()
+		if rp != nil {
+			opts.SetReadPreference(rp)
+		}
+		if rc != nil {
+			opts.SetReadConcern(rc)
+		}
+		if wc != nil {
+			opts.SetWriteConcern(wc)
+		}
+		out[repo] = opts
+		log.Info().Str("repository", repo).Str("readPreference", c.ReadPreference).Str("readConcern", c.ReadConcern).Str("writeConcern", c.WriteConcern).Msg("Mongo concerns")
+	}
+	return out
+}
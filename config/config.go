@@ -0,0 +1,908 @@
+// Package config loads the service configuration into a typed Config.
+//
+// Every setting has a default, and can be set in a YAML file (-config or
+// CONFIG_FILE), an environment variable and a command-line flag; later
+// sources win: defaults < YAML < environment < flags. Struct tags declare
+// each setting's sources:
+//
+//	Addr string `yaml:"addr" env:"LISTEN_ADDR" flag:"addr" default:":3000" usage:"..."`
+//
+// Any variable can instead be read from a file named by <NAME>_FILE, e.g.
+// MONGO_URI_FILE=/run/secrets/mongo_uri. Settings tagged secret:"true" are
+// masked by Redacted, and those tagged reload:"true" are applied again when
+// the service reloads its configuration without a restart. An empty
+// variable is ignored, unless its setting is tagged empty:"true": then it
+// sets an empty value, e.g. REGISTER_ROLES= for no roles.
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the full service configuration
+type Config struct {
+	// Store selects where the repositories keep their data: mongo,
+	// postgres, or memory for demos and tests, which loses everything on
+	// exit
+	Store string `yaml:"store" env:"STORE" flag:"store" default:"mongo" usage:"mongo, postgres or memory"`
+	// Env is production to refuse development-only settings
+	Env string `yaml:"env" env:"APP_ENV" usage:"production refuses development-only settings such as auth.devAuth"`
+	// MigrateOnStart applies pending migrations at startup; turn it off
+	// when a deploy job runs `migrate up` beforehand
+	MigrateOnStart bool   `yaml:"migrateOnStart" env:"MIGRATE_ON_START" default:"true"`
+	SeedDir        string `yaml:"seedDir" env:"SEED_DIR" default:"fixtures" usage:"directory of the users.json and items.json fixtures"`
+	// ReloadInterval is how often the files of ReloadFiles are checked for
+	// changes; 0 leaves reloading to SIGHUP
+	ReloadInterval time.Duration `yaml:"reloadInterval" env:"RELOAD_INTERVAL" default:"30s"`
+
+	Server          Server          `yaml:"server"`
+	TLS             TLS             `yaml:"tls"`
+	SecurityHeaders SecurityHeaders `yaml:"securityHeaders"`
+	Log             Log             `yaml:"log"`
+	Metrics         Metrics         `yaml:"metrics"`
+	Tracing         Tracing         `yaml:"tracing"`
+	Mongo           Mongo           `yaml:"mongo"`
+	Postgres        Postgres        `yaml:"postgres"`
+	Keycloak        Keycloak        `yaml:"keycloak"`
+	Auth            Auth            `yaml:"auth"`
+	Authz           Authz           `yaml:"authz"`
+	Gateway         Gateway         `yaml:"gateway"`
+	CORS            CORS            `yaml:"cors"`
+	RateLimit       RateLimit       `yaml:"rateLimit"`
+	Vault           Vault           `yaml:"vault"`
+	Tenancy         Tenancy         `yaml:"tenancy"`
+	Users           Users           `yaml:"users"`
+	Items           Items           `yaml:"items"`
+	Files           Files           `yaml:"files"`
+	Audit           Audit           `yaml:"audit"`
+	Events          Events          `yaml:"events"`
+	FeatureFlags    FeatureFlags    `yaml:"featureFlags"`
+
+	file string // the YAML file read, if any
+}
+
+// Server configures the HTTP listener
+type Server struct {
+	Addr            string        `yaml:"addr" env:"LISTEN_ADDR" flag:"addr" default:":3000" usage:"address the API listens on"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" default:"30s" usage:"how long to drain requests on shutdown"`
+	// RequestTimeout bounds the work of a handler; 0 disables it
+	RequestTimeout time.Duration `yaml:"requestTimeout" env:"REQUEST_TIMEOUT" default:"30s" usage:"deadline of a request's database and outgoing calls"`
+	// ProxyHeader names the header carrying the client IP, believed only
+	// from TrustedProxies, IPs or CIDRs such as KrakenD's
+	ProxyHeader    string   `yaml:"proxyHeader" env:"PROXY_HEADER" usage:"header with the client IP set by trusted proxies, e.g. X-Forwarded-For"`
+	TrustedProxies []string `yaml:"trustedProxies" env:"TRUSTED_PROXIES" usage:"IPs or CIDRs of the proxies whose proxy header is believed"`
+	// HTTP2 serves h2 over TLS, or cleartext h2c without it, through
+	// Fiber's net/http adaptor
+	HTTP2 bool `yaml:"http2" env:"HTTP2" usage:"serve HTTP/2 as well as HTTP/1.1"`
+}
+
+// TLS serves HTTPS on the API port when both files are set
+type TLS struct {
+	CertFile string `yaml:"certFile" env:"TLS_CERT_FILE" usage:"server certificate, PEM"`
+	KeyFile  string `yaml:"keyFile" env:"TLS_KEY_FILE" usage:"private key of the certificate, PEM"`
+	// ReloadInterval is how often the files are checked for a replaced
+	// certificate; 0 disables reloading
+	ReloadInterval time.Duration `yaml:"reloadInterval" env:"TLS_RELOAD_INTERVAL" default:"1m"`
+}
+
+// SecurityHeaders are set on every response; an empty header value drops
+// the header
+type SecurityHeaders struct {
+	Enabled bool `yaml:"enabled" env:"SECURITY_HEADERS" default:"true"`
+	// HSTSMaxAge is rounded down to seconds; 0 drops the header
+	HSTSMaxAge            time.Duration `yaml:"hstsMaxAge" env:"HSTS_MAX_AGE" default:"8760h"`
+	ContentSecurityPolicy string        `yaml:"contentSecurityPolicy" env:"CONTENT_SECURITY_POLICY" empty:"true" default:"default-src 'none'; frame-ancestors 'none'"`
+	FrameOptions          string        `yaml:"frameOptions" env:"FRAME_OPTIONS" empty:"true" default:"DENY"`
+	ReferrerPolicy        string        `yaml:"referrerPolicy" env:"REFERRER_POLICY" empty:"true" default:"no-referrer"`
+}
+
+// Log configures the global logger
+type Log struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL" flag:"log-level" default:"info" usage:"debug, info, warn or error"`
+	Format string `yaml:"format" env:"LOG_FORMAT" flag:"log-format" default:"json" usage:"json or console"`
+	Output string `yaml:"output" env:"LOG_OUTPUT" default:"stdout" usage:"stdout, stderr or a file path"`
+	// Access logs every request; those of AccessExclude path patterns only
+	// when they fail
+	Access        bool     `yaml:"access" env:"ACCESS_LOG" default:"true"`
+	AccessExclude []string `yaml:"accessExclude" env:"ACCESS_LOG_EXCLUDE" usage:"path patterns whose successful requests are not logged"`
+}
+
+// Metrics configures Prometheus metrics and the internal listener
+type Metrics struct {
+	Enabled bool `yaml:"enabled" env:"METRICS" default:"true"`
+	// Addr serves /metrics, and /debug/pprof with Pprof, on a listener of
+	// their own instead of the API port
+	Addr  string `yaml:"addr" env:"METRICS_ADDR" usage:"internal listener, e.g. :9090"`
+	Pprof bool   `yaml:"pprof" env:"PPROF" usage:"mount net/http/pprof under /debug/pprof"`
+}
+
+// Tracing exports spans over OTLP/HTTP when an endpoint is set; the other
+// standard OTEL_* variables, such as OTEL_SERVICE_NAME, are read by the SDK
+type Tracing struct {
+	Endpoint string `yaml:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT" usage:"OTLP/HTTP collector, e.g. http://otel-collector:4318"`
+	// TracesEndpoint is the full URL spans are posted to, instead of
+	// Endpoint's /v1/traces
+	TracesEndpoint string `yaml:"tracesEndpoint" env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"`
+}
+
+// Mongo configures the database connection
+type Mongo struct {
+	URI      string `yaml:"uri" env:"MONGO_URI" flag:"mongo-uri" default:"mongodb://localhost:27017" usage:"MongoDB connection string"`
+	Database string `yaml:"database" env:"MONGO_DB" flag:"mongo-db" default:"demo_db" usage:"MongoDB database name"`
+	// Transactions is auto (when the deployment supports them), required
+	// or off
+	Transactions string `yaml:"transactions" env:"MONGO_TRANSACTIONS" default:"auto" usage:"multi-document transactions: auto, required or off"`
+	// Search is auto (Atlas Search when the index exists), atlas or text
+	Search      string `yaml:"search" env:"MONGO_SEARCH" default:"auto" usage:"item search: auto, atlas or text"`
+	SearchIndex string `yaml:"searchIndex" env:"MONGO_SEARCH_INDEX" default:"items" usage:"Atlas Search index of the items collection"`
+	// Transient errors, e.g. during a primary election, are retried up to
+	// RetryAttempts calls in all; 1 disables retries
+	RetryAttempts  int           `yaml:"retryAttempts" env:"MONGO_RETRY_ATTEMPTS" default:"3" usage:"calls per repository operation on transient errors"`
+	RetryBaseDelay time.Duration `yaml:"retryBaseDelay" env:"MONGO_RETRY_BASE_DELAY" default:"50ms"`
+	RetryMaxDelay  time.Duration `yaml:"retryMaxDelay" env:"MONGO_RETRY_MAX_DELAY" default:"1s"`
+	// Pool and timeouts, the driver's defaults unless set; options in URI
+	// take precedence. SocketTimeout 0 waits as long as the context allows.
+	MaxPoolSize            int           `yaml:"maxPoolSize" env:"MONGO_MAX_POOL_SIZE" default:"100" usage:"most connections per server"`
+	MinPoolSize            int           `yaml:"minPoolSize" env:"MONGO_MIN_POOL_SIZE" default:"0" usage:"connections kept open per server"`
+	ConnectTimeout         time.Duration `yaml:"connectTimeout" env:"MONGO_CONNECT_TIMEOUT" default:"30s"`
+	SocketTimeout          time.Duration `yaml:"socketTimeout" env:"MONGO_SOCKET_TIMEOUT" default:"0s"`
+	ServerSelectionTimeout time.Duration `yaml:"serverSelectionTimeout" env:"MONGO_SERVER_SELECTION_TIMEOUT" default:"30s"`
+	// Concerns of every repository; empty settings keep the URI's, or the
+	// server's defaults
+	Concerns Concerns `yaml:"concerns"`
+	// RepositoryConcerns override them per repository, as
+	// <repository>.<setting>=<value>, e.g. stats.readPreference=secondary
+	RepositoryConcerns []string `yaml:"repositoryConcerns" env:"MONGO_REPOSITORY_CONCERNS" default:"stats.readPreference=secondaryPreferred,search.readPreference=secondaryPreferred"`
+	CSFLE              CSFLE    `yaml:"csfle"`
+}
+
+// CSFLE configures client-side field level encryption, off while
+// KMSProvider is empty
+type CSFLE struct {
+	KMSProvider string   `yaml:"kmsProvider" env:"CSFLE_KMS_PROVIDER" usage:"local or aws"`
+	Fields      []string `yaml:"fields" env:"CSFLE_FIELDS" usage:"collection.field[:deterministic|random] entries to encrypt"`
+	// KeyVault is the database.collection of the data keys
+	KeyVault   string `yaml:"keyVault" env:"CSFLE_KEY_VAULT" default:"encryption.__keyVault"`
+	KeyAltName string `yaml:"keyAltName" env:"CSFLE_KEY_ALT_NAME" default:"fiber-demo" usage:"name of the data key encrypting the fields"`
+	// LocalMasterKey is the base64 96-byte master key of the local provider
+	LocalMasterKey     string `yaml:"localMasterKey" env:"CSFLE_LOCAL_MASTER_KEY" secret:"true"`
+	AWSAccessKeyID     string `yaml:"awsAccessKeyId" env:"CSFLE_AWS_ACCESS_KEY_ID" secret:"true"`
+	AWSSecretAccessKey string `yaml:"awsSecretAccessKey" env:"CSFLE_AWS_SECRET_ACCESS_KEY" secret:"true"`
+	AWSKeyRegion       string `yaml:"awsKeyRegion" env:"CSFLE_AWS_KEY_REGION"`
+	AWSKeyARN          string `yaml:"awsKeyArn" env:"CSFLE_AWS_KEY_ARN" usage:"AWS KMS key wrapping the data key"`
+	CryptSharedLib     string `yaml:"cryptSharedLib" env:"CSFLE_CRYPT_SHARED_LIB" usage:"path of the crypt_shared library, instead of mongocryptd"`
+}
+
+func (c CSFLE) validate() []error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("mongo.csfle."+format, args...))
+		}
+	}
+	check(len(c.Fields) > 0, "fields: required")
+	for _, entry := range c.Fields {
+		path, algo, _ := strings.Cut(entry, ":")
+		coll, field, ok := strings.Cut(path, ".")
+		check(ok && coll != "" && field != "" && !strings.Contains(field, "."), "fields: %q: expected collection.field, top-level fields only", entry)
+		check(oneOf(algo, "", "deterministic", "random"), "fields: %q: algorithm must be deterministic or random", entry)
+	}
+	db, coll, ok := strings.Cut(c.KeyVault, ".")
+	check(ok && db != "" && coll != "", "keyVault: expected database.collection, got %q", c.KeyVault)
+	check(c.KeyAltName != "", "keyAltName: required")
+	switch c.KMSProvider {
+	case "local":
+		key, err := base64.StdEncoding.DecodeString(c.LocalMasterKey)
+		check(err == nil && len(key) == 96, "localMasterKey: must be 96 bytes, base64 encoded")
+	case "aws":
+		check(c.AWSAccessKeyID != "" && c.AWSSecretAccessKey != "" && c.AWSKeyRegion != "" && c.AWSKeyARN != "",
+			"kmsProvider aws needs awsAccessKeyId, awsSecretAccessKey, awsKeyRegion and awsKeyArn")
+	default:
+		check(false, "kmsProvider: unknown provider %q, expected local or aws", c.KMSProvider)
+	}
+	return errs
+}
+
+// Postgres configures the database of STORE=postgres
+type Postgres struct {
+	URL      string `yaml:"url" env:"POSTGRES_URL" flag:"postgres-url" secret:"true" usage:"PostgreSQL connection string"`
+	MaxConns int    `yaml:"maxConns" env:"POSTGRES_MAX_CONNS" default:"10" usage:"most pooled connections"`
+}
+
+// Concerns choose where reads go and how durable reads and writes are
+type Concerns struct {
+	ReadPreference string `yaml:"readPreference" env:"MONGO_READ_PREFERENCE" usage:"primary, primaryPreferred, secondary, secondaryPreferred or nearest"`
+	ReadConcern    string `yaml:"readConcern" env:"MONGO_READ_CONCERN" usage:"local, available, majority or linearizable"`
+	WriteConcern   string `yaml:"writeConcern" env:"MONGO_WRITE_CONCERN" usage:"majority, or how many nodes acknowledge writes"`
+}
+
+// tenantName constrains tenant IDs to what every store can name a database
+var tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// Repositories whose concerns can be overridden
+var concernRepositories = []string{"items", "users", "audit", "stats", "search", "files", "events"}
+
+func (c Concerns) validate() error {
+	if c.ReadPreference != "" && !oneOf(c.ReadPreference, "primary", "primaryPreferred", "secondary", "secondaryPreferred", "nearest") {
+		return fmt.Errorf("unknown read preference %q", c.ReadPreference)
+	}
+	if c.ReadConcern != "" && !oneOf(c.ReadConcern, "local", "available", "majority", "linearizable") {
+		return fmt.Errorf("unknown read concern %q", c.ReadConcern)
+	}
+	if c.WriteConcern != "" && c.WriteConcern != "majority" {
+		if n, err := strconv.Atoi(c.WriteConcern); err != nil || n < 0 {
+			return fmt.Errorf("write concern %q is neither majority nor a number", c.WriteConcern)
+		}
+	}
+	return nil
+}
+
+// ForRepositories returns the concerns of each repository with
+// overrides, the defaults applied to the settings they leave out
+func (m Mongo) ForRepositories() (map[string]Concerns, error) {
+	out := map[string]Concerns{}
+	for _, entry := range m.RepositoryConcerns {
+		key, value, ok := strings.Cut(entry, "=")
+		repo, setting, ok2 := strings.Cut(key, ".")
+		if !ok || !ok2 || value == "" {
+			return nil, fmt.Errorf("%q: expected <repository>.<setting>=<value>", entry)
+		}
+		if !oneOf(repo, concernRepositories...) {
+			return nil, fmt.Errorf("%q: repository must be one of %s", entry, strings.Join(concernRepositories, ", "))
+		}
+		c, seen := out[repo]
+		if !seen {
+			c = m.Concerns
+		}
+		switch setting {
+		case "readPreference":
+			c.ReadPreference = value
+		case "readConcern":
+			c.ReadConcern = value
+		case "writeConcern":
+			c.WriteConcern = value
+		default:
+			return nil, fmt.Errorf("%q: setting must be readPreference, readConcern or writeConcern", entry)
+		}
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("%q: %w", entry, err)
+		}
+		out[repo] = c
+	}
+	return out, nil
+}
+
+// Keycloak identifies the realm and this service's client in it
+type Keycloak struct {
+	Issuer        string `yaml:"issuer" env:"KEYCLOAK_ISSUER" flag:"keycloak-issuer" usage:"realm issuer URL"`
+	ClientID      string `yaml:"clientId" env:"KEYCLOAK_CLIENT_ID" usage:"confidential client for introspection and Keycloak APIs"`
+	ClientSecret  string `yaml:"clientSecret" env:"KEYCLOAK_CLIENT_SECRET" secret:"true"`
+	OIDCDiscovery bool   `yaml:"oidcDiscovery" env:"OIDC_DISCOVERY" default:"true" usage:"read endpoints from the issuer's discovery document"`
+	// AdminURL is the realm's Admin REST API, derived from Issuer unless set
+	AdminURL  string `yaml:"adminUrl" env:"KEYCLOAK_ADMIN_URL" usage:"e.g. http://keycloak:8080/admin/realms/demo-realm"`
+	HealthURL string `yaml:"healthUrl" env:"KEYCLOAK_HEALTH_URL" usage:"health endpoint /readyz also requires"`
+}
+
+// Auth configures token validation
+type Auth struct {
+	VerifyJWT              bool          `yaml:"verifyJwt" env:"VERIFY_JWT" flag:"verify-jwt" usage:"verify token signatures against the JWKS"`
+	TrustGatewayHeaders    bool          `yaml:"trustGatewayHeaders" env:"TRUST_GATEWAY_HEADERS" usage:"read identity from headers set by KrakenD"`
+	JWKSURL                string        `yaml:"jwksUrl" env:"JWKS_URL" usage:"JWKS location, default from the issuer"`
+	JWKSRefreshInterval    time.Duration `yaml:"jwksRefreshInterval" env:"JWKS_REFRESH_INTERVAL" default:"15m"`
+	JWKSMinRefreshInterval time.Duration `yaml:"jwksMinRefreshInterval" env:"JWKS_MIN_REFRESH_INTERVAL" default:"10s"`
+	AllowedAudiences       []string      `yaml:"allowedAudiences" env:"ALLOWED_AUDIENCES"`
+	AllowedIssuers         []string      `yaml:"allowedIssuers" env:"ALLOWED_ISSUERS"`
+	ClockSkew              time.Duration `yaml:"clockSkew" env:"JWT_CLOCK_SKEW" default:"30s"`
+	ClaimsCacheSize        int           `yaml:"claimsCacheSize" env:"CLAIMS_CACHE_SIZE"`
+	RealmsFile             string        `yaml:"realmsFile" env:"REALMS_FILE"`
+	IntrospectionMode      string        `yaml:"introspectionMode" env:"INTROSPECTION_MODE" usage:"off, opaque or always"`
+	IntrospectionURL       string        `yaml:"introspectionUrl" env:"INTROSPECTION_URL"`
+	IntrospectionCacheTTL  time.Duration `yaml:"introspectionCacheTtl" env:"INTROSPECTION_CACHE_TTL" default:"30s"`
+	PolicyFile             string        `yaml:"policyFile" env:"POLICY_FILE" reload:"true" usage:"route policies, reloaded on change"`
+	LogoutTokenMaxAge      time.Duration `yaml:"logoutTokenMaxAge" env:"LOGOUT_TOKEN_MAX_AGE" default:"2m" usage:"oldest accepted iat of a back-channel logout token"`
+	// DevAuth is "" or insecure, trusting X-Debug-User headers without a
+	// token; refused with APP_ENV=production
+	DevAuth string `yaml:"devAuth" env:"DEV_AUTH" usage:"insecure to trust debug identity headers, for development only"`
+	// RoleExtractor names a registered role extractor; RoleSources,
+	// RoleClientID and RoleHierarchy configure the built-in keycloak one
+	RoleExtractor           string        `yaml:"roleExtractor" env:"ROLE_EXTRACTOR" default:"keycloak"`
+	RoleSources             []string      `yaml:"roleSources" env:"ROLE_SOURCES" default:"roles,realm_access,resource_access" usage:"role claims in order of precedence"`
+	RoleClientID            string        `yaml:"roleClientId" env:"ROLE_CLIENT_ID" usage:"resource_access client to read roles of, default the token's azp"`
+	RoleHierarchy           string        `yaml:"roleHierarchy" env:"ROLE_HIERARCHY" usage:"senior>junior rules, comma-separated"`
+	ServiceAccountRolesFile string        `yaml:"serviceAccountRolesFile" env:"SERVICE_ACCOUNT_ROLES_FILE" usage:"roles of service accounts by client ID"`
+	ACRLevels               []string      `yaml:"acrLevels" env:"ACR_LEVELS" usage:"acr values from weakest to strongest"`
+	RequireVerifiedEmail    bool          `yaml:"requireVerifiedEmail" env:"REQUIRE_VERIFIED_EMAIL" usage:"reject mutations from accounts with unverified email"`
+	DPoPProofMaxAge         time.Duration `yaml:"dpopProofMaxAge" env:"DPOP_PROOF_MAX_AGE" default:"60s"`
+	DPoPBaseURL             string        `yaml:"dpopBaseUrl" env:"DPOP_BASE_URL" usage:"public URL DPoP proofs name, when KrakenD rewrites the host"`
+	// Revocation rejects tokens denylisted by jti or subject, remembered
+	// for RevocationMaxTokenLifetime
+	Revocation                 bool          `yaml:"revocation" env:"REVOCATION"`
+	RevocationMaxTokenLifetime time.Duration `yaml:"revocationMaxTokenLifetime" env:"REVOCATION_MAX_TOKEN_LIFETIME" default:"24h"`
+	// SessionTracking rejects tokens of logged out sessions, remembered for
+	// SessionMaxLifetime, Keycloak's SSO Session Max
+	SessionTracking    bool          `yaml:"sessionTracking" env:"SESSION_TRACKING"`
+	SessionMaxLifetime time.Duration `yaml:"sessionMaxLifetime" env:"SESSION_MAX_LIFETIME" default:"10h"`
+	APIKeys            bool          `yaml:"apiKeys" env:"API_KEYS" usage:"accept X-API-Key keys managed via /admin/api-keys"`
+}
+
+// Authz configures the optional authorization engines consulted after the
+// route guards
+type Authz struct {
+	Casbin               bool          `yaml:"casbin" env:"CASBIN" usage:"authorize every request with Casbin"`
+	CasbinModel          string        `yaml:"casbinModel" env:"CASBIN_MODEL" usage:"model file stored in Mongo on first start"`
+	CasbinReloadInterval time.Duration `yaml:"casbinReloadInterval" env:"CASBIN_RELOAD_INTERVAL" default:"1m"`
+	OPAURL               string        `yaml:"opaUrl" env:"OPA_URL" usage:"OPA decision endpoint authorizing every request"`
+	OPACacheTTL          time.Duration `yaml:"opaCacheTtl" env:"OPA_CACHE_TTL" default:"5s"`
+	UMATickets           bool          `yaml:"umaTickets" env:"UMA_TICKETS" usage:"answer missing permissions with UMA tickets"`
+	// KeycloakDecisionCacheTTL bounds how long permission decisions are
+	// cached per token, never past its exp
+	KeycloakDecisionCacheTTL time.Duration `yaml:"keycloakDecisionCacheTtl" env:"KEYCLOAK_DECISION_CACHE_TTL" default:"30s"`
+}
+
+// Gateway configures how requests prove they came through KrakenD
+type Gateway struct {
+	Secret    string   `yaml:"secret" env:"GATEWAY_SECRET" secret:"true" usage:"required in X-Gateway-Secret"`
+	ClientCA  string   `yaml:"clientCa" env:"GATEWAY_CLIENT_CA" usage:"CA of gateway client certificates, requiring mutual TLS"`
+	ClientCNs []string `yaml:"clientCns" env:"GATEWAY_CLIENT_CN" usage:"common names of accepted gateway client certificates"`
+	// ClientCertHeader carries the client certificate KrakenD received, for
+	// certificate-bound tokens behind TLS termination
+	ClientCertHeader string `yaml:"clientCertHeader" env:"CLIENT_CERT_HEADER"`
+}
+
+// CORS configures cross-origin requests from browsers calling the API
+// directly; off while AllowedOrigins is empty
+type CORS struct {
+	AllowedOrigins   []string      `yaml:"allowedOrigins" env:"CORS_ALLOWED_ORIGINS" reload:"true"`
+	AllowedMethods   []string      `yaml:"allowedMethods" env:"CORS_ALLOWED_METHODS" reload:"true"`
+	AllowedHeaders   []string      `yaml:"allowedHeaders" env:"CORS_ALLOWED_HEADERS" reload:"true"`
+	ExposedHeaders   []string      `yaml:"exposedHeaders" env:"CORS_EXPOSED_HEADERS" reload:"true"`
+	AllowCredentials bool          `yaml:"allowCredentials" env:"CORS_ALLOW_CREDENTIALS" reload:"true"`
+	MaxAge           time.Duration `yaml:"maxAge" env:"CORS_MAX_AGE" default:"10m" reload:"true"`
+}
+
+// RateLimit configures per-caller request budgets
+type RateLimit struct {
+	Rules     []string `yaml:"rules" env:"RATE_LIMITS" reload:"true" usage:"path=count/window entries, first match wins"`
+	Default   string   `yaml:"default" env:"RATE_LIMIT_DEFAULT" reload:"true" usage:"count/window for paths matching no rule"`
+	TiersFile string   `yaml:"tiersFile" env:"RATE_LIMIT_TIERS_FILE" reload:"true" usage:"per-role budgets, reloaded on change"`
+	RedisURL  string   `yaml:"redisUrl" env:"REDIS_URL" secret:"true" usage:"share counters across replicas"`
+}
+
+// Vault optionally supplies secrets at startup instead of the settings above
+type Vault struct {
+	Addr           string `yaml:"addr" env:"VAULT_ADDR" usage:"Vault server URL"`
+	Token          string `yaml:"token" env:"VAULT_TOKEN" secret:"true"`
+	KubernetesRole string `yaml:"kubernetesRole" env:"VAULT_KUBERNETES_ROLE" usage:"log in with the pod's service account instead of a token"`
+	// MongoRole names a database secrets engine role whose dynamic
+	// credentials replace those in mongo.uri
+	MongoRole  string `yaml:"mongoRole" env:"VAULT_MONGO_ROLE"`
+	MongoMount string `yaml:"mongoMount" env:"VAULT_MONGO_MOUNT" default:"database"`
+	// KeycloakSecretPath is a KV v2 secret, e.g. "secret/data/fiber-demo",
+	// whose KeycloakSecretKey field replaces keycloak.clientSecret
+	KeycloakSecretPath string `yaml:"keycloakSecretPath" env:"VAULT_KEYCLOAK_SECRET_PATH"`
+	KeycloakSecretKey  string `yaml:"keycloakSecretKey" env:"VAULT_KEYCLOAK_SECRET_KEY" default:"client_secret"`
+}
+
+// Tenancy serves several tenants, each with its own data
+type Tenancy struct {
+	Tenants []string `yaml:"tenants" env:"TENANTS" usage:"tenants served; unset serves one"`
+	Claim   string   `yaml:"claim" env:"TENANT_CLAIM" default:"tenant" usage:"token claim naming the caller's tenant"`
+	// Header names the tenant when the gateway sends it, if the token
+	// belongs to it: a member of a GroupPrefix<tenant> group
+	Header        string `yaml:"header" env:"TENANT_HEADER" usage:"e.g. X-Tenant-ID"`
+	GroupPrefix   string `yaml:"groupPrefix" env:"TENANT_GROUP_PREFIX" default:"/tenants/"`
+	Organizations bool   `yaml:"organizations" env:"ORGANIZATIONS" usage:"serve /orgs with members and invitations"`
+}
+
+// Users configures profiles and user management over the Keycloak Admin
+// API
+type Users struct {
+	Provisioning      bool          `yaml:"provisioning" env:"USER_PROVISIONING" usage:"upsert profiles from tokens and serve /me"`
+	ProvisionInterval time.Duration `yaml:"provisionInterval" env:"PROVISION_INTERVAL" default:"5m"`
+	Admin             bool          `yaml:"admin" env:"ADMIN_USERS" usage:"serve /admin/users"`
+	// GrantableRealmRoles and the roles of GrantableClients are those the
+	// role endpoints grant and revoke
+	GrantableRealmRoles []string `yaml:"grantableRealmRoles" env:"GRANTABLE_REALM_ROLES" empty:"true" default:"user,admin"`
+	GrantableClients    []string `yaml:"grantableClients" env:"GRANTABLE_CLIENTS"`
+	Registration        bool     `yaml:"registration" env:"REGISTRATION" usage:"serve POST /register"`
+	RegisterRoles       []string `yaml:"registerRoles" env:"REGISTER_ROLES" empty:"true" default:"user" usage:"realm roles of self-registered users"`
+	// RegisterRateLimit bounds registrations per client IP, as count/window
+	RegisterRateLimit string        `yaml:"registerRateLimit" env:"REGISTER_RATE_LIMIT" default:"5/1h"`
+	Sync              bool          `yaml:"sync" env:"USER_SYNC" usage:"mirror Keycloak users into keycloak_users"`
+	SyncInterval      time.Duration `yaml:"syncInterval" env:"USER_SYNC_INTERVAL" default:"5m"`
+	SyncFullInterval  time.Duration `yaml:"syncFullInterval" env:"USER_SYNC_FULL_INTERVAL" default:"24h"`
+	SyncLease         time.Duration `yaml:"syncLease" env:"USER_SYNC_LEASE" default:"10m"`
+}
+
+// Items configures the items API
+type Items struct {
+	BatchMax int  `yaml:"batchMax" env:"ITEMS_BATCH_MAX" default:"100" usage:"most items per POST /items:batch"`
+	ACL      bool `yaml:"acl" env:"ITEM_ACL" usage:"make items private to their owner and grantees"`
+	// RestrictedFields are field:role|role entries only callers holding
+	// one of the roles see; none turns redaction off
+	RestrictedFields []string `yaml:"restrictedFields" env:"RESTRICTED_FIELDS" default:"costPrice:admin,internalNotes:admin"`
+}
+
+// Files configures uploads and where they are stored
+type Files struct {
+	MaxSize      int      `yaml:"maxSize" env:"FILES_MAX_SIZE" default:"10485760" usage:"largest upload, in bytes"`
+	AllowedTypes []string `yaml:"allowedTypes" env:"FILES_ALLOWED_TYPES" default:"image/png,image/jpeg,image/gif,image/webp,application/pdf,text/plain"`
+	Store        string   `yaml:"store" env:"FILES_STORE" default:"gridfs" usage:"gridfs or s3"`
+	// Downloads from PresignThreshold bytes redirect to a presigned URL
+	// valid for PresignTTL, when the store supports it
+	PresignThreshold int           `yaml:"presignThreshold" env:"FILES_PRESIGN_THRESHOLD" default:"8388608"`
+	PresignTTL       time.Duration `yaml:"presignTtl" env:"FILES_PRESIGN_TTL" default:"15m"`
+	S3               S3            `yaml:"s3"`
+}
+
+// S3 is the bucket of FILES_STORE=s3
+type S3 struct {
+	Endpoint       string `yaml:"endpoint" env:"S3_ENDPOINT" usage:"host and port, e.g. minio:9000"`
+	Bucket         string `yaml:"bucket" env:"S3_BUCKET"`
+	Region         string `yaml:"region" env:"S3_REGION" default:"us-east-1"`
+	AccessKey      string `yaml:"accessKey" env:"S3_ACCESS_KEY" secret:"true"`
+	SecretKey      string `yaml:"secretKey" env:"S3_SECRET_KEY" secret:"true"`
+	UseSSL         bool   `yaml:"useSsl" env:"S3_USE_SSL" default:"true"`
+	PublicEndpoint string `yaml:"publicEndpoint" env:"S3_PUBLIC_ENDPOINT" usage:"host presigned URLs point to"`
+}
+
+// Audit configures the audit log of mutating requests
+type Audit struct {
+	Enabled   bool          `yaml:"enabled" env:"AUDIT_LOG" default:"true"`
+	Retention time.Duration `yaml:"retention" env:"AUDIT_RETENTION" default:"2160h"`
+}
+
+// Events configures the item change streams
+type Events struct {
+	MaxSubscribers int `yaml:"maxSubscribers" env:"EVENTS_MAX_SUBSCRIBERS" default:"100" usage:"open streams allowed at once"`
+}
+
+// FeatureFlags configures flag defaults and where changes are kept
+type FeatureFlags struct {
+	// Defaults are name or name=role:beta|tenant:acme entries
+	Defaults []string `yaml:"defaults" env:"FEATURE_FLAGS"`
+	// Store is mongo or memory, by default mongo with STORE=mongo
+	Store           string        `yaml:"store" env:"FEATURE_FLAGS_STORE"`
+	RefreshInterval time.Duration `yaml:"refreshInterval" env:"FEATURE_FLAGS_REFRESH_INTERVAL" default:"30s"`
+}
+
+// Load builds the Config from defaults, the YAML file named by -config or
+// CONFIG_FILE, the environment and args, in increasing precedence
+func Load(args []string) (*Config, error) {
+	cfg := &Config{}
+	fields := collect(reflect.ValueOf(cfg).Elem(), "")
+
+	fs := flag.NewFlagSet("fiber-demo", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration file")
+	flagValues := map[string]*rawFlag{}
+	for _, f := range fields {
+		if name := f.tag.Get("flag"); name != "" {
+			fv := &rawFlag{value: f.tag.Get("default"), isBool: f.value.Kind() == reflect.Bool}
+			fs.Var(fv, name, f.tag.Get("usage"))
+			flagValues[name] = fv
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	for _, f := range fields {
+		if def, ok := f.tag.Lookup("default"); ok {
+			if err := set(f.value, def); err != nil {
+				return nil, fmt.Errorf("default %s: %w", f.path, err)
+			}
+		}
+	}
+	if *configFile != "" {
+		cfg.file = *configFile
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", *configFile, err)
+		}
+	}
+	for _, f := range fields {
+		env := f.tag.Get("env")
+		if env == "" {
+			continue
+		}
+		v, ok, err := LookupEnv(env)
+		if err != nil {
+			return nil, err
+		}
+		if _, set := os.LookupEnv(env); !ok && set && f.tag.Get("empty") == "true" {
+			ok = true
+		}
+		if ok {
+			if err := set(f.value, v); err != nil {
+				return nil, fmt.Errorf("%s: %w", env, err)
+			}
+		}
+	}
+	var flagErr error
+	byFlag := map[string]field{}
+	for _, f := range fields {
+		if name := f.tag.Get("flag"); name != "" {
+			byFlag[name] = f
+		}
+	}
+	fs.Visit(func(fl *flag.Flag) {
+		f, ok := byFlag[fl.Name]
+		if !ok || flagErr != nil {
+			return
+		}
+		if err := set(f.value, flagValues[fl.Name].value); err != nil {
+			flagErr = fmt.Errorf("-%s: %w", fl.Name, err)
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+	return cfg, nil
+}
+
+// rawFlag keeps a flag's text for set; bool settings take no argument
+type rawFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *rawFlag) String() string     { return f.value }
+func (f *rawFlag) Set(v string) error { f.value = v; return nil }
+func (f *rawFlag) IsBoolFlag() bool   { return f.isBool }
+
+// LookupEnv returns the non-empty value of the environment variable name, or
+// the contents of the file named by name_FILE (a Docker or Kubernetes
+// secret mount) without trailing newlines. Setting both is an error.
+func LookupEnv(name string) (string, bool, error) {
+	v := os.Getenv(name)
+	path := os.Getenv(name + "_FILE")
+	switch {
+	case path == "":
+		return v, v != "", nil
+	case v != "":
+		return "", false, fmt.Errorf("%s and %s_FILE are both set", name, name)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+// field is one leaf setting of Config
+type field struct {
+	path  string // e.g. "mongo.uri"
+	value reflect.Value
+	tag   reflect.StructTag
+}
+
+func collect(v reflect.Value, prefix string) []field {
+	var out []field
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(sf.Tag.Get("yaml"), ",")[0]
+		path := prefix + name
+		if sf.Type.Kind() == reflect.Struct && sf.Type != reflect.TypeOf(time.Duration(0)) {
+			out = append(out, collect(v.Field(i), path+".")...)
+			continue
+		}
+		out = append(out, field{path: path, value: v.Field(i), tag: sf.Tag})
+	}
+	return out
+}
+
+// set parses s into v; lists are comma-separated
+func set(v reflect.Value, s string) error {
+	switch v.Interface().(type) {
+	case string:
+		v.SetString(s)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		v.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		v.SetInt(int64(n))
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		v.SetInt(int64(d))
+	case []string:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// Validate checks the whole configuration, reporting every problem at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	if _, port, err := net.SplitHostPort(c.Server.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("server.addr: %v", err))
+	} else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		errs = append(errs, fmt.Errorf("server.addr: port %q out of range 1-65535", port))
+	}
+	check(oneOf(c.Log.Level, "debug", "info", "warn", "error"), "log.level: unknown level %q", c.Log.Level)
+	check(oneOf(c.Log.Format, "json", "console"), "log.format: unknown format %q", c.Log.Format)
+	check(oneOf(c.Store, "mongo", "postgres", "memory"), "store: unknown store %q, expected mongo, postgres or memory", c.Store)
+	if c.Store == "postgres" {
+		if u, err := url.Parse(c.Postgres.URL); err != nil || !oneOf(u.Scheme, "postgres", "postgresql") {
+			errs = append(errs, fmt.Errorf("postgres.url: expected a postgres:// URI"))
+		}
+		check(c.Postgres.MaxConns >= 1, "postgres.maxConns: must be at least 1")
+	}
+
+	if u, err := url.Parse(c.Mongo.URI); err != nil || !oneOf(u.Scheme, "mongodb", "mongodb+srv") {
+		errs = append(errs, fmt.Errorf("mongo.uri: expected a mongodb:// or mongodb+srv:// URI"))
+	}
+	check(c.Mongo.Database != "", "mongo.database: required")
+	check(oneOf(c.Mongo.Transactions, "auto", "required", "off"), "mongo.transactions: expected auto, required or off, got %q", c.Mongo.Transactions)
+	check(oneOf(c.Mongo.Search, "auto", "atlas", "text"), "mongo.search: expected auto, atlas or text, got %q", c.Mongo.Search)
+	check(c.Mongo.MaxPoolSize >= 1 && c.Mongo.MinPoolSize >= 0 && c.Mongo.MinPoolSize <= c.Mongo.MaxPoolSize, "mongo.minPoolSize and maxPoolSize: expected 0 <= min <= max, max at least 1")
+	check(c.Mongo.ConnectTimeout > 0 && c.Mongo.ServerSelectionTimeout > 0 && c.Mongo.SocketTimeout >= 0, "mongo.connectTimeout and serverSelectionTimeout: must be positive")
+	check(c.Server.RequestTimeout >= 0, "server.requestTimeout: must not be negative")
+	check(c.Server.ProxyHeader == "" || len(c.Server.TrustedProxies) > 0, "server.proxyHeader requires server.trustedProxies")
+	for _, proxy := range c.Server.TrustedProxies {
+		_, _, err := net.ParseCIDR(proxy)
+		check(err == nil || net.ParseIP(proxy) != nil, "server.trustedProxies: %q is not an IP or CIDR", proxy)
+	}
+	check(c.Auth.LogoutTokenMaxAge > 0, "auth.logoutTokenMaxAge: must be positive")
+	check(oneOf(c.Auth.DevAuth, "", "insecure"), "auth.devAuth: unknown mode %q, only insecure is supported", c.Auth.DevAuth)
+	check(c.Auth.RoleExtractor != "", "auth.roleExtractor: required")
+	check(len(c.Auth.RoleSources) > 0, "auth.roleSources: required")
+	for _, source := range c.Auth.RoleSources {
+		check(oneOf(source, "roles", "realm_access", "resource_access"), "auth.roleSources: unknown role source %q", source)
+	}
+	check(c.Auth.DPoPProofMaxAge > 0, "auth.dpopProofMaxAge: must be positive")
+	check(c.Gateway.ClientCertHeader == "" || c.Gateway.Secret != "" || c.Gateway.ClientCA != "",
+		"gateway.clientCertHeader requires gateway.secret or gateway.clientCa, or any caller could forward a bound certificate")
+	check(len(c.Gateway.ClientCNs) == 0 || c.Gateway.ClientCA != "", "gateway.clientCns requires gateway.clientCa")
+	if err := c.Mongo.Concerns.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("mongo: %w", err))
+	}
+	if _, err := c.Mongo.ForRepositories(); err != nil {
+		errs = append(errs, fmt.Errorf("mongo.repositoryConcerns: %w", err))
+	}
+	check(c.Mongo.RetryAttempts >= 1, "mongo.retryAttempts: must be at least 1")
+	check(c.Mongo.RetryBaseDelay > 0 && c.Mongo.RetryMaxDelay >= c.Mongo.RetryBaseDelay, "mongo.retryBaseDelay and retryMaxDelay: expected 0 < base <= max")
+
+	checkURL := func(name, v string) {
+		if v == "" {
+			return
+		}
+		u, err := url.Parse(v)
+		check(err == nil && oneOf(u.Scheme, "http", "https") && u.Host != "", "%s: %q is not an http(s) URL", name, v)
+	}
+	checkURL("keycloak.issuer", c.Keycloak.Issuer)
+	checkURL("auth.jwksUrl", c.Auth.JWKSURL)
+	checkURL("auth.introspectionUrl", c.Auth.IntrospectionURL)
+	checkURL("auth.dpopBaseUrl", c.Auth.DPoPBaseURL)
+
+	check(!(c.Auth.TrustGatewayHeaders && c.Auth.VerifyJWT), "auth.trustGatewayHeaders and auth.verifyJwt are mutually exclusive")
+	if c.Auth.VerifyJWT {
+		check(c.Keycloak.Issuer != "" || c.Auth.JWKSURL != "" || c.Auth.RealmsFile != "",
+			"auth.verifyJwt requires keycloak.issuer, auth.jwksUrl or auth.realmsFile")
+	}
+	switch c.Auth.IntrospectionMode {
+	case "", "off":
+	case "opaque", "always":
+		check(!c.Auth.TrustGatewayHeaders, "auth.introspectionMode cannot be combined with auth.trustGatewayHeaders")
+		check(c.Keycloak.Issuer != "" || c.Auth.IntrospectionURL != "", "auth.introspectionMode requires keycloak.issuer or auth.introspectionUrl")
+		check(c.Keycloak.ClientID != "" && (c.Keycloak.ClientSecret != "" || c.Vault.KeycloakSecretPath != ""),
+			"auth.introspectionMode requires keycloak.clientId and keycloak.clientSecret")
+	default:
+		errs = append(errs, fmt.Errorf("auth.introspectionMode: unknown mode %q", c.Auth.IntrospectionMode))
+	}
+
+	check(!(c.CORS.AllowCredentials && oneOf("*", c.CORS.AllowedOrigins...)), "cors.allowCredentials cannot be combined with the * origin")
+	check(c.Auth.DevAuth != "insecure" || c.Env != "production", "auth.devAuth must not be used with env production")
+
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls.certFile and tls.keyFile must be set together")
+	check(c.Gateway.ClientCA == "" || c.TLS.CertFile != "", "gateway.clientCa requires tls.certFile and tls.keyFile")
+	// Handlers behind the net/http adaptor don't see the TLS connection
+	check(!(c.Server.HTTP2 && c.Gateway.ClientCA != ""), "server.http2 cannot be combined with gateway.clientCa")
+	check(c.SecurityHeaders.HSTSMaxAge == 0 || c.SecurityHeaders.HSTSMaxAge >= time.Second,
+		"securityHeaders.hstsMaxAge: %v is under a second; use 0 to drop the header", c.SecurityHeaders.HSTSMaxAge)
+	if c.Metrics.Addr != "" {
+		_, _, err := net.SplitHostPort(c.Metrics.Addr)
+		check(err == nil, "metrics.addr: %q is not host:port", c.Metrics.Addr)
+	}
+	checkURL("tracing.endpoint", c.Tracing.Endpoint)
+	checkURL("tracing.tracesEndpoint", c.Tracing.TracesEndpoint)
+	checkURL("keycloak.adminUrl", c.Keycloak.AdminURL)
+	checkURL("keycloak.healthUrl", c.Keycloak.HealthURL)
+	checkURL("authz.opaUrl", c.Authz.OPAURL)
+
+	keycloakClient := c.Keycloak.Issuer != "" && c.Keycloak.ClientID != "" && (c.Keycloak.ClientSecret != "" || c.Vault.KeycloakSecretPath != "")
+	for _, f := range []struct {
+		name string
+		on   bool
+	}{
+		{"users.admin", c.Users.Admin},
+		{"users.registration", c.Users.Registration},
+		{"users.sync", c.Users.Sync},
+		{"authz.umaTickets", c.Authz.UMATickets},
+	} {
+		check(!f.on || keycloakClient, "%s requires keycloak.issuer, keycloak.clientId and keycloak.clientSecret", f.name)
+	}
+	for _, f := range []struct {
+		name string
+		on   bool
+	}{
+		{"auth.apiKeys", c.Auth.APIKeys},
+		{"authz.casbin", c.Authz.Casbin},
+		{"users.sync", c.Users.Sync},
+		{"tenancy.organizations", c.Tenancy.Organizations},
+	} {
+		check(!f.on || c.Store == "mongo", "%s needs store mongo", f.name)
+	}
+	if _, _, err := ParseRateLimit(c.Users.RegisterRateLimit); err != nil {
+		errs = append(errs, fmt.Errorf("users.registerRateLimit: %v", err))
+	}
+	check(!c.Users.Sync || c.Users.SyncInterval > 0 && c.Users.SyncFullInterval > 0 && c.Users.SyncLease > 0,
+		"users.syncInterval, syncFullInterval and syncLease: must be positive")
+
+	for _, tenant := range c.Tenancy.Tenants {
+		check(tenantName.MatchString(tenant), "tenancy.tenants: invalid tenant %q, expected up to 32 lowercase letters, digits, _ or -", tenant)
+	}
+	if len(c.Tenancy.Tenants) > 0 {
+		check(c.Store != "postgres", "tenancy.tenants needs store mongo or memory")
+		check(c.Files.Store != "s3", "tenancy.tenants can't share one files.store s3 bucket; use gridfs")
+		check(!c.Users.Registration, "users.registration doesn't support tenancy.tenants: a new user has no tenant yet")
+		check(c.Tenancy.Claim != "", "tenancy.claim: required")
+	}
+
+	check(c.Items.BatchMax >= 1, "items.batchMax: must be at least 1")
+	if fields := c.Items.RestrictedFields; !(len(fields) == 1 && fields[0] == "none") {
+		for _, entry := range fields {
+			name, roles, ok := strings.Cut(entry, ":")
+			check(ok && name != "" && roles != "", "items.restrictedFields: %q: expected field:role|role, or none", entry)
+		}
+	}
+	check(c.Files.MaxSize >= 1, "files.maxSize: must be positive")
+	switch c.Files.Store {
+	case "", "gridfs":
+	case "s3":
+		check(c.Files.S3.Endpoint != "" && c.Files.S3.Bucket != "", "files.store s3 needs files.s3.endpoint and files.s3.bucket")
+	default:
+		errs = append(errs, fmt.Errorf("files.store: unknown store %q, expected gridfs or s3", c.Files.Store))
+	}
+	check(!c.Audit.Enabled || c.Audit.Retention > 0, "audit.retention: must be positive")
+	check(c.Events.MaxSubscribers >= 1, "events.maxSubscribers: must be at least 1")
+	check(oneOf(c.FeatureFlags.Store, "", "mongo", "memory"), "featureFlags.store: unknown store %q, expected mongo or memory", c.FeatureFlags.Store)
+	check(c.FeatureFlags.Store != "mongo" || c.Store == "mongo", "featureFlags.store mongo needs store mongo")
+	if c.Mongo.CSFLE.KMSProvider != "" {
+		errs = append(errs, c.Mongo.CSFLE.validate()...)
+	}
+
+	if c.Vault.Addr != "" {
+		checkURL("vault.addr", c.Vault.Addr)
+		check(c.Vault.Token != "" || c.Vault.KubernetesRole != "", "vault.addr requires vault.token or vault.kubernetesRole")
+	} else {
+		check(c.Vault.MongoRole == "" && c.Vault.KeycloakSecretPath == "", "vault.mongoRole and vault.keycloakSecretPath require vault.addr")
+	}
+	return errors.Join(errs...)
+}
+
+// ParseRateLimit reads "<count>/<window>", e.g. "100/1m"
+func ParseRateLimit(v string) (int64, time.Duration, error) {
+	count, window, ok := strings.Cut(v, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid limit %q, expected count/window", v)
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(count), 10, 64)
+	if err != nil || n < 0 {
+		return 0, 0, fmt.Errorf("invalid count in %q", v)
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(window))
+	if err != nil || d < time.Second {
+		return 0, 0, fmt.Errorf("invalid window in %q", v)
+	}
+	return n, d, nil
+}
+
+func oneOf(v string, allowed ...string) bool {
+	for _, a := range allowed {
+		if v == a {
+			return true
+		}
+	}
+	return false
+}
+
+// Redacted returns a copy safe to print: settings tagged secret:"true" are
+// masked, as is the password in the Mongo URI
+func (c *Config) Redacted() *Config {
+	out := *c
+	for _, f := range collect(reflect.ValueOf(&out).Elem(), "") {
+		if f.tag.Get("secret") == "true" && f.value.String() != "" {
+			f.value.SetString(redacted)
+		}
+	}
+	if u, err := url.Parse(out.Mongo.URI); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			out.Mongo.URI = u.String()
+		}
+	}
+	return &out
+}
+
+const redacted = "REDACTED"
+
+// File is the YAML file the configuration was read from, or ""
+func (c *Config) File() string {
+	return c.file
+}
+
+// ReloadFiles lists the files a reload reads again: the YAML file, files
+// named by reloadable settings such as auth.policyFile, and the <NAME>_FILE
+// of reloadable environment variables
+func (c *Config) ReloadFiles() []string {
+	var files []string
+	if c.file != "" {
+		files = append(files, c.file)
+	}
+	for _, f := range collect(reflect.ValueOf(c).Elem(), "") {
+		if f.tag.Get("reload") != "true" {
+			continue
+		}
+		if strings.HasSuffix(f.tag.Get("env"), "_FILE") && f.value.String() != "" {
+			files = append(files, f.value.String())
+		} else if path := os.Getenv(f.tag.Get("env") + "_FILE"); path != "" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// WriteYAML prints the configuration in the format Load reads
+func (c *Config) WriteYAML(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
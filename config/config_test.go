@@ -0,0 +1,121 @@
+package config
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadReadsFeatureSettingsFromTheEnvironment(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "master.key")
+	if err := os.WriteFile(key, []byte("c2VjcmV0\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TLS_CERT_FILE", "/certs/tls.crt")
+	t.Setenv("TLS_RELOAD_INTERVAL", "5m")
+	t.Setenv("USER_SYNC", "true")
+	t.Setenv("TENANTS", "acme, globex")
+	t.Setenv("CSFLE_LOCAL_MASTER_KEY_FILE", key)
+
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TLS.CertFile != "/certs/tls.crt" || cfg.TLS.ReloadInterval != 5*time.Minute {
+		t.Errorf("tls: got %+v", cfg.TLS)
+	}
+	if !cfg.Users.Sync || cfg.Users.SyncLease != 10*time.Minute {
+		t.Errorf("users: got sync %v, lease %v", cfg.Users.Sync, cfg.Users.SyncLease)
+	}
+	if !reflect.DeepEqual(cfg.Tenancy.Tenants, []string{"acme", "globex"}) {
+		t.Errorf("tenancy.tenants: got %q", cfg.Tenancy.Tenants)
+	}
+	if cfg.Mongo.CSFLE.LocalMasterKey != "c2VjcmV0" {
+		t.Errorf("mongo.csfle.localMasterKey: got %q", cfg.Mongo.CSFLE.LocalMasterKey)
+	}
+	if got := cfg.Redacted().Mongo.CSFLE.LocalMasterKey; got != redacted {
+		t.Errorf("redacted mongo.csfle.localMasterKey: got %q", got)
+	}
+}
+
+func TestEmptyVariablesOnlySetSettingsTaggedEmpty(t *testing.T) {
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Users.RegisterRoles, []string{"user"}) || cfg.SecurityHeaders.FrameOptions != "DENY" {
+		t.Fatalf("defaults: got roles %q, frame options %q", cfg.Users.RegisterRoles, cfg.SecurityHeaders.FrameOptions)
+	}
+
+	t.Setenv("REGISTER_ROLES", "")
+	t.Setenv("FRAME_OPTIONS", "")
+	t.Setenv("LISTEN_ADDR", "")
+	if cfg, err = Load(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Users.RegisterRoles) != 0 {
+		t.Errorf("users.registerRoles: got %q, want none", cfg.Users.RegisterRoles)
+	}
+	if cfg.SecurityHeaders.FrameOptions != "" {
+		t.Errorf("securityHeaders.frameOptions: got %q, want empty", cfg.SecurityHeaders.FrameOptions)
+	}
+	if cfg.Server.Addr != ":3000" {
+		t.Errorf("server.addr: got %q, want the default", cfg.Server.Addr)
+	}
+}
+
+func TestValidateChecksFeatureSettings(t *testing.T) {
+	masterKey := base64.StdEncoding.EncodeToString(make([]byte, 96))
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		want string // "" when the settings are valid
+	}{
+		{"tls pair", map[string]string{"TLS_CERT_FILE": "tls.crt", "TLS_KEY_FILE": "tls.key"}, ""},
+		{"tls cert without key", map[string]string{"TLS_CERT_FILE": "tls.crt"}, "tls.certFile and tls.keyFile"},
+		{"client ca without tls", map[string]string{"GATEWAY_CLIENT_CA": "ca.pem"}, "gateway.clientCa requires tls.certFile"},
+		{"hsts off", map[string]string{"HSTS_MAX_AGE": "0s"}, ""},
+		{"hsts under a second", map[string]string{"HSTS_MAX_AGE": "1ms"}, "securityHeaders.hstsMaxAge"},
+		{"register rate limit", map[string]string{"REGISTER_RATE_LIMIT": "5/hour"}, "users.registerRateLimit"},
+		{"register rate limit count", map[string]string{"REGISTER_RATE_LIMIT": "-1/1h"}, "users.registerRateLimit"},
+		{"registration without keycloak", map[string]string{"REGISTRATION": "true"}, "users.registration requires keycloak.issuer"},
+		{"api keys without mongo", map[string]string{"STORE": "memory", "API_KEYS": "true"}, "auth.apiKeys needs store mongo"},
+		{"tenant name", map[string]string{"TENANTS": "acme,Globex"}, `invalid tenant "Globex"`},
+		{"tenants on s3", map[string]string{"TENANTS": "acme", "FILES_STORE": "s3", "S3_ENDPOINT": "s3:9000", "S3_BUCKET": "files"}, "files.store s3 bucket"},
+		{"s3 without bucket", map[string]string{"FILES_STORE": "s3", "S3_ENDPOINT": "s3:9000"}, "files.s3.bucket"},
+		{"files store", map[string]string{"FILES_STORE": "disk"}, `files.store: unknown store "disk"`},
+		{"restricted fields", map[string]string{"RESTRICTED_FIELDS": "costPrice"}, "items.restrictedFields"},
+		{"feature flags store", map[string]string{"FEATURE_FLAGS_STORE": "redis"}, "featureFlags.store"},
+		{"opa url", map[string]string{"OPA_URL": "opa:8181"}, "authz.opaUrl"},
+		{"dev auth in production", map[string]string{"APP_ENV": "production", "DEV_AUTH": "insecure"}, "auth.devAuth must not be used"},
+		{"csfle local", map[string]string{"CSFLE_KMS_PROVIDER": "local", "CSFLE_FIELDS": "items.name:random", "CSFLE_LOCAL_MASTER_KEY": masterKey}, ""},
+		{"csfle provider", map[string]string{"CSFLE_KMS_PROVIDER": "gcp", "CSFLE_FIELDS": "items.name"}, `kmsProvider: unknown provider "gcp"`},
+		{"csfle without fields", map[string]string{"CSFLE_KMS_PROVIDER": "local", "CSFLE_LOCAL_MASTER_KEY": masterKey}, "mongo.csfle.fields: required"},
+		{"csfle nested field", map[string]string{"CSFLE_KMS_PROVIDER": "local", "CSFLE_FIELDS": "items.meta.name", "CSFLE_LOCAL_MASTER_KEY": masterKey}, "top-level fields only"},
+		{"csfle algorithm", map[string]string{"CSFLE_KMS_PROVIDER": "local", "CSFLE_FIELDS": "items.name:aes", "CSFLE_LOCAL_MASTER_KEY": masterKey}, "deterministic or random"},
+		{"csfle short master key", map[string]string{"CSFLE_KMS_PROVIDER": "local", "CSFLE_FIELDS": "items.name", "CSFLE_LOCAL_MASTER_KEY": "c2VjcmV0"}, "mongo.csfle.localMasterKey"},
+		{"csfle key vault", map[string]string{"CSFLE_KMS_PROVIDER": "local", "CSFLE_FIELDS": "items.name", "CSFLE_LOCAL_MASTER_KEY": masterKey, "CSFLE_KEY_VAULT": "keyVault"}, "mongo.csfle.keyVault"},
+		{"csfle aws", map[string]string{"CSFLE_KMS_PROVIDER": "aws", "CSFLE_FIELDS": "items.name", "CSFLE_AWS_KEY_REGION": "us-east-1"}, "kmsProvider aws needs"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := Load(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = cfg.Validate()
+			switch {
+			case tc.want == "" && err != nil:
+				t.Errorf("got %v, want no error", err)
+			case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+				t.Errorf("got %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/example/fiber-demo/config"
+)
+
+// configCheck implements `config check [flags]`: it loads and validates the
+// configuration like the server would and prints the effective settings
+// with secrets masked, without connecting to anything. It returns the exit
+// status.
+func configCheck(args []string) int {
+	loaded, err := config.Load(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "config error:", err)
+		return 2
+	}
+	if err := loaded.Redacted().WriteYAML(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "config error:", err)
+		return 2
+	}
+	if err := loaded.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:")
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintln(os.Stderr, "  -", line)
+		}
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "configuration OK")
+	return 0
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/example/fiber-demo/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/rs/zerolog/log"
+)
+
+// corsHandler is set while CORS origins are configured and swapped on
+// reload; behind KrakenD CORS is the gateway's job, this is for SPAs calling
+// :3000 directly in development
+var corsHandler atomic.Pointer[fiber.Handler]
+
+// Default lists, including the headers the auth subsystems read
+const (
+	corsDefaultMethods = "GET,POST,PUT,PATCH,DELETE,HEAD,OPTIONS"
+	corsDefaultHeaders = "Origin,Content-Type,Accept,Authorization,DPoP,X-API-Key,X-Request-ID,If-Match"
+	corsDefaultExposed = "ETag"
+)
+
+// corsMiddleware answers preflight requests before any auth middleware
+// runs, with the handler current at request time
+func corsMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if h := corsHandler.Load(); h != nil {
+			return (*h)(c)
+		}
+		return c.Next()
+	}
+}
+
+// loadCORS builds the CORS handler for cc, or nil when no origin is allowed
+func loadCORS(cc config.CORS) *fiber.Handler {
+	if len(cc.AllowedOrigins) == 0 {
+		return nil
+	}
+	conf := cors.Config{
+		AllowOrigins:     strings.Join(cc.AllowedOrigins, ","),
+		AllowMethods:     corsDefaultMethods,
+		AllowHeaders:     corsDefaultHeaders,
+		ExposeHeaders:    corsDefaultExposed,
+		AllowCredentials: cc.AllowCredentials,
+		MaxAge:           int(cc.MaxAge / time.Second),
+	}
+	if len(cc.AllowedMethods) > 0 {
+		conf.AllowMethods = strings.ToUpper(strings.Join(cc.AllowedMethods, ","))
+	}
+	if len(cc.AllowedHeaders) > 0 {
+		conf.AllowHeaders = strings.Join(cc.AllowedHeaders, ",")
+	}
+	if len(cc.ExposedHeaders) > 0 {
+		conf.ExposeHeaders = strings.Join(cc.ExposedHeaders, ",")
+	}
+	h := cors.New(conf)
+	return &h
+}
+
+// Load CORS_ALLOWED_ORIGINS, CORS_ALLOWED_METHODS, CORS_ALLOWED_HEADERS,
+// CORS_EXPOSED_HEADERS, CORS_ALLOW_CREDENTIALS and CORS_MAX_AGE
+func initCORS() {
+	h := loadCORS(cfg.CORS)
+	if h == nil {
+		return
+	}
+	corsHandler.Store(h)
+	log.Info().Strs("origins", cfg.CORS.AllowedOrigins).Msg("CORS enabled")
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/example/fiber-demo/config"
+	"github.com/example/fiber-demo/repository"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/mongocrypt"
+)
+
+// CSFLE algorithms. Deterministic values can be matched by equality
+// queries; random ones leak nothing, not even equality.
+const (
+	csfleDeterministic = "AEAD_AES_256_CBC_HMAC_SHA_512-Deterministic"
+	csfleRandom        = "AEAD_AES_256_CBC_HMAC_SHA_512-Random"
+)
+
+// csfleField is an entry of CSFLE_FIELDS, collection.field[:algorithm]
+type csfleField struct {
+	collection, field, algorithm string
+}
+
+func parseCSFLEFields(entries []string) ([]csfleField, error) {
+	var fields []csfleField
+	for _, entry := range entries {
+		path, algo, _ := strings.Cut(entry, ":")
+		coll, field, ok := strings.Cut(path, ".")
+		if !ok || coll == "" || field == "" || strings.Contains(field, ".") {
+			return nil, fmt.Errorf("%q: expected collection.field, top-level fields only", entry)
+		}
+		switch algo {
+		case "", "deterministic":
+			algo = csfleDeterministic
+		case "random":
+			algo = csfleRandom
+		default:
+			return nil, fmt.Errorf("%q: algorithm must be deterministic or random", entry)
+		}
+		if !repository.EncryptableField(coll, field) {
+			return nil, fmt.Errorf("%q: the collection schema requires another type than binData for this field", entry)
+		}
+		fields = append(fields, csfleField{collection: coll, field: field, algorithm: algo})
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("no fields to encrypt")
+	}
+	return fields, nil
+}
+
+// csfleKMS reads the KMS provider settings: the providers map of the
+// driver, and the master key data keys are created with
+func csfleKMS(c config.CSFLE) (map[string]map[string]interface{}, interface{}, error) {
+	switch c.KMSProvider {
+	case "local":
+		key, err := base64.StdEncoding.DecodeString(c.LocalMasterKey)
+		if err != nil || len(key) != 96 {
+			return nil, nil, errors.New("CSFLE_LOCAL_MASTER_KEY must be 96 bytes, base64 encoded")
+		}
+		return map[string]map[string]interface{}{"local": {"key": key}}, nil, nil
+	case "aws":
+		creds := map[string]interface{}{
+			"accessKeyId":     c.AWSAccessKeyID,
+			"secretAccessKey": c.AWSSecretAccessKey,
+		}
+		masterKey := bson.M{"region": c.AWSKeyRegion, "key": c.AWSKeyARN}
+		if creds["accessKeyId"] == "" || masterKey["region"] == "" || masterKey["key"] == "" {
+			return nil, nil, errors.New("the aws provider needs CSFLE_AWS_ACCESS_KEY_ID, CSFLE_AWS_SECRET_ACCESS_KEY, CSFLE_AWS_KEY_REGION and CSFLE_AWS_KEY_ARN")
+		}
+		return map[string]map[string]interface{}{"aws": creds}, masterKey, nil
+	}
+	return nil, nil, fmt.Errorf("unknown KMS provider %q, expected local or aws", c.KMSProvider)
+}
+
+// csfleDataKey returns the ID of the data key named altName in the key
+// vault, creating the key the first time
+func csfleDataKey(ctx context.Context, keyVault *mongo.Client, ns, provider string, kms map[string]map[string]interface{}, masterKey interface{}, altName string) (primitive.Binary, error) {
+	db, coll, _ := strings.Cut(ns, ".")
+	// Key alt names must be unique, or two replicas starting together could
+	// each create a key
+	_, err := keyVault.Database(db).Collection(coll).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "keyAltNames", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"keyAltNames": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		return primitive.Binary{}, err
+	}
+	ce, err := mongo.NewClientEncryption(keyVault, options.ClientEncryption().SetKeyVaultNamespace(ns).SetKmsProviders(kms))
+	if err != nil {
+		return primitive.Binary{}, err
+	}
+	defer ce.Close(ctx)
+
+	var key struct {
+		ID primitive.Binary `bson:"_id"`
+	}
+	err = ce.GetKeyByAltName(ctx, altName).Decode(&key)
+	if err == nil {
+		return key.ID, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return primitive.Binary{}, err
+	}
+	opts := options.DataKey().SetKeyAltNames([]string{altName})
+	if masterKey != nil {
+		opts.SetMasterKey(masterKey)
+	}
+	id, err := ce.CreateDataKey(ctx, provider, opts)
+	if mongo.IsDuplicateKeyError(err) {
+		// Another replica won the race
+		err = ce.GetKeyByAltName(ctx, altName).Decode(&key)
+		return key.ID, err
+	}
+	if err == nil {
+		log.Info().Str("keyAltName", altName).Msg("CSFLE data key created")
+	}
+	return id, err
+}
+
+// csfleOptions returns the auto encryption options of the Mongo client,
+// nil unless mongo.csfle.kmsProvider is set. Its fields are then encrypted
+// by the driver before writes and decrypted after reads, with a data key
+// kept in the keyVault namespace, in each of databases.
+func csfleOptions(ctx context.Context, databases []string) *options.AutoEncryptionOptions {
+	c := cfg.Mongo.CSFLE
+	provider := c.KMSProvider
+	if provider == "" {
+		return nil
+	}
+	fatal := func(err error) {
+		log.Fatal().Err(err).Msg("CSFLE error")
+	}
+	if mongocrypt.Version() == "" {
+		fatal(errors.New("this binary was built without libmongocrypt; rebuild with CGO_ENABLED=1 go build -tags cse"))
+	}
+	fields, err := parseCSFLEFields(c.Fields)
+	if err != nil {
+		fatal(fmt.Errorf("CSFLE_FIELDS: %w", err))
+	}
+	kms, masterKey, err := csfleKMS(c)
+	if err != nil {
+		fatal(err)
+	}
+	ns := c.KeyVault
+	if db, coll, ok := strings.Cut(ns, "."); !ok || db == "" || coll == "" {
+		fatal(fmt.Errorf("CSFLE_KEY_VAULT: expected database.collection, got %q", ns))
+	}
+	altName := c.KeyAltName
+
+	keyVaultOpts := mongoClientOptions()
+	keyVault, err := mongo.Connect(ctx, keyVaultOpts)
+	if err != nil {
+		fatal(err)
+	}
+	defer keyVault.Disconnect(context.Background())
+	keyID, err := csfleDataKey(ctx, keyVault, ns, provider, kms, masterKey, altName)
+	if err != nil {
+		fatal(fmt.Errorf("data key: %w", err))
+	}
+
+	// One schema per collection, every field under the same data key
+	schemas := map[string]interface{}{}
+	for _, database := range databases {
+		for _, f := range fields {
+			name := database + "." + f.collection
+			schema, ok := schemas[name].(bson.M)
+			if !ok {
+				schema = bson.M{
+					"bsonType":        "object",
+					"encryptMetadata": bson.M{"keyId": bson.A{keyID}},
+					"properties":      bson.M{},
+				}
+				schemas[name] = schema
+			}
+			schema["properties"].(bson.M)[f.field] = bson.M{
+				"encrypt": bson.M{"bsonType": "string", "algorithm": f.algorithm},
+			}
+		}
+	}
+
+	opts := options.AutoEncryption().
+		SetKeyVaultNamespace(ns).
+		SetKmsProviders(kms).
+		SetSchemaMap(schemas).
+		SetKeyVaultClientOptions(keyVaultOpts)
+	if lib := c.CryptSharedLib; lib != "" {
+		opts.SetExtraOptions(map[string]interface{}{"cryptSharedLibPath": lib, "cryptSharedLibRequired": true})
+	}
+	log.Info().Str("kms", provider).Int("fields", len(fields)).Msg("Client-side field level encryption enabled")
+	return opts
+}
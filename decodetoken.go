@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// runDecodeToken implements `decode-token [-verify] [config flags] <token|->`:
+// it prints the token's header and claims with the roles this service would
+// extract from it. With -verify the signature is checked against the JWKS
+// and the token's validity period against the clock, exiting 1 on failure.
+func runDecodeToken(args []string) int {
+	verify := false
+	var rest []string
+	for _, arg := range args {
+		if arg == "-verify" || arg == "--verify" {
+			verify = true
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	if len(rest) == 0 || rest[len(rest)-1] != "-" && strings.HasPrefix(rest[len(rest)-1], "-") {
+		fmt.Fprintln(os.Stderr, "usage: fiber-demo decode-token [-verify] [config flags] <token|->")
+		return 2
+	}
+	token, rest := rest[len(rest)-1], rest[:len(rest)-1]
+	if token == "-" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintln(os.Stderr, "decode-token: reading stdin:", err)
+			return 2
+		}
+		token = line
+	}
+	token = strings.TrimPrefix(strings.TrimSpace(token), "Bearer ")
+
+	loadConfig(rest)
+	// Keep stdout for the decoded token
+	cfg.Log.Output = "stderr"
+	initLogging()
+	initRoleExtractor()
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		fmt.Fprintln(os.Stderr, "decode-token: not a JWT")
+		return 1
+	}
+	var header map[string]interface{}
+	if data, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil || json.Unmarshal(data, &header) != nil {
+		fmt.Fprintln(os.Stderr, "decode-token: invalid header")
+		return 1
+	}
+	claims, err := parseUnverified(token)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "decode-token:", err)
+		return 1
+	}
+
+	out := map[string]interface{}{"header": header, "claims": claims.Raw, "callerType": claims.CallerType()}
+	if roles, err := extractRoles(claims); err != nil {
+		out["rolesError"] = err.Error()
+	} else {
+		out["roles"] = roles
+	}
+	if claims.ExpiresAt != nil {
+		left := time.Until(claims.ExpiresAt.Time).Round(time.Second)
+		out["expiresAt"] = claims.ExpiresAt.Time.UTC()
+		out["expired"] = left <= 0
+		if left > 0 {
+			out["expiresIn"] = left.String()
+		}
+	}
+
+	status := 0
+	if verify {
+		if err := verifyLocally(token); err != nil {
+			out["verified"] = false
+			out["verifyError"] = err.Error()
+			status = 1
+		} else {
+			out["verified"] = true
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		fmt.Fprintln(os.Stderr, "decode-token:", err)
+		return 1
+	}
+	return status
+}
+
+// verifyLocally checks the signature with the key sets the server would use,
+// then the validity period
+func verifyLocally(token string) error {
+	clockSkew = cfg.Auth.ClockSkew
+	initRealms()
+	if realms != nil {
+		for _, r := range realms {
+			r.keySet = startKeySet(r.jwksURL)
+		}
+	} else {
+		jwksURL := cfg.Auth.JWKSURL
+		if jwksURL == "" {
+			jwksURL = oidcEndpoints().JWKSURI
+		}
+		if jwksURL == "" {
+			return fmt.Errorf("-verify requires KEYCLOAK_ISSUER, JWKS_URL or REALMS_FILE")
+		}
+		jwtKeySet = startKeySet(jwksURL)
+	}
+	claims, err := verifyToken(token)
+	if err != nil {
+		return err
+	}
+	return validateTimes(claims, time.Now())
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Headers accepted instead of a token when DEV_AUTH=insecure
+const (
+	headerDebugUser  = "X-Debug-User"
+	headerDebugRoles = "X-Debug-Roles"
+)
+
+// devAuth is set when DEV_AUTH=insecure: anyone can then claim any identity
+var devAuth bool
+
+// devClaims fabricates claims for the X-Debug-User / X-Debug-Roles pair,
+// shaped like a Keycloak token so role guards and policies behave as usual
+func devClaims(c *fiber.Ctx) *KeycloakClaims {
+	user := c.Get(headerDebugUser)
+	roles := splitList(c.Get(headerDebugRoles))
+	if roles == nil {
+		roles = []string{}
+	}
+	now := time.Now()
+	claims := &KeycloakClaims{
+		PreferredUsername: user,
+		Email:             user + "@dev.local",
+		EmailVerified:     true,
+		Roles:             roles,
+		RealmAccess:       &RoleClaim{Roles: roles},
+	}
+	claims.Subject = "dev:" + user
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(time.Hour))
+	claims.Raw = jwt.MapClaims{
+		"sub":                claims.Subject,
+		"preferred_username": claims.PreferredUsername,
+		"email":              claims.Email,
+		"email_verified":     true,
+		"roles":              roles,
+	}
+	return claims
+}
+
+// Enable DEV_AUTH=insecure, which config.Validate refuses in production
+func initDevAuth() {
+	if cfg.Auth.DevAuth != "insecure" {
+		return
+	}
+	devAuth = true
+	log.Warn().Msgf("DEV_AUTH=insecure, %s/%s headers are trusted without a token", headerDebugUser, headerDebugRoles)
+}
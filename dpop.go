@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// headerDPoP carries the proof of possession for DPoP-bound tokens (RFC 9449)
+const headerDPoP = "DPoP"
+
+// dpopMaxAge is how old a proof's iat may be (DPOP_PROOF_MAX_AGE)
+var dpopMaxAge = 60 * time.Second
+
+// dpopBaseURL replaces the scheme and host of the request when rebuilding
+// the htu a proof must name (DPOP_BASE_URL). Behind KrakenD the client signs
+// the gateway's URL, not the backend's.
+var dpopBaseURL string
+
+// dpopSeen remembers proof jtis until they are too old to be accepted anyway
+var dpopSeen = newTTLCache[struct{}](100000)
+
+// dpopClaims is the payload of a DPoP proof JWT
+type dpopClaims struct {
+	jwt.RegisteredClaims
+	HTM string `json:"htm"`
+	HTU string `json:"htu"`
+	ATH string `json:"ath"`
+}
+
+// checkDPoP requires a valid DPoP proof when the token is bound to a key via
+// cnf.jkt, so a stolen token is useless without the client's private key
+func checkDPoP(c *fiber.Ctx, tokenString string, claims *KeycloakClaims) error {
+	if claims.Confirmation == nil || claims.Confirmation.JWKThumbprint == "" {
+		return nil
+	}
+	proof := c.Get(headerDPoP)
+	if proof == "" {
+		return fmt.Errorf("missing %s proof for DPoP-bound token", headerDPoP)
+	}
+
+	var key jwk
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithoutClaimsValidation(),
+	)
+	pc := &dpopClaims{}
+	_, err := parser.ParseWithClaims(proof, pc, func(t *jwt.Token) (interface{}, error) {
+		if t.Header["typ"] != "dpop+jwt" {
+			return nil, fmt.Errorf("typ must be dpop+jwt")
+		}
+		raw, err := json.Marshal(t.Header["jwk"])
+		if err != nil || json.Unmarshal(raw, &key) != nil {
+			return nil, fmt.Errorf("bad jwk header")
+		}
+		var private struct {
+			D string `json:"d"`
+		}
+		if json.Unmarshal(raw, &private) == nil && private.D != "" {
+			return nil, fmt.Errorf("jwk header must not contain a private key")
+		}
+		return key.publicKey()
+	})
+	if err != nil {
+		return fmt.Errorf("invalid DPoP proof: %v", err)
+	}
+
+	thumbprint, err := key.thumbprint()
+	if err != nil || thumbprint != claims.Confirmation.JWKThumbprint {
+		return fmt.Errorf("DPoP key does not match the token binding")
+	}
+	if !strings.EqualFold(pc.HTM, c.Method()) {
+		return fmt.Errorf("DPoP proof htm mismatch")
+	}
+	if !htuMatches(pc.HTU, dpopRequestURL(c)) {
+		return fmt.Errorf("DPoP proof htu mismatch")
+	}
+	ath := sha256.Sum256([]byte(tokenString))
+	if pc.ATH != base64.RawURLEncoding.EncodeToString(ath[:]) {
+		return fmt.Errorf("DPoP proof ath mismatch")
+	}
+	if pc.IssuedAt == nil {
+		return fmt.Errorf("DPoP proof has no iat")
+	}
+	now := time.Now()
+	if pc.IssuedAt.After(now.Add(clockSkew)) || pc.IssuedAt.Before(now.Add(-dpopMaxAge-clockSkew)) {
+		return fmt.Errorf("DPoP proof iat outside the accepted window")
+	}
+	if pc.ID == "" {
+		return fmt.Errorf("DPoP proof has no jti")
+	}
+	switch dpopSeen.add(thumbprint+":"+pc.ID, struct{}{}, pc.IssuedAt.Add(dpopMaxAge+clockSkew)) {
+	case errCacheHit:
+		return failure("dpop_replay", fmt.Errorf("DPoP proof replayed"))
+	case errCacheFull:
+		// Every remembered jti is still live: accepting the proof unchecked
+		// would allow replays, and calling it one would be wrong
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(dpopMaxAge/time.Second)))
+		return failure("dpop_cache_full", apperror.Unavailable("Too many recent DPoP proofs, retry later"))
+	}
+	return nil
+}
+
+// dpopRequestURL is the URL the client is expected to have signed
+func dpopRequestURL(c *fiber.Ctx) string {
+	if dpopBaseURL != "" {
+		return dpopBaseURL + c.Path()
+	}
+	return c.BaseURL() + c.Path()
+}
+
+// htuMatches compares htu to the request URL ignoring query, fragment and
+// the case of scheme and host
+func htuMatches(htu, requestURL string) bool {
+	if i := strings.IndexAny(htu, "?#"); i >= 0 {
+		htu = htu[:i]
+	}
+	split := func(u string) (string, string) {
+		i := strings.Index(u, "://")
+		if i < 0 {
+			return "", u
+		}
+		rest := u[i+3:]
+		j := strings.Index(rest, "/")
+		if j < 0 {
+			return strings.ToLower(u), "/"
+		}
+		return strings.ToLower(u[:i+3+j]), rest[j:]
+	}
+	origin, path := split(htu)
+	wantOrigin, wantPath := split(requestURL)
+	return origin == wantOrigin && path == wantPath
+}
+
+// publicKey returns the RSA or EC key described by the jwk
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		return k.rsaPublicKey()
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("bad x coordinate: %v", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("bad y coordinate: %v", err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// thumbprint is the RFC 7638 SHA-256 thumbprint: the required members in
+// lexicographic order, without whitespace
+func (k jwk) thumbprint() (string, error) {
+	var canonical string
+	switch k.Kty {
+	case "RSA":
+		canonical = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "EC":
+		canonical = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Crv, k.X, k.Y)
+	default:
+		return "", fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// Read DPOP_PROOF_MAX_AGE and DPOP_BASE_URL
+func initDPoP() {
+	dpopMaxAge = cfg.Auth.DPoPProofMaxAge
+	dpopBaseURL = strings.TrimSuffix(cfg.Auth.DPoPBaseURL, "/")
+}
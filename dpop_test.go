@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// dpopKey is a client key DPoP proofs are signed with
+type dpopKey struct {
+	private *ecdsa.PrivateKey
+	public  jwk
+}
+
+func newDPoPKey(t *testing.T) *dpopKey {
+	t.Helper()
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coord := func(b []byte) string {
+		padded := make([]byte, 32)
+		copy(padded[32-len(b):], b)
+		return base64.RawURLEncoding.EncodeToString(padded)
+	}
+	return &dpopKey{private: private, public: jwk{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   coord(private.X.Bytes()),
+		Y:   coord(private.Y.Bytes()),
+	}}
+}
+
+func (k *dpopKey) thumbprint(t *testing.T) string {
+	t.Helper()
+	thumbprint, err := k.public.thumbprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return thumbprint
+}
+
+// proof signs a proof for a GET of /me with accessToken, after change
+// edits its claims
+func (k *dpopKey) proof(t *testing.T, accessToken string, change func(jwt.MapClaims)) string {
+	t.Helper()
+	ath := sha256.Sum256([]byte(accessToken))
+	claims := jwt.MapClaims{
+		"htm": "GET",
+		"htu": "http://example.com/me",
+		"ath": base64.RawURLEncoding.EncodeToString(ath[:]),
+		"iat": time.Now().Unix(),
+		"jti": fmt.Sprintf("proof-%d", time.Now().UnixNano()),
+	}
+	if change != nil {
+		change(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = "dpop+jwt"
+	token.Header["jwk"] = map[string]string{"kty": k.public.Kty, "crv": k.public.Crv, "x": k.public.X, "y": k.public.Y}
+	signed, err := token.SignedString(k.private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestDPoPProofsAreChecked(t *testing.T) {
+	app := authApp()
+	key := newDPoPKey(t)
+	accessToken := sign(t, map[string]interface{}{
+		"sub":                "tokentest-frank",
+		"preferred_username": "frank",
+		"cnf":                map[string]interface{}{"jkt": key.thumbprint(t)},
+	})
+
+	accepted := key.proof(t, accessToken, nil)
+	if resp := call(t, app, http.MethodGet, "/me", accessToken, headerDPoP, accepted); resp.StatusCode != http.StatusOK {
+		t.Fatalf("valid proof: got %d, want 200", resp.StatusCode)
+	}
+
+	for _, tc := range []struct {
+		name, proof string
+	}{
+		{"missing", ""},
+		{"replayed", accepted},
+		{"signed by another key", newDPoPKey(t).proof(t, accessToken, nil)},
+		{"for another method", key.proof(t, accessToken, func(c jwt.MapClaims) { c["htm"] = "POST" })},
+		{"for another URL", key.proof(t, accessToken, func(c jwt.MapClaims) { c["htu"] = "http://example.com/admin" })},
+		{"for another host", key.proof(t, accessToken, func(c jwt.MapClaims) { c["htu"] = "https://evil.example/me" })},
+		{"for another token", key.proof(t, accessToken, func(c jwt.MapClaims) { c["ath"] = "bm90IHRoZSB0b2tlbg" })},
+		{"without ath", key.proof(t, accessToken, func(c jwt.MapClaims) { delete(c, "ath") })},
+		{"issued long ago", key.proof(t, accessToken, func(c jwt.MapClaims) { c["iat"] = time.Now().Add(-time.Hour).Unix() })},
+		{"issued in the future", key.proof(t, accessToken, func(c jwt.MapClaims) { c["iat"] = time.Now().Add(time.Hour).Unix() })},
+		{"without iat", key.proof(t, accessToken, func(c jwt.MapClaims) { delete(c, "iat") })},
+		{"without jti", key.proof(t, accessToken, func(c jwt.MapClaims) { delete(c, "jti") })},
+	} {
+		var headers []string
+		if tc.proof != "" {
+			headers = []string{headerDPoP, tc.proof}
+		}
+		if resp := call(t, app, http.MethodGet, "/me", accessToken, headers...); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("proof %s: got %d, want 401", tc.name, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import "strings"
+
+// splitList parses a comma-separated setting, dropping blanks
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// productionMode reports whether APP_ENV=production; development-only
+// features refuse to start then
+func productionMode() bool {
+	return cfg.Env == "production"
+}
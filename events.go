@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+)
+
+// eventHeartbeat keeps idle streams from being cut by proxies
+const eventHeartbeat = 15 * time.Second
+
+var (
+	// eventStreams is cancelled at shutdown, ending every open SSE stream and
+	// WebSocket so the drain doesn't wait on them
+	eventStreams, stopEventStreams = context.WithCancel(context.Background())
+
+	maxEventSubscribers int64 = 100
+	eventSubscribers    atomic.Int64
+)
+
+// itemEventJSON is the data of an SSE message
+type itemEventJSON struct {
+	Type string           `json:"type"`
+	ID   string           `json:"id"`
+	Item *repository.Item `json:"item,omitempty"`
+}
+
+// registerEventRoutes mounts GET /events/items, a Server-Sent Events stream
+// of item changes. Each message's id is a resume token: EventSource sends
+// it back as Last-Event-ID when reconnecting, and the stream continues
+// right after it. A token too old to resume starts a fresh stream with a
+// "reset" event, telling the client to refetch.
+func registerEventRoutes(app *fiber.App, watcher repository.ItemWatcher) {
+	app.Get("/events/items", requireAnyRole("user", "admin"), func(c *fiber.Ctx) error {
+		if mongoStore() && !mongoReplicaSet {
+			return apperror.Unavailable("Item events need MongoDB to run as a replica set")
+		}
+		if eventSubscribers.Add(1) > maxEventSubscribers {
+			eventSubscribers.Add(-1)
+			return apperror.RateLimited("Too many event subscribers, retry later")
+		}
+		token := c.Get("Last-Event-ID")
+		if token == "" {
+			token = c.Query("lastEventId")
+		}
+		ctx, cancel := context.WithCancel(withRequestPrincipal(withRequestTenant(eventStreams, c), c))
+		stream, err := watcher.WatchItems(ctx, token)
+		reset := false
+		if errors.Is(err, repository.ErrStaleResumeToken) {
+			reset = true
+			stream, err = watcher.WatchItems(ctx, "")
+		}
+		if err != nil {
+			cancel()
+			eventSubscribers.Add(-1)
+			return apperror.Internal("Cannot watch items", err)
+		}
+
+		// c is recycled once the handler returns; the writer keeps what it needs
+		hidden := hiddenFields(userFromCtx(c))
+		logger := requestLogger(c.UserContext()).With().Logger()
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Set(fiber.HeaderConnection, "keep-alive")
+		c.Set("X-Accel-Buffering", "no")
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			events := make(chan repository.ItemEvent)
+			go func() {
+				defer close(events)
+				for stream.Next(ctx) {
+					select {
+					case events <- stream.Event():
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+			defer func() {
+				cancel()
+				// The stream isn't safe for concurrent use: wait for the
+				// reader to stop before closing it
+				for range events {
+				}
+				_ = stream.Close(context.Background())
+				eventSubscribers.Add(-1)
+			}()
+
+			fmt.Fprintf(w, "retry: 3000\n\n")
+			if reset {
+				fmt.Fprintf(w, "event: reset\ndata: {}\n\n")
+			}
+			if w.Flush() != nil {
+				return
+			}
+			heartbeat := time.NewTicker(eventHeartbeat)
+			defer heartbeat.Stop()
+			for {
+				select {
+				case ev, ok := <-events:
+					if !ok {
+						if err := stream.Err(); err != nil && ctx.Err() == nil {
+							logger.Error().Err(err).Msg("Item change stream failed")
+						}
+						return
+					}
+					data, err := json.Marshal(itemEventJSON{Type: ev.Type, ID: ev.ID, Item: ev.Item})
+					if err == nil {
+						data, err = redactJSON(data, hidden)
+					}
+					if err != nil {
+						logger.Error().Err(err).Msg("Cannot encode item event")
+						return
+					}
+					fmt.Fprintf(w, "id: %s\nevent: item.%s\ndata: %s\n\n", ev.Token, ev.Type, data)
+				case <-heartbeat.C:
+					fmt.Fprintf(w, ": heartbeat\n\n")
+				case <-ctx.Done():
+					return
+				}
+				// A failed flush means the client went away
+				if w.Flush() != nil {
+					return
+				}
+			}
+		})
+		return nil
+	})
+}
+
+// Load EVENTS_MAX_SUBSCRIBERS
+func initEvents() {
+	maxEventSubscribers = int64(cfg.Events.MaxSubscribers)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/flags"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// featureFlags is the service behind flags.IsEnabled
+var featureFlags *flags.Service
+
+// withFlagSubject lets flags.IsEnabled(ctx, ...) target the user's roles
+// and tenant
+func withFlagSubject(ctx context.Context, user *User) context.Context {
+	return flags.WithSubject(ctx, flags.Subject{Roles: user.Roles, Tenant: tenantOf(user)})
+}
+
+// registerFlagRoutes mounts GET /flags, the flags on for the caller, and the
+// admin endpoints changing flags at runtime
+func registerFlagRoutes(app *fiber.App) {
+	app.Get("/flags", func(c *fiber.Ctx) error {
+		if _, err := currentUser(c); err != nil {
+			return unauthorized(c, err)
+		}
+		enabled := []string{}
+		for _, f := range featureFlags.List() {
+			if featureFlags.IsEnabled(c.UserContext(), f.Name) {
+				enabled = append(enabled, f.Name)
+			}
+		}
+		return c.JSON(fiber.Map{"enabled": enabled})
+	})
+
+	app.Get("/admin/flags", requireRole("admin"), func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"flags": featureFlags.List()})
+	})
+
+	app.Put("/admin/flags/:name", requireRole("admin"), func(c *fiber.Ctx) error {
+		var body struct {
+			Description string   `json:"description"`
+			Enabled     bool     `json:"enabled"`
+			Roles       []string `json:"roles"`
+			Tenants     []string `json:"tenants"`
+		}
+		if err := c.BodyParser(&body); err != nil {
+			return apperror.Validation("Invalid body")
+		}
+		f := flags.Flag{
+			Name:        c.Params("name"),
+			Description: body.Description,
+			Enabled:     body.Enabled,
+			Roles:       body.Roles,
+			Tenants:     body.Tenants,
+			UpdatedAt:   time.Now().UTC(),
+			UpdatedBy:   userFromCtx(c).Username,
+		}
+		if err := featureFlags.Save(c.UserContext(), f); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		requestLogger(c.UserContext()).Info().Str("flag", f.Name).Bool("enabled", f.Enabled).
+			Strs("flagRoles", f.Roles).Strs("flagTenants", f.Tenants).Msg("Feature flag changed")
+		return c.JSON(f)
+	})
+
+	// Deleting a saved flag falls back to its FEATURE_FLAGS default
+	app.Delete("/admin/flags/:name", requireRole("admin"), func(c *fiber.Ctx) error {
+		if err := featureFlags.Delete(c.UserContext(), c.Params("name")); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		requestLogger(c.UserContext()).Info().Str("flag", c.Params("name")).Msg("Feature flag reset")
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+}
+
+// Load FEATURE_FLAGS defaults and the flags saved in the feature_flags
+// collection (FEATURE_FLAGS_STORE=memory keeps changes in the process),
+// refreshed every FEATURE_FLAGS_REFRESH_INTERVAL (default 30s)
+func initFlags() {
+	defaults, err := flags.Parse(cfg.FeatureFlags.Defaults)
+	if err != nil {
+		log.Fatal().Err(err).Msg("FEATURE_FLAGS error")
+	}
+	kind := cfg.FeatureFlags.Store
+	if kind == "" {
+		// Flags are kept in MongoDB or memory only
+		kind = "memory"
+		if mongoStore() {
+			kind = "mongo"
+		}
+	}
+	var store flags.Store
+	switch kind {
+	case "mongo":
+		store = flags.NewMongoStore(mongoDB.Collection("feature_flags"))
+	case "memory":
+		store = flags.NewMemoryStore()
+	default:
+		log.Fatal().Msgf("FEATURE_FLAGS_STORE: unknown store %q, expected mongo or memory", kind)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	svc, err := flags.New(ctx, store, defaults)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Feature flags error")
+	}
+	featureFlags = svc
+	flags.SetDefault(svc)
+	log.Info().Int("count", len(svc.List())).Msg("Feature flags loaded")
+
+	if interval := cfg.FeatureFlags.RefreshInterval; interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				if err := svc.Refresh(ctx); err != nil {
+					log.Error().Err(err).Msg("Feature flags refresh error")
+				}
+				cancel()
+			}
+		}()
+	}
+}
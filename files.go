@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Upload limits, from FILES_MAX_SIZE and FILES_ALLOWED_TYPES
+var (
+	filesMaxSize      = 10 << 20
+	filesAllowedTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp", "application/pdf", "text/plain"}
+)
+
+var (
+	// s3Files replaces the GridFS store with FILES_STORE=s3
+	s3Files repository.BlobStore
+	// Downloads of files from presignThreshold bytes are redirected to a
+	// presigned URL valid for presignTTL, when the store supports it
+	presignThreshold = 8 << 20
+	presignTTL       = 15 * time.Minute
+)
+
+// Time budgets of file transfers, which outlast the handler when streaming
+const (
+	fileUploadTimeout   = 2 * time.Minute
+	fileDownloadTimeout = 10 * time.Minute
+	maxFileName         = 255
+)
+
+// bodyLimit is the app's request body limit: Fiber's default, raised to fit
+// the largest upload plus multipart overhead
+func bodyLimit() int {
+	if limit := filesMaxSize + 64<<10; limit > fiber.DefaultBodyLimit {
+		return limit
+	}
+	return fiber.DefaultBodyLimit
+}
+
+// sniffContentType detects the type of content from its first bytes; the
+// type the client claims is ignored
+func sniffContentType(r io.ReadSeeker) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	return mediaType, nil
+}
+
+// cleanFileName keeps the base name of an uploaded file, without control
+// characters, so it is safe to echo in Content-Disposition
+func cleanFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, filepath.Base(strings.ReplaceAll(name, "\\", "/")))
+	if name == "." || name == "/" || name == "" {
+		name = "file"
+	}
+	if len(name) > maxFileName {
+		name = name[:maxFileName]
+	}
+	return name
+}
+
+// cancelOnClose ends a transfer's context along with its content
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (r *cancelOnClose) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
+
+// fileError maps storage errors to API errors
+func fileError(err error) error {
+	if errors.Is(err, repository.ErrNotFound) {
+		return apperror.NotFound("File not found")
+	}
+	return apperror.Internal("File storage error", err)
+}
+
+// registerFileRoutes mounts the files API. Anyone with role user or admin
+// uploads; only the owner, or an admin, downloads or deletes a file.
+func registerFileRoutes(app *fiber.App, files repository.BlobStore) {
+	member := requireAnyRole("user", "admin")
+	owner := requireOwnership(repoOwnerLookup(files, "id"), "admin")
+
+	// multipart/form-data with the content in the "file" field
+	app.Post("/files", member, func(c *fiber.Ctx) error {
+		fh, err := c.FormFile("file")
+		if err != nil {
+			return apperror.Validation("Expected multipart/form-data with a file field", fiber.Map{"file": err.Error()})
+		}
+		if fh.Size > int64(filesMaxSize) {
+			return apperror.TooLarge("File exceeds the size limit")
+		}
+		content, err := fh.Open()
+		if err != nil {
+			return apperror.Internal("Cannot read upload", err)
+		}
+		defer content.Close()
+		contentType, err := sniffContentType(content)
+		if err != nil {
+			return apperror.Internal("Cannot read upload", err)
+		}
+		if !containsString(filesAllowedTypes, contentType) {
+			return apperror.Validation("Unsupported file type", fiber.Map{"file": contentType + " is not one of " + strings.Join(filesAllowedTypes, ", ")})
+		}
+
+		info := &repository.FileInfo{Name: cleanFileName(fh.Filename), ContentType: contentType, OwnerID: userFromCtx(c).Subject}
+		ctx, cancel := requestContext(c, fileUploadTimeout)
+		defer cancel()
+		if err := files.Upload(ctx, info, io.LimitReader(content, int64(filesMaxSize))); err != nil {
+			return fileError(err)
+		}
+		c.Locals(auditResourceKey, info.ID)
+		c.Location("/files/" + info.ID)
+		return c.Status(fiber.StatusCreated).JSON(info)
+	})
+
+	// A presigned URL for clients that fetch large files themselves, or
+	// sit behind a proxy that follows redirects
+	app.Get("/files/:id/url", member, owner, func(c *fiber.Ctx) error {
+		u, err := files.PresignURL(c.UserContext(), c.Params("id"), presignTTL)
+		if errors.Is(err, repository.ErrPresignUnsupported) {
+			return apperror.Unavailable("Presigned URLs need FILES_STORE=s3")
+		}
+		if err != nil {
+			return fileError(err)
+		}
+		return c.JSON(fiber.Map{"url": u, "expiresAt": time.Now().Add(presignTTL).UTC()})
+	})
+
+	app.Get("/files/:id", member, owner, func(c *fiber.Ctx) error {
+		info, err := files.Stat(c.UserContext(), c.Params("id"))
+		if err != nil {
+			return fileError(err)
+		}
+		if info.Size >= int64(presignThreshold) {
+			u, err := files.PresignURL(c.UserContext(), info.ID, presignTTL)
+			if err == nil {
+				return c.Redirect(u, fiber.StatusFound)
+			}
+			if !errors.Is(err, repository.ErrPresignUnsupported) {
+				return fileError(err)
+			}
+		}
+
+		// The transfer continues after the handler returns, so its context
+		// ends when the content is closed, or at the deadline
+		ctx, cancel := context.WithTimeout(withRequestTenant(context.Background(), c), fileDownloadTimeout)
+		info, content, err := files.Open(ctx, c.Params("id"))
+		if err != nil {
+			cancel()
+			return fileError(err)
+		}
+		c.Set(fiber.HeaderContentType, info.ContentType)
+		c.Set(fiber.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": info.Name}))
+		c.Set(fiber.HeaderLastModified, info.UploadedAt.Format(http.TimeFormat))
+		// Fiber closes content once it is sent
+		return c.SendStream(&cancelOnClose{ReadCloser: content, cancel: cancel}, int(info.Size))
+	})
+
+	app.Delete("/files/:id", member, owner, func(c *fiber.Ctx) error {
+		if err := files.Delete(c.UserContext(), c.Params("id")); err != nil {
+			return fileError(err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+}
+
+// Load the upload limits of files, and its store: gridfs, or s3 with the
+// settings of files.s3
+func initFiles() {
+	filesMaxSize = cfg.Files.MaxSize
+	if types := cfg.Files.AllowedTypes; len(types) > 0 {
+		filesAllowedTypes = types
+	}
+	presignThreshold = cfg.Files.PresignThreshold
+	presignTTL = cfg.Files.PresignTTL
+
+	if cfg.Files.Store == "s3" {
+		s3 := cfg.Files.S3
+		s3cfg := repository.S3Config{
+			Endpoint:       s3.Endpoint,
+			Bucket:         s3.Bucket,
+			Region:         s3.Region,
+			AccessKey:      s3.AccessKey,
+			SecretKey:      s3.SecretKey,
+			UseSSL:         s3.UseSSL,
+			PublicEndpoint: s3.PublicEndpoint,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var err error
+		if s3Files, err = repository.NewS3(ctx, s3cfg); err != nil {
+			log.Fatal().Err(err).Msg("S3 error")
+		}
+		log.Info().Str("endpoint", s3cfg.Endpoint).Str("bucket", s3cfg.Bucket).Msg("Files stored in S3")
+	}
+}
@@ -0,0 +1,206 @@
+// Package flags evaluates feature flags for the caller of a request:
+//
+//	if flags.IsEnabled(ctx, "new-items-api") { ... }
+//
+// A flag is on for everyone when Enabled, otherwise only for callers holding
+// one of its Roles or belonging to one of its Tenants. Defaults come from the
+// environment and are overridden by flags saved in a Store, which admins can
+// change at runtime. Unknown flags are off.
+package flags
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Flag is one feature flag and its targeting
+type Flag struct {
+	Name        string    `json:"name" bson:"_id"`
+	Description string    `json:"description,omitempty" bson:"description,omitempty"`
+	Enabled     bool      `json:"enabled" bson:"enabled"`                     // on for everyone
+	Roles       []string  `json:"roles,omitempty" bson:"roles,omitempty"`     // on for callers with any of these
+	Tenants     []string  `json:"tenants,omitempty" bson:"tenants,omitempty"` // on for callers in any of these
+	UpdatedAt   time.Time `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+	UpdatedBy   string    `json:"updatedBy,omitempty" bson:"updatedBy,omitempty"`
+	// Source is "env" for defaults, "store" for saved flags
+	Source string `json:"source" bson:"-"`
+}
+
+// Subject is who a flag is evaluated for
+type Subject struct {
+	Roles  []string
+	Tenant string
+}
+
+type subjectKey struct{}
+
+// WithSubject returns ctx carrying the subject IsEnabled evaluates for
+func WithSubject(ctx context.Context, s Subject) context.Context {
+	return context.WithValue(ctx, subjectKey{}, s)
+}
+
+// SubjectFrom returns the subject of ctx; the zero Subject when there is none
+func SubjectFrom(ctx context.Context) Subject {
+	s, _ := ctx.Value(subjectKey{}).(Subject)
+	return s
+}
+
+// On reports whether f is on for s
+func (f *Flag) On(s Subject) bool {
+	if f.Enabled {
+		return true
+	}
+	for _, r := range f.Roles {
+		for _, have := range s.Roles {
+			if r == have {
+				return true
+			}
+		}
+	}
+	for _, t := range f.Tenants {
+		if s.Tenant != "" && t == s.Tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// Store persists flags overriding the defaults
+type Store interface {
+	List(ctx context.Context) ([]Flag, error)
+	Save(ctx context.Context, f Flag) error
+	// Delete removes a saved flag; deleting one that isn't saved is no error
+	Delete(ctx context.Context, name string) error
+}
+
+// Service caches the flags of a Store merged over defaults
+type Service struct {
+	store    Store
+	defaults map[string]Flag
+
+	mu    sync.RWMutex
+	flags map[string]Flag
+}
+
+// New loads the store's flags over defaults
+func New(ctx context.Context, store Store, defaults []Flag) (*Service, error) {
+	s := &Service{store: store, defaults: map[string]Flag{}}
+	for _, f := range defaults {
+		f.Source = "env"
+		s.defaults[f.Name] = f
+	}
+	if err := s.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Refresh reloads the saved flags, picking up changes made by other replicas
+func (s *Service) Refresh(ctx context.Context) error {
+	saved, err := s.store.List(ctx)
+	if err != nil {
+		return err
+	}
+	merged := make(map[string]Flag, len(s.defaults)+len(saved))
+	for name, f := range s.defaults {
+		merged[name] = f
+	}
+	for _, f := range saved {
+		f.Source = "store"
+		merged[f.Name] = f
+	}
+	s.mu.Lock()
+	s.flags = merged
+	s.mu.Unlock()
+	return nil
+}
+
+// IsEnabled reports whether the flag is on for the subject of ctx
+func (s *Service) IsEnabled(ctx context.Context, name string) bool {
+	s.mu.RLock()
+	f, ok := s.flags[name]
+	s.mu.RUnlock()
+	return ok && f.On(SubjectFrom(ctx))
+}
+
+// List returns every flag sorted by name
+func (s *Service) List() []Flag {
+	s.mu.RLock()
+	out := make([]Flag, 0, len(s.flags))
+	for _, f := range s.flags {
+		out = append(out, f)
+	}
+	s.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Save stores f, overriding its default if any
+func (s *Service) Save(ctx context.Context, f Flag) error {
+	if err := s.store.Save(ctx, f); err != nil {
+		return err
+	}
+	return s.Refresh(ctx)
+}
+
+// Delete removes the saved flag; a default of the same name applies again
+func (s *Service) Delete(ctx context.Context, name string) error {
+	if err := s.store.Delete(ctx, name); err != nil {
+		return err
+	}
+	return s.Refresh(ctx)
+}
+
+var defaultService atomic.Pointer[Service]
+
+// SetDefault makes s the service behind the package-level IsEnabled
+func SetDefault(s *Service) {
+	defaultService.Store(s)
+}
+
+// IsEnabled reports whether the flag is on for the subject of ctx, using the
+// service set with SetDefault; every flag is off before that
+func IsEnabled(ctx context.Context, name string) bool {
+	s := defaultService.Load()
+	return s != nil && s.IsEnabled(ctx, name)
+}
+
+// Parse reads flag defaults such as
+//
+//	new-items-api
+//	beta-search=role:beta|tenant:acme
+//
+// A bare name is on for everyone; targets enable it for the given roles and
+// tenants only.
+func Parse(entries []string) ([]Flag, error) {
+	var out []Flag
+	for _, entry := range entries {
+		name, targets, hasTargets := strings.Cut(entry, "=")
+		f := Flag{Name: strings.TrimSpace(name), Enabled: !hasTargets}
+		if f.Name == "" {
+			return nil, fmt.Errorf("flag %q: name is required", entry)
+		}
+		if hasTargets {
+			for _, t := range strings.Split(targets, "|") {
+				kind, value, _ := strings.Cut(strings.TrimSpace(t), ":")
+				switch {
+				case value == "":
+					return nil, fmt.Errorf("flag %s: invalid target %q, expected role:<name> or tenant:<id>", f.Name, t)
+				case kind == "role":
+					f.Roles = append(f.Roles, value)
+				case kind == "tenant":
+					f.Tenants = append(f.Tenants, value)
+				default:
+					return nil, fmt.Errorf("flag %s: invalid target %q, expected role:<name> or tenant:<id>", f.Name, t)
+				}
+			}
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
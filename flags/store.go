@@ -0,0 +1,79 @@
+package flags
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoStore keeps flags in a collection shared by every replica, one
+// document per flag with the name as _id
+type MongoStore struct {
+	coll *mongo.Collection
+}
+
+// NewMongoStore stores flags in coll
+func NewMongoStore(coll *mongo.Collection) *MongoStore {
+	return &MongoStore{coll: coll}
+}
+
+func (m *MongoStore) List(ctx context.Context) ([]Flag, error) {
+	cursor, err := m.coll.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var out []Flag
+	if err := cursor.All(ctx, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (m *MongoStore) Save(ctx context.Context, f Flag) error {
+	_, err := m.coll.ReplaceOne(ctx, bson.M{"_id": f.Name}, f, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (m *MongoStore) Delete(ctx context.Context, name string) error {
+	_, err := m.coll.DeleteOne(ctx, bson.M{"_id": name})
+	return err
+}
+
+// MemoryStore keeps flags in the process, so changes are lost on restart
+// and not shared between replicas
+type MemoryStore struct {
+	mu    sync.Mutex
+	flags map[string]Flag
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{flags: map[string]Flag{}}
+}
+
+func (m *MemoryStore) List(context.Context) ([]Flag, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Flag, 0, len(m.flags))
+	for _, f := range m.flags {
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+func (m *MemoryStore) Save(_ context.Context, f Flag) error {
+	m.mu.Lock()
+	m.flags[f.Name] = f
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryStore) Delete(_ context.Context, name string) error {
+	m.mu.Lock()
+	delete(m.flags, name)
+	m.mu.Unlock()
+	return nil
+}
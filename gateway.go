@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// headerGatewaySecret carries the secret shared between KrakenD and this service
+const headerGatewaySecret = "X-Gateway-Secret"
+
+var (
+	// gatewaySecret is compared against X-Gateway-Secret (GATEWAY_SECRET)
+	gatewaySecret string
+
+	// gatewayMTLS is set when the server requires gateway client certificates
+	// (GATEWAY_CLIENT_CA); gatewayClientCNs optionally pins their common names
+	gatewayMTLS      bool
+	gatewayClientCNs []string
+)
+
+// verifyGateway proves the request came through KrakenD before claims that
+// KrakenD is trusted to have validated are accepted. With neither a secret
+// nor mTLS configured every request is trusted, as before.
+func verifyGateway(c *fiber.Ctx) error {
+	if gatewaySecret != "" {
+		got := c.Get(headerGatewaySecret)
+		if subtle.ConstantTimeCompare([]byte(got), []byte(gatewaySecret)) != 1 {
+			return fmt.Errorf("request did not come through the gateway")
+		}
+	}
+	if gatewayMTLS {
+		state := c.Context().TLSConnectionState()
+		if state == nil || len(state.VerifiedChains) == 0 {
+			return fmt.Errorf("missing gateway client certificate")
+		}
+		if len(gatewayClientCNs) > 0 && !containsString(gatewayClientCNs, state.PeerCertificates[0].Subject.CommonName) {
+			return fmt.Errorf("gateway client certificate not allowed")
+		}
+	}
+	return nil
+}
+
+// Load gateway trust settings
+func initGateway() {
+	gatewaySecret = cfg.Gateway.Secret
+	if gatewaySecret != "" {
+		log.Info().Str("header", headerGatewaySecret).Msg("Requiring gateway secret header")
+	}
+	if cfg.Gateway.ClientCA != "" {
+		gatewayMTLS = true
+		gatewayClientCNs = cfg.Gateway.ClientCNs
+		log.Info().Str("ca", cfg.Gateway.ClientCA).Msg("Requiring gateway client certificates")
+	}
+}
+
+// listen starts the server, over TLS when TLS_CERT_FILE is set and with
+// mutual TLS when gateway client certificates are required
+func listen(app *fiber.App, addr string) error {
+	if http2Enabled {
+		return listenHTTP2(app, addr)
+	}
+	if tlsCerts == nil {
+		return app.Listen(addr)
+	}
+	ln, err := tlsListener(addr)
+	if err != nil {
+		return err
+	}
+	return app.Listener(ln)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// healthHTTP probes dependencies; probes must answer well within the
+// orchestrator's timeout
+var healthHTTP = &http.Client{Timeout: 2 * time.Second}
+
+// dependencyCheck is one entry of the /readyz body
+type dependencyCheck struct {
+	Status    string  `json:"status"` // "ok" or "down"
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// readinessChecks returns the dependencies /readyz probes: the database
+// unless in memory, each JWKS when tokens are verified here, Vault lease
+// renewal when secrets come from Vault, and KEYCLOAK_HEALTH_URL if set
+func readinessChecks() map[string]func(ctx context.Context) error {
+	checks := map[string]func(ctx context.Context) error{}
+	if mongoClient != nil {
+		checks["mongo"] = func(ctx context.Context) error { return mongoClient.Ping(ctx, nil) }
+	}
+	if pgPool != nil {
+		checks["postgres"] = pgPool.Ping
+	}
+	if jwtKeySet != nil {
+		checks["jwks"] = urlCheck(jwtKeySet.url)
+	}
+	for iss, r := range realms {
+		if r.keySet != nil {
+			checks["jwks:"+iss] = urlCheck(r.keySet.url)
+		}
+	}
+	if vaultEnabled {
+		checks["vault"] = func(context.Context) error { return vaultError() }
+	}
+	if url := cfg.Keycloak.HealthURL; url != "" {
+		checks["keycloak"] = urlCheck(url)
+	}
+	return checks
+}
+
+// urlCheck succeeds when url answers 2xx
+func urlCheck(url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := healthHTTP.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("%s returned %s", url, resp.Status)
+		}
+		return nil
+	}
+}
+
+// registerHealthRoutes mounts the probes ahead of the auth middleware:
+// /livez answers while the process serves requests, /readyz only while its
+// dependencies do too, with 503 and the failing checks otherwise
+func registerHealthRoutes(app *fiber.App) {
+	app.Get("/livez", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"status": "ok"})
+	})
+
+	app.Get("/readyz", func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(c.UserContext(), 3*time.Second)
+		defer cancel()
+
+		checks := readinessChecks()
+		results := make(map[string]dependencyCheck, len(checks))
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for name, check := range checks {
+			wg.Add(1)
+			go func(name string, check func(ctx context.Context) error) {
+				defer wg.Done()
+				start := time.Now()
+				err := check(ctx)
+				res := dependencyCheck{Status: "ok", LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+				if err != nil {
+					res.Status, res.Error = "down", err.Error()
+				}
+				mu.Lock()
+				results[name] = res
+				mu.Unlock()
+			}(name, check)
+		}
+		wg.Wait()
+
+		status := "ok"
+		for _, res := range results {
+			if res.Status != "ok" {
+				status = "unavailable"
+				c.Status(fiber.StatusServiceUnavailable)
+			}
+		}
+		return c.JSON(fiber.Map{"status": status, "checks": results})
+	})
+}
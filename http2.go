@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// http2Enabled is set by HTTP2=true. fasthttp, under Fiber, only speaks
+// HTTP/1.1, so the app is then served through net/http instead: h2 over TLS
+// when TLS_CERT_FILE is set, h2c (cleartext, e.g. from KrakenD inside the
+// cluster) otherwise, with HTTP/1.1 still accepted on the same port.
+var http2Enabled bool
+
+// httpServer is the net/http server used when http2Enabled
+var httpServer *http.Server
+
+// listenHTTP2 serves app on addr through net/http with HTTP/2 enabled
+func listenHTTP2(app *fiber.App, addr string) error {
+	h2 := &http2.Server{}
+	httpServer = &http.Server{
+		Addr:              addr,
+		Handler:           adaptor.FiberApp(app),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	var ln net.Listener
+	var err error
+	if tlsCerts != nil {
+		if err := http2.ConfigureServer(httpServer, h2); err != nil {
+			return err
+		}
+		ln, err = tlsListener(addr, "h2", "http/1.1")
+	} else {
+		httpServer.Handler = h2c.NewHandler(httpServer.Handler, h2)
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if err := httpServer.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// shutdownServer stops accepting connections and waits up to timeout for
+// in-flight requests, on whichever server is serving app
+func shutdownServer(app *fiber.App, timeout time.Duration) error {
+	if httpServer == nil {
+		return app.ShutdownWithTimeout(timeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return httpServer.Shutdown(ctx)
+}
+
+// Enable HTTP/2 when server.http2 is set
+func initHTTP2() {
+	if !cfg.Server.HTTP2 {
+		return
+	}
+	http2Enabled = true
+	if tlsCerts != nil {
+		log.Info().Msg("HTTP/2 enabled over TLS")
+	} else {
+		log.Info().Msg("HTTP/2 cleartext (h2c) enabled")
+	}
+}
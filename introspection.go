@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// tokenIntrospector is set when INTROSPECTION_MODE is "opaque" or "always"
+var tokenIntrospector *introspector
+
+// introspector validates tokens through Keycloak's RFC 7662 introspection
+// endpoint, for realms issuing opaque (reference) access tokens
+type introspector struct {
+	endpoint     string
+	clientID     string
+	clientSecret string
+	// always introspects JWTs as well instead of only opaque tokens
+	always bool
+	ttl    time.Duration
+	client *http.Client
+	cache  *ttlCache[*KeycloakClaims]
+}
+
+// handles reports whether tokenString should be introspected rather than
+// parsed locally. JWTs have three dot-separated segments, opaque tokens don't.
+func (i *introspector) handles(tokenString string) bool {
+	return i.always || strings.Count(tokenString, ".") != 2
+}
+
+// introspect asks Keycloak whether the token is active, caching active
+// results for at most ttl and never past the token's own expiry
+func (i *introspector) introspect(tokenString string) (*KeycloakClaims, error) {
+	sum := sha256.Sum256([]byte(tokenString))
+	key := hex.EncodeToString(sum[:])
+	if claims, ok := i.cache.get(key); ok {
+		return claims, nil
+	}
+
+	form := url.Values{"token": {tokenString}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, i.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("introspection failed: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(i.clientID, i.clientSecret)
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("introspection failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection failed: unexpected status %d", resp.StatusCode)
+	}
+
+	claims := &KeycloakClaims{}
+	if err := json.NewDecoder(resp.Body).Decode(claims); err != nil {
+		return nil, fmt.Errorf("introspection failed: %v", err)
+	}
+	if active, _ := claims.Claim("active").(bool); !active {
+		return nil, fmt.Errorf("token is not active")
+	}
+	if claims.PreferredUsername == "" {
+		claims.PreferredUsername, _ = claims.Claim("username").(string)
+	}
+
+	expires := time.Now().Add(i.ttl)
+	if claims.ExpiresAt != nil && claims.ExpiresAt.Before(expires) {
+		expires = claims.ExpiresAt.Time
+	}
+	i.cache.set(key, claims, expires)
+	return claims, nil
+}
+
+// Enable token introspection when INTROSPECTION_MODE is set; its
+// requirements are checked by config.Validate
+func initIntrospection() {
+	mode := cfg.Auth.IntrospectionMode
+	if mode == "" || mode == "off" {
+		return
+	}
+	endpoint := cfg.Auth.IntrospectionURL
+	if endpoint == "" {
+		endpoint = oidcEndpoints().IntrospectionEndpoint
+	}
+	ttl := cfg.Auth.IntrospectionCacheTTL
+
+	tokenIntrospector = &introspector{
+		endpoint:     endpoint,
+		clientID:     cfg.Keycloak.ClientID,
+		clientSecret: cfg.Keycloak.ClientSecret,
+		always:       mode == "always",
+		ttl:          ttl,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		cache:        newTTLCache[*KeycloakClaims](10000),
+	}
+	log.Info().Str("endpoint", endpoint).Msg("Token introspection enabled")
+}
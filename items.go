@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+)
+
+// itemInput is the body of item writes; nil fields are absent from the JSON
+type itemInput struct {
+	Name          *string   `json:"name"`
+	Description   *string   `json:"description"`
+	Price         *float64  `json:"price"`
+	Tags          *[]string `json:"tags"`
+	CostPrice     *float64  `json:"costPrice"`
+	InternalNotes *string   `json:"internalNotes"`
+	// Location is a GeoJSON point, {"type": "Point", "coordinates": [lng, lat]}
+	Location *repository.GeoPoint `json:"location"`
+	// Version is the one being edited, for clients that can't send If-Match
+	Version *int64 `json:"version"`
+}
+
+// Limits checked by itemInput.validate
+const (
+	maxItemName        = 100
+	maxItemDescription = 1000
+	maxItemTags        = 20
+	maxItemTag         = 30
+)
+
+// itemsBatchMax caps the items of POST /items:batch, from ITEMS_BATCH_MAX
+var itemsBatchMax = 100
+
+// parseItemInput decodes the body strictly: unknown fields and trailing
+// data are rejected so typos don't silently drop changes
+func parseItemInput(c *fiber.Ctx) (*itemInput, error) {
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+		return nil, apperror.Validation("Content-Type must be application/json")
+	}
+	var in itemInput
+	if err := decodeStrict(c.Body(), &in); err != nil {
+		return nil, err
+	}
+	return &in, nil
+}
+
+// decodeStrict decodes a JSON object into v, rejecting unknown fields and
+// trailing data
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return apperror.Validation("Invalid body", fiber.Map{"body": err.Error()})
+	}
+	if dec.More() {
+		return apperror.Validation("Invalid body", fiber.Map{"body": "unexpected data after the JSON object"})
+	}
+	return nil
+}
+
+// batchResult is the outcome of one item of POST /items:batch, in the
+// order sent. Error has the shape of an error response body.
+type batchResult struct {
+	Index  int              `json:"index"`
+	Status int              `json:"status"`
+	Item   *repository.Item `json:"item,omitempty"`
+	Error  fiber.Map        `json:"error,omitempty"`
+}
+
+func batchFailure(index int, err error) batchResult {
+	var appErr *apperror.Error
+	if !errors.As(err, &appErr) {
+		appErr = apperror.Internal("Database error", err)
+	}
+	body := fiber.Map{"error": appErr.Message, "code": appErr.Code}
+	if appErr.Details != nil {
+		body["details"] = appErr.Details
+	}
+	return batchResult{Index: index, Status: appErr.Status, Error: body}
+}
+
+// createItemBatch validates and inserts the items of a batch with a single
+// bulk write. Ordered, the batch stops at the first invalid or failed item
+// and the rest are reported as not attempted.
+func createItemBatch(ctx context.Context, items repository.ItemRepository, owner string, raws []json.RawMessage, ordered bool) ([]batchResult, error) {
+	results := make([]batchResult, len(raws))
+	var valid []*repository.Item
+	var at []int
+	now := time.Now().UTC()
+	for i, raw := range raws {
+		var in itemInput
+		err := decodeStrict(raw, &in)
+		if err == nil {
+			err = in.validate(true)
+		}
+		if err != nil {
+			results[i] = batchFailure(i, err)
+			if ordered {
+				for j := i + 1; j < len(raws); j++ {
+					results[j] = batchFailure(j, itemError(repository.ErrNotAttempted))
+				}
+				break
+			}
+			continue
+		}
+		item := &repository.Item{OwnerID: owner, CreatedAt: now}
+		in.apply(item)
+		valid = append(valid, item)
+		at = append(at, i)
+	}
+
+	errs, err := items.CreateMany(ctx, valid, ordered)
+	if err != nil {
+		return nil, err
+	}
+	for k, item := range valid {
+		i := at[k]
+		if errs[k] != nil {
+			results[i] = batchFailure(i, itemError(errs[k]))
+			continue
+		}
+		results[i] = batchResult{Index: i, Status: fiber.StatusCreated, Item: item}
+	}
+	return results, nil
+}
+
+// validate checks the present fields; full writes (POST, PUT) also need
+// name and price
+func (in *itemInput) validate(full bool) error {
+	errs := fiber.Map{}
+	if in.Name != nil {
+		*in.Name = strings.TrimSpace(*in.Name)
+		if *in.Name == "" || len(*in.Name) > maxItemName {
+			errs["name"] = fmt.Sprintf("must be 1-%d characters", maxItemName)
+		}
+	} else if full {
+		errs["name"] = "is required"
+	}
+	if in.Description != nil && len(*in.Description) > maxItemDescription {
+		errs["description"] = fmt.Sprintf("must be at most %d characters", maxItemDescription)
+	}
+	if in.Price != nil {
+		if *in.Price < 0 {
+			errs["price"] = "must not be negative"
+		}
+	} else if full {
+		errs["price"] = "is required"
+	}
+	if in.CostPrice != nil && *in.CostPrice < 0 {
+		errs["costPrice"] = "must not be negative"
+	}
+	if in.InternalNotes != nil && len(*in.InternalNotes) > maxItemDescription {
+		errs["internalNotes"] = fmt.Sprintf("must be at most %d characters", maxItemDescription)
+	}
+	if in.Tags != nil {
+		if len(*in.Tags) > maxItemTags {
+			errs["tags"] = fmt.Sprintf("at most %d tags", maxItemTags)
+		}
+		for _, t := range *in.Tags {
+			if t == "" || len(t) > maxItemTag {
+				errs["tags"] = fmt.Sprintf("tags must be 1-%d characters", maxItemTag)
+			}
+		}
+	}
+	if in.Location != nil {
+		if err := validGeoPoint(in.Location); err != "" {
+			errs["location"] = err
+		}
+	}
+	if !full && in.Name == nil && in.Description == nil && in.Price == nil && in.Tags == nil &&
+		in.CostPrice == nil && in.InternalNotes == nil && in.Location == nil {
+		return apperror.Validation("Nothing to update")
+	}
+	if len(errs) > 0 {
+		return apperror.Validation("Invalid item", errs)
+	}
+	return nil
+}
+
+// apply copies the present fields onto item
+func (in *itemInput) apply(item *repository.Item) {
+	if in.Name != nil {
+		item.Name = *in.Name
+	}
+	if in.Description != nil {
+		item.Description = *in.Description
+	}
+	if in.Price != nil {
+		item.Price = *in.Price
+	}
+	if in.Tags != nil {
+		item.Tags = *in.Tags
+	}
+	if in.CostPrice != nil {
+		item.CostPrice = *in.CostPrice
+	}
+	if in.InternalNotes != nil {
+		item.InternalNotes = *in.InternalNotes
+	}
+	if in.Location != nil {
+		item.Location = in.Location
+	}
+}
+
+// validGeoPoint explains what is wrong with p, "" when it is a valid point
+func validGeoPoint(p *repository.GeoPoint) string {
+	if p.Type != "Point" || len(p.Coordinates) != 2 {
+		return `must be {"type": "Point", "coordinates": [lng, lat]}`
+	}
+	if lng, lat := p.Coordinates[0], p.Coordinates[1]; lng < -180 || lng > 180 || lat < -90 || lat > 90 {
+		return "longitude must be -180..180 and latitude -90..90"
+	}
+	return ""
+}
+
+// Radius of GET /items/near, in meters
+const (
+	defaultNearRadius = 1000
+	maxNearRadius     = 1000000
+)
+
+// nearQuery reads ?lat, ?lng and ?radius of GET /items/near
+func nearQuery(c *fiber.Ctx) (repository.NearQuery, error) {
+	q := repository.NearQuery{Radius: defaultNearRadius}
+	errs := fiber.Map{}
+	for _, coord := range []struct {
+		name  string
+		dest  *float64
+		limit float64
+	}{{"lat", &q.Lat, 90}, {"lng", &q.Lng, 180}} {
+		n, err := strconv.ParseFloat(c.Query(coord.name), 64)
+		if err != nil || n < -coord.limit || n > coord.limit {
+			errs[coord.name] = fmt.Sprintf("is required, -%v..%v", coord.limit, coord.limit)
+		}
+		*coord.dest = n
+	}
+	if v := c.Query("radius"); v != "" {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil || n <= 0 || n > maxNearRadius {
+			errs["radius"] = fmt.Sprintf("must be a distance in meters, up to %d", maxNearRadius)
+		}
+		q.Radius = n
+	}
+	if len(errs) > 0 {
+		return q, apperror.Validation("Invalid location query", errs)
+	}
+	return q, nil
+}
+
+// expectedVersion is the item version an update was made against: the
+// If-Match ETag, else the body's version. Updates without one are refused,
+// so two editors can't silently overwrite each other.
+func expectedVersion(c *fiber.Ctx, in *itemInput) (int64, error) {
+	if v := c.Get(fiber.HeaderIfMatch); v != "" {
+		n, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(v, "W/"), `"`), 10, 64)
+		if err != nil {
+			return 0, apperror.Validation("If-Match must be the ETag of the item, e.g. \"3\"")
+		}
+		return n, nil
+	}
+	if in.Version != nil {
+		return *in.Version, nil
+	}
+	return 0, apperror.PreconditionRequired("Send If-Match with the item's ETag, or its version in the body")
+}
+
+// setItemETag sets the ETag If-Match is checked against
+func setItemETag(c *fiber.Ctx, item *repository.Item) {
+	c.Set(fiber.HeaderETag, `"`+strconv.FormatInt(item.Version, 10)+`"`)
+}
+
+// itemChanges lists the fields an update changed, for the audit log
+func itemChanges(before, after *repository.Item) []repository.FieldChange {
+	var changes []repository.FieldChange
+	add := func(field string, from, to interface{}) {
+		changes = append(changes, repository.FieldChange{Field: field, From: from, To: to})
+	}
+	if before.Name != after.Name {
+		add("name", before.Name, after.Name)
+	}
+	if before.Description != after.Description {
+		add("description", before.Description, after.Description)
+	}
+	if before.Price != after.Price {
+		add("price", before.Price, after.Price)
+	}
+	if strings.Join(before.Tags, ",") != strings.Join(after.Tags, ",") {
+		add("tags", before.Tags, after.Tags)
+	}
+	if before.CostPrice != after.CostPrice {
+		add("costPrice", before.CostPrice, after.CostPrice)
+	}
+	if !sameLocation(before.Location, after.Location) {
+		add("location", before.Location, after.Location)
+	}
+	if before.InternalNotes != after.InternalNotes {
+		// Notes can be long; only note that they changed
+		add("internalNotes", nil, nil)
+	}
+	return changes
+}
+
+func sameLocation(a, b *repository.GeoPoint) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Coordinates[0] == b.Coordinates[0] && a.Coordinates[1] == b.Coordinates[1]
+}
+
+// itemFilterFields are the fields of ?filter on GET /items; price takes a
+// range, "10..50", "10.." or "..50"
+var itemFilterFields = []string{"ownerId", "tag", "name", "price"}
+
+func itemFilter(f map[string]string) (repository.ItemFilter, error) {
+	filter := repository.ItemFilter{OwnerID: f["ownerId"], Tag: f["tag"], NameContains: f["name"]}
+	if v, ok := f["price"]; ok {
+		lo, hi, ok := strings.Cut(v, "..")
+		if !ok {
+			return filter, apperror.Validation("Invalid list parameters", fiber.Map{"filter": "price expects min..max"})
+		}
+		for _, bound := range []struct {
+			text string
+			dest **float64
+		}{{lo, &filter.MinPrice}, {hi, &filter.MaxPrice}} {
+			if bound.text == "" {
+				continue
+			}
+			n, err := strconv.ParseFloat(bound.text, 64)
+			if err != nil {
+				return filter, apperror.Validation("Invalid list parameters", fiber.Map{"filter": "price bounds must be numbers"})
+			}
+			*bound.dest = &n
+		}
+	}
+	return filter, nil
+}
+
+// itemError maps repository errors to API errors
+func itemError(err error) error {
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		return apperror.NotFound("Item not found")
+	case errors.Is(err, repository.ErrDuplicate):
+		return apperror.Conflict("An item with this name already exists")
+	case errors.Is(err, repository.ErrVersionConflict):
+		return apperror.Conflict("The item was changed since this version; fetch it again and reapply the change")
+	case errors.Is(err, repository.ErrSchemaViolation):
+		return apperror.Unprocessable("The item fails the database's schema validation")
+	case errors.Is(err, repository.ErrNotAttempted):
+		return apperror.FailedDependency("Not attempted: an earlier item of the batch failed")
+	case errors.Is(err, repository.ErrForbidden):
+		return apperror.Forbidden("Not allowed to make this change to the item")
+	case errors.Is(err, repository.ErrInvalidCursor):
+		return apperror.Validation("Invalid list parameters", fiber.Map{"cursor": "malformed, or issued for another sort"})
+	}
+	return apperror.Internal("Database error", err)
+}
+
+// registerItemRoutes mounts the items API: users read, admins write. Writes
+// run in a transaction with their audit entry, so the two commit or roll
+// back together.
+func registerItemRoutes(app *fiber.App, repos *repository.Repositories) {
+	items := repos.Items
+	read := requireAnyRole("user", "admin")
+	write := requireRole("admin")
+	if itemACL {
+		// Anyone creates items, and their grants decide who changes them
+		write = read
+	}
+
+	app.Get("/items", read, func(c *fiber.Ctx) error {
+		params, err := parseListParams(c, repository.ItemSortFields, itemFilterFields)
+		if err != nil {
+			return err
+		}
+		filter, err := itemFilter(params.filter)
+		if err != nil {
+			return err
+		}
+		var total int64
+		if params.cursor == "" {
+			if total, err = items.Count(c.UserContext(), filter); err != nil {
+				return itemError(err)
+			}
+		}
+		list, next, err := items.List(c.UserContext(), filter, params.repoPage())
+		if err != nil {
+			return itemError(err)
+		}
+		return c.JSON(listEnvelope("items", list, params, total, next))
+	})
+
+	// Items within ?radius meters of ?lat, ?lng, the closest first, each
+	// with its distance. Takes ?filter like GET /items.
+	app.Get("/items/near", read, func(c *fiber.Ctx) error {
+		q, err := nearQuery(c)
+		if err != nil {
+			return err
+		}
+		params, err := parseListParams(c, nil, itemFilterFields)
+		if err != nil {
+			return err
+		}
+		if params.cursor != "" || len(params.sort) > 0 {
+			return apperror.Validation("Invalid list parameters", fiber.Map{"page": "results are by distance, paged with page"})
+		}
+		if q.Filter, err = itemFilter(params.filter); err != nil {
+			return err
+		}
+		q.Page = params.repoPage()
+		list, err := items.Near(c.UserContext(), q)
+		if err != nil {
+			return itemError(err)
+		}
+		return c.JSON(fiber.Map{"items": list, "page": params.page, "limit": params.limit})
+	})
+
+	app.Get("/items/:id", read, func(c *fiber.Ctx) error {
+		item, err := items.Get(c.UserContext(), c.Params("id"))
+		if err != nil {
+			return itemError(err)
+		}
+		setItemETag(c, item)
+		return c.JSON(item)
+	})
+
+	app.Post("/items", write, func(c *fiber.Ctx) error {
+		in, err := parseItemInput(c)
+		if err != nil {
+			return err
+		}
+		if err := in.validate(true); err != nil {
+			return err
+		}
+		item := &repository.Item{OwnerID: userFromCtx(c).Subject, CreatedAt: time.Now().UTC()}
+		in.apply(item)
+		err = repos.Tx.InTx(c.UserContext(), func(ctx context.Context) error {
+			if err := items.Create(ctx, item); err != nil {
+				return err
+			}
+			return auditInTx(ctx, c, repos.Audit, fiber.StatusCreated, item.ID, nil)
+		})
+		if err != nil {
+			return itemError(err)
+		}
+		c.Location("/items/" + item.ID)
+		setItemETag(c, item)
+		return c.Status(fiber.StatusCreated).JSON(item)
+	})
+
+	// Bulk inserts for data loaders: {"items": [...], "ordered": false}.
+	// Ordered by default, like MongoDB. 201 when every item was created,
+	// else 207 with each item's status in results.
+	app.Post("/items\\:batch", write, func(c *fiber.Ctx) error {
+		if !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationJSON) {
+			return apperror.Validation("Content-Type must be application/json")
+		}
+		var body struct {
+			Items   []json.RawMessage `json:"items"`
+			Ordered *bool             `json:"ordered"`
+		}
+		if err := decodeStrict(c.Body(), &body); err != nil {
+			return err
+		}
+		if len(body.Items) == 0 || len(body.Items) > itemsBatchMax {
+			return apperror.Validation("Invalid batch", fiber.Map{"items": fmt.Sprintf("must hold 1-%d items", itemsBatchMax)})
+		}
+		ordered := body.Ordered == nil || *body.Ordered
+		results, err := createItemBatch(c.UserContext(), items, userFromCtx(c).Subject, body.Items, ordered)
+		if err != nil {
+			return itemError(err)
+		}
+		created := 0
+		for _, r := range results {
+			if r.Status == fiber.StatusCreated {
+				created++
+			}
+		}
+		status := fiber.StatusCreated
+		if created < len(results) {
+			status = fiber.StatusMultiStatus
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"created": created,
+			"failed":  len(results) - created,
+			"results": results,
+		})
+	})
+
+	// PUT replaces every editable field, PATCH only those sent
+	update := func(full bool) fiber.Handler {
+		return func(c *fiber.Ctx) error {
+			in, err := parseItemInput(c)
+			if err != nil {
+				return err
+			}
+			if err := in.validate(full); err != nil {
+				return err
+			}
+			version, err := expectedVersion(c, in)
+			if err != nil {
+				return err
+			}
+			var item *repository.Item
+			err = repos.Tx.InTx(c.UserContext(), func(ctx context.Context) error {
+				if item, err = items.Get(ctx, c.Params("id")); err != nil {
+					return err
+				}
+				before := *item
+				item.Version = version
+				if full {
+					item.Description, item.Tags = "", nil
+					item.CostPrice, item.InternalNotes = 0, ""
+					item.Location = nil
+				}
+				in.apply(item)
+				item.UpdatedAt = time.Now().UTC()
+				if err := items.Update(ctx, item); err != nil {
+					return err
+				}
+				return auditInTx(ctx, c, repos.Audit, fiber.StatusOK, item.ID, itemChanges(&before, item))
+			})
+			if err != nil {
+				return itemError(err)
+			}
+			setItemETag(c, item)
+			return c.JSON(item)
+		}
+	}
+	app.Put("/items/:id", write, update(true))
+	app.Patch("/items/:id", write, update(false))
+
+	app.Delete("/items/:id", write, func(c *fiber.Ctx) error {
+		err := repos.Tx.InTx(c.UserContext(), func(ctx context.Context) error {
+			if err := items.Delete(ctx, c.Params("id")); err != nil {
+				return err
+			}
+			return auditInTx(ctx, c, repos.Audit, fiber.StatusNoContent, c.Params("id"), nil)
+		})
+		if err != nil {
+			return itemError(err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+}
+
+// Load ITEMS_BATCH_MAX
+func initItems() {
+	itemsBatchMax = cfg.Items.BatchMax
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/example/fiber-demo/repository"
+	"github.com/example/fiber-demo/tokentest"
+)
+
+func TestItemsRequireRoles(t *testing.T) {
+	app := newTestApp()
+	registerItemRoutes(app, repository.NewMemory())
+	// Signed with a key outside the JWKS
+	other, err := tokentest.NewIssuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	forged, err := other.Token("mallory", "user", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name, token string
+		status      int
+	}{
+		{"without a token", "", http.StatusUnauthorized},
+		{"with a malformed token", "not.a.token", http.StatusUnauthorized},
+		{"with a forged token", forged, http.StatusUnauthorized},
+		{"without a role", token(t, "nobody"), http.StatusForbidden},
+		{"as a user", token(t, "alice", "user"), http.StatusOK},
+	} {
+		if resp := call(t, app, http.MethodGet, "/items", tc.token); resp.StatusCode != tc.status {
+			t.Errorf("GET /items %s: got %d, want %d", tc.name, resp.StatusCode, tc.status)
+		}
+	}
+	if resp := callJSON(t, app, http.MethodPost, "/items", token(t, "alice", "user"), `{"name": "Lamp", "price": 25}`, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST /items as a user: got %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestItemsLifecycle(t *testing.T) {
+	app := newTestApp()
+	registerItemRoutes(app, repository.NewMemory())
+	admin, user := token(t, "root", "admin"), token(t, "alice", "user")
+
+	for _, body := range []string{`{"price": 25}`, `{"name": "Lamp", "price": -1}`, `{"name": "Lamp", "price": 25, "owner": "x"}`} {
+		if resp := callJSON(t, app, http.MethodPost, "/items", admin, body, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("POST /items %s: got %d, want 400", body, resp.StatusCode)
+		}
+	}
+
+	var item repository.Item
+	resp := callJSON(t, app, http.MethodPost, "/items", admin, `{"name": "Lamp", "price": 25, "tags": ["home"]}`, &item)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /items: got %d, want 201", resp.StatusCode)
+	}
+	if item.OwnerID != "tokentest-root" || resp.Header.Get("Location") != "/items/"+item.ID {
+		t.Errorf("POST /items: owner %q at %q", item.OwnerID, resp.Header.Get("Location"))
+	}
+	etag := resp.Header.Get("ETag")
+
+	var got repository.Item
+	if resp := callJSON(t, app, http.MethodGet, "/items/"+item.ID, user, "", &got); resp.StatusCode != http.StatusOK || got.Name != "Lamp" {
+		t.Errorf("GET /items/%s as a user: got %d %+v", item.ID, resp.StatusCode, got)
+	}
+
+	path := "/items/" + item.ID
+	if resp := callJSON(t, app, http.MethodPatch, path, admin, `{"price": 30}`, nil); resp.StatusCode != http.StatusPreconditionRequired {
+		t.Errorf("PATCH without a version: got %d, want 428", resp.StatusCode)
+	}
+	var updated repository.Item
+	resp = callJSON(t, app, http.MethodPatch, path, admin, `{"price": 30, "version": `+strconv.FormatInt(item.Version, 10)+`}`, &updated)
+	if resp.StatusCode != http.StatusOK || updated.Price != 30 || updated.Name != "Lamp" || resp.Header.Get("ETag") == etag {
+		t.Errorf("PATCH: got %d %+v with ETag %q", resp.StatusCode, updated, resp.Header.Get("ETag"))
+	}
+	if resp := callJSON(t, app, http.MethodPatch, path, admin, `{"price": 35, "version": `+strconv.FormatInt(item.Version, 10)+`}`, nil); resp.StatusCode != http.StatusConflict {
+		t.Errorf("PATCH with a stale version: got %d, want 409", resp.StatusCode)
+	}
+
+	if resp := call(t, app, http.MethodDelete, path, admin); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE: got %d, want 204", resp.StatusCode)
+	}
+	if resp := call(t, app, http.MethodGet, path, user); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET after DELETE: got %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestItemsListFiltersSortsAndPages(t *testing.T) {
+	app := newTestApp()
+	registerItemRoutes(app, repository.NewMemory())
+	admin, user := token(t, "root", "admin"), token(t, "alice", "user")
+	for _, body := range []string{
+		`{"name": "Lamp", "price": 25, "tags": ["home"]}`,
+		`{"name": "Desk", "price": 120, "tags": ["home", "office"]}`,
+		`{"name": "Pen", "price": 2, "tags": ["office"]}`,
+	} {
+		if resp := callJSON(t, app, http.MethodPost, "/items", admin, body, nil); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("POST /items %s: got %d", body, resp.StatusCode)
+		}
+	}
+
+	var list struct {
+		Items []repository.Item `json:"items"`
+		Total int64             `json:"total"`
+	}
+	if resp := callJSON(t, app, http.MethodGet, "/items?filter=tag:office&sort=-price", user, "", &list); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /items filtered: got %d", resp.StatusCode)
+	}
+	if list.Total != 2 || len(list.Items) != 2 || list.Items[0].Name != "Desk" || list.Items[1].Name != "Pen" {
+		t.Errorf("GET /items?filter=tag:office&sort=-price: got %+v", list)
+	}
+	if resp := callJSON(t, app, http.MethodGet, "/items?sort=name&limit=2&page=2", user, "", &list); resp.StatusCode != http.StatusOK || list.Total != 3 || len(list.Items) != 1 || list.Items[0].Name != "Pen" {
+		t.Errorf("GET /items page 2 of 2: got %d %+v", resp.StatusCode, list)
+	}
+	for _, query := range []string{"sort=costPrice", "filter=internalNotes:x", "limit=0"} {
+		if resp := call(t, app, http.MethodGet, "/items?"+query, user); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET /items?%s: got %d, want 400", query, resp.StatusCode)
+		}
+	}
+}
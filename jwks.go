@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// jwk is a single entry of a JWKS document as published by Keycloak.
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// jwksKeySet caches the RSA signing keys of a Keycloak realm by kid. Keys are
+// refreshed periodically and whenever a token names an unknown kid, so
+// Keycloak key rotation doesn't require a restart.
+type jwksKeySet struct {
+	url    string
+	client *http.Client
+
+	// minRefreshInterval rate-limits unknown-kid refreshes so garbage kids
+	// can't be used to hammer Keycloak
+	minRefreshInterval time.Duration
+
+	mu          sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	lastRefresh time.Time // last successful fetch
+	lastAttempt time.Time
+
+	// refreshMu serializes refreshes so concurrent misses fetch once
+	refreshMu sync.Mutex
+
+	hits, misses, refreshes, refreshErrors atomic.Uint64
+}
+
+// jwksStats is a snapshot of the cache counters
+type jwksStats struct {
+	Keys          int       `json:"keys"`
+	Hits          uint64    `json:"hits"`
+	Misses        uint64    `json:"misses"`
+	Refreshes     uint64    `json:"refreshes"`
+	RefreshErrors uint64    `json:"refreshErrors"`
+	LastRefresh   time.Time `json:"lastRefresh"`
+}
+
+func newJWKSKeySet(url string) *jwksKeySet {
+	return &jwksKeySet{
+		url:                url,
+		client:             &http.Client{Timeout: 10 * time.Second},
+		minRefreshInterval: 10 * time.Second,
+		keys:               map[string]*rsa.PublicKey{},
+	}
+}
+
+// refresh downloads the JWKS document and replaces the cached keys. On
+// failure the previous keys stay in use.
+func (s *jwksKeySet) refresh() error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	s.mu.Lock()
+	s.lastAttempt = time.Now()
+	s.mu.Unlock()
+
+	s.refreshes.Add(1)
+	if err := s.fetch(); err != nil {
+		s.refreshErrors.Add(1)
+		return err
+	}
+	return nil
+}
+
+func (s *jwksKeySet) fetch() error {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch JWKS: unexpected status %d", resp.StatusCode)
+	}
+
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("failed to decode JWKS: %v", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range doc.Keys {
+		// Keycloak also publishes encryption keys; only signing keys are relevant here
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		pub, err := k.rsaPublicKey()
+		if err != nil {
+			return fmt.Errorf("invalid JWKS key %q: %v", k.Kid, err)
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no RSA signing keys in JWKS")
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.lastRefresh = time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+// refreshEvery keeps the key set current in the background
+func (s *jwksKeySet) refreshEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.refresh(); err != nil {
+			log.Error().Err(err).Str("jwks", s.url).Msg("JWKS refresh error")
+		}
+	}
+}
+
+// keyfunc resolves the verification key for a token by its kid header,
+// refetching the JWKS once when the kid is unknown
+func (s *jwksKeySet) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	if key, ok := s.lookup(kid); ok {
+		s.hits.Add(1)
+		return key, nil
+	}
+	s.misses.Add(1)
+
+	s.mu.RLock()
+	stale := time.Since(s.lastAttempt) >= s.minRefreshInterval
+	s.mu.RUnlock()
+	if stale {
+		if err := s.refresh(); err != nil {
+			log.Error().Err(err).Str("jwks", s.url).Msg("JWKS refresh error")
+		}
+		if key, ok := s.lookup(kid); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (s *jwksKeySet) lookup(kid string) (*rsa.PublicKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+func (s *jwksKeySet) stats() jwksStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return jwksStats{
+		Keys:          len(s.keys),
+		Hits:          s.hits.Load(),
+		Misses:        s.misses.Load(),
+		Refreshes:     s.refreshes.Load(),
+		RefreshErrors: s.refreshErrors.Load(),
+		LastRefresh:   s.lastRefresh,
+	}
+}
+
+func (k jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("bad modulus: %v", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("bad exponent: %v", err)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// jwksServer publishes whichever signing keys it was last given and counts
+// the fetches
+type jwksServer struct {
+	*httptest.Server
+	fetches atomic.Int32
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PrivateKey
+}
+
+func newJWKSServer(t *testing.T) *jwksServer {
+	t.Helper()
+	s := &jwksServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var doc struct {
+			Keys []jwk `json:"keys"`
+		}
+		for kid, key := range s.keys {
+			doc.Keys = append(doc.Keys, jwk{
+				Kid: kid,
+				Kty: "RSA",
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(doc)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// publish replaces the published keys
+func (s *jwksServer) publish(keys map[string]*rsa.PrivateKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func newSigningKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// verify parses a token signed by key under kid with the key set
+func verify(t *testing.T, keySet *jwksKeySet, kid string, key *rsa.PrivateKey) error {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "tokentest-grace"})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = jwt.Parse(signed, keySet.keyfunc)
+	return err
+}
+
+// expire lets the next unknown kid refetch the key set
+func expire(keySet *jwksKeySet) {
+	keySet.mu.Lock()
+	defer keySet.mu.Unlock()
+	keySet.lastAttempt = time.Now().Add(-keySet.minRefreshInterval)
+}
+
+func TestJWKSFollowsKeyRotation(t *testing.T) {
+	server := newJWKSServer(t)
+	old, current := newSigningKey(t), newSigningKey(t)
+	server.publish(map[string]*rsa.PrivateKey{"old": old})
+	keySet := newJWKSKeySet(server.URL)
+	if err := keySet.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(t, keySet, "old", old); err != nil {
+		t.Fatalf("token of the published key: %v", err)
+	}
+
+	// Keycloak rotates: tokens name a kid the cache hasn't seen yet
+	server.publish(map[string]*rsa.PrivateKey{"current": current})
+	expire(keySet)
+	if err := verify(t, keySet, "current", current); err != nil {
+		t.Fatalf("token of the rotated key: %v", err)
+	}
+	if got := server.fetches.Load(); got != 2 {
+		t.Errorf("fetches: got %d, want 2", got)
+	}
+	if err := verify(t, keySet, "old", old); err == nil {
+		t.Error("token of the retired key was accepted")
+	}
+	if err := verify(t, keySet, "current", old); err == nil {
+		t.Error("token naming the current kid but signed by another key was accepted")
+	}
+}
+
+func TestJWKSRateLimitsUnknownKidRefreshes(t *testing.T) {
+	server := newJWKSServer(t)
+	key := newSigningKey(t)
+	server.publish(map[string]*rsa.PrivateKey{"current": key})
+	keySet := newJWKSKeySet(server.URL)
+	if err := keySet.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := verify(t, keySet, "garbage", key); err == nil {
+			t.Fatal("token of an unknown kid was accepted")
+		}
+	}
+	if got := server.fetches.Load(); got != 1 {
+		t.Errorf("fetches within the refresh interval: got %d, want 1", got)
+	}
+
+	expire(keySet)
+	for i := 0; i < 5; i++ {
+		verify(t, keySet, "garbage", key)
+	}
+	if got := server.fetches.Load(); got != 2 {
+		t.Errorf("fetches once the interval passed: got %d, want 2", got)
+	}
+	if stats := keySet.stats(); stats.Misses != 10 || stats.Refreshes != 2 {
+		t.Errorf("stats: got %+v, want 10 misses and 2 refreshes", stats)
+	}
+}
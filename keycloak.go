@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keycloakClient calls Keycloak with this service's own confidential client
+// credentials (KEYCLOAK_CLIENT_ID / KEYCLOAK_CLIENT_SECRET)
+type keycloakClient struct {
+	clientID     string
+	clientSecret string
+	http         *http.Client
+
+	mu           sync.Mutex
+	serviceToken string
+	serviceExp   time.Time
+}
+
+var (
+	keycloakOnce sync.Once
+	keycloakAPI  *keycloakClient
+)
+
+// keycloak returns the shared client, or nil when no client credentials are
+// configured
+func keycloak() *keycloakClient {
+	keycloakOnce.Do(func() {
+		clientID := cfg.Keycloak.ClientID
+		if clientID == "" {
+			return
+		}
+		keycloakAPI = &keycloakClient{
+			clientID:     clientID,
+			clientSecret: cfg.Keycloak.ClientSecret,
+			http:         &http.Client{Timeout: 10 * time.Second},
+		}
+	})
+	return keycloakAPI
+}
+
+// tokenResponse is the token endpoint's JSON reply
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+// accessToken returns a client-credentials token for this service, reusing
+// it until shortly before it expires
+func (k *keycloakClient) accessToken() (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.serviceToken != "" && time.Now().Before(k.serviceExp) {
+		return k.serviceToken, nil
+	}
+
+	tok, err := k.requestToken(url.Values{"grant_type": {"client_credentials"}})
+	if err != nil {
+		return "", err
+	}
+	k.serviceToken = tok.AccessToken
+	// Renew 30s early so a token never expires in flight
+	k.serviceExp = time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second - 30*time.Second)
+	return k.serviceToken, nil
+}
+
+// requestToken posts a grant to the token endpoint, authenticating as this client
+func (k *keycloakClient) requestToken(form url.Values) (*tokenResponse, error) {
+	endpoint := oidcEndpoints().TokenEndpoint
+	if endpoint == "" {
+		return nil, fmt.Errorf("KEYCLOAK_ISSUER is not configured")
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(k.clientID, k.clientSecret)
+
+	var tok tokenResponse
+	if err := k.do(req, &tok); err != nil {
+		return nil, fmt.Errorf("token request failed: %v", err)
+	}
+	return &tok, nil
+}
+
+// do sends req and decodes a JSON reply into out (when non-nil). Non-2xx
+// replies become a *keycloakError.
+func (k *keycloakClient) do(req *http.Request, out interface{}) error {
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &keycloakError{Status: resp.StatusCode, Body: string(body)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// keycloakError is a non-2xx reply from Keycloak
+type keycloakError struct {
+	Status int
+	Body   string
+}
+
+func (e *keycloakError) Error() string {
+	return fmt.Sprintf("keycloak returned status %d: %s", e.Status, e.Body)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// adminUsers is set when ADMIN_USERS=true
+	adminUsers bool
+
+	// keycloakAdminURL is the Admin REST API of the realm, set by the
+	// features using it: KEYCLOAK_ADMIN_URL, or derived from the issuer,
+	// http://keycloak:8080/realms/demo-realm giving
+	// http://keycloak:8080/admin/realms/demo-realm
+	keycloakAdminURL string
+)
+
+// keycloakUser is what /admin/users shows of a Keycloak user; attributes
+// and credentials stay in Keycloak
+type keycloakUser struct {
+	ID               string `json:"id"`
+	Username         string `json:"username"`
+	Email            string `json:"email,omitempty"`
+	FirstName        string `json:"firstName,omitempty"`
+	LastName         string `json:"lastName,omitempty"`
+	Enabled          bool   `json:"enabled"`
+	EmailVerified    bool   `json:"emailVerified"`
+	CreatedTimestamp int64  `json:"createdTimestamp,omitempty"`
+}
+
+// resetToken drops the cached service token, e.g. after Keycloak rejected
+// it, so the next call gets a fresh one
+func (k *keycloakClient) resetToken() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.serviceToken = ""
+}
+
+// admin calls the Admin REST API at path with the service token, sending
+// body as JSON when non-nil and decoding the reply into out. A rejected
+// token is renewed and the call tried once more, as roles granted to the
+// service account only show in new tokens.
+func (k *keycloakClient) admin(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	endpoint := keycloakAdminURL + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	for attempt := 0; ; attempt++ {
+		token, err := k.accessToken()
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		err = k.do(req, out)
+		var kcErr *keycloakError
+		if attempt == 0 && errors.As(err, &kcErr) && kcErr.Status == http.StatusUnauthorized {
+			k.resetToken()
+			continue
+		}
+		return err
+	}
+}
+
+// keycloakAdminError maps Admin API failures to API errors
+func keycloakAdminError(err error) error {
+	var kcErr *keycloakError
+	if errors.As(err, &kcErr) {
+		switch kcErr.Status {
+		case http.StatusNotFound:
+			return apperror.NotFound("User not found")
+		case http.StatusConflict:
+			return apperror.Conflict("Keycloak refused the change as conflicting")
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return apperror.FailedDependency("The service account may not manage users; grant it realm-management's view-users and manage-users roles")
+		}
+	}
+	return apperror.Internal("Keycloak Admin API error", err)
+}
+
+// userPath is the Admin API path of the user of the :id parameter
+func userPath(c *fiber.Ctx) string {
+	return "/users/" + url.PathEscape(c.Params("id"))
+}
+
+// notSelf refuses changes of admins to their own account, which would
+// lock them out mid-request
+func notSelf(c *fiber.Ctx) error {
+	if c.Params("id") == userFromCtx(c).Subject {
+		return apperror.Conflict("Admins can't disable or delete their own account")
+	}
+	return nil
+}
+
+// registerAdminUserRoutes mounts /admin/users, which manages Keycloak's
+// users through the Admin REST API. Deleting a user soft-deletes their
+// profile here too.
+func registerAdminUserRoutes(app *fiber.App, users repository.UserRepository) {
+	admin := requireRole("admin")
+	kc := keycloak()
+
+	// ?search matches username, email, first and last name; ?username,
+	// ?email and ?enabled filter on one attribute. Paged with ?page and
+	// ?limit.
+	app.Get("/admin/users", admin, func(c *fiber.Ctx) error {
+		page, limit := c.QueryInt("page", 1), c.QueryInt("limit", defaultPageLimit)
+		if page < 1 || limit < 1 || limit > maxPageLimit {
+			return apperror.Validation("Invalid list parameters", fiber.Map{"page": "page from 1, limit from 1 to " + strconv.Itoa(maxPageLimit)})
+		}
+		query := url.Values{}
+		for _, name := range []string{"search", "username", "email", "enabled"} {
+			if v := c.Query(name); v != "" {
+				query.Set(name, v)
+			}
+		}
+		var total int
+		if err := kc.admin(c.UserContext(), http.MethodGet, "/users/count", query, nil, &total); err != nil {
+			return keycloakAdminError(err)
+		}
+		query.Set("first", strconv.Itoa((page-1)*limit))
+		query.Set("max", strconv.Itoa(limit))
+		query.Set("briefRepresentation", "true")
+		list := []keycloakUser{}
+		if err := kc.admin(c.UserContext(), http.MethodGet, "/users", query, nil, &list); err != nil {
+			return keycloakAdminError(err)
+		}
+		return c.JSON(fiber.Map{"users": list, "page": page, "limit": limit, "total": total})
+	})
+
+	app.Get("/admin/users/:id", admin, func(c *fiber.Ctx) error {
+		var user keycloakUser
+		if err := kc.admin(c.UserContext(), http.MethodGet, userPath(c), nil, nil, &user); err != nil {
+			return keycloakAdminError(err)
+		}
+		return c.JSON(user)
+	})
+
+	// Disabling also ends the user's sessions, so their refresh tokens stop
+	// working now rather than at their next login
+	app.Post("/admin/users/:id/disable", admin, func(c *fiber.Ctx) error {
+		if err := notSelf(c); err != nil {
+			return err
+		}
+		ctx := c.UserContext()
+		if err := kc.admin(ctx, http.MethodPut, userPath(c), nil, fiber.Map{"enabled": false}, nil); err != nil {
+			return keycloakAdminError(err)
+		}
+		if err := kc.admin(ctx, http.MethodPost, userPath(c)+"/logout", nil, nil, nil); err != nil {
+			return keycloakAdminError(err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Post("/admin/users/:id/enable", admin, func(c *fiber.Ctx) error {
+		if err := kc.admin(c.UserContext(), http.MethodPut, userPath(c), nil, fiber.Map{"enabled": true}, nil); err != nil {
+			return keycloakAdminError(err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Delete("/admin/users/:id", admin, func(c *fiber.Ctx) error {
+		if err := notSelf(c); err != nil {
+			return err
+		}
+		ctx := c.UserContext()
+		if err := kc.admin(ctx, http.MethodDelete, userPath(c), nil, nil, nil); err != nil {
+			return keycloakAdminError(err)
+		}
+		if err := users.Delete(ctx, c.Params("id")); err != nil && !errors.Is(err, repository.ErrNotFound) {
+			requestLogger(ctx).Error().Err(err).Str("user", c.Params("id")).Msg("Cannot delete the profile of a deleted Keycloak user")
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+}
+
+// initKeycloakAdminURL sets keycloakAdminURL for feature, which needs the
+// Admin API and the service account calling it
+func initKeycloakAdminURL(feature string) {
+	if keycloak() == nil || oidcEndpoints().Issuer == "" {
+		log.Fatal().Msg(feature + "=true requires KEYCLOAK_ISSUER and KEYCLOAK_CLIENT_ID/KEYCLOAK_CLIENT_SECRET")
+	}
+	if keycloakAdminURL != "" {
+		return
+	}
+	keycloakAdminURL = strings.TrimSuffix(cfg.Keycloak.AdminURL, "/")
+	if keycloakAdminURL == "" {
+		issuer := oidcEndpoints().Issuer
+		i := strings.LastIndex(issuer, "/realms/")
+		if i < 0 {
+			log.Fatal().Str("issuer", issuer).Msg("Cannot derive the Admin API URL from KEYCLOAK_ISSUER; set KEYCLOAK_ADMIN_URL")
+		}
+		keycloakAdminURL = issuer[:i] + "/admin" + issuer[i:]
+	}
+}
+
+// Enable /admin/users when ADMIN_USERS=true
+func initAdminUsers() {
+	if !cfg.Users.Admin {
+		return
+	}
+	initKeycloakAdminURL("ADMIN_USERS")
+	grantableRealmRoles = cfg.Users.GrantableRealmRoles
+	grantableClients = cfg.Users.GrantableClients
+	for _, client := range reservedClients {
+		if containsString(grantableClients, client) {
+			log.Fatal().Msgf("GRANTABLE_CLIENTS can't include %s, whose roles are Keycloak's own permissions", client)
+		}
+	}
+	adminUsers = true
+	log.Info().Str("url", keycloakAdminURL).Strs("realmRoles", grantableRealmRoles).Strs("clients", grantableClients).Msg("Keycloak user management enabled")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+)
+
+// keycloakGroup is a Keycloak group as /admin/groups shows it; Keycloak
+// versions listing subgroups inline fill SubGroups
+type keycloakGroup struct {
+	ID            string          `json:"id"`
+	Name          string          `json:"name"`
+	Path          string          `json:"path"`
+	SubGroupCount int             `json:"subGroupCount,omitempty"`
+	SubGroups     []keycloakGroup `json:"subGroups,omitempty"`
+}
+
+// groupPath is the Admin API path of the group of the :group parameter,
+// or of :id on /admin/groups/:id
+func groupPath(c *fiber.Ctx, param string) string {
+	return "/groups/" + url.PathEscape(c.Params(param))
+}
+
+// pageQuery reads ?page and ?limit into the first and max of the Admin API
+func pageQuery(c *fiber.Ctx) (url.Values, error) {
+	page, limit := c.QueryInt("page", 1), c.QueryInt("limit", defaultPageLimit)
+	if page < 1 || limit < 1 || limit > maxPageLimit {
+		return nil, apperror.Validation("Invalid list parameters", fiber.Map{"page": "page from 1, limit from 1 to " + strconv.Itoa(maxPageLimit)})
+	}
+	return url.Values{"first": {strconv.Itoa((page - 1) * limit)}, "max": {strconv.Itoa(limit)}}, nil
+}
+
+// userGroupPaths returns the paths of the groups the user of path is a
+// direct member of, sorted
+func userGroupPaths(ctx context.Context, kc *keycloakClient, path string) ([]string, error) {
+	var groups []keycloakGroup
+	if err := kc.admin(ctx, http.MethodGet, path+"/groups", url.Values{"briefRepresentation": {"true"}}, nil, &groups); err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(groups))
+	for _, g := range groups {
+		paths = append(paths, g.Path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// registerGroupRoutes mounts /admin/groups and /admin/users/:id/groups,
+// Keycloak's groups and their members. Membership changes show in the
+// groups claim of the user's next token, and so in their item grants; the
+// audit log records each with the user's groups before and after.
+func registerGroupRoutes(app *fiber.App, audit repository.AuditRepository) {
+	admin := requireRole("admin")
+	kc := keycloak()
+
+	// Top-level groups, ?search matching names at any depth; paged with
+	// ?page and ?limit
+	app.Get("/admin/groups", admin, func(c *fiber.Ctx) error {
+		query, err := pageQuery(c)
+		if err != nil {
+			return err
+		}
+		if search := c.Query("search"); search != "" {
+			query.Set("search", search)
+		}
+		groups := []keycloakGroup{}
+		if err := kc.admin(c.UserContext(), http.MethodGet, "/groups", query, nil, &groups); err != nil {
+			return keycloakAdminError(err)
+		}
+		return c.JSON(fiber.Map{"groups": groups})
+	})
+
+	app.Get("/admin/groups/:id", admin, func(c *fiber.Ctx) error {
+		var group keycloakGroup
+		if err := kc.admin(c.UserContext(), http.MethodGet, groupPath(c, "id"), nil, nil, &group); err != nil {
+			return groupError(err)
+		}
+		return c.JSON(group)
+	})
+
+	// Direct members of the group, paged with ?page and ?limit
+	app.Get("/admin/groups/:id/members", admin, func(c *fiber.Ctx) error {
+		query, err := pageQuery(c)
+		if err != nil {
+			return err
+		}
+		query.Set("briefRepresentation", "true")
+		members := []keycloakUser{}
+		if err := kc.admin(c.UserContext(), http.MethodGet, groupPath(c, "id")+"/members", query, nil, &members); err != nil {
+			return groupError(err)
+		}
+		return c.JSON(fiber.Map{"members": members})
+	})
+
+	app.Get("/admin/users/:id/groups", admin, func(c *fiber.Ctx) error {
+		groups := []keycloakGroup{}
+		query := url.Values{"briefRepresentation": {"true"}}
+		if err := kc.admin(c.UserContext(), http.MethodGet, userPath(c)+"/groups", query, nil, &groups); err != nil {
+			return keycloakAdminError(err)
+		}
+		return c.JSON(fiber.Map{"groups": groups})
+	})
+
+	// change joins or leaves the :group of the user, as method says
+	change := func(c *fiber.Ctx, method string) error {
+		ctx := c.UserContext()
+		// Tells a missing group from a missing user, which Keycloak doesn't
+		if err := kc.admin(ctx, http.MethodGet, groupPath(c, "group"), nil, nil, nil); err != nil {
+			return groupError(err)
+		}
+		before, err := userGroupPaths(ctx, kc, userPath(c))
+		if err != nil {
+			return keycloakAdminError(err)
+		}
+		if err := kc.admin(ctx, method, userPath(c)+groupPath(c, "group"), nil, nil, nil); err != nil {
+			return keycloakAdminError(err)
+		}
+		after, err := userGroupPaths(ctx, kc, userPath(c))
+		if err != nil {
+			return keycloakAdminError(err)
+		}
+		var changes []repository.FieldChange
+		if !sameStrings(before, after) {
+			changes = []repository.FieldChange{{Field: "groups", From: before, To: after}}
+		}
+		if err := auditInTx(ctx, c, audit, fiber.StatusOK, c.Params("id"), changes); err != nil {
+			// Keycloak has the change; auditMiddleware still records the
+			// request, without the groups
+			requestLogger(ctx).Error().Err(err).Msg("Cannot record audit entry")
+		}
+		return c.JSON(fiber.Map{"groups": after})
+	}
+
+	// Both are idempotent: joining a group twice or leaving one the user
+	// isn't in succeeds
+	app.Put("/admin/users/:id/groups/:group", admin, func(c *fiber.Ctx) error {
+		return change(c, http.MethodPut)
+	})
+	app.Delete("/admin/users/:id/groups/:group", admin, func(c *fiber.Ctx) error {
+		return change(c, http.MethodDelete)
+	})
+}
+
+// groupError maps Admin API failures of group calls, where 404 is the
+// group's
+func groupError(err error) error {
+	var kcErr *keycloakError
+	if errors.As(err, &kcErr) && kcErr.Status == http.StatusNotFound {
+		return apperror.NotFound("Group not found")
+	}
+	return keycloakAdminError(err)
+}
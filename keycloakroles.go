@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxRoleChanges bounds the roles one request grants and revokes
+const maxRoleChanges = 50
+
+var (
+	// grantableRealmRoles are the realm roles /admin/users/:id/roles grants
+	// and revokes, GRANTABLE_REALM_ROLES
+	grantableRealmRoles = []string{"user", "admin"}
+	// grantableClients are the clients whose roles it grants and revokes,
+	// GRANTABLE_CLIENTS
+	grantableClients []string
+)
+
+// reservedClients hold Keycloak's own permissions, realm administration
+// and identity brokering, which no allowlist opens
+var reservedClients = []string{"realm-management", "broker"}
+
+// keycloakRole is a role representation of the Admin API, as role mapping
+// calls take it
+type keycloakRole struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Composite   bool   `json:"composite"`
+	ClientRole  bool   `json:"clientRole"`
+	ContainerID string `json:"containerId,omitempty"`
+}
+
+// roleSet is the roles of a user, or of a change to them: realm roles,
+// and client roles by client ID
+type roleSet struct {
+	Realm   []string            `json:"realm"`
+	Clients map[string][]string `json:"clients,omitempty"`
+}
+
+func (s roleSet) size() int {
+	n := len(s.Realm)
+	for _, roles := range s.Clients {
+		n += len(roles)
+	}
+	return n
+}
+
+// rolesBody is the body of POST /admin/users/:id/roles
+type rolesBody struct {
+	Grant  roleSet `json:"grant"`
+	Revoke roleSet `json:"revoke"`
+}
+
+func (b *rolesBody) validate() error {
+	n := b.Grant.size() + b.Revoke.size()
+	if n == 0 {
+		return apperror.Validation("Invalid body", fiber.Map{"roles": "grant or revoke at least one role"})
+	}
+	if n > maxRoleChanges {
+		return apperror.Validation("Invalid body", fiber.Map{"roles": "up to 50 roles per request"})
+	}
+	for _, set := range []roleSet{b.Grant, b.Revoke} {
+		for client, roles := range set.Clients {
+			if client == "" {
+				return apperror.Validation("Invalid body", fiber.Map{"clients": "client IDs can't be empty"})
+			}
+			if containsString(roles, "") {
+				return apperror.Validation("Invalid body", fiber.Map{"clients": "role names can't be empty"})
+			}
+			if len(roles) > 0 && (!containsString(grantableClients, client) || containsString(reservedClients, client)) {
+				return apperror.Validation("Invalid body", fiber.Map{"clients": "roles of client " + client + " can't be managed here"})
+			}
+		}
+		for _, role := range set.Realm {
+			if role == "" {
+				return apperror.Validation("Invalid body", fiber.Map{"realm": "role names can't be empty"})
+			}
+			if !containsString(grantableRealmRoles, role) {
+				return apperror.Validation("Invalid body", fiber.Map{"realm": "realm role " + role + " can't be managed here"})
+			}
+		}
+	}
+	return nil
+}
+
+// userRoles returns the roles mapped to the user of path directly, each
+// list sorted
+func userRoles(ctx context.Context, kc *keycloakClient, path string) (*roleSet, error) {
+	var mappings roleMappings
+	if err := kc.admin(ctx, http.MethodGet, path+"/role-mappings", nil, nil, &mappings); err != nil {
+		return nil, err
+	}
+	set := &roleSet{Realm: []string{}, Clients: map[string][]string{}}
+	for _, r := range mappings.RealmMappings {
+		set.Realm = append(set.Realm, r.Name)
+	}
+	sort.Strings(set.Realm)
+	for client, m := range mappings.ClientMappings {
+		for _, r := range m.Mappings {
+			set.Clients[client] = append(set.Clients[client], r.Name)
+		}
+		sort.Strings(set.Clients[client])
+	}
+	return set, nil
+}
+
+// roleResolver looks up the representations role mapping calls take,
+// memoizing client lookups for the request
+type roleResolver struct {
+	ctx     context.Context
+	kc      *keycloakClient
+	clients map[string]string
+}
+
+// notFound turns a 404 of the Admin API into a validation error naming
+// what doesn't exist, leaving other errors as they are
+func notFound(err error, field, msg string) error {
+	var kcErr *keycloakError
+	if errors.As(err, &kcErr) && kcErr.Status == http.StatusNotFound {
+		return apperror.Validation("Invalid body", fiber.Map{field: msg})
+	}
+	return err
+}
+
+// client returns the internal ID of the client with clientID
+func (r *roleResolver) client(clientID string) (string, error) {
+	if id, ok := r.clients[clientID]; ok {
+		return id, nil
+	}
+	var found []struct {
+		ID       string `json:"id"`
+		ClientID string `json:"clientId"`
+	}
+	query := url.Values{"clientId": {clientID}}
+	if err := r.kc.admin(r.ctx, http.MethodGet, "/clients", query, nil, &found); err != nil {
+		return "", err
+	}
+	for _, c := range found {
+		if c.ClientID == clientID {
+			r.clients[clientID] = c.ID
+			return c.ID, nil
+		}
+	}
+	return "", apperror.Validation("Invalid body", fiber.Map{"clients": "no client " + clientID})
+}
+
+// realm returns the realm roles of names
+func (r *roleResolver) realm(names []string) ([]keycloakRole, error) {
+	roles := make([]keycloakRole, 0, len(names))
+	for _, name := range names {
+		var role keycloakRole
+		if err := r.kc.admin(r.ctx, http.MethodGet, "/roles/"+url.PathEscape(name), nil, nil, &role); err != nil {
+			return nil, notFound(err, "realm", "no realm role "+name)
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+// clientRoles returns the roles of names of the client with internal ID id
+func (r *roleResolver) clientRoles(clientID, id string, names []string) ([]keycloakRole, error) {
+	roles := make([]keycloakRole, 0, len(names))
+	for _, name := range names {
+		var role keycloakRole
+		if err := r.kc.admin(r.ctx, http.MethodGet, "/clients/"+id+"/roles/"+url.PathEscape(name), nil, nil, &role); err != nil {
+			return nil, notFound(err, "clients", "no role "+name+" of client "+clientID)
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+// roleChange is one role mapping call: the roles to add to or remove from
+// a mapping path
+type roleChange struct {
+	method string
+	path   string
+	roles  []keycloakRole
+}
+
+// plan resolves body into the calls making the change, every role looked
+// up before any mapping changes
+func (r *roleResolver) plan(base string, body *rolesBody) ([]roleChange, error) {
+	var changes []roleChange
+	for _, step := range []struct {
+		method string
+		set    roleSet
+	}{{http.MethodPost, body.Grant}, {http.MethodDelete, body.Revoke}} {
+		if len(step.set.Realm) > 0 {
+			roles, err := r.realm(step.set.Realm)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, roleChange{step.method, base + "/role-mappings/realm", roles})
+		}
+		for clientID, names := range step.set.Clients {
+			if len(names) == 0 {
+				continue
+			}
+			id, err := r.client(clientID)
+			if err != nil {
+				return nil, err
+			}
+			roles, err := r.clientRoles(clientID, id, names)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, roleChange{step.method, base + "/role-mappings/clients/" + id, roles})
+		}
+	}
+	return changes, nil
+}
+
+// roleChanges lists what differs between before and after, for the audit
+// log: realmRoles, and clientRoles.<client ID> per client
+func roleChanges(before, after *roleSet) []repository.FieldChange {
+	var changes []repository.FieldChange
+	if !sameStrings(before.Realm, after.Realm) {
+		changes = append(changes, repository.FieldChange{Field: "realmRoles", From: before.Realm, To: after.Realm})
+	}
+	clients := map[string]bool{}
+	for client := range before.Clients {
+		clients[client] = true
+	}
+	for client := range after.Clients {
+		clients[client] = true
+	}
+	names := make([]string, 0, len(clients))
+	for client := range clients {
+		names = append(names, client)
+	}
+	sort.Strings(names)
+	for _, client := range names {
+		if from, to := before.Clients[client], after.Clients[client]; !sameStrings(from, to) {
+			changes = append(changes, repository.FieldChange{Field: "clientRoles." + client, From: from, To: to})
+		}
+	}
+	return changes
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// registerRoleRoutes mounts /admin/users/:id/roles, the realm and client
+// roles mapped to a user directly. Changes show in the user's tokens from
+// their next refresh; the audit log records each with the roles before
+// and after.
+func registerRoleRoutes(app *fiber.App, audit repository.AuditRepository) {
+	admin := requireRole("admin")
+	kc := keycloak()
+
+	app.Get("/admin/users/:id/roles", admin, func(c *fiber.Ctx) error {
+		roles, err := userRoles(c.UserContext(), kc, userPath(c))
+		if err != nil {
+			return keycloakAdminError(err)
+		}
+		return c.JSON(roles)
+	})
+
+	// Grants the roles of "grant" and revokes those of "revoke", e.g.
+	// {"grant": {"realm": ["editor"]}, "revoke": {"clients": {"app": ["viewer"]}}}
+	app.Post("/admin/users/:id/roles", admin, func(c *fiber.Ctx) error {
+		var body rolesBody
+		if err := decodeStrict(c.Body(), &body); err != nil {
+			return err
+		}
+		if err := body.validate(); err != nil {
+			return err
+		}
+		if c.Params("id") == userFromCtx(c).Subject && containsString(body.Revoke.Realm, "admin") {
+			return apperror.Conflict("Admins can't revoke their own admin role")
+		}
+		ctx := c.UserContext()
+		before, err := userRoles(ctx, kc, userPath(c))
+		if err != nil {
+			return keycloakAdminError(err)
+		}
+		resolver := &roleResolver{ctx: ctx, kc: kc, clients: map[string]string{}}
+		changes, err := resolver.plan(userPath(c), &body)
+		if err != nil {
+			var appErr *apperror.Error
+			if errors.As(err, &appErr) {
+				return err
+			}
+			return keycloakAdminError(err)
+		}
+		for _, change := range changes {
+			if err := kc.admin(ctx, change.method, change.path, nil, change.roles, nil); err != nil {
+				return keycloakAdminError(err)
+			}
+		}
+		after, err := userRoles(ctx, kc, userPath(c))
+		if err != nil {
+			return keycloakAdminError(err)
+		}
+		if err := auditInTx(ctx, c, audit, fiber.StatusOK, c.Params("id"), roleChanges(before, after)); err != nil {
+			// Keycloak has the change; auditMiddleware still records the
+			// request, without the roles
+			requestLogger(ctx).Error().Err(err).Msg("Cannot record audit entry")
+		}
+		return c.JSON(after)
+	})
+}
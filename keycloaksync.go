@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// syncPageSize is the page of users and admin events read per Admin API
+// call
+const syncPageSize = 100
+
+var (
+	// userSync is set when USER_SYNC=true
+	userSync *userSyncer
+
+	// userSyncs is cancelled at shutdown, ending a sync in progress
+	userSyncs, stopUserSync = context.WithCancel(context.Background())
+)
+
+// syncedUser is a Keycloak user as mirrored in keycloak_users, keyed by
+// their ID (the sub of their tokens), with the roles assigned to them
+// directly, for joins with the app's data
+type syncedUser struct {
+	Username      string              `bson:"username"`
+	Email         string              `bson:"email,omitempty"`
+	FirstName     string              `bson:"firstName,omitempty"`
+	LastName      string              `bson:"lastName,omitempty"`
+	Enabled       bool                `bson:"enabled"`
+	EmailVerified bool                `bson:"emailVerified"`
+	CreatedAt     time.Time           `bson:"createdAt"`
+	RealmRoles    []string            `bson:"realmRoles"`
+	ClientRoles   map[string][]string `bson:"clientRoles,omitempty"`
+	// SyncedAt is when Keycloak was read, not written: a slower run holding
+	// an older read doesn't overwrite a newer one
+	SyncedAt time.Time `bson:"syncedAt"`
+}
+
+// syncState is the keycloak_sync document of the user sync: the lease
+// keeping replicas from syncing at once, and where the last run got to
+type syncState struct {
+	LeaseOwner string    `json:"-" bson:"leaseOwner,omitempty"`
+	LeaseUntil time.Time `json:"-" bson:"leaseUntil"`
+	// EventCursor is the time, in Unix milliseconds, of the newest admin
+	// event applied
+	EventCursor  int64     `json:"eventCursor" bson:"eventCursor"`
+	LastRun      time.Time `json:"lastRun" bson:"lastRun"`
+	LastFullSync time.Time `json:"lastFullSync" bson:"lastFullSync"`
+	LastError    string    `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	Stats        syncStats `json:"stats" bson:"stats"`
+}
+
+// syncStats counts what the last run did
+type syncStats struct {
+	Full    bool `json:"full" bson:"full"`
+	Synced  int  `json:"synced" bson:"synced"`
+	Deleted int  `json:"deleted" bson:"deleted"`
+	// Stale counts the users a newer read had already written
+	Stale int `json:"stale" bson:"stale"`
+}
+
+// adminEvent is the part of a Keycloak admin event the sync reads
+type adminEvent struct {
+	Time         int64  `json:"time"`
+	ResourcePath string `json:"resourcePath"`
+}
+
+// roleMappings is the reply of /users/{id}/role-mappings
+type roleMappings struct {
+	RealmMappings  []struct{ Name string } `json:"realmMappings"`
+	ClientMappings map[string]struct {
+		Mappings []struct{ Name string } `json:"mappings"`
+	} `json:"clientMappings"`
+}
+
+// userSyncer mirrors Keycloak's users into Mongo. Runs are incremental,
+// re-reading the users named by the admin events since the cursor, with
+// a full pass every fullInterval for what events miss: self-registered
+// users, and realms not recording admin events.
+type userSyncer struct {
+	kc           *keycloakClient
+	users        *mongo.Collection
+	state        *mongo.Collection
+	owner        string
+	interval     time.Duration
+	fullInterval time.Duration
+	// lease bounds a run; a replica that died mid-run holds it no longer
+	lease time.Duration
+	// trigger asks the loop for a run now, full when true
+	trigger chan bool
+}
+
+func (s *userSyncer) ensureIndexes(ctx context.Context) error {
+	_, err := s.users.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "username", Value: 1}}},
+		{Keys: bson.D{{Key: "email", Value: 1}}},
+		{Keys: bson.D{{Key: "realmRoles", Value: 1}}},
+		{Keys: bson.D{{Key: "syncedAt", Value: 1}}},
+	})
+	return err
+}
+
+// acquire takes the lease, reporting false while another replica holds it
+func (s *userSyncer) acquire(ctx context.Context) (*syncState, bool, error) {
+	now := time.Now().UTC()
+	var st syncState
+	err := s.state.FindOneAndUpdate(ctx,
+		bson.M{"_id": "users", "$or": bson.A{
+			bson.M{"leaseUntil": bson.M{"$lt": now}},
+			bson.M{"leaseOwner": s.owner},
+		}},
+		bson.M{"$set": bson.M{"leaseOwner": s.owner, "leaseUntil": now.Add(s.lease)}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&st)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &st, true, nil
+}
+
+// release records the run and gives up the lease
+func (s *userSyncer) release(ctx context.Context, st *syncState) error {
+	set := bson.M{
+		"leaseUntil":   time.Time{},
+		"eventCursor":  st.EventCursor,
+		"lastRun":      st.LastRun,
+		"stats":        st.Stats,
+		"lastError":    st.LastError,
+		"lastFullSync": st.LastFullSync,
+	}
+	_, err := s.state.UpdateOne(ctx, bson.M{"_id": "users", "leaseOwner": s.owner}, bson.M{"$set": set, "$unset": bson.M{"leaseOwner": ""}})
+	return err
+}
+
+// status returns the state of the last run
+func (s *userSyncer) status(ctx context.Context) (*syncState, error) {
+	var st syncState
+	err := s.state.FindOne(ctx, bson.M{"_id": "users"}).Decode(&st)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return &st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// run syncs once, full when asked or due. It returns without syncing
+// while another replica holds the lease.
+func (s *userSyncer) run(ctx context.Context, full bool) error {
+	ctx, cancel := context.WithTimeout(ctx, s.lease)
+	defer cancel()
+	st, ok, err := s.acquire(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	started := time.Now().UTC()
+	full = full || st.LastFullSync.IsZero() || started.Sub(st.LastFullSync) >= s.fullInterval
+	st.Stats = syncStats{Full: full}
+	if full {
+		err = s.syncAll(ctx, started, st)
+	} else {
+		err = s.syncEvents(ctx, st)
+	}
+	st.LastRun, st.LastError = started, ""
+	if err != nil {
+		st.LastError = err.Error()
+	} else if full {
+		st.LastFullSync = started
+	}
+	// The lease is released even when the run's own deadline passed
+	rctx, rcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer rcancel()
+	if rerr := s.release(rctx, st); rerr != nil && err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// syncAll reads every user. The cursor moves to the run's start first, as
+// the pass covers the events before it; users left with an older read are
+// gone from Keycloak, or were missed as paging shifted, so each is looked
+// up before being marked deleted.
+func (s *userSyncer) syncAll(ctx context.Context, started time.Time, st *syncState) error {
+	if cursor := started.UnixMilli(); cursor > st.EventCursor {
+		st.EventCursor = cursor
+	}
+	for first := 0; ; first += syncPageSize {
+		query := url.Values{"first": {strconv.Itoa(first)}, "max": {strconv.Itoa(syncPageSize)}}
+		var page []keycloakUser
+		readAt := time.Now().UTC()
+		if err := s.kc.admin(ctx, http.MethodGet, "/users", query, nil, &page); err != nil {
+			return fmt.Errorf("list users: %w", err)
+		}
+		for i := range page {
+			if err := s.store(ctx, &page[i], readAt, &st.Stats); err != nil {
+				return err
+			}
+		}
+		if len(page) < syncPageSize {
+			break
+		}
+	}
+	cur, err := s.users.Find(ctx,
+		bson.M{"syncedAt": bson.M{"$lt": started}, "deletedAt": bson.M{"$exists": false}},
+		options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var missing []struct {
+		ID string `bson:"_id"`
+	}
+	if err := cur.All(ctx, &missing); err != nil {
+		return err
+	}
+	for _, m := range missing {
+		if err := s.syncUser(ctx, m.ID, &st.Stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncEvents re-reads the users changed by the admin events from the
+// cursor on. Events of the cursor's millisecond are read again, as more
+// may have been recorded after the last run; re-reading a user is
+// harmless.
+func (s *userSyncer) syncEvents(ctx context.Context, st *syncState) error {
+	changed := map[string]bool{}
+	newest := st.EventCursor
+	query := url.Values{
+		"dateFrom":      {time.UnixMilli(st.EventCursor).UTC().Format("2006-01-02")},
+		"resourceTypes": {"USER", "REALM_ROLE_MAPPING", "CLIENT_ROLE_MAPPING", "GROUP_MEMBERSHIP"},
+		"max":           {strconv.Itoa(syncPageSize)},
+	}
+	for first := 0; ; first += syncPageSize {
+		query.Set("first", strconv.Itoa(first))
+		var events []adminEvent
+		if err := s.kc.admin(ctx, http.MethodGet, "/admin-events", query, nil, &events); err != nil {
+			return fmt.Errorf("list admin events: %w", err)
+		}
+		for _, ev := range events {
+			if ev.Time < st.EventCursor {
+				continue
+			}
+			if ev.Time > newest {
+				newest = ev.Time
+			}
+			// users/{id}, or below it, e.g. users/{id}/role-mappings/realm
+			if parts := strings.Split(ev.ResourcePath, "/"); len(parts) > 1 && parts[0] == "users" {
+				changed[parts[1]] = true
+			}
+		}
+		if len(events) < syncPageSize {
+			break
+		}
+	}
+	for id := range changed {
+		if err := s.syncUser(ctx, id, &st.Stats); err != nil {
+			return err
+		}
+	}
+	st.EventCursor = newest
+	return nil
+}
+
+// syncUser re-reads the user id, marking them deleted when Keycloak no
+// longer has them
+func (s *userSyncer) syncUser(ctx context.Context, id string, stats *syncStats) error {
+	readAt := time.Now().UTC()
+	var user keycloakUser
+	err := s.kc.admin(ctx, http.MethodGet, "/users/"+url.PathEscape(id), nil, nil, &user)
+	var kcErr *keycloakError
+	if errors.As(err, &kcErr) && kcErr.Status == http.StatusNotFound {
+		res, err := s.users.UpdateOne(ctx,
+			bson.M{"_id": id, "syncedAt": bson.M{"$lt": readAt}, "deletedAt": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"deletedAt": readAt, "syncedAt": readAt}})
+		if err != nil {
+			return err
+		}
+		stats.Deleted += int(res.ModifiedCount)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get user %s: %w", id, err)
+	}
+	return s.store(ctx, &user, readAt, stats)
+}
+
+// store writes user, as read at readAt, with their role mappings. A
+// document read later is kept, and counted stale.
+func (s *userSyncer) store(ctx context.Context, user *keycloakUser, readAt time.Time, stats *syncStats) error {
+	var roles roleMappings
+	if err := s.kc.admin(ctx, http.MethodGet, "/users/"+url.PathEscape(user.ID)+"/role-mappings", nil, nil, &roles); err != nil {
+		return fmt.Errorf("get roles of %s: %w", user.ID, err)
+	}
+	doc := syncedUser{
+		Username:      user.Username,
+		Email:         user.Email,
+		FirstName:     user.FirstName,
+		LastName:      user.LastName,
+		Enabled:       user.Enabled,
+		EmailVerified: user.EmailVerified,
+		CreatedAt:     time.UnixMilli(user.CreatedTimestamp).UTC(),
+		RealmRoles:    []string{},
+		SyncedAt:      readAt,
+	}
+	for _, r := range roles.RealmMappings {
+		doc.RealmRoles = append(doc.RealmRoles, r.Name)
+	}
+	for client, m := range roles.ClientMappings {
+		if doc.ClientRoles == nil {
+			doc.ClientRoles = map[string][]string{}
+		}
+		for _, r := range m.Mappings {
+			doc.ClientRoles[client] = append(doc.ClientRoles[client], r.Name)
+		}
+	}
+	// A newer document fails the filter, and the upsert then collides with
+	// its _id
+	_, err := s.users.UpdateOne(ctx,
+		bson.M{"_id": user.ID, "syncedAt": bson.M{"$lt": readAt}},
+		bson.M{"$set": doc, "$unset": bson.M{"deletedAt": ""}},
+		options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		stats.Stale++
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	stats.Synced++
+	return nil
+}
+
+// loop runs the sync every interval, and when triggered, until ctx ends
+func (s *userSyncer) loop(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	full := false
+	for {
+		start := time.Now()
+		if err := s.run(ctx, full); err != nil && ctx.Err() == nil {
+			log.Error().Err(err).Msg("Keycloak user sync error")
+		} else if err == nil {
+			log.Debug().Dur("took", time.Since(start)).Msg("Keycloak user sync done")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			full = false
+		case full = <-s.trigger:
+		}
+	}
+}
+
+// registerUserSyncRoutes mounts /admin/user-sync: GET shows the last run,
+// POST asks for one now, full with ?full=true
+func registerUserSyncRoutes(app *fiber.App) {
+	admin := requireRole("admin")
+
+	app.Get("/admin/user-sync", admin, func(c *fiber.Ctx) error {
+		st, err := userSync.status(c.UserContext())
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.JSON(st)
+	})
+
+	app.Post("/admin/user-sync", admin, func(c *fiber.Ctx) error {
+		select {
+		case userSync.trigger <- c.QueryBool("full"):
+		default:
+			// A run is already asked for
+		}
+		return c.SendStatus(fiber.StatusAccepted)
+	})
+}
+
+// Start the Keycloak user sync when USER_SYNC=true
+func initUserSync() {
+	if !cfg.Users.Sync {
+		return
+	}
+	initKeycloakAdminURL("USER_SYNC")
+	host, _ := os.Hostname()
+	userSync = &userSyncer{
+		kc:           keycloak(),
+		users:        mongoDB.Collection("keycloak_users"),
+		state:        mongoDB.Collection("keycloak_sync"),
+		owner:        host + ":" + strconv.Itoa(os.Getpid()),
+		interval:     cfg.Users.SyncInterval,
+		fullInterval: cfg.Users.SyncFullInterval,
+		lease:        cfg.Users.SyncLease,
+		trigger:      make(chan bool, 1),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := userSync.ensureIndexes(ctx); err != nil {
+		log.Fatal().Err(err).Msg("User sync indexes error")
+	}
+	go userSync.loop(userSyncs)
+	log.Info().Dur("interval", userSync.interval).Dur("full", userSync.fullInterval).Msg("Keycloak user sync enabled")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Configure the global logger from cfg.Log. Runs right after the config is
+// loaded, so every later init logs through it.
+func initLogging() {
+	level, err := zerolog.ParseLevel(strings.ToLower(cfg.Log.Level))
+	if err != nil || level == zerolog.NoLevel {
+		log.Fatal().Msgf("LOG_LEVEL: unknown level %q", cfg.Log.Level)
+	}
+	zerolog.SetGlobalLevel(level)
+	zerolog.TimeFieldFormat = time.RFC3339Nano
+	zerolog.DurationFieldUnit = time.Millisecond
+	zerolog.DurationFieldInteger = false
+
+	var out io.Writer = os.Stdout
+	switch v := cfg.Log.Output; v {
+	case "stdout":
+	case "stderr":
+		out = os.Stderr
+	default:
+		f, err := os.OpenFile(v, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			log.Fatal().Err(err).Msg("LOG_OUTPUT error")
+		}
+		out = f
+	}
+	switch cfg.Log.Format {
+	case "json":
+	case "console":
+		out = zerolog.ConsoleWriter{Out: out, TimeFormat: time.RFC3339}
+	default:
+		log.Fatal().Msgf("LOG_FORMAT: unknown format %q", cfg.Log.Format)
+	}
+
+	log.Logger = zerolog.New(out).With().Timestamp().Logger()
+	// zerolog.Ctx falls back to it outside requests
+	zerolog.DefaultContextLogger = &log.Logger
+}
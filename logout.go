@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// backchannelLogoutEvent is the event a Keycloak logout token must carry
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// logoutHandlers run for every accepted logout token, so each subsystem
+// holding per-session state can drop it. sid or sub may be empty.
+var logoutHandlers []func(sid, sub string)
+
+// onBackchannelLogout registers a handler run when Keycloak ends a session
+func onBackchannelLogout(h func(sid, sub string)) {
+	logoutHandlers = append(logoutHandlers, h)
+}
+
+// logoutSeen remembers the jtis of accepted logout tokens until their iat
+// is too old to be accepted anyway
+var logoutSeen = newTTLCache[struct{}](100000)
+
+var (
+	logoutKeysMu sync.Mutex
+	logoutKeys   = map[string]*jwksKeySet{}
+)
+
+// logoutKeySet returns a lazily loaded key set for jwksURL
+func logoutKeySet(jwksURL string) *jwksKeySet {
+	logoutKeysMu.Lock()
+	defer logoutKeysMu.Unlock()
+	ks, ok := logoutKeys[jwksURL]
+	if !ok {
+		ks = newJWKSKeySet(jwksURL)
+		logoutKeys[jwksURL] = ks
+	}
+	return ks
+}
+
+// logoutKeyfunc resolves logout token signing keys. Logout tokens are always
+// verified, even when access tokens are left to the gateway.
+func logoutKeyfunc(token *jwt.Token) (interface{}, error) {
+	if realms != nil {
+		claims, _ := token.Claims.(*KeycloakClaims)
+		if claims == nil || realmFor(claims.Issuer) == nil {
+			return nil, fmt.Errorf("unknown issuer")
+		}
+		r := realmFor(claims.Issuer)
+		if r.keySet != nil {
+			return r.keySet.keyfunc(token)
+		}
+		return logoutKeySet(r.jwksURL).keyfunc(token)
+	}
+	if jwtKeySet != nil {
+		return jwtKeySet.keyfunc(token)
+	}
+	jwksURL := oidcEndpoints().JWKSURI
+	if jwksURL == "" {
+		return nil, fmt.Errorf("KEYCLOAK_ISSUER is not configured")
+	}
+	return logoutKeySet(jwksURL).keyfunc(token)
+}
+
+// validateLogoutToken applies the OIDC Back-Channel Logout 1.0 checks
+func validateLogoutToken(tokenString string) (*KeycloakClaims, error) {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512"}),
+		jwt.WithoutClaimsValidation(),
+	)
+	claims := &KeycloakClaims{}
+	if _, err := parser.ParseWithClaims(tokenString, claims, logoutKeyfunc); err != nil {
+		return nil, fmt.Errorf("invalid logout token: %v", err)
+	}
+
+	if realms == nil {
+		if iss := oidcEndpoints().Issuer; iss != "" && strings.TrimSuffix(claims.Issuer, "/") != iss {
+			return nil, fmt.Errorf("logout token issuer not allowed")
+		}
+	}
+	if len(allowedIssuers) > 0 && !containsString(allowedIssuers, strings.TrimSuffix(claims.Issuer, "/")) {
+		return nil, fmt.Errorf("logout token issuer not allowed")
+	}
+	if clientID := cfg.Keycloak.ClientID; clientID != "" && !audienceAllowed(claims, []string{clientID}) {
+		return nil, fmt.Errorf("logout token audience not allowed")
+	}
+	if claims.IssuedAt == nil {
+		return nil, fmt.Errorf("logout token has no iat")
+	}
+	now := time.Now()
+	maxAge := cfg.Auth.LogoutTokenMaxAge
+	if claims.IssuedAt.After(now.Add(clockSkew)) || claims.IssuedAt.Before(now.Add(-maxAge-clockSkew)) {
+		return nil, fmt.Errorf("logout token iat outside the accepted window")
+	}
+	if claims.ExpiresAt != nil && now.After(claims.ExpiresAt.Add(clockSkew)) {
+		return nil, fmt.Errorf("logout token is expired")
+	}
+	if claims.ID == "" {
+		return nil, fmt.Errorf("logout token has no jti")
+	}
+	if claims.SessionID == "" && claims.Subject == "" {
+		return nil, fmt.Errorf("logout token has neither sid nor sub")
+	}
+	if _, ok := claims.Raw["nonce"]; ok {
+		return nil, fmt.Errorf("logout token must not contain a nonce")
+	}
+	events, _ := claims.Raw["events"].(map[string]interface{})
+	if _, ok := events[backchannelLogoutEvent]; !ok {
+		return nil, fmt.Errorf("logout token lacks the back-channel logout event")
+	}
+	switch logoutSeen.add(claims.Issuer+":"+claims.ID, struct{}{}, claims.IssuedAt.Add(maxAge+clockSkew)) {
+	case errCacheHit:
+		return nil, fmt.Errorf("logout token replayed")
+	case errCacheFull:
+		return nil, apperror.Unavailable("Too many recent logout tokens, retry later")
+	}
+	return claims, nil
+}
+
+// Endpoint Keycloak calls (as the client's "Backchannel logout URL") when a
+// session ends
+func registerLogoutRoutes(app *fiber.App) {
+	app.Post("/auth/backchannel-logout", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		claims, err := validateLogoutToken(c.FormValue("logout_token"))
+		var appErr *apperror.Error
+		if errors.As(err, &appErr) {
+			return appErr
+		}
+		if err != nil {
+			requestLogger(c.UserContext()).Warn().Err(err).Msg("Backchannel logout rejected")
+			return errorJSON(c, fiber.StatusBadRequest, fiber.Map{"error": "invalid_request", "error_description": err.Error()})
+		}
+		for _, h := range logoutHandlers {
+			h(claims.SessionID, claims.Subject)
+		}
+		requestLogger(c.UserContext()).Info().Str("sid", claims.SessionID).Str("sub", claims.Subject).Msg("Backchannel logout")
+		return c.SendStatus(fiber.StatusOK)
+	})
+}
+
+func init() {
+	// Drop the session's cached claims: introspection results would keep
+	// its tokens active until they expire. Those of claimsCache go too,
+	// though a signed token still validates until exp; checkTokenState,
+	// which rejects ended sessions, runs on cached claims as on fresh ones.
+	onBackchannelLogout(func(sid, sub string) {
+		ended := func(claims *KeycloakClaims) bool {
+			if sid != "" {
+				return claims.SessionID == sid
+			}
+			return claims.Subject == sub
+		}
+		if tokenIntrospector != nil {
+			tokenIntrospector.cache.deleteWhere(ended)
+		}
+		if claimsCache != nil {
+			claimsCache.deleteWhere(ended)
+		}
+	})
+}
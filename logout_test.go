@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackchannelLogoutChecksFreshnessAndReplay(t *testing.T) {
+	app := newTestApp()
+	registerLogoutRoutes(app)
+	post := func(token string) int {
+		form := url.Values{"logout_token": {token}}
+		req := httptest.NewRequest(http.MethodPost, "/auth/backchannel-logout", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	logoutToken := func(jti string, iat time.Time) string {
+		claims := map[string]interface{}{
+			"sub":    "tokentest-alice",
+			"sid":    "session-1",
+			"events": map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+			"iat":    iat.Unix(),
+			"exp":    iat.Add(time.Minute).Unix(),
+		}
+		if jti != "" {
+			claims["jti"] = jti
+		}
+		return sign(t, claims)
+	}
+
+	fresh := logoutToken("logout-1", time.Now())
+	if status := post(fresh); status != http.StatusOK {
+		t.Fatalf("fresh logout token: got %d, want 200", status)
+	}
+	for _, tc := range []struct {
+		name, token string
+	}{
+		{"replayed", fresh},
+		{"without jti", logoutToken("", time.Now())},
+		{"issued long ago", logoutToken("logout-2", time.Now().Add(-time.Hour))},
+		{"issued in the future", logoutToken("logout-3", time.Now().Add(time.Hour))},
+	} {
+		if status := post(tc.token); status != http.StatusBadRequest {
+			t.Errorf("logout token %s: got %d, want 400", tc.name, status)
+		}
+	}
+}
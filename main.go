@@ -3,138 +3,313 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
-	"os"
-	"strings"
 	"time"
 
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/config"
+	"github.com/example/fiber-demo/repository"
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v4"
+	"github.com/rs/zerolog/log"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
+	// cfg is loaded first thing in main
+	cfg *config.Config
+
 	mongoClient *mongo.Client
 	mongoDB     *mongo.Database
+	// mongoReplicaSet is set when the deployment has replica set features:
+	// transactions and change streams
+	mongoReplicaSet bool
+	// mongoTransactions is set when compound writes run in transactions
+	mongoTransactions bool
+	// mongoAtlasSearch is set when item search runs on Atlas Search
+	mongoAtlasSearch bool
 )
 
-// --- NEW HELPER FUNCTION ---
-// Manually parse the JWT from the Authorization header without validation
-func parseToken(c *fiber.Ctx) (jwt.MapClaims, error) {
-	authHeader := c.Get("Authorization")
-	if authHeader == "" {
-		return nil, fmt.Errorf("missing Authorization header")
+// mongoClientOptions applies the pool, timeout and concern settings, then
+// the URI, whose options win
+func mongoClientOptions() *options.ClientOptions {
+	opts := options.Client().
+		SetMaxPoolSize(uint64(cfg.Mongo.MaxPoolSize)).
+		SetMinPoolSize(uint64(cfg.Mongo.MinPoolSize)).
+		SetConnectTimeout(cfg.Mongo.ConnectTimeout).
+		SetSocketTimeout(cfg.Mongo.SocketTimeout).
+		SetServerSelectionTimeout(cfg.Mongo.ServerSelectionTimeout)
+	rp, rc, wc := mongoConcerns(cfg.Mongo.Concerns)
+	if rp != nil {
+		opts.SetReadPreference(rp)
 	}
-
-	parts := strings.Split(authHeader, " ")
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		return nil, fmt.Errorf("invalid Authorization header format")
+	if rc != nil {
+		opts.SetReadConcern(rc)
 	}
-	tokenString := parts[1]
-
-	// Parse the token without verifying the signature. We trust KrakenD for that.
-	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse token: %v", err)
+	if wc != nil {
+		opts.SetWriteConcern(wc)
 	}
+	return opts.ApplyURI(cfg.Mongo.URI)
+}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return nil, fmt.Errorf("invalid token claims")
-	}
-	return claims, nil
+// mongoStore tells whether the data lives in MongoDB, STORE=mongo; the
+// subsystems keeping their own collections need it
+func mongoStore() bool {
+	return cfg.Store == "mongo"
 }
 
-// --- MODIFIED HELPER ---
-// extract roles from parsed claims
-func extractRoles(claims jwt.MapClaims) ([]string, error) {
-	// Keycloak now puts roles in a top-level "roles" claim
-	if rolesClaim, ok := claims["roles"].([]interface{}); ok {
-		var out []string
-		for _, r := range rolesClaim {
-			if s, ok2 := r.(string); ok2 {
-				out = append(out, s)
-			}
-		}
-		return out, nil
-	}
-	return nil, fmt.Errorf("no roles in token")
+// postgresStore tells whether the data lives in PostgreSQL, STORE=postgres
+func postgresStore() bool {
+	return cfg.Store == "postgres"
 }
 
-// --- MODIFIED MIDDLEWARE ---
-// Middleware to allow only users with a specific role
-func requireRole(role string) fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		claims, err := parseToken(c)
-		if err != nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
-		}
+// memoryStore tells whether the data lives in memory, STORE=memory
+func memoryStore() bool {
+	return cfg.Store == "memory"
+}
 
-		roles, err := extractRoles(claims)
-		if err != nil {
-			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Cannot extract roles"})
-		}
-		for _, r := range roles {
-			if r == role {
-				// Store claims in context for the next handler to use
-				c.Locals("claims", claims)
-				return c.Next()
-			}
-		}
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": fmt.Sprintf("Missing role: %s", role)})
+// ephemeralStore returns the EphemeralRepository over collection, one of
+// repository.EphemeralCollections
+func ephemeralStore(collection string) repository.EphemeralRepository {
+	switch {
+	case memoryStore():
+		return repository.NewMemoryEphemeral()
+	case postgresStore():
+		return repository.NewPostgresEphemeral(pgPool, collection)
 	}
+	return repository.NewEphemeral(mongoDB, collection)
 }
 
-// Connect to MongoDB
+// Connect to MongoDB, unless the data lives elsewhere
 func initMongo() {
-	mongoURI := os.Getenv("MONGO_URI")
-	if mongoURI == "" {
-		mongoURI = "mongodb://localhost:27017"
+	if memoryStore() {
+		log.Warn().Msg("STORE=memory: data lives in this process and is lost on exit")
+	}
+	if !mongoStore() {
+		return
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	clientOptions := options.Client().ApplyURI(mongoURI)
+	clientOptions := mongoClientOptions().SetMonitor(mongoMonitors())
+	if encryption := csfleOptions(ctx, dataDatabases()); encryption != nil {
+		clientOptions.SetAutoEncryptionOptions(encryption)
+	}
 	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		log.Fatal("Mongo Connect error:", err)
+		log.Fatal().Err(err).Msg("Mongo Connect error")
 	}
 	if err = client.Ping(ctx, nil); err != nil {
-		log.Fatal("Mongo Ping error:", err)
+		log.Fatal().Err(err).Msg("Mongo Ping error")
 	}
 	mongoClient = client
-	dbName := os.Getenv("MONGO_DB")
-	if dbName == "" {
-		dbName = "demo_db"
+	mongoDB = client.Database(cfg.Mongo.Database)
+	log.Info().Str("db", cfg.Mongo.Database).Msg("Connected to MongoDB")
+
+	supported, err := repository.SupportsTransactions(ctx, mongoDB)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Mongo hello error")
+	}
+	mongoReplicaSet = supported
+	switch {
+	case cfg.Mongo.Transactions == "off":
+	case supported:
+		mongoTransactions = true
+		log.Info().Msg("Mongo transactions enabled")
+	case cfg.Mongo.Transactions == "required":
+		log.Fatal().Msg("MONGO_TRANSACTIONS=required but MongoDB is a standalone server; run it as a replica set")
+	default:
+		log.Warn().Msg("MongoDB is a standalone server: compound writes run without transactions")
+	}
+
+	index := cfg.Mongo.SearchIndex
+	switch {
+	case cfg.Mongo.Search == "text":
+	case repository.HasAtlasSearchIndex(ctx, client.Database(dataDatabases()[0]), index):
+		mongoAtlasSearch = true
+		log.Info().Str("index", index).Msg("Item search uses Atlas Search")
+	case cfg.Mongo.Search == "atlas":
+		log.Fatal().Str("index", index).Msg("MONGO_SEARCH=atlas but the items collection has no such Atlas Search index")
+	default:
+		log.Info().Msg("Item search uses the text index")
+	}
+}
+
+// newRepositories returns the repositories of STORE: with TENANTS, those
+// of a registry routing each call to its tenant's
+func newRepositories() *repository.Repositories {
+	if !multiTenant() {
+		return openRepositories("")
+	}
+	registry, err := repository.NewTenantRegistry(tenants, func(tenant string) (*repository.Repositories, error) {
+		return openRepositories(tenant), nil
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Tenant registry error")
+	}
+	return registry.Repositories()
+}
+
+// openRepositories returns the repositories over the data of tenant, ""
+// when a single one is served. The memory store starts with the fixtures,
+// outside production.
+func openRepositories(tenant string) *repository.Repositories {
+	if postgresStore() {
+		return repository.NewPostgres(pgPool)
+	}
+	if memoryStore() {
+		repos := repository.NewMemory()
+		if !productionMode() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			counts, err := seedRepositories(ctx, repos, seedDir())
+			if err != nil {
+				log.Warn().Err(err).Str("tenant", tenant).Msg("Cannot seed the memory store")
+			} else {
+				log.Info().Interface("records", counts).Str("tenant", tenant).Msg("Memory store seeded")
+			}
+		}
+		return repos
+	}
+
+	concerns := mongoRepositoryOptions()
+	db := mongoClient.Database(tenantDatabase(tenant))
+	repos := repository.NewMongo(db, mongoTransactions, concerns)
+	if mongoAtlasSearch {
+		repos.Search = repository.NewAtlasSearch(mongoClient.Database(db.Name(), concerns["search"]), cfg.Mongo.SearchIndex)
+	}
+	if cfg.Mongo.RetryAttempts > 1 {
+		repos = repository.WithRetry(repos, repository.RetryPolicy{
+			Attempts:  cfg.Mongo.RetryAttempts,
+			BaseDelay: cfg.Mongo.RetryBaseDelay,
+			MaxDelay:  cfg.Mongo.RetryMaxDelay,
+		})
 	}
-	mongoDB = client.Database(dbName)
-	log.Println("Connected to MongoDB:", mongoURI)
+	return repos
 }
 
-func main() {
+// runServe implements `serve [flags]`: it sets up every subsystem and serves
+// until a shutdown signal
+func runServe(args []string) int {
+	loadConfig(args)
+	initMetrics()
+	initTracing()
+	initVault()
+	initTenancy()
 	initMongo()
+	initPostgres()
+	initMigrations()
+	initAuth()
+	initTLS()
+	initGateway()
+	initCertBinding()
+	initHTTP2()
+	initPolicies()
+	initCasbin()
+	initOPA()
+	initUMA()
+	initAdminUsers()
+	initUserSync()
+	initRegistration()
+	initKeycloakAuthz()
+	initRevocation()
+	initSessions()
+	initFlags()
+	initOrganizations()
+	initProjection()
+	initAudit()
+	initEvents()
+	initItems()
+	initItemACL()
+	initProvisioning()
+	initFiles()
+	initCORS()
+	initSecurityHeaders()
+	initRateLimit()
+	initAccessLog()
+	initReload()
 
-	app := fiber.New()
+	repos := newRepositories()
+	if itemACL {
+		repos = repository.WithACL(repos)
+	}
+	if s3Files != nil {
+		repos.Files = s3Files
+	}
 
-	// Public route (no auth)
-	app.Get("/public", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{"message": "This is a public endpoint."})
+	app := fiber.New(fiber.Config{
+		ErrorHandler: apperror.Handler,
+		BodyLimit:    bodyLimit(),
+		// Behind KrakenD, c.IP() is the client's, as rate limits key on it,
+		// provided the request came from a trusted proxy
+		ProxyHeader:             cfg.Server.ProxyHeader,
+		EnableTrustedProxyCheck: len(cfg.Server.TrustedProxies) > 0,
+		TrustedProxies:          cfg.Server.TrustedProxies,
+		EnableIPValidation:      true,
 	})
+	app.Use(requestIDMiddleware(), tracingMiddleware())
+	if cfg.Server.RequestTimeout > 0 {
+		app.Use(requestTimeoutMiddleware(cfg.Server.RequestTimeout))
+	}
+	if accessLogEnabled {
+		app.Use(accessLogMiddleware())
+	}
+	if metricsRegistry != nil {
+		app.Use(metricsMiddleware())
+		registerMetricsRoutes(app)
+	}
+	registerPprofRoutes(app)
+	registerHealthRoutes(app)
 
-	// Protected route: any authenticated user
-	app.Get("/profile", func(c *fiber.Ctx) error {
-		claims, err := parseToken(c)
-		if err != nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+	if securityHeadersEnabled {
+		app.Use(securityHeadersMiddleware())
+	}
+	// CORS, rate limits and policies can be switched on by a reload, so
+	// their middleware is always installed and passes through while unset
+	app.Use(corsMiddleware())
+	app.Use(rateLimitMiddleware())
+	if auditEnabled {
+		app.Use(auditMiddleware(repos.Audit))
+	}
+	if provisioning {
+		app.Use(provisionMiddleware(repos.Users))
+	}
+	if apiKeys != nil {
+		app.Use(apiKeyQuotaMiddleware())
+		registerAPIKeyRoutes(app)
+	}
+	app.Use(policyMiddleware())
+	if casbinEnforcer != nil {
+		app.Use(casbinMiddleware())
+		registerCasbinRoutes(app)
+	}
+	if opaClient != nil {
+		app.Use(opaMiddleware())
+	}
+	if requireVerifiedEmailGlobally {
+		app.Use(verifiedEmailMiddleware())
+	}
+	if restrictedFields != nil {
+		app.Use(projectionMiddleware())
+	}
+
+	// Public route (token optional, personalized when present)
+	app.Get("/public", optionalAuth(), func(c *fiber.Ctx) error {
+		resp := fiber.Map{"message": "This is a public endpoint."}
+		if claims := claimsFromCtx(c); claims != nil {
+			resp["greeting"] = fmt.Sprintf("Welcome back, %v", claims.Username())
 		}
-		username, _ := claims["preferred_username"].(string)
+		return c.JSON(resp)
+	})
 
+	// Protected route: any authenticated user
+	app.Get("/profile", authenticate(), func(c *fiber.Ctx) error {
+		user := userFromCtx(c)
 		return c.JSON(fiber.Map{
-			"message":  fmt.Sprintf("Hello, %v", username),
-			"roles":    claims["roles"],
-			"subject":  claims["sub"],
-			"issuedAt": claims["iat"],
+			"message":    fmt.Sprintf("Hello, %v", user.Username),
+			"roles":      user.Roles,
+			"subject":    user.Subject,
+			"issuedAt":   user.Claims.IssuedAt,
+			"callerType": user.Claims.CallerType(),
 		})
 	})
 
@@ -145,16 +320,71 @@ func main() {
 
 	// Protected route: only users with realm role "admin"
 	app.Get("/admin", requireRole("admin"), func(c *fiber.Ctx) error {
-		count, err := mongoDB.Collection("items").CountDocuments(context.Background(), struct{}{})
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Database error"})
+		return c.JSON(fiber.Map{"message": "Hello, admin-level endpoint!"})
+	})
+
+	// Before the item routes, where /items/:id would take /items/search
+	registerSearchRoutes(app, repos.Search)
+	registerItemRoutes(app, repos)
+	if itemACL {
+		registerPermissionRoutes(app, repos)
+	}
+	registerTrashRoutes(app, repos)
+	registerAuditRoutes(app, repos.Audit)
+	registerStatsRoutes(app, repos.Stats)
+	registerEventRoutes(app, repos.Events)
+	registerWebSocketRoutes(app)
+	registerFileRoutes(app, repos.Files)
+
+	if revocations != nil {
+		registerRevocationRoutes(app)
+	}
+	registerLogoutRoutes(app)
+	if sessions != nil {
+		registerSessionRoutes(app)
+	}
+	registerFlagRoutes(app)
+	if adminUsers {
+		registerAdminUserRoutes(app, repos.Users)
+		registerRoleRoutes(app, repos.Audit)
+		registerGroupRoutes(app, repos.Audit)
+	}
+	if userSync != nil {
+		registerUserSyncRoutes(app)
+	}
+	if registration {
+		registerRegistrationRoutes(app, repos.Users)
+	}
+	if provisioning {
+		registerMeRoutes(app, repos.Users)
+	}
+	if organizations != nil {
+		registerOrgRoutes(app)
+	}
+	registerSeedRoutes(app, repos)
+
+	// Rejected requests by route, status and reason
+	app.Get("/admin/auth-failures", requireRole("admin"), func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"failures": authFailureCounts()})
+	})
+
+	// JWKS cache counters, only meaningful with VERIFY_JWT=true
+	app.Get("/admin/jwks", requireRole("admin"), func(c *fiber.Ctx) error {
+		if !verifyJWT {
+			return apperror.NotFound("JWT verification is disabled")
 		}
-		return c.JSON(fiber.Map{
-			"message":     "Hello, admin-level endpoint!",
-			"itemCountDB": count,
-		})
+		if realms != nil {
+			stats := fiber.Map{}
+			for iss, r := range realms {
+				stats[iss] = r.keySet.stats()
+			}
+			return c.JSON(stats)
+		}
+		return c.JSON(jwtKeySet.stats())
 	})
 
-	log.Println("Starting server on port 3000")
-	log.Fatal(app.Listen(":3000"))
+	serveInternal()
+	log.Info().Str("addr", cfg.Server.Addr).Msg("Starting server")
+	serve(app, cfg.Server.Addr)
+	return 0
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/tokentest"
+	"github.com/gofiber/fiber/v2"
+)
+
+// issuer signs the tokens of the tests, which the service verifies as it
+// would Keycloak's
+var issuer *tokentest.Issuer
+
+// TestMain configures the service to verify tokens of issuer, with
+// in-memory stores
+func TestMain(m *testing.M) {
+	var err error
+	if issuer, err = tokentest.NewIssuer(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("STORE", "memory")
+	os.Setenv("VERIFY_JWT", "true")
+	os.Setenv("KEYCLOAK_ISSUER", issuer.URL())
+	os.Setenv("LOG_LEVEL", "error")
+	loadConfig(nil)
+	initAuth()
+	code := m.Run()
+	issuer.Close()
+	os.Exit(code)
+}
+
+// newTestApp returns an app answering errors as the service does
+func newTestApp() *fiber.App {
+	return fiber.New(fiber.Config{ErrorHandler: apperror.Handler})
+}
+
+// call sends a request with token as bearer, when set, and headers as
+// name, value pairs
+func call(t *testing.T, app *fiber.App, method, path, token string, headers ...string) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// callJSON sends body as JSON with token as bearer, and decodes the reply
+// into out when set
+func callJSON(t *testing.T, app *fiber.App, method, path, token, body string, out interface{}) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp
+}
+
+// token returns a token of issuer for username with realm roles
+func token(t *testing.T, username string, roles ...string) string {
+	t.Helper()
+	tok, err := issuer.Token(username, roles...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+// sign returns a token of issuer with claims
+func sign(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	token, err := issuer.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
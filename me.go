@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Bounds of the profile fields users edit via /me
+const (
+	maxAvatarURL       = 2048
+	maxBio             = 1000
+	maxPreferenceBytes = 8 << 10
+)
+
+var (
+	// provisioning is set when USER_PROVISIONING=true
+	provisioning bool
+	// provisionInterval spaces out the profile upserts of a user; within
+	// it, requests don't touch the users collection
+	provisionInterval = 5 * time.Minute
+	// provisioned remembers the users upserted within provisionInterval,
+	// by tenant and sub
+	provisioned = newTTLCache[bool](10000)
+)
+
+// provisionedCaller tells whether user gets a profile: people, not
+// service accounts or API keys
+func provisionedCaller(user *User) bool {
+	return !user.Claims.IsServiceAccount() && !user.Claims.IsAPIKey()
+}
+
+// provisionUser upserts the profile of the request's user from the token,
+// at most once per provisionInterval
+func provisionUser(c *fiber.Ctx, users repository.UserRepository) error {
+	user := userFromCtx(c)
+	if user == nil || !provisionedCaller(user) {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(c.UserContext(), 5*time.Second)
+	defer cancel()
+	key := repository.TenantOf(ctx) + "/" + user.Subject
+	if _, ok := provisioned.get(key); ok {
+		return nil
+	}
+	name, _ := user.Claims.Raw["name"].(string)
+	username := user.Username
+	if username == "" {
+		username = user.Subject
+	}
+	profile := &repository.UserProfile{
+		ID:          user.Subject,
+		Username:    username,
+		Email:       user.Claims.Email,
+		DisplayName: name,
+		Roles:       append([]string{}, user.Roles...),
+		LastSeenAt:  time.Now().UTC(),
+	}
+	if err := users.Provision(ctx, profile); err != nil {
+		return err
+	}
+	provisioned.set(key, true, time.Now().Add(provisionInterval))
+	return nil
+}
+
+// Middleware provisioning the profile of callers the route authenticated.
+// A failure is logged, not answered: the request itself went through.
+func provisionMiddleware(users repository.UserRepository) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		err := c.Next()
+		if perr := provisionUser(c, users); perr != nil {
+			requestLogger(c.UserContext()).Warn().Err(perr).Msg("Cannot provision the user profile")
+		}
+		return err
+	}
+}
+
+// meBody is the body of PATCH /me; absent fields are kept
+type meBody struct {
+	AvatarURL   *string                `json:"avatarUrl"`
+	Bio         *string                `json:"bio"`
+	Preferences map[string]interface{} `json:"preferences"`
+}
+
+func (b *meBody) validate() error {
+	details := fiber.Map{}
+	if b.AvatarURL != nil && *b.AvatarURL != "" {
+		u, err := url.Parse(*b.AvatarURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" || len(*b.AvatarURL) > maxAvatarURL {
+			details["avatarUrl"] = "an https URL of up to 2048 characters"
+		}
+	}
+	if b.Bio != nil && len([]rune(*b.Bio)) > maxBio {
+		details["bio"] = "up to 1000 characters"
+	}
+	if len(details) > 0 {
+		return apperror.Validation("Invalid body", details)
+	}
+	if b.Preferences != nil {
+		return validatePreferences(b.Preferences)
+	}
+	return nil
+}
+
+// profileError maps repository errors of the caller's profile
+func profileError(err error) error {
+	if errors.Is(err, repository.ErrNotFound) {
+		return apperror.NotFound("No profile for this user")
+	}
+	return apperror.Internal("Database error", err)
+}
+
+// myProfile returns the caller's profile, provisioning it first so the
+// first request finds it
+func myProfile(c *fiber.Ctx, users repository.UserRepository) (*repository.UserProfile, error) {
+	if !provisionedCaller(userFromCtx(c)) {
+		return nil, apperror.NotFound("Service accounts and API keys have no profile")
+	}
+	if err := provisionUser(c, users); err != nil {
+		return nil, apperror.Internal("Database error", err)
+	}
+	profile, err := users.Get(c.UserContext(), userFromCtx(c).Subject)
+	if err != nil {
+		return nil, profileError(err)
+	}
+	return profile, nil
+}
+
+// registerMeRoutes mounts /me, the caller's profile: the fields Keycloak
+// owns come from the token, the others are the user's to edit
+func registerMeRoutes(app *fiber.App, users repository.UserRepository) {
+	auth := authenticate()
+
+	app.Get("/me", auth, func(c *fiber.Ctx) error {
+		profile, err := myProfile(c, users)
+		if err != nil {
+			return err
+		}
+		return c.JSON(profile)
+	})
+
+	app.Patch("/me", auth, func(c *fiber.Ctx) error {
+		var body meBody
+		if err := decodeStrict(c.Body(), &body); err != nil {
+			return err
+		}
+		if err := body.validate(); err != nil {
+			return err
+		}
+		profile, err := myProfile(c, users)
+		if err != nil {
+			return err
+		}
+		if body.Preferences != nil {
+			// Conditional on the version read, like PUT /me/preferences, and
+			// moving its ETag on
+			version, err := users.SetPreferences(c.UserContext(), profile.ID, body.Preferences, profile.PreferencesVersion)
+			if err != nil {
+				return preferencesError(err)
+			}
+			profile.Preferences, profile.PreferencesVersion = body.Preferences, version
+		}
+		if body.AvatarURL != nil {
+			profile.AvatarURL = *body.AvatarURL
+		}
+		if body.Bio != nil {
+			profile.Bio = *body.Bio
+		}
+		profile.UpdatedAt = time.Now().UTC()
+		if err := users.Save(c.UserContext(), profile); err != nil {
+			return profileError(err)
+		}
+		return c.JSON(profile)
+	})
+
+	// Clears the fields the user edits, keeping those from the token
+	app.Delete("/me", auth, func(c *fiber.Ctx) error {
+		profile, err := myProfile(c, users)
+		if err != nil {
+			return err
+		}
+		if profile.Preferences != nil {
+			version, err := users.SetPreferences(c.UserContext(), profile.ID, nil, profile.PreferencesVersion)
+			if err != nil {
+				return preferencesError(err)
+			}
+			profile.Preferences, profile.PreferencesVersion = nil, version
+		}
+		profile.AvatarURL, profile.Bio = "", ""
+		profile.UpdatedAt = time.Now().UTC()
+		if err := users.Save(c.UserContext(), profile); err != nil {
+			return profileError(err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	registerPreferenceRoutes(app, users)
+}
+
+// Load USER_PROVISIONING and PROVISION_INTERVAL
+func initProvisioning() {
+	provisioning = cfg.Users.Provisioning
+	provisionInterval = cfg.Users.ProvisionInterval
+	if provisioning {
+		log.Info().Dur("interval", provisionInterval).Msg("User profiles are provisioned from tokens")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/example/fiber-demo/repository"
+)
+
+func TestMeProvisionsAndEditsTheProfile(t *testing.T) {
+	app := newTestApp()
+	users := repository.NewMemory().Users
+	registerMeRoutes(app, users)
+	alice := sign(t, map[string]interface{}{"sub": "alice", "preferred_username": "alice", "email": "alice@example.com", "name": "Alice Doe"})
+
+	var profile repository.UserProfile
+	if resp := callJSON(t, app, http.MethodGet, "/me", alice, "", &profile); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /me: got %d, want 200", resp.StatusCode)
+	}
+	if profile.ID != "alice" || profile.Email != "alice@example.com" || profile.DisplayName != "Alice Doe" {
+		t.Errorf("GET /me: got %+v, want the profile of the token", profile)
+	}
+
+	if resp := callJSON(t, app, http.MethodPatch, "/me", alice, `{"avatarUrl": "http://example.com/a.png"}`, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("PATCH /me with an http avatar: got %d, want 400", resp.StatusCode)
+	}
+	if resp := callJSON(t, app, http.MethodPatch, "/me", alice, `{"email": "mallory@example.com"}`, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("PATCH /me of a token field: got %d, want 400", resp.StatusCode)
+	}
+	if resp := callJSON(t, app, http.MethodPatch, "/me", alice, `{"bio": "Hi"}`, &profile); resp.StatusCode != http.StatusOK || profile.Bio != "Hi" {
+		t.Errorf("PATCH /me: got %d %+v, want 200 with the bio", resp.StatusCode, profile)
+	}
+	if stored, err := users.Get(context.Background(), "alice"); err != nil || stored.Bio != "Hi" {
+		t.Errorf("PATCH /me stored %+v, %v", stored, err)
+	}
+
+	if resp := callJSON(t, app, http.MethodDelete, "/me", alice, "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE /me: got %d, want 204", resp.StatusCode)
+	}
+	var cleared repository.UserProfile
+	if resp := callJSON(t, app, http.MethodGet, "/me", alice, "", &cleared); resp.StatusCode != http.StatusOK || cleared.Bio != "" || cleared.Email != "alice@example.com" {
+		t.Errorf("GET /me after DELETE: got %d %+v, want the token fields only", resp.StatusCode, cleared)
+	}
+}
+
+func TestMeHasNoProfileForServiceAccounts(t *testing.T) {
+	app := newTestApp()
+	registerMeRoutes(app, repository.NewMemory().Users)
+	robot := sign(t, map[string]interface{}{"sub": "robot", "client_id": "billing"})
+	if resp := call(t, app, http.MethodGet, "/me", robot); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /me as a service account: got %d, want 404", resp.StatusCode)
+	}
+}
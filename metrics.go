@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// metricsRegistry holds the app's metrics plus the Go runtime and process
+// collectors; nil when METRICS=false
+var metricsRegistry *prometheus.Registry
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route pattern and status.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route pattern.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	mongoDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongo_command_duration_seconds",
+		Help:    "MongoDB command latency by command and outcome.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"command", "outcome"})
+
+	authFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_failures_total",
+		Help: "Rejected requests by route pattern, status and reason.",
+	}, []string{"route", "status", "reason"})
+)
+
+// Middleware counting and timing requests by route pattern, which keeps
+// label cardinality bounded unlike raw paths
+func metricsMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+		if err != nil {
+			// Render the error now so the counted status is the one sent
+			if herr := c.App().ErrorHandler(c, err); herr != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+		route := c.Route().Path
+		httpRequests.WithLabelValues(c.Method(), route, strconv.Itoa(c.Response().StatusCode())).Inc()
+		httpDuration.WithLabelValues(c.Method(), route).Observe(time.Since(start).Seconds())
+		return nil
+	}
+}
+
+// mongoMonitor times driver commands for mongo_command_duration_seconds
+func mongoMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			mongoDuration.WithLabelValues(e.CommandName, "success").Observe(e.Duration.Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			mongoDuration.WithLabelValues(e.CommandName, "failure").Observe(e.Duration.Seconds())
+		},
+	}
+}
+
+// jwksCollector exports the JWKS cache counters of every key set at scrape
+// time, labelled by JWKS URL
+type jwksCollector struct{}
+
+var (
+	jwksKeysDesc    = prometheus.NewDesc("jwks_keys", "Keys in the JWKS cache.", []string{"jwks"}, nil)
+	jwksHitsDesc    = prometheus.NewDesc("jwks_cache_hits_total", "Key lookups served from the JWKS cache.", []string{"jwks"}, nil)
+	jwksMissesDesc  = prometheus.NewDesc("jwks_cache_misses_total", "Key lookups for unknown kids.", []string{"jwks"}, nil)
+	jwksRefreshDesc = prometheus.NewDesc("jwks_refreshes_total", "JWKS fetches.", []string{"jwks"}, nil)
+	jwksErrorsDesc  = prometheus.NewDesc("jwks_refresh_errors_total", "Failed JWKS fetches.", []string{"jwks"}, nil)
+)
+
+func (jwksCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- jwksKeysDesc
+	ch <- jwksHitsDesc
+	ch <- jwksMissesDesc
+	ch <- jwksRefreshDesc
+	ch <- jwksErrorsDesc
+}
+
+func (jwksCollector) Collect(ch chan<- prometheus.Metric) {
+	sets := []*jwksKeySet{jwtKeySet}
+	for _, r := range realms {
+		sets = append(sets, r.keySet)
+	}
+	for _, s := range sets {
+		if s == nil {
+			continue
+		}
+		st := s.stats()
+		ch <- prometheus.MustNewConstMetric(jwksKeysDesc, prometheus.GaugeValue, float64(st.Keys), s.url)
+		ch <- prometheus.MustNewConstMetric(jwksHitsDesc, prometheus.CounterValue, float64(st.Hits), s.url)
+		ch <- prometheus.MustNewConstMetric(jwksMissesDesc, prometheus.CounterValue, float64(st.Misses), s.url)
+		ch <- prometheus.MustNewConstMetric(jwksRefreshDesc, prometheus.CounterValue, float64(st.Refreshes), s.url)
+		ch <- prometheus.MustNewConstMetric(jwksErrorsDesc, prometheus.CounterValue, float64(st.RefreshErrors), s.url)
+	}
+}
+
+// metricsHandler serves the registry in the Prometheus text format
+func metricsHandler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+}
+
+// internalApp serves operational endpoints (/metrics, /debug/pprof) on
+// METRICS_ADDR, a port that is only reachable inside the deployment; nil
+// when they share the API port
+var internalApp *fiber.App
+
+// registerMetricsRoutes mounts /metrics on internalApp, or on app so
+// scrapes bypass the auth middleware registered after it
+func registerMetricsRoutes(app *fiber.App) {
+	if internalApp != nil {
+		app = internalApp
+	}
+	app.Get("/metrics", metricsHandler())
+}
+
+// serveInternal starts the METRICS_ADDR listener once its routes are mounted
+func serveInternal() {
+	if internalApp == nil {
+		return
+	}
+	addr := cfg.Metrics.Addr
+	go func() {
+		log.Info().Str("addr", addr).Msg("Serving internal endpoints")
+		if err := internalApp.Listen(addr); err != nil {
+			log.Fatal().Err(err).Msg("Internal server error")
+		}
+	}()
+}
+
+// Set up the registry unless METRICS=false, and the METRICS_ADDR listener
+func initMetrics() {
+	if cfg.Metrics.Addr != "" {
+		internalApp = fiber.New(fiber.Config{DisableStartupMessage: true})
+	}
+	if !cfg.Metrics.Enabled {
+		return
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpDuration, mongoDuration, authFailuresTotal,
+		jwksCollector{},
+	)
+	metricsRegistry = reg
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/example/fiber-demo/repository"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// migration is one versioned schema change. down undoes up; nil marks the
+// migration irreversible. Both must be safe to run again after a partial
+// failure.
+type migration struct {
+	version int
+	name    string
+	up      func(ctx context.Context, db *mongo.Database) error
+	down    func(ctx context.Context, db *mongo.Database) error
+}
+
+// migrations in version order; append new ones, never renumber
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "items indexes",
+		up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("items").Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetName("name_unique").SetUnique(true)},
+				{Keys: bson.D{{Key: "ownerId", Value: 1}}, Options: options.Index().SetName("ownerId")},
+			})
+			return err
+		},
+		down: func(ctx context.Context, db *mongo.Database) error {
+			return dropIndexes(ctx, db.Collection("items"), "name_unique", "ownerId")
+		},
+	},
+	{
+		version: 2,
+		name:    "items createdAt backfill",
+		// Documents written before createdAt existed get the time encoded in
+		// their ObjectID
+		up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("items").UpdateMany(ctx,
+				bson.M{"createdAt": bson.M{"$exists": false}, "_id": bson.M{"$type": "objectId"}},
+				mongo.Pipeline{{{Key: "$set", Value: bson.M{"createdAt": bson.M{"$toDate": "$_id"}}}}})
+			return err
+		},
+	},
+	{
+		version: 3,
+		name:    "soft delete indexes",
+		// Only deleted documents are indexed, for the trash listings
+		up: func(ctx context.Context, db *mongo.Database) error {
+			for _, coll := range []string{"items", "users"} {
+				_, err := db.Collection(coll).Indexes().CreateOne(ctx, mongo.IndexModel{
+					Keys: bson.D{{Key: "deletedAt", Value: 1}},
+					Options: options.Index().SetName("deletedAt").
+						SetPartialFilterExpression(bson.M{"deletedAt": bson.M{"$exists": true}}),
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		down: func(ctx context.Context, db *mongo.Database) error {
+			for _, coll := range []string{"items", "users"} {
+				if err := dropIndexes(ctx, db.Collection(coll), "deletedAt"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 4,
+		name:    "items version",
+		// Items written before versioning start at 1, like new ones
+		up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("items").UpdateMany(ctx,
+				bson.M{"version": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"version": int64(1)}})
+			return err
+		},
+	},
+	{
+		version: 5,
+		name:    "audit log indexes",
+		// Entries carry their own expiry, so AUDIT_RETENTION can change
+		// without rebuilding the TTL index
+		up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("audit_logs").Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetName("expiresAt_ttl").SetExpireAfterSeconds(0)},
+				{Keys: bson.D{{Key: "at", Value: -1}}, Options: options.Index().SetName("at")},
+				{Keys: bson.D{{Key: "actor.sub", Value: 1}, {Key: "at", Value: -1}}, Options: options.Index().SetName("actor_at")},
+				{Keys: bson.D{{Key: "resourceId", Value: 1}, {Key: "at", Value: -1}}, Options: options.Index().SetName("resource_at")},
+			})
+			return err
+		},
+		down: func(ctx context.Context, db *mongo.Database) error {
+			return dropIndexes(ctx, db.Collection("audit_logs"), "expiresAt_ttl", "at", "actor_at", "resource_at")
+		},
+	},
+	{
+		version: 6,
+		name:    "items text index",
+		// Item search without Atlas Search; names weigh most
+		up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("items").Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "name", Value: "text"}, {Key: "description", Value: "text"}, {Key: "tags", Value: "text"}},
+				Options: options.Index().SetName("items_text").SetWeights(bson.M{"name": 10, "tags": 5, "description": 1}),
+			})
+			return err
+		},
+		down: func(ctx context.Context, db *mongo.Database) error {
+			return dropIndexes(ctx, db.Collection("items"), "items_text")
+		},
+	},
+	{
+		version: 7,
+		name:    "items location index",
+		// 2dsphere indexes skip documents without the field
+		up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection("items").Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "location", Value: "2dsphere"}},
+				Options: options.Index().SetName("location_2dsphere"),
+			})
+			return err
+		},
+		down: func(ctx context.Context, db *mongo.Database) error {
+			return dropIndexes(ctx, db.Collection("items"), "location_2dsphere")
+		},
+	},
+	{
+		version: 8,
+		name:    "ephemeral collections TTL",
+		// Records expire at their expiresAt. The index keeps the default
+		// name, the one stores created at startup before this migration.
+		up: func(ctx context.Context, db *mongo.Database) error {
+			for _, coll := range repository.EphemeralCollections {
+				_, err := db.Collection(coll).Indexes().CreateOne(ctx, mongo.IndexModel{
+					Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+					Options: options.Index().SetExpireAfterSeconds(0),
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		down: func(ctx context.Context, db *mongo.Database) error {
+			for _, coll := range repository.EphemeralCollections {
+				if err := dropIndexes(ctx, db.Collection(coll), "expiresAt_1"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 9,
+		name:    "collection schema validators",
+		// Moderate validation: documents already invalid can still be
+		// updated, valid ones must stay valid
+		up: applySchemas,
+		down: func(ctx context.Context, db *mongo.Database) error {
+			for _, s := range repository.CollectionSchemas {
+				if err := setValidator(ctx, db, s.Collection, bson.M{}, "off"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 10,
+		name:    "schema validators for CSFLE",
+		// users.email may hold binData, its encrypted form. Changes to
+		// repository.CollectionSchemas need a migration like this one.
+		up: applySchemas,
+	},
+	{
+		version: 11,
+		name:    "items ACL",
+		// The validator checks the grants; multikey indexes serve the
+		// readers' filter
+		up: func(ctx context.Context, db *mongo.Database) error {
+			if err := applySchemas(ctx, db); err != nil {
+				return err
+			}
+			_, err := db.Collection("items").Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "acl.sub", Value: 1}}, Options: options.Index().SetName("acl_sub")},
+				{Keys: bson.D{{Key: "acl.group", Value: 1}}, Options: options.Index().SetName("acl_group")},
+			})
+			return err
+		},
+		down: func(ctx context.Context, db *mongo.Database) error {
+			return dropIndexes(ctx, db.Collection("items"), "acl_sub", "acl_group")
+		},
+	},
+	{
+		version: 12,
+		name:    "schema validators for user profiles",
+		// The fields of provisioned profiles and /me
+		up: applySchemas,
+	},
+	{
+		version: 13,
+		name:    "schema validators for preference versions",
+		up:      applySchemas,
+	},
+}
+
+// applySchemas sets the validators of repository.CollectionSchemas
+func applySchemas(ctx context.Context, db *mongo.Database) error {
+	for _, s := range repository.CollectionSchemas {
+		if err := setValidator(ctx, db, s.Collection, bson.M{"$jsonSchema": s.Schema}, "moderate"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appliedMigration is a document of the migrations collection
+type appliedMigration struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+// setValidator replaces the validator of coll, creating the collection
+// when it doesn't exist yet
+func setValidator(ctx context.Context, db *mongo.Database, coll string, validator bson.M, level string) error {
+	err := db.RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: coll},
+		{Key: "validator", Value: validator},
+		{Key: "validationLevel", Value: level},
+		{Key: "validationAction", Value: "error"},
+	}).Err()
+	var cmdErr mongo.CommandError
+	// NamespaceNotFound
+	if errors.As(err, &cmdErr) && cmdErr.Code == 26 {
+		if level == "off" {
+			return nil
+		}
+		opts := options.CreateCollection().SetValidator(validator).SetValidationLevel(level).SetValidationAction("error")
+		return db.CreateCollection(ctx, coll, opts)
+	}
+	return err
+}
+
+func dropIndexes(ctx context.Context, coll *mongo.Collection, names ...string) error {
+	for _, name := range names {
+		if _, err := coll.Indexes().DropOne(ctx, name); err != nil {
+			var cmdErr mongo.CommandError
+			// IndexNotFound: already dropped
+			if errors.As(err, &cmdErr) && cmdErr.Code == 27 {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// appliedVersions returns the versions recorded in the migrations collection
+func appliedVersions(ctx context.Context, db *mongo.Database) (map[int]appliedMigration, error) {
+	cursor, err := db.Collection("migrations").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var docs []appliedMigration
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	applied := make(map[int]appliedMigration, len(docs))
+	for _, d := range docs {
+		applied[d.Version] = d
+	}
+	return applied, nil
+}
+
+// migrateUp applies up to steps pending migrations in order, all when steps
+// is 0, and returns how many ran. A replica applying the same version
+// concurrently is harmless: the steps are idempotent and only one record
+// is kept.
+func migrateUp(ctx context.Context, db *mongo.Database, steps int) (int, error) {
+	applied, err := appliedVersions(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	ran := 0
+	for _, m := range migrations {
+		if _, done := applied[m.version]; done {
+			continue
+		}
+		if steps > 0 && ran == steps {
+			break
+		}
+		if err := m.up(ctx, db); err != nil {
+			return ran, fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		rec := appliedMigration{Version: m.version, Name: m.name, AppliedAt: time.Now().UTC()}
+		if _, err := db.Collection("migrations").InsertOne(ctx, rec); err != nil && !mongo.IsDuplicateKeyError(err) {
+			return ran, fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		log.Info().Int("version", m.version).Str("name", m.name).Msg("Migration applied")
+		ran++
+	}
+	return ran, nil
+}
+
+// migrateDown reverts the latest steps applied migrations, newest first
+func migrateDown(ctx context.Context, db *mongo.Database, steps int) (int, error) {
+	applied, err := appliedVersions(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	ran := 0
+	for i := len(migrations) - 1; i >= 0 && ran < steps; i-- {
+		m := migrations[i]
+		if _, done := applied[m.version]; !done {
+			continue
+		}
+		if m.down == nil {
+			return ran, fmt.Errorf("migration %d (%s) is irreversible", m.version, m.name)
+		}
+		if err := m.down(ctx, db); err != nil {
+			return ran, fmt.Errorf("reverting migration %d (%s): %w", m.version, m.name, err)
+		}
+		if _, err := db.Collection("migrations").DeleteOne(ctx, bson.M{"_id": m.version}); err != nil {
+			return ran, fmt.Errorf("reverting migration %d (%s): %w", m.version, m.name, err)
+		}
+		log.Info().Int("version", m.version).Str("name", m.name).Msg("Migration reverted")
+		ran++
+	}
+	return ran, nil
+}
+
+// runMigrate implements `migrate [up [N] | down [N] | status] [config
+// flags]`: up applies pending migrations (all, or the next N), down
+// reverts the last N (default 1), status lists them
+func runMigrate(args []string) int {
+	action := "up"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		action, args = args[0], args[1:]
+	}
+	steps := 0
+	if action == "down" {
+		steps = 1
+	}
+	if len(args) > 0 {
+		if n, err := strconv.Atoi(args[0]); err == nil && n > 0 {
+			steps, args = n, args[1:]
+		}
+	}
+	switch action {
+	case "up", "down", "status":
+	default:
+		fmt.Fprintln(os.Stderr, "usage: fiber-demo migrate [up [N] | down [N] | status] [config flags]")
+		return 2
+	}
+
+	loadConfig(args)
+	initTenancy()
+	if memoryStore() {
+		fmt.Fprintln(os.Stderr, "migrate: STORE=memory has no schema to migrate")
+		return 1
+	}
+	if postgresStore() {
+		return runMigratePostgres(action, steps)
+	}
+	initVault()
+	initMongo()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	defer mongoClient.Disconnect(context.Background())
+
+	for _, db := range migrationDatabases() {
+		var err error
+		var ran int
+		switch action {
+		case "up":
+			ran, err = migrateUp(ctx, db, steps)
+		case "down":
+			ran, err = migrateDown(ctx, db, steps)
+		case "status":
+			applied, lerr := appliedVersions(ctx, db)
+			if lerr != nil {
+				err = lerr
+				break
+			}
+			if multiTenant() {
+				fmt.Printf("%s:\n", db.Name())
+			}
+			for _, m := range migrations {
+				state := "pending"
+				if a, ok := applied[m.version]; ok {
+					state = "applied " + a.AppliedAt.Format(time.RFC3339)
+				}
+				fmt.Printf("%4d  %-30s %s\n", m.version, m.name, state)
+			}
+			continue
+		}
+		if err != nil {
+			log.Error().Err(err).Str("db", db.Name()).Int("completed", ran).Msg("Migration failed")
+			return 1
+		}
+		log.Info().Str("db", db.Name()).Int("count", ran).Str("direction", action).Msg("Migrations done")
+	}
+	return 0
+}
+
+// runMigratePostgres runs `migrate up` of STORE=postgres, whose schema
+// only goes up, all the way
+func runMigratePostgres(action string, steps int) int {
+	if action != "up" || steps > 0 {
+		fmt.Fprintln(os.Stderr, "migrate: STORE=postgres only supports migrate up, with no count")
+		return 2
+	}
+	initVault()
+	initPostgres()
+	defer pgPool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	ran, err := repository.MigratePostgres(ctx, pgPool)
+	if err != nil {
+		log.Error().Err(err).Msg("Migration failed")
+		return 1
+	}
+	log.Info().Int("count", ran).Str("direction", action).Msg("Migrations done")
+	return 0
+}
+
+// Apply pending migrations at startup unless MIGRATE_ON_START=false, e.g.
+// when a deploy job runs `migrate up` beforehand
+func initMigrations() {
+	if !cfg.MigrateOnStart || memoryStore() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	if postgresStore() {
+		if _, err := repository.MigratePostgres(ctx, pgPool); err != nil {
+			log.Fatal().Err(err).Msg("Migration error")
+		}
+		return
+	}
+	for _, db := range migrationDatabases() {
+		if _, err := migrateUp(ctx, db, 0); err != nil {
+			log.Fatal().Err(err).Str("db", db.Name()).Msg("Migration error")
+		}
+	}
+}
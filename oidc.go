@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// oidcProviderMetadata is the subset of /.well-known/openid-configuration
+// this service uses
+type oidcProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	JWKSURI               string `json:"jwks_uri"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+}
+
+var (
+	oidcOnce sync.Once
+	oidcMeta oidcProviderMetadata
+)
+
+// oidcEndpoints returns the realm endpoints for KEYCLOAK_ISSUER. They are
+// discovered on first use; when discovery is disabled (OIDC_DISCOVERY=false)
+// or fails, Keycloak's standard paths under the issuer are used. Fields are
+// empty when KEYCLOAK_ISSUER is not set.
+func oidcEndpoints() oidcProviderMetadata {
+	oidcOnce.Do(func() {
+		oidcMeta = loadOIDCEndpoints()
+	})
+	return oidcMeta
+}
+
+func loadOIDCEndpoints() oidcProviderMetadata {
+	issuer := strings.TrimSuffix(cfg.Keycloak.Issuer, "/")
+	if issuer == "" {
+		return oidcProviderMetadata{}
+	}
+	meta := oidcProviderMetadata{
+		Issuer:                issuer,
+		JWKSURI:               issuer + "/protocol/openid-connect/certs",
+		TokenEndpoint:         issuer + "/protocol/openid-connect/token",
+		EndSessionEndpoint:    issuer + "/protocol/openid-connect/logout",
+		IntrospectionEndpoint: issuer + "/protocol/openid-connect/token/introspect",
+	}
+	if !cfg.Keycloak.OIDCDiscovery {
+		return meta
+	}
+
+	// Keycloak may still be starting when we boot, so retry briefly
+	var discovered *oidcProviderMetadata
+	var err error
+	for attempt := 1; attempt <= 5; attempt++ {
+		if discovered, err = discoverOIDC(issuer); err == nil {
+			break
+		}
+		time.Sleep(2 * time.Second)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("OIDC discovery failed, using default Keycloak endpoints")
+		return meta
+	}
+	if strings.TrimSuffix(discovered.Issuer, "/") != issuer {
+		log.Warn().Str("discovered", discovered.Issuer).Str("issuer", issuer).Msg("OIDC discovery: issuer does not match KEYCLOAK_ISSUER")
+	}
+	if discovered.JWKSURI != "" {
+		meta.JWKSURI = discovered.JWKSURI
+	}
+	if discovered.TokenEndpoint != "" {
+		meta.TokenEndpoint = discovered.TokenEndpoint
+	}
+	if discovered.EndSessionEndpoint != "" {
+		meta.EndSessionEndpoint = discovered.EndSessionEndpoint
+	}
+	if discovered.IntrospectionEndpoint != "" {
+		meta.IntrospectionEndpoint = discovered.IntrospectionEndpoint
+	}
+	log.Info().Str("issuer", issuer).Msg("OIDC discovery succeeded")
+	return meta
+}
+
+// discoverOIDC fetches the provider metadata document of issuer
+func discoverOIDC(issuer string) (*oidcProviderMetadata, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC configuration: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch OIDC configuration: unexpected status %d", resp.StatusCode)
+	}
+	var meta oidcProviderMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("failed to decode OIDC configuration: %v", err)
+	}
+	return &meta, nil
+}
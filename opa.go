@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// opaClient is set when OPA_URL points at an OPA decision endpoint, e.g.
+// http://opa:8181/v1/data/httpapi/authz
+var opaClient *opaDecider
+
+// opaDecider asks an OPA sidecar for allow/deny decisions, caching them
+// per (method, path, identity) for a short TTL
+type opaDecider struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+	cache  *ttlCache[bool]
+}
+
+// opaInput is sent as {"input": ...}; policies see input.method, input.path,
+// input.claims and input.roles (claims and roles are absent for anonymous calls)
+type opaInput struct {
+	Method string                 `json:"method"`
+	Path   string                 `json:"path"`
+	Claims map[string]interface{} `json:"claims,omitempty"`
+	Roles  []string               `json:"roles,omitempty"`
+}
+
+func (o *opaDecider) decide(input opaInput) (bool, error) {
+	payload, err := json.Marshal(fiber.Map{"input": input})
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(payload)
+	key := hex.EncodeToString(sum[:])
+	if allowed, ok := o.cache.get(key); ok {
+		return allowed, nil
+	}
+
+	resp, err := o.client.Post(o.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return false, fmt.Errorf("OPA request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("OPA request failed: unexpected status %d", resp.StatusCode)
+	}
+
+	// The rule may evaluate to a bare boolean or to {"allow": bool}; an
+	// undefined result (no "result" key) means deny
+	var out struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return false, fmt.Errorf("OPA response invalid: %v", err)
+	}
+	allowed := false
+	if len(out.Result) > 0 {
+		if err := json.Unmarshal(out.Result, &allowed); err != nil {
+			var obj struct {
+				Allow bool `json:"allow"`
+			}
+			if err := json.Unmarshal(out.Result, &obj); err != nil {
+				return false, fmt.Errorf("OPA result must be a boolean or {\"allow\": bool}")
+			}
+			allowed = obj.Allow
+		}
+	}
+
+	o.cache.set(key, allowed, time.Now().Add(o.ttl))
+	return allowed, nil
+}
+
+// Middleware enforcing the OPA decision for every request. Calls without a
+// token are evaluated anonymously; OPA failures deny the request.
+func opaMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		input := opaInput{Method: c.Method(), Path: c.Path()}
+		if hasCredentials(c) {
+			user, err := currentUser(c)
+			if err != nil {
+				return unauthorized(c, err)
+			}
+			input.Claims = user.Claims.Raw
+			input.Roles = user.Roles
+		}
+
+		allowed, err := opaClient.decide(input)
+		if err != nil {
+			return apperror.Internal("Authorization error", err)
+		}
+		if !allowed {
+			return forbidden(c, "policy_denied", "Forbidden by policy")
+		}
+		return c.Next()
+	}
+}
+
+// Enable OPA authorization when OPA_URL is set
+func initOPA() {
+	url := cfg.Authz.OPAURL
+	if url == "" {
+		return
+	}
+	opaClient = &opaDecider{
+		url:    url,
+		ttl:    cfg.Authz.OPACacheTTL,
+		client: &http.Client{Timeout: 2 * time.Second},
+		cache:  newTTLCache[bool](10000),
+	}
+	log.Info().Str("url", url).Msg("OPA authorization enabled")
+}
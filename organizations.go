@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Organization roles, each granting what the ones after it do
+const (
+	orgOwner  = "owner"
+	orgMember = "member"
+	orgViewer = "viewer"
+)
+
+// orgRoleRank orders the organization roles; higher ranks include lower ones
+var orgRoleRank = map[string]int{orgViewer: 1, orgMember: 2, orgOwner: 3}
+
+// orgInvitationTTL is how long an invitation can be accepted
+const orgInvitationTTL = 7 * 24 * time.Hour
+
+// organizations is set when ORGANIZATIONS=true
+var organizations *orgStore
+
+type organization struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	Name      string             `bson:"name" json:"name"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+	CreatedBy string             `bson:"createdBy" json:"createdBy"`
+}
+
+// orgMembership is a member of an organization, keyed "<org>:<sub>"
+type orgMembership struct {
+	ID        string             `bson:"_id" json:"-"`
+	OrgID     primitive.ObjectID `bson:"orgId" json:"orgId"`
+	Subject   string             `bson:"subject" json:"subject"`
+	Username  string             `bson:"username" json:"username"`
+	Role      string             `bson:"role" json:"role"`
+	InvitedBy string             `bson:"invitedBy,omitempty" json:"invitedBy,omitempty"`
+	JoinedAt  time.Time          `bson:"joinedAt" json:"joinedAt"`
+}
+
+func membershipID(org primitive.ObjectID, sub string) string {
+	return org.Hex() + ":" + sub
+}
+
+// orgInvitation lets the holder of its token, signed in with a verified
+// Email, join with Role. Only the SHA-256 of the token is kept.
+type orgInvitation struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	OrgID     primitive.ObjectID `bson:"orgId" json:"orgId"`
+	Hash      string             `bson:"hash" json:"-"`
+	Email     string             `bson:"email" json:"email"`
+	Role      string             `bson:"role" json:"role"`
+	InvitedBy string             `bson:"invitedBy" json:"invitedBy"`
+	ExpiresAt time.Time          `bson:"expiresAt" json:"expiresAt"`
+}
+
+// orgStore keeps organizations, memberships and invitations in the
+// database of the request's tenant
+type orgStore struct{}
+
+type orgCollections struct {
+	orgs        *mongo.Collection
+	members     *mongo.Collection
+	invitations *mongo.Collection
+}
+
+func (orgStore) in(ctx context.Context) orgCollections {
+	db := mongoClient.Database(tenantDatabase(repository.TenantOf(ctx)))
+	return orgCollections{
+		orgs:        db.Collection("organizations"),
+		members:     db.Collection("org_members"),
+		invitations: db.Collection("org_invitations"),
+	}
+}
+
+// ensureIndexes creates the indexes of the collections of db: members by
+// subject, invitations by token and organization, and their TTL
+func (orgStore) ensureIndexes(ctx context.Context, db *mongo.Database) error {
+	if _, err := db.Collection("org_members").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "subject", Value: 1}}},
+		{Keys: bson.D{{Key: "orgId", Value: 1}, {Key: "role", Value: 1}}},
+	}); err != nil {
+		return err
+	}
+	_, err := db.Collection("org_invitations").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "orgId", Value: 1}}},
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
+
+// membership returns the caller's membership of org, or nil
+func (s orgStore) membership(ctx context.Context, org primitive.ObjectID, sub string) (*orgMembership, error) {
+	var m orgMembership
+	err := s.in(ctx).members.FindOne(ctx, bson.M{"_id": membershipID(org, sub)}).Decode(&m)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// owners counts the owners of org
+func (s orgStore) owners(ctx context.Context, org primitive.ObjectID) (int64, error) {
+	return s.in(ctx).members.CountDocuments(ctx, bson.M{"orgId": org, "role": orgOwner})
+}
+
+func hashInvitation(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// orgFromCtx returns the organization loaded by requireOrgRole
+func orgFromCtx(c *fiber.Ctx) *organization {
+	org, _ := c.Locals("org").(*organization)
+	return org
+}
+
+// orgMembershipFromCtx returns the caller's membership loaded by
+// requireOrgRole
+func orgMembershipFromCtx(c *fiber.Ctx) *orgMembership {
+	m, _ := c.Locals("orgMembership").(*orgMembership)
+	return m
+}
+
+// Middleware allowing members of the organization of the :org route
+// parameter holding role or a higher one. Non-members get 404, so the
+// organizations of others stay unseen. The organization and membership
+// are stored for orgFromCtx and orgMembershipFromCtx.
+func requireOrgRole(role string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, err := currentUser(c)
+		if err != nil {
+			return unauthorized(c, err)
+		}
+		id, err := primitive.ObjectIDFromHex(c.Params("org"))
+		if err != nil {
+			return apperror.NotFound("Organization not found")
+		}
+		ctx, cancel := context.WithTimeout(c.UserContext(), 5*time.Second)
+		defer cancel()
+		m, err := organizations.membership(ctx, id, user.Subject)
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		if m == nil {
+			return apperror.NotFound("Organization not found")
+		}
+		if orgRoleRank[m.Role] < orgRoleRank[role] {
+			return forbidden(c, "missing_org_role", "Requires organization role: "+role)
+		}
+		var org organization
+		err = organizations.in(ctx).orgs.FindOne(ctx, bson.M{"_id": id}).Decode(&org)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return apperror.NotFound("Organization not found")
+		}
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		c.Locals("org", &org)
+		c.Locals("orgMembership", m)
+		return c.Next()
+	}
+}
+
+// validOrgRole checks role is an organization role, as sent in a body
+func validOrgRole(role string) error {
+	if _, ok := orgRoleRank[role]; !ok {
+		return apperror.Validation("Invalid body", fiber.Map{"role": "expected owner, member or viewer"})
+	}
+	return nil
+}
+
+// registerOrgRoutes mounts the organizations API. Any signed-in user can
+// create one, becoming its owner; owners invite members and manage them.
+func registerOrgRoutes(app *fiber.App) {
+	type orgBody struct {
+		Name string `json:"name"`
+	}
+
+	app.Post("/orgs", authenticate(), func(c *fiber.Ctx) error {
+		var body orgBody
+		if err := c.BodyParser(&body); err != nil {
+			return apperror.Validation("Invalid body")
+		}
+		if body.Name = strings.TrimSpace(body.Name); body.Name == "" || len(body.Name) > 100 {
+			return apperror.Validation("Invalid body", fiber.Map{"name": "required, up to 100 characters"})
+		}
+		user := userFromCtx(c)
+		ctx := c.UserContext()
+		colls := organizations.in(ctx)
+		now := time.Now().UTC()
+		org := &organization{ID: primitive.NewObjectID(), Name: body.Name, CreatedAt: now, CreatedBy: user.Subject}
+		if _, err := colls.orgs.InsertOne(ctx, org); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		owner := &orgMembership{ID: membershipID(org.ID, user.Subject), OrgID: org.ID, Subject: user.Subject, Username: user.Username, Role: orgOwner, JoinedAt: now}
+		if _, err := colls.members.InsertOne(ctx, owner); err != nil {
+			// Don't leave an organization nobody owns
+			_, _ = colls.orgs.DeleteOne(ctx, bson.M{"_id": org.ID})
+			return apperror.Internal("Database error", err)
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"organization": org, "role": orgOwner})
+	})
+
+	// The caller's organizations, with their role in each
+	app.Get("/orgs", authenticate(), func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		colls := organizations.in(ctx)
+		cur, err := colls.members.Find(ctx, bson.M{"subject": userFromCtx(c).Subject})
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		var memberships []orgMembership
+		if err := cur.All(ctx, &memberships); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		roles := map[primitive.ObjectID]string{}
+		ids := bson.A{}
+		for _, m := range memberships {
+			roles[m.OrgID] = m.Role
+			ids = append(ids, m.OrgID)
+		}
+		cur, err = colls.orgs.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		var orgs []organization
+		if err := cur.All(ctx, &orgs); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		type orgWithRole struct {
+			organization
+			Role string `json:"role"`
+		}
+		out := []orgWithRole{}
+		for _, org := range orgs {
+			out = append(out, orgWithRole{organization: org, Role: roles[org.ID]})
+		}
+		return c.JSON(fiber.Map{"organizations": out})
+	})
+
+	app.Get("/orgs/:org", requireOrgRole(orgViewer), func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"organization": orgFromCtx(c), "role": orgMembershipFromCtx(c).Role})
+	})
+
+	app.Patch("/orgs/:org", requireOrgRole(orgOwner), func(c *fiber.Ctx) error {
+		var body orgBody
+		if err := c.BodyParser(&body); err != nil {
+			return apperror.Validation("Invalid body")
+		}
+		if body.Name = strings.TrimSpace(body.Name); body.Name == "" || len(body.Name) > 100 {
+			return apperror.Validation("Invalid body", fiber.Map{"name": "required, up to 100 characters"})
+		}
+		org := orgFromCtx(c)
+		if _, err := organizations.in(c.UserContext()).orgs.UpdateOne(c.UserContext(), bson.M{"_id": org.ID}, bson.M{"$set": bson.M{"name": body.Name}}); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		org.Name = body.Name
+		return c.JSON(fiber.Map{"organization": org})
+	})
+
+	// Deleting an organization removes its members and invitations
+	app.Delete("/orgs/:org", requireOrgRole(orgOwner), func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		colls := organizations.in(ctx)
+		id := orgFromCtx(c).ID
+		if _, err := colls.orgs.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		if _, err := colls.members.DeleteMany(ctx, bson.M{"orgId": id}); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		if _, err := colls.invitations.DeleteMany(ctx, bson.M{"orgId": id}); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	app.Get("/orgs/:org/members", requireOrgRole(orgViewer), func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		cur, err := organizations.in(ctx).members.Find(ctx, bson.M{"orgId": orgFromCtx(c).ID},
+			options.Find().SetSort(bson.D{{Key: "joinedAt", Value: 1}}))
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		members := []orgMembership{}
+		if err := cur.All(ctx, &members); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.JSON(fiber.Map{"members": members})
+	})
+
+	type memberBody struct {
+		Role string `json:"role"`
+	}
+
+	// Owners change the role of members; an organization keeps one owner
+	// at least
+	app.Patch("/orgs/:org/members/:sub", requireOrgRole(orgOwner), func(c *fiber.Ctx) error {
+		var body memberBody
+		if err := c.BodyParser(&body); err != nil {
+			return apperror.Validation("Invalid body")
+		}
+		if err := validOrgRole(body.Role); err != nil {
+			return err
+		}
+		ctx := c.UserContext()
+		org := orgFromCtx(c)
+		m, err := organizations.membership(ctx, org.ID, c.Params("sub"))
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		if m == nil {
+			return apperror.NotFound("Member not found")
+		}
+		if m.Role == orgOwner && body.Role != orgOwner {
+			if n, err := organizations.owners(ctx, org.ID); err != nil {
+				return apperror.Internal("Database error", err)
+			} else if n <= 1 {
+				return apperror.Conflict("An organization needs an owner; make another member owner first")
+			}
+		}
+		if _, err := organizations.in(ctx).members.UpdateOne(ctx, bson.M{"_id": m.ID}, bson.M{"$set": bson.M{"role": body.Role}}); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		m.Role = body.Role
+		return c.JSON(m)
+	})
+
+	// Owners remove members, and members can leave; the last owner can't
+	app.Delete("/orgs/:org/members/:sub", requireOrgRole(orgViewer), func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		org := orgFromCtx(c)
+		sub := c.Params("sub")
+		if sub != userFromCtx(c).Subject && orgMembershipFromCtx(c).Role != orgOwner {
+			return forbidden(c, "missing_org_role", "Requires organization role: "+orgOwner)
+		}
+		m, err := organizations.membership(ctx, org.ID, sub)
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		if m == nil {
+			return apperror.NotFound("Member not found")
+		}
+		if m.Role == orgOwner {
+			if n, err := organizations.owners(ctx, org.ID); err != nil {
+				return apperror.Internal("Database error", err)
+			} else if n <= 1 {
+				return apperror.Conflict("An organization needs an owner; make another member owner first")
+			}
+		}
+		if _, err := organizations.in(ctx).members.DeleteOne(ctx, bson.M{"_id": m.ID}); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	type invitationBody struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+
+	// The response is the only time the invitation token is shown; the
+	// owner passes it on to the invitee
+	app.Post("/orgs/:org/invitations", requireOrgRole(orgOwner), func(c *fiber.Ctx) error {
+		var body invitationBody
+		if err := c.BodyParser(&body); err != nil {
+			return apperror.Validation("Invalid body")
+		}
+		if body.Email = strings.ToLower(strings.TrimSpace(body.Email)); !strings.Contains(body.Email, "@") {
+			return apperror.Validation("Invalid body", fiber.Map{"email": "required"})
+		}
+		if body.Role == "" {
+			body.Role = orgMember
+		}
+		if err := validOrgRole(body.Role); err != nil {
+			return err
+		}
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return apperror.Internal("Cannot create invitation", err)
+		}
+		token := base64.RawURLEncoding.EncodeToString(b)
+		inv := &orgInvitation{
+			ID:        primitive.NewObjectID(),
+			OrgID:     orgFromCtx(c).ID,
+			Hash:      hashInvitation(token),
+			Email:     body.Email,
+			Role:      body.Role,
+			InvitedBy: userFromCtx(c).Subject,
+			ExpiresAt: time.Now().Add(orgInvitationTTL).UTC(),
+		}
+		if _, err := organizations.in(c.UserContext()).invitations.InsertOne(c.UserContext(), inv); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"token": token, "invitation": inv})
+	})
+
+	app.Get("/orgs/:org/invitations", requireOrgRole(orgOwner), func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		cur, err := organizations.in(ctx).invitations.Find(ctx, bson.M{"orgId": orgFromCtx(c).ID, "expiresAt": bson.M{"$gt": time.Now()}})
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		invitations := []orgInvitation{}
+		if err := cur.All(ctx, &invitations); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.JSON(fiber.Map{"invitations": invitations})
+	})
+
+	app.Delete("/orgs/:org/invitations/:id", requireOrgRole(orgOwner), func(c *fiber.Ctx) error {
+		id, err := primitive.ObjectIDFromHex(c.Params("id"))
+		if err != nil {
+			return apperror.NotFound("Invitation not found")
+		}
+		res, err := organizations.in(c.UserContext()).invitations.DeleteOne(c.UserContext(), bson.M{"_id": id, "orgId": orgFromCtx(c).ID})
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		if res.DeletedCount == 0 {
+			return apperror.NotFound("Invitation not found")
+		}
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	// Accepting takes a token whose verified email is the invited one; the
+	// invitation is used up
+	app.Post("/org-invitations/:token/accept", authenticate(), func(c *fiber.Ctx) error {
+		user := userFromCtx(c)
+		ctx := c.UserContext()
+		colls := organizations.in(ctx)
+		var inv orgInvitation
+		err := colls.invitations.FindOne(ctx, bson.M{"hash": hashInvitation(c.Params("token")), "expiresAt": bson.M{"$gt": time.Now()}}).Decode(&inv)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return apperror.NotFound("Invitation not found or expired")
+		}
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		if !user.Claims.EmailVerified || !strings.EqualFold(user.Claims.Email, inv.Email) {
+			return forbidden(c, "invitation_email", "The invitation is for another email address")
+		}
+		if existing, err := organizations.membership(ctx, inv.OrgID, user.Subject); err != nil {
+			return apperror.Internal("Database error", err)
+		} else if existing != nil {
+			return apperror.Conflict("Already a member of the organization")
+		}
+		m := &orgMembership{
+			ID:        membershipID(inv.OrgID, user.Subject),
+			OrgID:     inv.OrgID,
+			Subject:   user.Subject,
+			Username:  user.Username,
+			Role:      inv.Role,
+			InvitedBy: inv.InvitedBy,
+			JoinedAt:  time.Now().UTC(),
+		}
+		if _, err := colls.members.InsertOne(ctx, m); mongo.IsDuplicateKeyError(err) {
+			return apperror.Conflict("Already a member of the organization")
+		} else if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		if _, err := colls.invitations.DeleteOne(ctx, bson.M{"_id": inv.ID}); err != nil {
+			requestLogger(ctx).Error().Err(err).Msg("Cannot delete accepted invitation")
+		}
+		return c.Status(fiber.StatusCreated).JSON(m)
+	})
+}
+
+// Enable the organizations API when ORGANIZATIONS=true
+func initOrganizations() {
+	if !cfg.Tenancy.Organizations {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	organizations = &orgStore{}
+	for _, name := range dataDatabases() {
+		if err := organizations.ensureIndexes(ctx, mongoClient.Database(name)); err != nil {
+			log.Fatal().Err(err).Str("db", name).Msg("Organization indexes error")
+		}
+	}
+	log.Info().Msg("Organizations enabled")
+}
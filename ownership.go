@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+)
+
+// errResourceNotFound is returned by owner lookups when the resource doesn't exist
+var errResourceNotFound = repository.ErrNotFound
+
+// ownerLookup returns the ownerId (a token sub) of the resource a request targets
+type ownerLookup func(c *fiber.Ctx) (string, error)
+
+// Middleware allowing the request only when the caller's sub owns the
+// resource, or the caller holds one of overrideRoles (e.g. "admin")
+func requireOwnership(lookup ownerLookup, overrideRoles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, err := currentUser(c)
+		if err != nil {
+			return unauthorized(c, err)
+		}
+		if containsAny(user.Roles, overrideRoles) {
+			return c.Next()
+		}
+
+		owner, err := lookup(c)
+		if errors.Is(err, errResourceNotFound) {
+			return apperror.NotFound("Not found")
+		}
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		if owner == "" || owner != user.Subject {
+			return forbidden(c, "not_owner", "Not the resource owner")
+		}
+		return c.Next()
+	}
+}
+
+// repoOwnerLookup asks repo for the owner of the record whose ID is the
+// route parameter param
+func repoOwnerLookup(repo repository.OwnerFinder, param string) ownerLookup {
+	return func(c *fiber.Ctx) (string, error) {
+		ctx, cancel := context.WithTimeout(c.UserContext(), 5*time.Second)
+		defer cancel()
+		return repo.OwnerOf(ctx, c.Params(param))
+	}
+}
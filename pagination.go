@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Listing limits shared by every collection endpoint
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+	maxPage          = 10000 // deeper pages cost a large skip; narrow the filter instead
+	maxFilterValue   = 100
+)
+
+// listParams are the ?page, ?limit, ?sort, ?filter and ?cursor parameters
+// of a collection endpoint, already checked against what it allows
+type listParams struct {
+	page, limit int
+	sort        []repository.SortField
+	filter      map[string]string
+	cursor      string
+}
+
+// parseListParams reads
+//
+//	?page=2&limit=50&sort=-price,name&filter=tag:office,name:lamp
+//
+// sort takes fields of sortable, "-" for descending; filter takes
+// comma-separated field:value pairs for fields of filterable. Anything else
+// is rejected, so unchecked input never reaches a query. ?cursor, the
+// nextCursor of a previous response, replaces page for deep pagination.
+func parseListParams(c *fiber.Ctx, sortable, filterable []string) (*listParams, error) {
+	p := &listParams{page: 1, limit: defaultPageLimit, filter: map[string]string{}}
+	errs := fiber.Map{}
+
+	if v := c.Query("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPage {
+			errs["page"] = "must be a number between 1 and " + strconv.Itoa(maxPage)
+		}
+		p.page = n
+	}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			errs["limit"] = "must be a number between 1 and " + strconv.Itoa(maxPageLimit)
+		}
+		p.limit = n
+	}
+	for _, field := range splitList(c.Query("sort")) {
+		s := repository.SortField{Field: strings.TrimPrefix(field, "-"), Desc: strings.HasPrefix(field, "-")}
+		if !containsString(sortable, s.Field) {
+			errs["sort"] = "can sort by " + strings.Join(sortable, ", ")
+			break
+		}
+		p.sort = append(p.sort, s)
+	}
+	for _, pair := range splitList(c.Query("filter")) {
+		field, value, ok := strings.Cut(pair, ":")
+		if !ok || !containsString(filterable, field) {
+			errs["filter"] = "expected field:value pairs for " + strings.Join(filterable, ", ")
+			break
+		}
+		if value == "" || len(value) > maxFilterValue || strings.IndexFunc(value, unicode.IsControl) >= 0 {
+			errs["filter"] = field + " must be 1-" + strconv.Itoa(maxFilterValue) + " printable characters"
+			break
+		}
+		p.filter[field] = value
+	}
+	p.cursor = c.Query("cursor")
+	if len(errs) > 0 {
+		return nil, apperror.Validation("Invalid list parameters", errs)
+	}
+	return p, nil
+}
+
+// repoPage is the repository window for the requested page
+func (p *listParams) repoPage() repository.Page {
+	return repository.Page{Offset: (p.page - 1) * p.limit, Limit: p.limit, Sort: p.sort, Cursor: p.cursor}
+}
+
+// listEnvelope is the response of collection endpoints: the records under
+// key plus paging metadata. nextCursor, when set, fetches the following
+// page; cursor pages leave out page and the totals, which would need a
+// full count.
+func listEnvelope(key string, records interface{}, p *listParams, total int64, next string) fiber.Map {
+	resp := fiber.Map{key: records, "limit": p.limit}
+	if next != "" {
+		resp["nextCursor"] = next
+	}
+	if p.cursor == "" {
+		resp["page"] = p.page
+		resp["total"] = total
+		resp["totalPages"] = (total + int64(p.limit) - 1) / int64(p.limit)
+	}
+	return resp
+}
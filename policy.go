@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// policyRule maps a path pattern and methods to the authorization it needs.
+// Patterns are matched segment by segment: "*" and ":name" match one
+// segment, a trailing "**" matches the rest of the path.
+type policyRule struct {
+	Path     string   `json:"path"`
+	Methods  []string `json:"methods"`  // empty matches every method
+	Roles    []string `json:"roles"`    // caller needs any of these
+	AllRoles []string `json:"allRoles"` // caller needs every one of these
+	Scopes   []string `json:"scopes"`   // caller needs every one of these
+	Groups   []string `json:"groups"`   // caller needs any of these
+	Clients  []string `json:"clients"`  // token's azp must be one of these
+	Public   bool     `json:"public"`   // no token required
+
+	segments []string
+}
+
+// policyRules is loaded from POLICY_FILE and swapped on reload; the first
+// matching rule applies
+var policyRules atomic.Pointer[[]policyRule]
+
+func (r *policyRule) matches(method, path string) bool {
+	if len(r.Methods) > 0 && !containsString(r.Methods, method) {
+		return false
+	}
+	return pathMatches(r.segments, path)
+}
+
+// pathMatches reports whether path matches a pattern compiled by
+// compilePathPattern. Like Fiber's routing, which is neither case-sensitive
+// nor strict about trailing slashes, it ignores both, so /ITEMS/1/ meets
+// the rules of the route it reaches.
+func pathMatches(pattern []string, path string) bool {
+	segments := splitPath(path)
+	for i, want := range pattern {
+		if want == "**" {
+			return true
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if want != "*" && !strings.HasPrefix(want, ":") && want != segments[i] {
+			return false
+		}
+	}
+	return len(segments) == len(pattern)
+}
+
+// compilePathPattern splits a pattern such as "/items/:id" or "/admin/**"
+// into segments for pathMatches
+func compilePathPattern(p string) ([]string, error) {
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("path %q must start with /", p)
+	}
+	segments := splitPath(p)
+	for j, seg := range segments {
+		if seg == "**" && j != len(segments)-1 {
+			return nil, fmt.Errorf("** is only allowed at the end of %q", p)
+		}
+	}
+	return segments, nil
+}
+
+// authorize checks the user against the rule, returning the reason for denial
+func (r *policyRule) authorize(user *User) error {
+	claims := user.Claims
+	if len(r.Roles) > 0 || len(r.AllRoles) > 0 {
+		if user.rolesErr != nil {
+			return fmt.Errorf("Cannot extract roles")
+		}
+		roles := user.Roles
+		if len(r.Roles) > 0 && !containsAny(roles, r.Roles) {
+			return fmt.Errorf("Requires any of roles: %s", strings.Join(r.Roles, ", "))
+		}
+		for _, role := range r.AllRoles {
+			if !containsString(roles, role) {
+				return fmt.Errorf("Missing role: %s", role)
+			}
+		}
+	}
+	if len(r.Clients) > 0 && !containsString(r.Clients, claims.AuthorizedParty) {
+		return fmt.Errorf("Client not allowed: %s", claims.AuthorizedParty)
+	}
+	for _, scope := range r.Scopes {
+		if !claims.HasScope(scope) {
+			return fmt.Errorf("Missing scope: %s", scope)
+		}
+	}
+	if len(r.Groups) > 0 {
+		member := false
+		for _, g := range r.Groups {
+			if claims.InGroup(g) {
+				member = true
+				break
+			}
+		}
+		if !member {
+			return fmt.Errorf("Requires any of groups: %s", strings.Join(r.Groups, ", "))
+		}
+	}
+	return nil
+}
+
+// Middleware enforcing POLICY_FILE rules ahead of the route's own guards.
+// Requests matching no rule are passed through unchanged.
+func policyMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		rules := policyRules.Load()
+		if rules == nil {
+			return c.Next()
+		}
+		for i := range *rules {
+			rule := &(*rules)[i]
+			if !rule.matches(c.Method(), c.Path()) {
+				continue
+			}
+			if rule.Public {
+				return c.Next()
+			}
+			user, err := currentUser(c)
+			if err != nil {
+				return unauthorized(c, err)
+			}
+			if err := rule.authorize(user); err != nil {
+				return forbidden(c, "policy_denied", err.Error())
+			}
+			return c.Next()
+		}
+		return c.Next()
+	}
+}
+
+// Load route policies from POLICY_FILE, e.g.
+//
+//	[{"path": "/public", "public": true},
+//	 {"path": "/profile", "clients": ["mobile-app"]},
+//	 {"path": "/items/**", "methods": ["POST", "PUT", "DELETE"], "roles": ["admin"]},
+//	 {"path": "/items/**", "roles": ["user", "admin"]}]
+func initPolicies() {
+	path := cfg.Auth.PolicyFile
+	if path == "" {
+		return
+	}
+	rules, err := loadPolicies(path)
+	if err != nil {
+		log.Fatal().Err(err).Msg("POLICY_FILE error")
+	}
+	policyRules.Store(&rules)
+	log.Info().Int("count", len(rules)).Str("file", path).Msg("Loaded route policies")
+}
+
+func loadPolicies(path string) ([]policyRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []policyRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		r := &rules[i]
+		segments, err := compilePathPattern(r.Path)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		r.segments = segments
+		for j, m := range r.Methods {
+			r.Methods[j] = strings.ToUpper(m)
+		}
+	}
+	return rules, nil
+}
+
+// splitPath returns the lowercased segments of p
+func splitPath(p string) []string {
+	p = strings.ToLower(strings.Trim(p, "/"))
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func containsAny(list, candidates []string) bool {
+	for _, c := range candidates {
+		if containsString(list, c) {
+			return true
+		}
+	}
+	return false
+}
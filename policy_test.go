@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// usePolicies enforces the rules of the POLICY_FILE content until the test
+// ends
+func usePolicies(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policies.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := loadPolicies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := policyRules.Load()
+	t.Cleanup(func() { policyRules.Store(saved) })
+	policyRules.Store(&rules)
+}
+
+func TestPoliciesMatchPathsAsFiberRoutes(t *testing.T) {
+	usePolicies(t, `[{"path": "/Items/**", "roles": ["admin"]}]`)
+	app := newTestApp()
+	app.Use(policyMiddleware())
+	app.Get("/items/:id", func(c *fiber.Ctx) error {
+		return c.SendString(c.Params("id"))
+	})
+	user, admin := token(t, "alice", "user"), token(t, "root", "admin")
+
+	for _, path := range []string{"/items/1", "/ITEMS/1", "/Items/1", "/items/1/", "/ITEMS/1/"} {
+		if resp := call(t, app, http.MethodGet, path, user); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("GET %s as a user: got %d, want 403", path, resp.StatusCode)
+		}
+		if resp := call(t, app, http.MethodGet, path, admin); resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s as an admin: got %d, want 200", path, resp.StatusCode)
+		}
+	}
+}
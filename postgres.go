@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+// pgPool is the PostgreSQL pool of STORE=postgres
+var pgPool *pgxpool.Pool
+
+// Connect to PostgreSQL when STORE=postgres
+func initPostgres() {
+	if !postgresStore() {
+		return
+	}
+	poolConfig, err := pgxpool.ParseConfig(cfg.Postgres.URL)
+	if err != nil {
+		log.Fatal().Err(err).Msg("POSTGRES_URL error")
+	}
+	poolConfig.MaxConns = int32(cfg.Postgres.MaxConns)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Postgres connect error")
+	}
+	if err := pool.Ping(ctx); err != nil {
+		log.Fatal().Err(err).Msg("Postgres Ping error")
+	}
+	pgPool = pool
+	log.Info().Str("db", poolConfig.ConnConfig.Database).Msg("Connected to PostgreSQL")
+}
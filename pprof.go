@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/pprof"
+	"github.com/rs/zerolog/log"
+)
+
+// registerPprofRoutes mounts net/http/pprof under /debug/pprof when
+// PPROF=true: on the METRICS_ADDR listener if there is one, otherwise on
+// app for admins only, e.g.
+//
+//	curl -H "Authorization: Bearer $TOKEN" -o cpu.out "http://localhost:3000/debug/pprof/profile?seconds=30"
+func registerPprofRoutes(app *fiber.App) {
+	if !cfg.Metrics.Pprof {
+		return
+	}
+	if internalApp != nil {
+		internalApp.Use(pprof.New())
+		log.Info().Msg("pprof enabled on the internal listener")
+		return
+	}
+	app.Use("/debug/pprof", requireRole("admin"), pprof.New())
+	log.Info().Msg("pprof enabled for admins under /debug/pprof")
+}
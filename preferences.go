@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+)
+
+// localeTag is the shape of a BCP 47 language tag, e.g. en or pt-BR
+var localeTag = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// preferenceCheck returns what is wrong with a preference value, or ""
+type preferenceCheck func(v interface{}) string
+
+func oneOf(values ...string) preferenceCheck {
+	return func(v interface{}) string {
+		if s, ok := v.(string); ok && containsString(values, s) {
+			return ""
+		}
+		return "one of " + strings.Join(values, ", ")
+	}
+}
+
+func isBool(v interface{}) string {
+	if _, ok := v.(bool); ok {
+		return ""
+	}
+	return "true or false"
+}
+
+// object checks an object holding only the fields of schema
+func object(schema map[string]preferenceCheck) preferenceCheck {
+	return func(v interface{}) string {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return "an object"
+		}
+		for k, fv := range obj {
+			check, ok := schema[k]
+			if !ok {
+				return "unknown field " + k
+			}
+			if problem := check(fv); problem != "" {
+				return k + ": " + problem
+			}
+		}
+		return ""
+	}
+}
+
+// preferenceSchema lists the preferences clients may store. Settings of
+// their own go under custom, which takes any object.
+var preferenceSchema = map[string]preferenceCheck{
+	"locale": func(v interface{}) string {
+		if s, ok := v.(string); ok && len(s) <= 35 && localeTag.MatchString(s) {
+			return ""
+		}
+		return "a BCP 47 language tag, e.g. en-GB"
+	},
+	"theme": oneOf("light", "dark", "system"),
+	"notifications": object(map[string]preferenceCheck{
+		"email":  isBool,
+		"push":   isBool,
+		"digest": oneOf("off", "daily", "weekly"),
+	}),
+	"custom": func(v interface{}) string {
+		if _, ok := v.(map[string]interface{}); ok {
+			return ""
+		}
+		return "an object"
+	},
+}
+
+// validatePreferences checks prefs against preferenceSchema and the size
+// bound, with a detail per offending field
+func validatePreferences(prefs map[string]interface{}) error {
+	details := fiber.Map{}
+	for k, v := range prefs {
+		check, ok := preferenceSchema[k]
+		if !ok {
+			details[k] = "unknown preference; keep settings of your own under custom"
+			continue
+		}
+		if problem := check(v); problem != "" {
+			details[k] = problem
+		}
+	}
+	if data, _ := json.Marshal(prefs); len(data) > maxPreferenceBytes {
+		details["preferences"] = "up to 8 KiB of JSON"
+	}
+	if len(details) > 0 {
+		return apperror.Validation("Invalid preferences", details)
+	}
+	return nil
+}
+
+// setPreferencesETag sets the ETag If-Match is checked against
+func setPreferencesETag(c *fiber.Ctx, version int64) string {
+	etag := `"` + strconv.FormatInt(version, 10) + `"`
+	c.Set(fiber.HeaderETag, etag)
+	return etag
+}
+
+// registerPreferenceRoutes mounts /me/preferences. PUT replaces the whole
+// document, and needs If-Match with the ETag of GET, so concurrent
+// writers from several devices don't overwrite each other unseen.
+func registerPreferenceRoutes(app *fiber.App, users repository.UserRepository) {
+	auth := authenticate()
+
+	app.Get("/me/preferences", auth, func(c *fiber.Ctx) error {
+		profile, err := myProfile(c, users)
+		if err != nil {
+			return err
+		}
+		etag := setPreferencesETag(c, profile.PreferencesVersion)
+		if c.Get(fiber.HeaderIfNoneMatch) == etag {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+		prefs := profile.Preferences
+		if prefs == nil {
+			prefs = map[string]interface{}{}
+		}
+		return c.JSON(prefs)
+	})
+
+	app.Put("/me/preferences", auth, func(c *fiber.Ctx) error {
+		match := c.Get(fiber.HeaderIfMatch)
+		if match == "" {
+			return apperror.PreconditionRequired("Send If-Match with the ETag of GET /me/preferences")
+		}
+		version, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(match, "W/"), `"`), 10, 64)
+		if err != nil {
+			return apperror.Validation("If-Match must be the ETag of the preferences, e.g. \"3\"")
+		}
+		var prefs map[string]interface{}
+		if err := decodeStrict(c.Body(), &prefs); err != nil {
+			return err
+		}
+		if prefs == nil {
+			return apperror.Validation("Invalid body", fiber.Map{"body": "a JSON object"})
+		}
+		if err := validatePreferences(prefs); err != nil {
+			return err
+		}
+		profile, err := myProfile(c, users)
+		if err != nil {
+			return err
+		}
+		version, err = users.SetPreferences(c.UserContext(), profile.ID, prefs, version)
+		if err != nil {
+			return preferencesError(err)
+		}
+		setPreferencesETag(c, version)
+		return c.JSON(prefs)
+	})
+}
+
+// preferencesError maps the errors of SetPreferences, where a conflict is
+// a write of another device since the version the caller read
+func preferencesError(err error) error {
+	if errors.Is(err, repository.ErrVersionConflict) {
+		return apperror.Conflict("The preferences were changed since they were read; fetch them again and reapply the change")
+	}
+	return profileError(err)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/example/fiber-demo/repository"
+)
+
+func TestPreferencesNeedTheCurrentETag(t *testing.T) {
+	app := newTestApp()
+	registerPreferenceRoutes(app, repository.NewMemory().Users)
+	carol := sign(t, map[string]interface{}{"sub": "carol", "preferred_username": "carol"})
+	put := func(ifMatch, body string) *http.Response {
+		req := httptest.NewRequest(http.MethodPut, "/me/preferences", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+carol)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := call(t, app, http.MethodGet, "/me/preferences", carol)
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("GET /me/preferences: got %d with ETag %q", resp.StatusCode, etag)
+	}
+	if resp := call(t, app, http.MethodGet, "/me/preferences", carol, "If-None-Match", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("GET /me/preferences with If-None-Match: got %d, want 304", resp.StatusCode)
+	}
+
+	for _, tc := range []struct {
+		name, ifMatch, body string
+		status              int
+	}{
+		{"without If-Match", "", `{"theme": "dark"}`, http.StatusPreconditionRequired},
+		{"with a bad If-Match", "yesterday", `{"theme": "dark"}`, http.StatusBadRequest},
+		{"with an unknown preference", etag, `{"fontSize": 12}`, http.StatusBadRequest},
+		{"with a bad value", etag, `{"theme": "pink"}`, http.StatusBadRequest},
+		{"with a stale ETag", `"41"`, `{"theme": "dark"}`, http.StatusConflict},
+	} {
+		if resp := put(tc.ifMatch, tc.body); resp.StatusCode != tc.status {
+			body, _ := io.ReadAll(resp.Body)
+			t.Errorf("PUT /me/preferences %s: got %d %s, want %d", tc.name, resp.StatusCode, body, tc.status)
+		}
+	}
+
+	resp = put(etag, `{"theme": "dark", "notifications": {"digest": "daily"}}`)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Fatalf("PUT /me/preferences: got %d with ETag %q, want 200 and a new ETag", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	if resp := put(etag, `{"theme": "light"}`); resp.StatusCode != http.StatusConflict {
+		t.Errorf("PUT /me/preferences with the replaced ETag: got %d, want 409", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(call(t, app, http.MethodGet, "/me/preferences", carol).Body)
+	if !strings.Contains(string(body), `"theme":"dark"`) {
+		t.Errorf("GET /me/preferences after PUT: got %s", body)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// restrictedField is a JSON field only callers holding one of roles see
+type restrictedField struct {
+	name  string
+	roles []string
+	// needle is `"name":`, to skip bodies that can't contain the field
+	needle []byte
+}
+
+// restrictedFields is loaded from RESTRICTED_FIELDS. The response of every
+// route is checked, so a new endpoint can't leak a field by forgetting to
+// redact it.
+var restrictedFields = []restrictedField{
+	newRestrictedField("costPrice", "admin"),
+	newRestrictedField("internalNotes", "admin"),
+}
+
+func newRestrictedField(name string, roles ...string) restrictedField {
+	return restrictedField{name: name, roles: roles, needle: []byte(`"` + name + `":`)}
+}
+
+// hiddenFields returns the restricted fields user may not see; a nil user
+// sees none of them
+func hiddenFields(user *User) map[string]bool {
+	var hidden map[string]bool
+	for _, f := range restrictedFields {
+		if user != nil && containsAny(user.Roles, f.roles) {
+			continue
+		}
+		if hidden == nil {
+			hidden = map[string]bool{}
+		}
+		hidden[f.name] = true
+	}
+	return hidden
+}
+
+// Middleware removing the fields the caller may not see from JSON
+// responses, at any depth, so lists and single records are redacted alike
+func projectionMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if err := c.Next(); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(string(c.Response().Header.ContentType()), fiber.MIMEApplicationJSON) {
+			return nil
+		}
+		hidden := hiddenFields(userFromCtx(c))
+		if hidden == nil {
+			return nil
+		}
+		data, err := redactJSON(c.Response().Body(), hidden)
+		if err != nil {
+			// Not ours to fix; never pass it through unredacted
+			requestLogger(c.UserContext()).Error().Err(err).Msg("Cannot redact response")
+			c.Response().ResetBody()
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		c.Response().SetBodyRaw(data)
+		return nil
+	}
+}
+
+// redactJSON returns data without the hidden fields, as is when it has
+// none of them. Streaming handlers, which the middleware can't see into,
+// redact their messages with it.
+func redactJSON(data []byte, hidden map[string]bool) ([]byte, error) {
+	present := false
+	for _, f := range restrictedFields {
+		if hidden[f.name] && bytes.Contains(data, f.needle) {
+			present = true
+			break
+		}
+	}
+	if !present {
+		return data, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	redact(v, hidden)
+	return json.Marshal(v)
+}
+
+// redact deletes the hidden keys from every object in v
+func redact(v interface{}, hidden map[string]bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if hidden[k] {
+				delete(v, k)
+				continue
+			}
+			redact(child, hidden)
+		}
+	case []interface{}:
+		for _, child := range v {
+			redact(child, hidden)
+		}
+	}
+}
+
+// parseRestrictedFields reads entries such as "costPrice:admin" or
+// "internalNotes:admin|auditor"
+func parseRestrictedFields(entries []string) ([]restrictedField, error) {
+	var fields []restrictedField
+	for _, e := range entries {
+		name, roles, ok := strings.Cut(e, ":")
+		if !ok || name == "" || roles == "" {
+			return nil, fmt.Errorf("%q: expected field:role|role", e)
+		}
+		fields = append(fields, newRestrictedField(name, strings.Split(roles, "|")...))
+	}
+	return fields, nil
+}
+
+// Load RESTRICTED_FIELDS; "none" turns redaction off
+func initProjection() {
+	entries := cfg.Items.RestrictedFields
+	if len(entries) == 1 && entries[0] == "none" {
+		restrictedFields = nil
+		log.Info().Msg("Field redaction disabled")
+		return
+	}
+	fields, err := parseRestrictedFields(entries)
+	if err != nil {
+		log.Fatal().Err(err).Msg("RESTRICTED_FIELDS error")
+	}
+	restrictedFields = fields
+	log.Info().Int("count", len(fields)).Msg("Loaded restricted fields")
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// rateLimitStore counts requests per key in fixed windows
+type rateLimitStore interface {
+	// incr counts one request in key's current window and returns the count
+	// so far; the window is forgotten after window
+	incr(ctx context.Context, key string, window time.Duration) (int64, error)
+}
+
+// redisRateLimitStore shares counters across replicas
+type redisRateLimitStore struct {
+	client *redis.Client
+}
+
+// incrScript sets the expiry with the first INCR so no key outlives its window
+var incrScript = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if n == 1 then redis.call("PEXPIRE", KEYS[1], ARGV[1]) end
+return n`)
+
+func (s *redisRateLimitStore) incr(ctx context.Context, key string, window time.Duration) (int64, error) {
+	return incrScript.Run(ctx, s.client, []string{key}, window.Milliseconds()).Int64()
+}
+
+// memoryRateLimitStore is used without REDIS_URL; limits then apply per replica
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	windows map[string]*memoryWindow
+}
+
+type memoryWindow struct {
+	count   int64
+	expires time.Time
+}
+
+func (s *memoryRateLimitStore) incr(_ context.Context, key string, window time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	w, ok := s.windows[key]
+	if !ok || now.After(w.expires) {
+		if len(s.windows) >= 100000 {
+			for k, w := range s.windows {
+				if now.After(w.expires) {
+					delete(s.windows, k)
+				}
+			}
+		}
+		w = &memoryWindow{expires: now.Add(window)}
+		s.windows[key] = w
+	}
+	w.count++
+	return w.count, nil
+}
+
+// rateLimitRule limits requests to paths matching pattern, per caller
+type rateLimitRule struct {
+	pattern  string
+	segments []string
+	limit    int64
+	window   time.Duration
+}
+
+// rateLimitSettings are the configured limits, replaced as a whole on reload
+type rateLimitSettings struct {
+	rules       []rateLimitRule // RATE_LIMITS, first match wins
+	defaultRule *rateLimitRule  // RATE_LIMIT_DEFAULT, for unmatched paths
+	tiers       []rateLimitTier // RATE_LIMIT_TIERS_FILE, first match wins
+}
+
+func (s *rateLimitSettings) enabled() bool {
+	return s != nil && (len(s.rules) > 0 || s.defaultRule != nil || len(s.tiers) > 0)
+}
+
+var (
+	rateLimiter rateLimitStore
+	rateLimits  atomic.Pointer[rateLimitSettings]
+)
+
+// rateLimitIdentity is the token sub, or the client IP for anonymous calls
+// and calls whose credentials don't authenticate
+func rateLimitIdentity(c *fiber.Ctx) (string, *User) {
+	if hasCredentials(c) {
+		if user, err := currentUser(c); err == nil {
+			return "sub:" + user.Subject, user
+		}
+	}
+	return "ip:" + c.IP(), nil
+}
+
+// enforce counts the request against every rule, answering 429 once the
+// caller exceeds any. X-RateLimit-* headers describe the rule closest to
+// its limit. Counter failures let the request through.
+func enforce(c *fiber.Ctx, rules ...*rateLimitRule) error {
+	identity, user := rateLimitIdentity(c)
+	if tier := tierFor(user); tier != nil {
+		if tier.Unlimited {
+			return c.Next()
+		}
+		rules = append(rules, &tier.rule)
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), time.Second)
+	defer cancel()
+	now := time.Now()
+	var tightest *rateLimitRule
+	var remaining int64
+	var reset time.Time
+	for _, rule := range rules {
+		start := now.Truncate(rule.window)
+		key := fmt.Sprintf("ratelimit:%s:%s:%d", rule.pattern, identity, start.Unix())
+		count, err := rateLimiter.incr(ctx, key, rule.window)
+		if err != nil {
+			requestLogger(ctx).Error().Err(err).Msg("Rate limit error")
+			continue
+		}
+		if left := rule.limit - count; tightest == nil || left < remaining {
+			tightest, remaining, reset = rule, left, start.Add(rule.window)
+		}
+	}
+	if tightest == nil {
+		return c.Next()
+	}
+
+	resetIn := strconv.Itoa(int(reset.Sub(now).Seconds()) + 1)
+	c.Set("X-RateLimit-Limit", strconv.FormatInt(tightest.limit, 10))
+	c.Set("X-RateLimit-Reset", resetIn)
+	if remaining < 0 {
+		c.Set("X-RateLimit-Remaining", "0")
+		c.Set(fiber.HeaderRetryAfter, resetIn)
+		return apperror.RateLimited("Rate limit exceeded")
+	}
+	c.Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+	return c.Next()
+}
+
+// Middleware applying RATE_LIMITS / RATE_LIMIT_DEFAULT and the caller's
+// tier to every request, with the settings current at request time
+func rateLimitMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		s := rateLimits.Load()
+		if !s.enabled() {
+			return c.Next()
+		}
+		rule := s.defaultRule
+		// pathMatches ignores case and trailing slashes as routing does, so
+		// /Items/1/ counts against the rule of /items/**
+		for i := range s.rules {
+			if pathMatches(s.rules[i].segments, c.Path()) {
+				rule = &s.rules[i]
+				break
+			}
+		}
+		if rule == nil {
+			return enforce(c)
+		}
+		return enforce(c, rule)
+	}
+}
+
+// Middleware limiting each caller to limit requests per window for a route
+// group, e.g. app.Group("/reports", rateLimit("reports", 10, time.Minute)).
+// Groups sharing a name share counters.
+func rateLimit(name string, limit int64, window time.Duration) fiber.Handler {
+	rule := &rateLimitRule{pattern: name, limit: limit, window: window}
+	return func(c *fiber.Ctx) error {
+		if rateLimiter == nil {
+			return c.Next()
+		}
+		return enforce(c, rule)
+	}
+}
+
+// rateLimitTier is a per-caller budget for callers with given roles or
+// service accounts, shared by all routes
+type rateLimitTier struct {
+	Name           string   `json:"name"`
+	Roles          []string `json:"roles"`          // caller holds any of these
+	ServiceAccount bool     `json:"serviceAccount"` // caller is a service account
+	Limit          string   `json:"limit"`          // "<count>/<window>"
+	Unlimited      bool     `json:"unlimited"`      // exempt from every rate limit
+
+	rule rateLimitRule
+}
+
+// tierFor returns the tier of an authenticated user, or nil
+func tierFor(user *User) *rateLimitTier {
+	s := rateLimits.Load()
+	if user == nil || s == nil {
+		return nil
+	}
+	for i := range s.tiers {
+		t := &s.tiers[i]
+		if (t.ServiceAccount && user.Claims.IsServiceAccount()) || containsAny(user.Roles, t.Roles) {
+			return t
+		}
+	}
+	return nil
+}
+
+// loadRateLimitTiers reads tiers such as
+//
+//	[{"name": "admin", "roles": ["admin"], "unlimited": true},
+//	 {"name": "service", "serviceAccount": true, "limit": "1000/1m"},
+//	 {"name": "user", "roles": ["user"], "limit": "100/1m"}]
+func loadRateLimitTiers(path string) ([]rateLimitTier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tiers []rateLimitTier
+	if err := json.Unmarshal(data, &tiers); err != nil {
+		return nil, err
+	}
+	for i := range tiers {
+		t := &tiers[i]
+		if t.Name == "" {
+			return nil, fmt.Errorf("tier %d: name is required", i)
+		}
+		if t.Unlimited {
+			continue
+		}
+		n, window, err := config.ParseRateLimit(t.Limit)
+		if err != nil {
+			return nil, fmt.Errorf("tier %s: %v", t.Name, err)
+		}
+		t.rule = rateLimitRule{pattern: "tier:" + t.Name, limit: n, window: window}
+	}
+	return tiers, nil
+}
+
+// loadRateLimits parses RATE_LIMITS ("/admin/**=30/1m,/items/**=100/1m"),
+// RATE_LIMIT_DEFAULT and RATE_LIMIT_TIERS_FILE
+func loadRateLimits(rc config.RateLimit) (*rateLimitSettings, error) {
+	s := &rateLimitSettings{}
+	for _, entry := range rc.Rules {
+		pattern, limit, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("RATE_LIMITS: invalid entry %q, expected path=count/window", entry)
+		}
+		pattern = strings.TrimSpace(pattern)
+		segments, err := compilePathPattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("RATE_LIMITS: %v", err)
+		}
+		n, window, err := config.ParseRateLimit(limit)
+		if err != nil {
+			return nil, fmt.Errorf("RATE_LIMITS: %v", err)
+		}
+		s.rules = append(s.rules, rateLimitRule{pattern: pattern, segments: segments, limit: n, window: window})
+	}
+	if rc.Default != "" {
+		n, window, err := config.ParseRateLimit(rc.Default)
+		if err != nil {
+			return nil, fmt.Errorf("RATE_LIMIT_DEFAULT: %v", err)
+		}
+		s.defaultRule = &rateLimitRule{pattern: "default", limit: n, window: window}
+	}
+	if rc.TiersFile != "" {
+		tiers, err := loadRateLimitTiers(rc.TiersFile)
+		if err != nil {
+			return nil, fmt.Errorf("RATE_LIMIT_TIERS_FILE: %v", err)
+		}
+		s.tiers = tiers
+	}
+	return s, nil
+}
+
+// Load the rate limits and REDIS_URL
+func initRateLimit() {
+	s, err := loadRateLimits(cfg.RateLimit)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Rate limit config error")
+	}
+	rateLimits.Store(s)
+	if len(s.tiers) > 0 {
+		log.Info().Int("count", len(s.tiers)).Str("file", cfg.RateLimit.TiersFile).Msg("Loaded rate limit tiers")
+	}
+
+	if redisURL := cfg.RateLimit.RedisURL; redisURL != "" {
+		opts, err := redis.ParseURL(redisURL)
+		if err != nil {
+			log.Fatal().Err(err).Msg("REDIS_URL error")
+		}
+		client := redis.NewClient(opts)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := client.Ping(ctx).Err(); err != nil {
+			log.Fatal().Err(err).Msg("Redis Ping error")
+		}
+		rateLimiter = &redisRateLimitStore{client: client}
+		log.Info().Str("addr", opts.Addr).Msg("Rate limits shared via Redis")
+	} else {
+		rateLimiter = &memoryRateLimitStore{windows: map[string]*memoryWindow{}}
+		if s.enabled() {
+			log.Warn().Msg("Rate limits kept in memory; set REDIS_URL to share them across replicas")
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/example/fiber-demo/config"
+	"github.com/gofiber/fiber/v2"
+)
+
+// useRateLimits applies rc with in-memory counters until the test ends
+func useRateLimits(t *testing.T, rc config.RateLimit) {
+	t.Helper()
+	s, err := loadRateLimits(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, savedStore := rateLimits.Load(), rateLimiter
+	t.Cleanup(func() { rateLimits.Store(saved); rateLimiter = savedStore })
+	rateLimits.Store(s)
+	rateLimiter = &memoryRateLimitStore{windows: map[string]*memoryWindow{}}
+}
+
+func TestRateLimitRulesMatchPathsAsFiberRoutes(t *testing.T) {
+	useRateLimits(t, config.RateLimit{Rules: []string{"/items/**=3/1m"}, Default: "100/1m"})
+	app := newTestApp()
+	app.Use(rateLimitMiddleware())
+	app.Get("/items/:id", func(c *fiber.Ctx) error {
+		return c.SendString(c.Params("id"))
+	})
+
+	for i, path := range []string{"/items/1", "/ITEMS/1", "/Items/1/", "/items/1/"} {
+		resp := call(t, app, http.MethodGet, path, "")
+		if got := resp.Header.Get("X-RateLimit-Limit"); got != "3" {
+			t.Errorf("GET %s: limit %q, want the 3 of /items/**", path, got)
+		}
+		want := http.StatusOK
+		if i == 3 {
+			want = http.StatusTooManyRequests
+		}
+		if resp.StatusCode != want {
+			t.Errorf("GET %s, request %d: got %d, want %d", path, i+1, resp.StatusCode, want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// realmConfig is one entry of the REALMS_FILE JSON array
+type realmConfig struct {
+	Issuer       string   `json:"issuer"`
+	JWKSURL      string   `json:"jwksUrl"`
+	RoleSources  []string `json:"roleSources"`
+	RoleClientID string   `json:"roleClientId"`
+	Audiences    []string `json:"audiences"`
+}
+
+// realm holds the per-issuer validation keys and role rules
+type realm struct {
+	issuer    string
+	jwksURL   string
+	keySet    *jwksKeySet // set when VERIFY_JWT=true
+	roles     RoleExtractor
+	audiences []string
+}
+
+// realms maps issuer URL (without trailing slash) to its realm. When set,
+// tokens from any other issuer are rejected.
+var realms map[string]*realm
+
+// realmFor returns the configured realm for iss, or nil
+func realmFor(iss string) *realm {
+	return realms[strings.TrimSuffix(iss, "/")]
+}
+
+// Load the realms served by this instance from REALMS_FILE, e.g.
+//
+//	[{"issuer": "http://keycloak:8080/realms/a", "roleSources": ["realm_access"]},
+//	 {"issuer": "http://keycloak:8080/realms/b", "audiences": ["b-app"]}]
+//
+// Realms without roleSources use the global role extractor.
+func initRealms() {
+	path := cfg.Auth.RealmsFile
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal().Err(err).Msg("REALMS_FILE error")
+	}
+	var configs []realmConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		log.Fatal().Err(err).Msg("REALMS_FILE error")
+	}
+
+	realms = map[string]*realm{}
+	for _, rc := range configs {
+		r, err := newRealm(rc)
+		if err != nil {
+			log.Fatal().Err(err).Msg("REALMS_FILE error")
+		}
+		if _, dup := realms[r.issuer]; dup {
+			log.Fatal().Msgf("REALMS_FILE error: realm %q listed twice", r.issuer)
+		}
+		realms[r.issuer] = r
+		log.Info().Str("issuer", r.issuer).Msg("Serving realm")
+	}
+}
+
+func newRealm(rc realmConfig) (*realm, error) {
+	issuer := strings.TrimSuffix(rc.Issuer, "/")
+	if issuer == "" {
+		return nil, fmt.Errorf("realm without issuer")
+	}
+	r := &realm{
+		issuer:    issuer,
+		jwksURL:   rc.JWKSURL,
+		audiences: rc.Audiences,
+	}
+	if r.jwksURL == "" {
+		r.jwksURL = issuer + "/protocol/openid-connect/certs"
+	}
+	if len(rc.RoleSources) > 0 {
+		for _, s := range rc.RoleSources {
+			switch s {
+			case "roles", "realm_access", "resource_access":
+			default:
+				return nil, fmt.Errorf("realm %q: unknown role source %q", issuer, s)
+			}
+		}
+		r.roles = &keycloakRoleExtractor{sources: rc.RoleSources, clientID: rc.RoleClientID}
+	}
+	return r, nil
+}
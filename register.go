@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/config"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Bounds of the fields of POST /register
+const (
+	minPassword = 8
+	maxPassword = 128
+	maxName     = 100
+)
+
+var (
+	// registration is set when REGISTRATION=true
+	registration bool
+	// registerRoles are the realm roles of new users, REGISTER_ROLES
+	registerRoles = []string{"user"}
+	// registerLimit and registerWindow bound registrations per client IP,
+	// REGISTER_RATE_LIMIT
+	registerLimit  int64 = 5
+	registerWindow       = time.Hour
+)
+
+// usernamePattern is what usernames look like once lowercased, as Keycloak
+// stores them
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{2,49}$`)
+
+// reservedUsernamePrefix is how Keycloak names the users of service
+// accounts, which nobody may register as
+const reservedUsernamePrefix = "service-account-"
+
+// registerBody is the body of POST /register
+type registerBody struct {
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+}
+
+func (b *registerBody) validate() error {
+	b.Username = strings.ToLower(strings.TrimSpace(b.Username))
+	b.Email = strings.ToLower(strings.TrimSpace(b.Email))
+	b.FirstName, b.LastName = strings.TrimSpace(b.FirstName), strings.TrimSpace(b.LastName)
+	details := fiber.Map{}
+	if !usernamePattern.MatchString(b.Username) || strings.HasPrefix(b.Username, reservedUsernamePrefix) {
+		details["username"] = "3 to 50 letters, digits, dots, dashes and underscores, starting with a letter or digit and not with service-account-"
+	}
+	if addr, err := mail.ParseAddress(b.Email); err != nil || addr.Address != b.Email {
+		details["email"] = "an email address"
+	}
+	if n := len([]rune(b.Password)); n < minPassword || n > maxPassword {
+		details["password"] = "8 to 128 characters"
+	}
+	if len([]rune(b.FirstName)) > maxName {
+		details["firstName"] = "up to 100 characters"
+	}
+	if len([]rune(b.LastName)) > maxName {
+		details["lastName"] = "up to 100 characters"
+	}
+	if len(details) > 0 {
+		return apperror.Validation("Invalid body", details)
+	}
+	return nil
+}
+
+// keycloakMessage returns the message of a Keycloak error body, which the
+// Admin API puts in errorMessage or error_description
+func keycloakMessage(body string) string {
+	var reply struct {
+		ErrorMessage     string `json:"errorMessage"`
+		ErrorDescription string `json:"error_description"`
+	}
+	_ = json.Unmarshal([]byte(body), &reply)
+	if reply.ErrorMessage != "" {
+		return reply.ErrorMessage
+	}
+	return reply.ErrorDescription
+}
+
+// usernameTaken tells whether Keycloak has a user named username
+func usernameTaken(ctx context.Context, kc *keycloakClient, username string) (bool, error) {
+	var found []keycloakUser
+	query := url.Values{"username": {username}, "exact": {"true"}, "briefRepresentation": {"true"}}
+	if err := kc.admin(ctx, http.MethodGet, "/users", query, nil, &found); err != nil {
+		return false, err
+	}
+	return len(found) > 0, nil
+}
+
+// usernameSuggestions returns up to three free usernames close to taken,
+// for the reply to a conflict; lookups failing leave fewer
+func usernameSuggestions(ctx context.Context, kc *keycloakClient, taken string) []string {
+	base := taken
+	if len(base) > 46 {
+		base = base[:46]
+	}
+	suggestions := []string{}
+	for attempt := 0; attempt < 5 && len(suggestions) < 3; attempt++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(1000))
+		if err != nil {
+			break
+		}
+		candidate := fmt.Sprintf("%s%03d", base, n.Int64())
+		if containsString(suggestions, candidate) {
+			continue
+		}
+		if exists, err := usernameTaken(ctx, kc, candidate); err == nil && !exists {
+			suggestions = append(suggestions, candidate)
+		}
+	}
+	return suggestions
+}
+
+// registrationError maps a failed user creation. Keycloak answers 409 for
+// a taken username or email, and 400 for a password its policy refuses.
+func registrationError(ctx context.Context, kc *keycloakClient, body *registerBody, err error) error {
+	var kcErr *keycloakError
+	if !errors.As(err, &kcErr) {
+		return apperror.Internal("Keycloak Admin API error", err)
+	}
+	msg := keycloakMessage(kcErr.Body)
+	switch kcErr.Status {
+	case http.StatusConflict:
+		if strings.Contains(strings.ToLower(msg), "email") {
+			conflict := apperror.Conflict("An account with this email exists; sign in or reset its password")
+			conflict.Code = "email_taken"
+			return conflict
+		}
+		conflict := apperror.Conflict("This username is taken")
+		conflict.Code = "username_taken"
+		conflict.Details = fiber.Map{"suggestions": usernameSuggestions(ctx, kc, body.Username)}
+		return conflict
+	case http.StatusBadRequest:
+		if msg == "" {
+			msg = "Keycloak refused the account"
+		}
+		return apperror.Validation("Invalid body", fiber.Map{"password": msg})
+	}
+	return keycloakAdminError(err)
+}
+
+// createUser creates the Keycloak user of body, to verify their email
+// before signing in, and returns its ID
+func createUser(ctx context.Context, kc *keycloakClient, body *registerBody) (string, error) {
+	user := fiber.Map{
+		"username":        body.Username,
+		"email":           body.Email,
+		"firstName":       body.FirstName,
+		"lastName":        body.LastName,
+		"enabled":         true,
+		"emailVerified":   false,
+		"requiredActions": []string{"VERIFY_EMAIL"},
+		"credentials":     []fiber.Map{{"type": "password", "value": body.Password, "temporary": false}},
+	}
+	if err := kc.admin(ctx, http.MethodPost, "/users", nil, user, nil); err != nil {
+		return "", err
+	}
+	// The ID is only in the Location of the reply, which kc.admin discards
+	var found []keycloakUser
+	query := url.Values{"username": {body.Username}, "exact": {"true"}, "briefRepresentation": {"true"}}
+	if err := kc.admin(ctx, http.MethodGet, "/users", query, nil, &found); err != nil {
+		return "", err
+	}
+	if len(found) != 1 {
+		return "", fmt.Errorf("created user %s not found", body.Username)
+	}
+	return found[0].ID, nil
+}
+
+// starterPreferences are the preferences of new accounts, which
+// preferenceSchema accepts
+func starterPreferences() map[string]interface{} {
+	return map[string]interface{}{
+		"theme": "system",
+		"notifications": map[string]interface{}{
+			"email":  true,
+			"push":   false,
+			"digest": "weekly",
+		},
+	}
+}
+
+// grantDefaultRoles maps registerRoles to the user id
+func grantDefaultRoles(ctx context.Context, kc *keycloakClient, id string) error {
+	if len(registerRoles) == 0 {
+		return nil
+	}
+	resolver := &roleResolver{ctx: ctx, kc: kc, clients: map[string]string{}}
+	roles, err := resolver.realm(registerRoles)
+	if err != nil {
+		return err
+	}
+	return kc.admin(ctx, http.MethodPost, "/users/"+url.PathEscape(id)+"/role-mappings/realm", nil, roles, nil)
+}
+
+// registerRegistrationRoutes mounts POST /register, creating an account
+// for anyone: a Keycloak user, who verifies their email before signing
+// in, with the roles of REGISTER_ROLES and a starter profile. A user
+// created but left without their roles is deleted again, so a retry
+// doesn't meet a half-made account.
+func registerRegistrationRoutes(app *fiber.App, users repository.UserRepository) {
+	kc := keycloak()
+
+	app.Post("/register", rateLimit("register", registerLimit, registerWindow), func(c *fiber.Ctx) error {
+		var body registerBody
+		if err := decodeStrict(c.Body(), &body); err != nil {
+			return err
+		}
+		if err := body.validate(); err != nil {
+			return err
+		}
+		ctx := c.UserContext()
+		id, err := createUser(ctx, kc, &body)
+		if err != nil {
+			return registrationError(ctx, kc, &body, err)
+		}
+		if err := grantDefaultRoles(ctx, kc, id); err != nil {
+			if derr := kc.admin(ctx, http.MethodDelete, "/users/"+url.PathEscape(id), nil, nil, nil); derr != nil {
+				requestLogger(ctx).Error().Err(derr).Str("user", id).Msg("Cannot delete user left without default roles")
+			}
+			var appErr *apperror.Error
+			if errors.As(err, &appErr) {
+				// A REGISTER_ROLES role missing from the realm
+				return apperror.Internal("Registration is misconfigured", err)
+			}
+			return keycloakAdminError(err)
+		}
+		// Keycloak's mail reaches the user with a link, Keycloak also asks on
+		// their first sign-in
+		if err := kc.admin(ctx, http.MethodPut, "/users/"+url.PathEscape(id)+"/send-verify-email", nil, nil, nil); err != nil {
+			requestLogger(ctx).Warn().Err(err).Str("user", id).Msg("Cannot send the verification email")
+		}
+		now := time.Now().UTC()
+		profile := &repository.UserProfile{
+			ID:                 id,
+			Username:           body.Username,
+			Email:              body.Email,
+			DisplayName:        strings.TrimSpace(body.FirstName + " " + body.LastName),
+			CreatedAt:          now,
+			Roles:              append([]string{}, registerRoles...),
+			Preferences:        starterPreferences(),
+			PreferencesVersion: 1,
+		}
+		if err := users.Save(ctx, profile); err != nil {
+			// The account works without it; the profile then starts at sign-in
+			requestLogger(ctx).Error().Err(err).Str("user", id).Msg("Cannot create the starter profile")
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"id":                id,
+			"username":          body.Username,
+			"email":             body.Email,
+			"emailVerification": "pending",
+		})
+	})
+}
+
+// Enable POST /register when REGISTRATION=true
+func initRegistration() {
+	if !cfg.Users.Registration {
+		return
+	}
+	initKeycloakAdminURL("REGISTRATION")
+	registerRoles = cfg.Users.RegisterRoles
+	var err error
+	if registerLimit, registerWindow, err = config.ParseRateLimit(cfg.Users.RegisterRateLimit); err != nil {
+		log.Fatal().Err(err).Msg("REGISTER_RATE_LIMIT error")
+	}
+	registration = true
+	log.Info().Strs("roles", registerRoles).Msg("Self-registration enabled")
+}
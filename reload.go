@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/example/fiber-demo/config"
+	"github.com/rs/zerolog/log"
+)
+
+// reloadMu serialises reloads triggered by SIGHUP and the file watcher
+var reloadMu sync.Mutex
+
+// reloadConfig reads the configuration again and swaps in the route
+// policies, CORS settings and rate limits it names. Either everything valid
+// is applied or, on any error, nothing is and the running settings stay.
+// Other settings still need a restart.
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	loaded, err := config.Load(configArgs)
+	if err != nil {
+		return err
+	}
+	if err := loaded.Validate(); err != nil {
+		return err
+	}
+	var policies *[]policyRule
+	if path := loaded.Auth.PolicyFile; path != "" {
+		rules, err := loadPolicies(path)
+		if err != nil {
+			return fmt.Errorf("POLICY_FILE: %v", err)
+		}
+		policies = &rules
+	}
+	limits, err := loadRateLimits(loaded.RateLimit)
+	if err != nil {
+		return err
+	}
+
+	policyRules.Store(policies)
+	corsHandler.Store(loadCORS(loaded.CORS))
+	rateLimits.Store(limits)
+	policyCount := 0
+	if policies != nil {
+		policyCount = len(*policies)
+	}
+	log.Info().Int("policies", policyCount).Strs("corsOrigins", loaded.CORS.AllowedOrigins).
+		Int("rateLimits", len(limits.rules)).Int("rateLimitTiers", len(limits.tiers)).Msg("Configuration reloaded")
+	return nil
+}
+
+// watchReloadFiles polls the files a reload reads and reloads once any of
+// them changes; polling also follows the symlink swaps Kubernetes uses to
+// update mounted ConfigMaps
+func watchReloadFiles(interval time.Duration) {
+	modTimes := map[string]time.Time{}
+	changed := func() bool {
+		found := false
+		for _, f := range cfg.ReloadFiles() {
+			info, err := os.Stat(f)
+			if err != nil {
+				continue
+			}
+			if last, seen := modTimes[f]; seen && info.ModTime().After(last) {
+				found = true
+			}
+			modTimes[f] = info.ModTime()
+		}
+		return found
+	}
+	changed()
+	for range time.Tick(interval) {
+		if !changed() {
+			continue
+		}
+		if err := reloadConfig(); err != nil {
+			log.Error().Err(err).Msg("Configuration reload error, keeping the running settings")
+		}
+	}
+}
+
+// Reload on SIGHUP, and when a watched file changes, checked every
+// RELOAD_INTERVAL (default 30s, 0 disables watching)
+func initReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Info().Msg("SIGHUP received, reloading configuration")
+			if err := reloadConfig(); err != nil {
+				log.Error().Err(err).Msg("Configuration reload error, keeping the running settings")
+			}
+		}
+	}()
+
+	if interval := cfg.ReloadInterval; interval > 0 && len(cfg.ReloadFiles()) > 0 {
+		go watchReloadFiles(interval)
+	}
+}
@@ -0,0 +1,223 @@
+package repository
+
+import "context"
+
+// Access levels, each including the ones before it. Grants give read or
+// write; owner is the record's owner's alone, needed to delete the record
+// or change its grants.
+const (
+	AccessRead  = "read"
+	AccessWrite = "write"
+	AccessOwner = "owner"
+)
+
+var accessRank = map[string]int{AccessRead: 1, AccessWrite: 2, AccessOwner: 3}
+
+// ValidGrantAccess tells whether access can be granted
+func ValidGrantAccess(access string) bool {
+	return access == AccessRead || access == AccessWrite
+}
+
+// Grant shares a record with a subject, or with the members of a group
+type Grant struct {
+	Subject string `json:"sub,omitempty" bson:"sub,omitempty"`
+	Group   string `json:"group,omitempty" bson:"group,omitempty"`
+	Access  string `json:"access" bson:"access"`
+}
+
+// Principal is who a call is made on behalf of, for the ACL checks
+type Principal struct {
+	Subject string
+	// Groups the subject is a member of, each listed with its ancestors,
+	// since a grant to a group covers its subgroups
+	Groups []string
+	// Superuser reaches every record, like admins
+	Superuser bool
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns ctx for calls on behalf of p
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalOf returns the principal of ctx, or nil
+func PrincipalOf(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// Allowed is the ACL check: whether p has access to a record of owner
+// shared by grants. A nil p is the service itself and has every access.
+func Allowed(p *Principal, owner string, grants []Grant, access string) bool {
+	if p == nil || p.Superuser || (owner != "" && owner == p.Subject) {
+		return true
+	}
+	if access == AccessOwner {
+		return false
+	}
+	for _, g := range grants {
+		if accessRank[g.Access] < accessRank[access] {
+			continue
+		}
+		if (g.Subject != "" && g.Subject == p.Subject) || (g.Group != "" && containsString(p.Groups, g.Group)) {
+			return true
+		}
+	}
+	return false
+}
+
+// reader returns the principal whose reads of ctx are filtered, or nil
+func reader(ctx context.Context) *Principal {
+	if p := PrincipalOf(ctx); p != nil && !p.Superuser {
+		return p
+	}
+	return nil
+}
+
+// WithACL wraps the item repositories of repos with the ACL checks, for
+// calls whose context carries a Principal: reads only see the items the
+// principal owns or is granted, writes need write access, and deletes and
+// changes to an item's grants need its owner. Items it can't read are
+// ErrNotFound, so their existence doesn't leak.
+func WithACL(repos *Repositories) *Repositories {
+	wrapped := *repos
+	wrapped.Items = &aclItems{next: repos.Items}
+	wrapped.Search = &aclSearch{next: repos.Search}
+	if repos.Events != nil {
+		wrapped.Events = &aclWatcher{next: repos.Events}
+	}
+	return &wrapped
+}
+
+type aclItems struct {
+	next ItemRepository
+}
+
+// check loads the item id and checks p's access to it
+func (a *aclItems) check(ctx context.Context, id, access string) (*Item, error) {
+	item, err := a.next.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	p := PrincipalOf(ctx)
+	if !Allowed(p, item.OwnerID, item.ACL, AccessRead) {
+		return nil, ErrNotFound
+	}
+	if !Allowed(p, item.OwnerID, item.ACL, access) {
+		return nil, ErrForbidden
+	}
+	return item, nil
+}
+
+func (a *aclItems) OwnerOf(ctx context.Context, id string) (string, error) {
+	if _, err := a.check(ctx, id, AccessRead); err != nil {
+		return "", err
+	}
+	return a.next.OwnerOf(ctx, id)
+}
+
+func (a *aclItems) Count(ctx context.Context, filter ItemFilter) (int64, error) {
+	filter.Reader = reader(ctx)
+	return a.next.Count(ctx, filter)
+}
+
+func (a *aclItems) List(ctx context.Context, filter ItemFilter, page Page) ([]Item, string, error) {
+	filter.Reader = reader(ctx)
+	return a.next.List(ctx, filter, page)
+}
+
+func (a *aclItems) Get(ctx context.Context, id string) (*Item, error) {
+	return a.check(ctx, id, AccessRead)
+}
+
+func (a *aclItems) Create(ctx context.Context, item *Item) error {
+	return a.next.Create(ctx, item)
+}
+
+func (a *aclItems) CreateMany(ctx context.Context, items []*Item, ordered bool) ([]error, error) {
+	return a.next.CreateMany(ctx, items, ordered)
+}
+
+// Update takes write access, and the owner's to change the owner or the
+// grants
+func (a *aclItems) Update(ctx context.Context, item *Item) error {
+	stored, err := a.check(ctx, item.ID, AccessWrite)
+	if err != nil {
+		return err
+	}
+	if (stored.OwnerID != item.OwnerID || !sameGrants(stored.ACL, item.ACL)) &&
+		!Allowed(PrincipalOf(ctx), stored.OwnerID, stored.ACL, AccessOwner) {
+		return ErrForbidden
+	}
+	return a.next.Update(ctx, item)
+}
+
+func (a *aclItems) Delete(ctx context.Context, id string) error {
+	if _, err := a.check(ctx, id, AccessOwner); err != nil {
+		return err
+	}
+	return a.next.Delete(ctx, id)
+}
+
+func (a *aclItems) Restore(ctx context.Context, id string) (*Item, error) {
+	return a.next.Restore(ctx, id)
+}
+
+func (a *aclItems) Near(ctx context.Context, q NearQuery) ([]NearItem, error) {
+	q.Filter.Reader = reader(ctx)
+	return a.next.Near(ctx, q)
+}
+
+func sameGrants(a, b []Grant) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type aclSearch struct {
+	next ItemSearcher
+}
+
+func (a *aclSearch) Provider() string { return a.next.Provider() }
+
+func (a *aclSearch) Search(ctx context.Context, q SearchQuery) (*SearchResult, error) {
+	q.Reader = reader(ctx)
+	return a.next.Search(ctx, q)
+}
+
+// aclWatcher drops the events of items the principal can't read. Deletes
+// carry no item and pass, exposing only the ID.
+type aclWatcher struct {
+	next ItemWatcher
+}
+
+func (a *aclWatcher) WatchItems(ctx context.Context, token string) (ItemStream, error) {
+	stream, err := a.next.WatchItems(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return &aclStream{ItemStream: stream, p: reader(ctx)}, nil
+}
+
+type aclStream struct {
+	ItemStream
+	p *Principal
+}
+
+func (s *aclStream) Next(ctx context.Context) bool {
+	for s.ItemStream.Next(ctx) {
+		ev := s.ItemStream.Event()
+		if ev.Item == nil || Allowed(s.p, ev.Item.OwnerID, ev.Item.ACL, AccessRead) {
+			return true
+		}
+	}
+	return false
+}
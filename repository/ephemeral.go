@@ -0,0 +1,194 @@
+package repository
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EphemeralCollections are the collections of EphemeralRepository records,
+// given their TTL index by the migrations. Add a collection here before
+// using it with NewEphemeral.
+var EphemeralCollections = []string{
+	"terminated_sessions",
+	"revoked_tokens",
+	"revoked_subjects",
+	"idempotency_keys",
+}
+
+// mongoEphemeral stores each record as its document, plus _id and
+// expiresAt, the field of the TTL index
+type mongoEphemeral struct {
+	coll *mongo.Collection
+}
+
+// NewEphemeral returns an EphemeralRepository over collection, one of
+// EphemeralCollections
+func NewEphemeral(db *mongo.Database, collection string) EphemeralRepository {
+	return &mongoEphemeral{coll: db.Collection(collection)}
+}
+
+func (m *mongoEphemeral) Put(ctx context.Context, key string, record interface{}, expiresAt time.Time) error {
+	doc := bson.M{}
+	if record != nil {
+		raw, err := bson.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			return err
+		}
+	}
+	doc["_id"] = key
+	doc["expiresAt"] = expiresAt
+	_, err := m.coll.ReplaceOne(ctx, bson.M{"_id": key}, doc, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (m *mongoEphemeral) Get(ctx context.Context, key string, record interface{}) error {
+	// The TTL monitor runs once a minute, so expired records can linger
+	res := m.coll.FindOne(ctx, bson.M{"_id": key, "expiresAt": bson.M{"$gt": time.Now()}})
+	if record == nil {
+		return mongoErr(res.Err())
+	}
+	return mongoErr(res.Decode(record))
+}
+
+func (m *mongoEphemeral) Delete(ctx context.Context, key string) error {
+	res, err := m.coll.DeleteOne(ctx, bson.M{"_id": key})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// memoryEphemeral keeps records BSON-encoded, so Get decodes them like the
+// Mongo repository does. Expired records are swept as new ones come in.
+type memoryEphemeral struct {
+	mu        sync.Mutex
+	records   map[string]memoryRecord
+	lastSweep time.Time
+}
+
+type memoryRecord struct {
+	raw       bson.Raw
+	expiresAt time.Time
+}
+
+// memorySweepInterval spaces out the sweeps of expired records
+const memorySweepInterval = time.Minute
+
+// NewMemoryEphemeral returns an EphemeralRepository in memory, for
+// NewMemory's repositories
+func NewMemoryEphemeral() EphemeralRepository {
+	return &memoryEphemeral{records: map[string]memoryRecord{}}
+}
+
+func (m *memoryEphemeral) Put(ctx context.Context, key string, record interface{}, expiresAt time.Time) error {
+	var raw bson.Raw
+	if record != nil {
+		var err error
+		if raw, err = bson.Marshal(record); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now := time.Now(); now.Sub(m.lastSweep) >= memorySweepInterval {
+		for k, r := range m.records {
+			if !r.expiresAt.After(now) {
+				delete(m.records, k)
+			}
+		}
+		m.lastSweep = now
+	}
+	m.records[strings.Clone(key)] = memoryRecord{raw: raw, expiresAt: expiresAt}
+	return nil
+}
+
+func (m *memoryEphemeral) Get(ctx context.Context, key string, record interface{}) error {
+	m.mu.Lock()
+	r, ok := m.records[key]
+	m.mu.Unlock()
+	if !ok || !r.expiresAt.After(time.Now()) {
+		return ErrNotFound
+	}
+	if record == nil || r.raw == nil {
+		return nil
+	}
+	return bson.Unmarshal(r.raw, record)
+}
+
+func (m *memoryEphemeral) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.records[key]; !ok {
+		return ErrNotFound
+	}
+	delete(m.records, key)
+	return nil
+}
+
+// postgresEphemeral keeps records BSON-encoded in the ephemeral table,
+// keyed by collection, so Get decodes them like the Mongo repository does.
+// Expired rows are swept as new ones come in.
+type postgresEphemeral struct {
+	pool       *pgxpool.Pool
+	collection string
+	sweeper    pgSweeper
+}
+
+// NewPostgresEphemeral returns an EphemeralRepository over the rows of
+// collection, one of EphemeralCollections, in the ephemeral table
+func NewPostgresEphemeral(pool *pgxpool.Pool, collection string) EphemeralRepository {
+	return &postgresEphemeral{pool: pool, collection: collection}
+}
+
+func (p *postgresEphemeral) Put(ctx context.Context, key string, record interface{}, expiresAt time.Time) error {
+	var raw []byte
+	if record != nil {
+		var err error
+		if raw, err = bson.Marshal(record); err != nil {
+			return err
+		}
+	}
+	if err := p.sweeper.sweep(ctx, p.pool, "DELETE FROM ephemeral WHERE collection = $1 AND expires_at <= now()", p.collection); err != nil {
+		return err
+	}
+	_, err := p.pool.Exec(ctx, `INSERT INTO ephemeral (collection, key, record, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (collection, key) DO UPDATE SET record = EXCLUDED.record, expires_at = EXCLUDED.expires_at`,
+		p.collection, key, raw, expiresAt)
+	return err
+}
+
+func (p *postgresEphemeral) Get(ctx context.Context, key string, record interface{}) error {
+	var raw []byte
+	err := p.pool.QueryRow(ctx, "SELECT record FROM ephemeral WHERE collection = $1 AND key = $2 AND expires_at > now()", p.collection, key).Scan(&raw)
+	if err != nil {
+		return pgErr(err)
+	}
+	if record == nil || raw == nil {
+		return nil
+	}
+	return bson.Unmarshal(raw, record)
+}
+
+func (p *postgresEphemeral) Delete(ctx context.Context, key string) error {
+	tag, err := p.pool.Exec(ctx, "DELETE FROM ephemeral WHERE collection = $1 AND key = $2", p.collection, key)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// gridFSStore keeps files in the default GridFS bucket, fs.files and
+// fs.chunks, with the owner and content type in the file's metadata
+type gridFSStore struct {
+	db *mongo.Database
+}
+
+// gridFSMetadata is the metadata of a GridFS file
+type gridFSMetadata struct {
+	OwnerID     string `bson:"ownerId"`
+	ContentType string `bson:"contentType"`
+}
+
+// bucket returns a bucket bounded by the deadline of ctx. Deadlines are
+// per bucket, so concurrent requests each get their own.
+func (s *gridFSStore) bucket(ctx context.Context) (*gridfs.Bucket, error) {
+	b, err := gridfs.NewBucket(s.db)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = b.SetReadDeadline(deadline)
+		_ = b.SetWriteDeadline(deadline)
+	}
+	return b, nil
+}
+
+func (s *gridFSStore) Upload(ctx context.Context, info *FileInfo, content io.Reader) error {
+	b, err := s.bucket(ctx)
+	if err != nil {
+		return err
+	}
+	meta := gridFSMetadata{OwnerID: info.OwnerID, ContentType: info.ContentType}
+	up, err := b.OpenUploadStream(info.Name, options.GridFSUpload().SetMetadata(meta))
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(up, content)
+	if err != nil {
+		_ = up.Abort()
+		return err
+	}
+	if err := up.Close(); err != nil {
+		return err
+	}
+	info.ID = up.FileID.(primitive.ObjectID).Hex()
+	info.Size = n
+	// The driver stamps uploadDate on Close too, at millisecond precision
+	info.UploadedAt = time.Now().UTC().Truncate(time.Millisecond)
+	return nil
+}
+
+// gridFSFile is a document of fs.files
+type gridFSFile struct {
+	ID         interface{}        `bson:"_id"`
+	Length     int64              `bson:"length"`
+	Name       string             `bson:"filename"`
+	UploadDate primitive.DateTime `bson:"uploadDate"`
+	Metadata   gridFSMetadata     `bson:"metadata"`
+}
+
+func (f *gridFSFile) info() *FileInfo {
+	return &FileInfo{
+		ID:          idString(f.ID),
+		Name:        f.Name,
+		ContentType: f.Metadata.ContentType,
+		Size:        f.Length,
+		OwnerID:     f.Metadata.OwnerID,
+		UploadedAt:  f.UploadDate.Time().UTC(),
+	}
+}
+
+func (s *gridFSStore) Stat(ctx context.Context, id string) (*FileInfo, error) {
+	var f gridFSFile
+	if err := s.db.Collection("fs.files").FindOne(ctx, bson.M{"_id": mongoID(id)}).Decode(&f); err != nil {
+		return nil, mongoErr(err)
+	}
+	return f.info(), nil
+}
+
+func (s *gridFSStore) Open(ctx context.Context, id string) (*FileInfo, io.ReadCloser, error) {
+	info, err := s.Stat(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := s.bucket(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	down, err := b.OpenDownloadStream(mongoID(id))
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return info, down, nil
+}
+
+func (s *gridFSStore) OwnerOf(ctx context.Context, id string) (string, error) {
+	info, err := s.Stat(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return info.OwnerID, nil
+}
+
+// PresignURL is unsupported: GridFS content is only reachable through the
+// database
+func (s *gridFSStore) PresignURL(ctx context.Context, id string, ttl time.Duration) (string, error) {
+	return "", ErrPresignUnsupported
+}
+
+func (s *gridFSStore) Delete(ctx context.Context, id string) error {
+	b, err := s.bucket(ctx)
+	if err != nil {
+		return err
+	}
+	err = b.DeleteContext(ctx, mongoID(id))
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
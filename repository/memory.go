@@ -0,0 +1,739 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// NewMemory returns repositories keeping everything in the process's
+// memory, for demos and tests: nothing survives a restart, and each replica
+// has its own data. Records are copied in and out, so callers can't change
+// them behind the store's back. Writes to several repositories aren't
+// atomic, and there is no schema validation beyond the uniqueness of item
+// names.
+func NewMemory() *Repositories {
+	watcher := &memoryWatcher{subs: map[*memoryStream]struct{}{}}
+	items := &memoryItems{items: map[string]*Item{}, watcher: watcher}
+	return &Repositories{
+		Items:  items,
+		Users:  &memoryUsers{users: map[string]*UserProfile{}},
+		Audit:  &memoryAudit{},
+		Events: watcher,
+		Files:  &memoryFiles{files: map[string]*memoryFile{}},
+		Stats:  &memoryStats{items: items},
+		Search: &memorySearch{items: items},
+		Tx:     memoryTx{},
+	}
+}
+
+// memoryTx runs fn directly: memory writes can't be rolled back
+type memoryTx struct{}
+
+func (memoryTx) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+// detach copies src into dst through BSON, as the Mongo repositories store
+// records, so the store keeps no reference to the caller's memory, such as
+// request buffers Fiber reuses
+func detach(src, dst interface{}) error {
+	raw, err := bson.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, dst)
+}
+
+// compareValues orders two values of a sort field, which are of the same
+// type; nil and zero times sort first, as missing fields do in MongoDB
+func compareValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case string:
+		return strings.Compare(a, b.(string))
+	case float64:
+		b := b.(float64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	case *time.Time:
+		b := b.(*time.Time)
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		case b == nil:
+			return 1
+		}
+		return a.Compare(*b)
+	}
+	return 0
+}
+
+// compareBy orders a and b by sort, then by ID, given the value of each
+// field of a record
+func compareBy(sort []SortField, a, b interface{}, field func(record interface{}, name string) interface{}) int {
+	for _, s := range sort {
+		if c := compareValues(field(a, s.Field), field(b, s.Field)); c != 0 {
+			if s.Desc {
+				return -c
+			}
+			return c
+		}
+	}
+	return strings.Compare(field(a, "_id").(string), field(b, "_id").(string))
+}
+
+// window returns the records of page among n sorted ones, as start and end
+// indexes
+func window(n int, page Page) (int, int) {
+	start := page.Offset
+	if start > n {
+		start = n
+	}
+	end := n
+	if page.Limit > 0 && start+page.Limit < n {
+		end = start + page.Limit
+	}
+	return start, end
+}
+
+// cloneItem copies item deeply enough that the copy shares nothing mutable
+func cloneItem(item Item) Item {
+	if item.Tags != nil {
+		item.Tags = append([]string{}, item.Tags...)
+	}
+	if item.Location != nil {
+		loc := *item.Location
+		loc.Coordinates = append([]float64{}, loc.Coordinates...)
+		item.Location = &loc
+	}
+	if item.DeletedAt != nil {
+		at := *item.DeletedAt
+		item.DeletedAt = &at
+	}
+	if item.ACL != nil {
+		item.ACL = append([]Grant{}, item.ACL...)
+	}
+	return item
+}
+
+// itemField is the value of an item's sort field, "_id" being the ID
+func itemField(record interface{}, name string) interface{} {
+	item := record.(*Item)
+	switch name {
+	case "_id":
+		return item.ID
+	case "name":
+		return item.Name
+	case "price":
+		return item.Price
+	case "createdAt":
+		return item.CreatedAt
+	case "updatedAt":
+		return item.UpdatedAt
+	case "deletedAt":
+		return item.DeletedAt
+	}
+	return nil
+}
+
+func matchItem(item *Item, f ItemFilter) bool {
+	switch {
+	case (item.DeletedAt != nil) != f.Deleted:
+		return false
+	case f.OwnerID != "" && item.OwnerID != f.OwnerID:
+		return false
+	case f.Tag != "" && !containsString(item.Tags, f.Tag):
+		return false
+	case f.NameContains != "" && !strings.Contains(strings.ToLower(item.Name), strings.ToLower(f.NameContains)):
+		return false
+	case f.MinPrice != nil && item.Price < *f.MinPrice:
+		return false
+	case f.MaxPrice != nil && item.Price > *f.MaxPrice:
+		return false
+	case f.Reader != nil && !Allowed(f.Reader, item.OwnerID, item.ACL, AccessRead):
+		return false
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type memoryItems struct {
+	mu      sync.RWMutex
+	items   map[string]*Item
+	watcher *memoryWatcher
+}
+
+// matching returns the stored items f matches; the caller holds the lock
+func (m *memoryItems) matching(f ItemFilter) []*Item {
+	var out []*Item
+	for _, item := range m.items {
+		if matchItem(item, f) {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// nameTaken tells whether an item other than id has name, deleted ones
+// included like the unique index; the caller holds the lock
+func (m *memoryItems) nameTaken(name, id string) bool {
+	for _, item := range m.items {
+		if item.Name == name && item.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memoryItems) Count(ctx context.Context, filter ItemFilter) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return int64(len(m.matching(filter))), nil
+}
+
+// List pages with the cursors of the Mongo repository, so a cursor reads
+// the same wherever it was issued
+func (m *memoryItems) List(ctx context.Context, filter ItemFilter, page Page) ([]Item, string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	matched := m.matching(filter)
+	if page.Cursor != "" {
+		after, err := cursorItem(page)
+		if err != nil {
+			return nil, "", err
+		}
+		rest := matched[:0]
+		for _, item := range matched {
+			if compareBy(page.Sort, item, after, itemField) > 0 {
+				rest = append(rest, item)
+			}
+		}
+		matched = rest
+		page.Offset = 0
+	}
+	sort.Slice(matched, func(i, j int) bool { return compareBy(page.Sort, matched[i], matched[j], itemField) < 0 })
+	start, end := window(len(matched), page)
+	items := make([]Item, 0, end-start)
+	for _, item := range matched[start:end] {
+		items = append(items, cloneItem(*item))
+	}
+	next := ""
+	if page.Limit > 0 && len(items) == page.Limit {
+		last := items[len(items)-1]
+		raw, err := bson.Marshal(itemDoc{ID: mongoID(last.ID), Item: last})
+		if err != nil {
+			return nil, "", err
+		}
+		if next, err = encodeCursor(page.Sort, raw); err != nil {
+			return nil, "", err
+		}
+	}
+	return items, next, nil
+}
+
+// cursorItem rebuilds the last item of the previous page from its cursor,
+// as far as the sort goes
+func cursorItem(page Page) (*Item, error) {
+	c, err := decodeCursor(page)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	for i, s := range page.Sort {
+		doc[s.Field] = c.Values[i]
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var item Item
+	if err := bson.Unmarshal(raw, &item); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	item.ID = idString(c.ID)
+	return &item, nil
+}
+
+// earthRadius is the mean radius of the Earth in meters, as $geoNear uses
+const earthRadius = 6378100
+
+// distance is the great-circle distance between two points, in meters
+func distance(a, b *GeoPoint) float64 {
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	lng1, lat1 := rad(a.Coordinates[0]), rad(a.Coordinates[1])
+	lng2, lat2 := rad(b.Coordinates[0]), rad(b.Coordinates[1])
+	h := math.Pow(math.Sin((lat2-lat1)/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin((lng2-lng1)/2), 2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+func (m *memoryItems) Near(ctx context.Context, q NearQuery) ([]NearItem, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	at := NewGeoPoint(q.Lat, q.Lng)
+	var near []NearItem
+	for _, item := range m.matching(q.Filter) {
+		if item.Location == nil || len(item.Location.Coordinates) != 2 {
+			continue
+		}
+		if d := distance(at, item.Location); d <= q.Radius {
+			near = append(near, NearItem{Item: cloneItem(*item), Distance: d})
+		}
+	}
+	sort.Slice(near, func(i, j int) bool {
+		if near[i].Distance != near[j].Distance {
+			return near[i].Distance < near[j].Distance
+		}
+		return near[i].ID < near[j].ID
+	})
+	start, end := window(len(near), q.Page)
+	return near[start:end], nil
+}
+
+func (m *memoryItems) Get(ctx context.Context, id string) (*Item, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	item, ok := m.items[id]
+	if !ok || item.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+	out := cloneItem(*item)
+	return &out, nil
+}
+
+func (m *memoryItems) OwnerOf(ctx context.Context, id string) (string, error) {
+	item, err := m.Get(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return item.OwnerID, nil
+}
+
+// insert stores item under a new ID; the caller holds the lock
+func (m *memoryItems) insert(item *Item) error {
+	if m.nameTaken(item.Name, "") {
+		return ErrDuplicate
+	}
+	item.ID = primitive.NewObjectID().Hex()
+	item.Version = 1
+	var stored Item
+	if err := detach(item, &stored); err != nil {
+		return err
+	}
+	stored.ID = item.ID
+	m.items[item.ID] = &stored
+	m.watcher.publish(ItemEvent{Type: ItemCreated, ID: item.ID, Item: &stored})
+	return nil
+}
+
+func (m *memoryItems) Create(ctx context.Context, item *Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.insert(item)
+}
+
+func (m *memoryItems) CreateMany(ctx context.Context, items []*Item, ordered bool) ([]error, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	errs := make([]error, len(items))
+	for i, item := range items {
+		if errs[i] = m.insert(item); errs[i] != nil && ordered {
+			for j := i + 1; j < len(items); j++ {
+				errs[j] = ErrNotAttempted
+			}
+			break
+		}
+	}
+	return errs, nil
+}
+
+func (m *memoryItems) Update(ctx context.Context, item *Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.items[item.ID]
+	switch {
+	case !ok || stored.DeletedAt != nil:
+		return ErrNotFound
+	case stored.Version != item.Version:
+		return ErrVersionConflict
+	case m.nameTaken(item.Name, item.ID):
+		return ErrDuplicate
+	}
+	var next Item
+	if err := detach(item, &next); err != nil {
+		return err
+	}
+	next.ID = stored.ID
+	next.Version++
+	m.items[stored.ID] = &next
+	item.Version = next.Version
+	m.watcher.publish(ItemEvent{Type: ItemUpdated, ID: item.ID, Item: &next})
+	return nil
+}
+
+func (m *memoryItems) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.items[id]
+	if !ok || item.DeletedAt != nil {
+		return ErrNotFound
+	}
+	now := time.Now().UTC()
+	deleted := cloneItem(*item)
+	deleted.DeletedAt = &now
+	m.items[id] = &deleted
+	m.watcher.publish(ItemEvent{Type: ItemDeleted, ID: id})
+	return nil
+}
+
+func (m *memoryItems) Restore(ctx context.Context, id string) (*Item, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.items[id]
+	if !ok || item.DeletedAt == nil {
+		return nil, ErrNotFound
+	}
+	restored := cloneItem(*item)
+	restored.DeletedAt = nil
+	m.items[id] = &restored
+	m.watcher.publish(ItemEvent{Type: ItemCreated, ID: id, Item: &restored})
+	out := cloneItem(restored)
+	return &out, nil
+}
+
+// cloneUser copies user, which only shares DeletedAt
+func cloneUser(user UserProfile) UserProfile {
+	if user.DeletedAt != nil {
+		at := *user.DeletedAt
+		user.DeletedAt = &at
+	}
+	if user.Roles != nil {
+		user.Roles = append([]string{}, user.Roles...)
+	}
+	if user.Preferences != nil {
+		var prefs map[string]interface{}
+		_ = detach(user.Preferences, &prefs)
+		user.Preferences = prefs
+	}
+	return user
+}
+
+func userField(record interface{}, name string) interface{} {
+	user := record.(*UserProfile)
+	switch name {
+	case "_id":
+		return user.ID
+	case "username":
+		return user.Username
+	case "createdAt":
+		return user.CreatedAt
+	case "deletedAt":
+		return user.DeletedAt
+	}
+	return nil
+}
+
+type memoryUsers struct {
+	mu    sync.RWMutex
+	users map[string]*UserProfile
+}
+
+func (m *memoryUsers) Get(ctx context.Context, id string) (*UserProfile, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, ok := m.users[id]
+	if !ok || user.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+	out := cloneUser(*user)
+	return &out, nil
+}
+
+func (m *memoryUsers) Save(ctx context.Context, user *UserProfile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var stored UserProfile
+	if err := detach(user, &stored); err != nil {
+		return err
+	}
+	m.users[stored.ID] = &stored
+	return nil
+}
+
+func (m *memoryUsers) Provision(ctx context.Context, user *UserProfile) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var next UserProfile
+	if stored, ok := m.users[user.ID]; ok {
+		next = cloneUser(*stored)
+	} else {
+		next = UserProfile{ID: user.ID, CreatedAt: user.LastSeenAt, FirstSeenAt: user.LastSeenAt}
+	}
+	next.Username, next.Email, next.DisplayName = user.Username, user.Email, user.DisplayName
+	next.Roles = append([]string(nil), user.Roles...)
+	next.LastSeenAt = user.LastSeenAt
+	if next.FirstSeenAt.IsZero() {
+		next.FirstSeenAt = user.LastSeenAt
+	}
+	m.users[next.ID] = &next
+	return nil
+}
+
+func (m *memoryUsers) SetPreferences(ctx context.Context, id string, prefs map[string]interface{}, version int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.users[id]
+	switch {
+	case !ok || stored.DeletedAt != nil:
+		return 0, ErrNotFound
+	case stored.PreferencesVersion != version:
+		return 0, ErrVersionConflict
+	}
+	next := cloneUser(*stored)
+	next.Preferences = nil
+	if prefs != nil {
+		if err := detach(prefs, &next.Preferences); err != nil {
+			return 0, err
+		}
+	}
+	next.PreferencesVersion++
+	next.UpdatedAt = time.Now().UTC()
+	m.users[id] = &next
+	return next.PreferencesVersion, nil
+}
+
+func (m *memoryUsers) Count(ctx context.Context) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var n int64
+	for _, user := range m.users {
+		if user.DeletedAt == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryUsers) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[id]
+	if !ok || user.DeletedAt != nil {
+		return ErrNotFound
+	}
+	now := time.Now().UTC()
+	deleted := cloneUser(*user)
+	deleted.DeletedAt = &now
+	m.users[id] = &deleted
+	return nil
+}
+
+func (m *memoryUsers) ListDeleted(ctx context.Context, page Page) ([]UserProfile, int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var deleted []*UserProfile
+	for _, user := range m.users {
+		if user.DeletedAt != nil {
+			deleted = append(deleted, user)
+		}
+	}
+	sort.Slice(deleted, func(i, j int) bool { return compareBy(page.Sort, deleted[i], deleted[j], userField) < 0 })
+	start, end := window(len(deleted), page)
+	users := make([]UserProfile, 0, end-start)
+	for _, user := range deleted[start:end] {
+		users = append(users, cloneUser(*user))
+	}
+	return users, int64(len(deleted)), nil
+}
+
+func (m *memoryUsers) Restore(ctx context.Context, id string) (*UserProfile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[id]
+	if !ok || user.DeletedAt == nil {
+		return nil, ErrNotFound
+	}
+	restored := cloneUser(*user)
+	restored.DeletedAt = nil
+	m.users[id] = &restored
+	out := restored
+	return &out, nil
+}
+
+// memoryAudit keeps the entries in recording order; expired ones are
+// dropped as new ones come in
+type memoryAudit struct {
+	mu      sync.RWMutex
+	entries []AuditEntry
+}
+
+func auditField(record interface{}, name string) interface{} {
+	entry := record.(*AuditEntry)
+	switch name {
+	case "_id":
+		return entry.ID
+	case "at":
+		return entry.At
+	}
+	return nil
+}
+
+func matchAudit(entry *AuditEntry, f AuditFilter) bool {
+	switch {
+	case f.Actor != "" && entry.Actor.Subject != f.Actor:
+		return false
+	case f.Method != "" && entry.Method != f.Method:
+		return false
+	case f.Route != "" && entry.Route != f.Route:
+		return false
+	case f.ResourceID != "" && entry.ResourceID != f.ResourceID:
+		return false
+	case !f.Since.IsZero() && entry.At.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !entry.At.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+func (m *memoryAudit) Record(ctx context.Context, entry *AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	kept := m.entries[:0]
+	for _, e := range m.entries {
+		if e.ExpiresAt.IsZero() || e.ExpiresAt.After(now) {
+			kept = append(kept, e)
+		}
+	}
+	var stored AuditEntry
+	if err := detach(entry, &stored); err != nil {
+		return err
+	}
+	entry.ID = primitive.NewObjectID().Hex()
+	stored.ID = entry.ID
+	stored.ExpiresAt = entry.ExpiresAt
+	m.entries = append(kept, stored)
+	return nil
+}
+
+func (m *memoryAudit) List(ctx context.Context, filter AuditFilter, page Page) ([]AuditEntry, int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(page.Sort) == 0 {
+		page.Sort = []SortField{{Field: "at", Desc: true}}
+	}
+	var matched []*AuditEntry
+	for i := range m.entries {
+		if matchAudit(&m.entries[i], filter) {
+			matched = append(matched, &m.entries[i])
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return compareBy(page.Sort, matched[i], matched[j], auditField) < 0 })
+	start, end := window(len(matched), page)
+	entries := make([]AuditEntry, 0, end-start)
+	for _, entry := range matched[start:end] {
+		entries = append(entries, *entry)
+	}
+	return entries, int64(len(matched)), nil
+}
+
+// memoryFile is a stored file and its content
+type memoryFile struct {
+	info    FileInfo
+	content []byte
+}
+
+type memoryFiles struct {
+	mu    sync.RWMutex
+	files map[string]*memoryFile
+}
+
+func (m *memoryFiles) Upload(ctx context.Context, info *FileInfo, content io.Reader) error {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	info.ID = primitive.NewObjectID().Hex()
+	info.Size = int64(len(data))
+	info.UploadedAt = time.Now().UTC()
+	var stored FileInfo
+	if err := detach(info, &stored); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[info.ID] = &memoryFile{info: stored, content: data}
+	return nil
+}
+
+func (m *memoryFiles) Stat(ctx context.Context, id string) (*FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, ok := m.files[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	info := f.info
+	return &info, nil
+}
+
+// Open hands out the stored content, which is never modified in place
+func (m *memoryFiles) Open(ctx context.Context, id string) (*FileInfo, io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, ok := m.files[id]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	info := f.info
+	return &info, io.NopCloser(bytes.NewReader(f.content)), nil
+}
+
+func (m *memoryFiles) OwnerOf(ctx context.Context, id string) (string, error) {
+	info, err := m.Stat(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return info.OwnerID, nil
+}
+
+// PresignURL is unsupported: the content is only reachable through the
+// service
+func (m *memoryFiles) PresignURL(ctx context.Context, id string, ttl time.Duration) (string, error) {
+	return "", ErrPresignUnsupported
+}
+
+func (m *memoryFiles) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.files, id)
+	return nil
+}
@@ -0,0 +1,99 @@
+package repository
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// memorySearch matches whole words of searchPaths, case-insensitively,
+// ranking items by how many of the query's words they have. Fuzzy is
+// ignored; autocomplete matches name prefixes.
+type memorySearch struct {
+	items *memoryItems
+}
+
+func (s *memorySearch) Provider() string { return "memory" }
+
+// words splits s into its lowercase words
+func words(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// score counts the words of terms among those of item's searchPaths
+func score(item *Item, terms []string) int {
+	have := map[string]bool{}
+	for _, w := range words(item.Name + " " + item.Description + " " + strings.Join(item.Tags, " ")) {
+		have[w] = true
+	}
+	n := 0
+	for _, t := range terms {
+		if have[t] {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *memorySearch) Search(ctx context.Context, q SearchQuery) (*SearchResult, error) {
+	s.items.mu.RLock()
+	defer s.items.mu.RUnlock()
+	type match struct {
+		item  *Item
+		score int
+	}
+	var matches []match
+	terms := words(q.Text)
+	prefix := strings.ToLower(q.Text)
+	for _, item := range s.items.matching(ItemFilter{Tag: q.Tag, Reader: q.Reader}) {
+		if q.Autocomplete {
+			if strings.HasPrefix(strings.ToLower(item.Name), prefix) {
+				matches = append(matches, match{item: item})
+			}
+		} else if n := score(item, terms); n > 0 {
+			matches = append(matches, match{item: item, score: n})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		if a.item.Name != b.item.Name {
+			return a.item.Name < b.item.Name
+		}
+		return a.item.ID < b.item.ID
+	})
+
+	res := &SearchResult{Items: []Item{}, Total: int64(len(matches))}
+	start, end := window(len(matches), q.Page)
+	for _, m := range matches[start:end] {
+		res.Items = append(res.Items, cloneItem(*m.item))
+	}
+	if q.Facets {
+		counts := map[string]int64{}
+		for _, m := range matches {
+			for _, tag := range m.item.Tags {
+				counts[tag]++
+			}
+		}
+		tags := []FacetCount{}
+		for tag, n := range counts {
+			tags = append(tags, FacetCount{Value: tag, Count: n})
+		}
+		sort.Slice(tags, func(i, j int) bool {
+			if tags[i].Count != tags[j].Count {
+				return tags[i].Count > tags[j].Count
+			}
+			return tags[i].Value < tags[j].Value
+		})
+		if len(tags) > searchFacetLimit {
+			tags = tags[:searchFacetLimit]
+		}
+		res.Facets = map[string][]FacetCount{"tags": tags}
+	}
+	return res, nil
+}
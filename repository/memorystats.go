@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// memoryStats computes the statistics of mongoStats over memoryItems
+type memoryStats struct {
+	items *memoryItems
+}
+
+func (m *memoryStats) Stats() []StatInfo {
+	infos := make([]StatInfo, len(mongoStats))
+	for i, s := range mongoStats {
+		infos[i] = s.StatInfo
+	}
+	return infos
+}
+
+// group is a bucket of a statistic: its items' count, price total and
+// latest creation
+type group struct {
+	key   string
+	count int
+	sum   float64
+	last  time.Time
+}
+
+// groups buckets the live items created in the window of p by the keys
+// an item is in
+func (m *memoryStats) groups(p StatParams, keys func(item *Item) []string) []*group {
+	m.items.mu.RLock()
+	defer m.items.mu.RUnlock()
+	byKey := map[string]*group{}
+	var out []*group
+	for _, item := range m.items.matching(ItemFilter{}) {
+		if (!p.Since.IsZero() && item.CreatedAt.Before(p.Since)) || (!p.Until.IsZero() && !item.CreatedAt.Before(p.Until)) {
+			continue
+		}
+		for _, key := range keys(item) {
+			g, ok := byKey[key]
+			if !ok {
+				g = &group{key: key}
+				byKey[key] = g
+				out = append(out, g)
+			}
+			g.count++
+			g.sum += item.Price
+			if item.CreatedAt.After(g.last) {
+				g.last = item.CreatedAt
+			}
+		}
+	}
+	return out
+}
+
+// largestFirst sorts groups by count, then key, keeping the first limit
+func largestFirst(groups []*group, limit int) []*group {
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].count != groups[j].count {
+			return groups[i].count > groups[j].count
+		}
+		return groups[i].key < groups[j].key
+	})
+	start, end := window(len(groups), Page{Limit: limit})
+	return groups[start:end]
+}
+
+func (m *memoryStats) Run(ctx context.Context, name string, params StatParams) ([]StatRow, error) {
+	rows := []StatRow{}
+	switch name {
+	case "items-by-tag":
+		for _, g := range largestFirst(m.groups(params, func(item *Item) []string { return item.Tags }), params.Limit) {
+			rows = append(rows, StatRow{"tag": g.key, "count": g.count, "avgPrice": g.sum / float64(g.count)})
+		}
+	case "items-by-owner":
+		for _, g := range largestFirst(m.groups(params, func(item *Item) []string { return []string{item.OwnerID} }), params.Limit) {
+			rows = append(rows, StatRow{"ownerId": g.key, "count": g.count, "lastCreatedAt": g.last})
+		}
+	case "items-created-daily":
+		groups := m.groups(params, func(item *Item) []string { return []string{item.CreatedAt.UTC().Format("2006-01-02")} })
+		sort.Slice(groups, func(i, j int) bool { return groups[i].key > groups[j].key })
+		start, end := window(len(groups), Page{Limit: params.Limit})
+		for _, g := range groups[start:end] {
+			rows = append(rows, StatRow{"day": g.key, "count": g.count})
+		}
+	default:
+		return nil, ErrNotFound
+	}
+	return rows, nil
+}
@@ -0,0 +1,129 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// Limits of the memory change feed: the events kept for resuming, and those
+// a slow stream may fall behind by before it is cut, room for a full replay
+const (
+	memoryEventHistory = 1000
+	memoryStreamBuffer = memoryEventHistory
+)
+
+// errStreamBehind ends a stream whose reader can't keep up; it resumes from
+// its last token like after any failure
+var errStreamBehind = errors.New("change stream fell behind")
+
+// memoryWatcher feeds the writes of memoryItems to its streams. Tokens are
+// sequence numbers; the latest events are kept to resume from.
+type memoryWatcher struct {
+	mu      sync.Mutex
+	seq     int64
+	history []ItemEvent
+	subs    map[*memoryStream]struct{}
+}
+
+// publish numbers ev and hands it to every stream; the caller holds the
+// lock of the items
+func (w *memoryWatcher) publish(ev ItemEvent) {
+	if ev.Item != nil {
+		item := cloneItem(*ev.Item)
+		ev.Item = &item
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.seq++
+	ev.Token = strconv.FormatInt(w.seq, 10)
+	w.history = append(w.history, ev)
+	if len(w.history) > memoryEventHistory {
+		w.history = w.history[len(w.history)-memoryEventHistory:]
+	}
+	for s := range w.subs {
+		s.send(ev)
+	}
+}
+
+func (w *memoryWatcher) WatchItems(ctx context.Context, token string) (ItemStream, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := &memoryStream{watcher: w, events: make(chan ItemEvent, memoryStreamBuffer)}
+	if token != "" {
+		after, err := strconv.ParseInt(token, 10, 64)
+		first := w.seq - int64(len(w.history)) // the last event no longer kept
+		if err != nil || after < first || after > w.seq {
+			return nil, ErrStaleResumeToken
+		}
+		for _, ev := range w.history[after-first:] {
+			s.send(ev)
+		}
+	}
+	w.subs[s] = struct{}{}
+	return s, nil
+}
+
+// memoryStream receives events on a buffered channel, closed when the
+// stream ends
+type memoryStream struct {
+	watcher *memoryWatcher
+	events  chan ItemEvent
+	event   ItemEvent
+	// err and closed are guarded by the watcher's lock
+	err    error
+	closed bool
+}
+
+// send queues ev, cutting the stream when it is full; the caller holds the
+// watcher's lock
+func (s *memoryStream) send(ev ItemEvent) {
+	if s.closed {
+		return
+	}
+	select {
+	case s.events <- ev:
+	default:
+		s.err = errStreamBehind
+		s.end()
+	}
+}
+
+// end closes the channel and unsubscribes; the caller holds the watcher's
+// lock
+func (s *memoryStream) end() {
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+		delete(s.watcher.subs, s)
+	}
+}
+
+func (s *memoryStream) Next(ctx context.Context) bool {
+	select {
+	case ev, ok := <-s.events:
+		if !ok {
+			return false
+		}
+		s.event = ev
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *memoryStream) Event() ItemEvent { return s.event }
+
+func (s *memoryStream) Err() error {
+	s.watcher.mu.Lock()
+	defer s.watcher.mu.Unlock()
+	return s.err
+}
+
+func (s *memoryStream) Close(ctx context.Context) error {
+	s.watcher.mu.Lock()
+	defer s.watcher.mu.Unlock()
+	s.end()
+	return nil
+}
@@ -0,0 +1,528 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewMongo returns repositories over the items and users collections of db.
+// Without transactions, see SupportsTransactions, Tx runs its writes one
+// by one. concerns sets the read preference and read and write concerns of
+// the repositories named by key: items, users, audit, events, files, stats
+// and search; the others inherit db's.
+func NewMongo(db *mongo.Database, transactions bool, concerns map[string]*options.DatabaseOptions) *Repositories {
+	// Repositories with concerns of their own use db through another handle
+	in := func(repo string) *mongo.Database {
+		if opts, ok := concerns[repo]; ok {
+			return db.Client().Database(db.Name(), opts)
+		}
+		return db
+	}
+	return &Repositories{
+		Items:  &mongoItems{coll: in("items").Collection("items")},
+		Users:  &mongoUsers{coll: in("users").Collection("users")},
+		Audit:  &mongoAudit{coll: in("audit").Collection("audit_logs")},
+		Events: &mongoWatcher{coll: in("events").Collection("items")},
+		Files:  &gridFSStore{db: in("files")},
+		Stats:  &mongoStatsRunner{db: in("stats")},
+		Search: &textSearch{coll: in("search").Collection("items")},
+		Tx:     &mongoTx{client: db.Client(), enabled: transactions},
+	}
+}
+
+// mongoID matches hex IDs as ObjectIDs, anything else as a string _id
+func mongoID(id string) interface{} {
+	if oid, err := primitive.ObjectIDFromHex(id); err == nil {
+		return oid
+	}
+	return id
+}
+
+// idString is the string form of a stored _id
+func idString(id interface{}) string {
+	switch v := id.(type) {
+	case primitive.ObjectID:
+		return v.Hex()
+	case string:
+		return v
+	default:
+		return ""
+	}
+}
+
+// live matches documents that aren't soft-deleted
+var live = bson.M{"deletedAt": nil}
+
+// byID matches the live document with id
+func byID(id interface{}) bson.M {
+	return bson.M{"_id": id, "deletedAt": nil}
+}
+
+// deletedByID matches the soft-deleted document with id
+func deletedByID(id interface{}) bson.M {
+	return bson.M{"_id": id, "deletedAt": bson.M{"$ne": nil}}
+}
+
+// softDelete stamps the live document with id as deleted
+func softDelete(ctx context.Context, coll *mongo.Collection, id interface{}) error {
+	res, err := coll.UpdateOne(ctx, byID(id), bson.M{"$set": bson.M{"deletedAt": time.Now().UTC()}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// restore clears deletedAt of the deleted document with id and decodes the
+// result into v
+func restore(ctx context.Context, coll *mongo.Collection, id interface{}, v interface{}) error {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	res := coll.FindOneAndUpdate(ctx, deletedByID(id), bson.M{"$unset": bson.M{"deletedAt": ""}}, opts)
+	return mongoErr(res.Decode(v))
+}
+
+// mongoErr maps driver errors to the package's
+func mongoErr(err error) error {
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return ErrNotFound
+	case mongo.IsDuplicateKeyError(err):
+		return ErrDuplicate
+	}
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && serverErr.HasErrorCode(documentValidationFailure) {
+		return fmt.Errorf("%w: %v", ErrSchemaViolation, err)
+	}
+	return err
+}
+
+// documentValidationFailure is the server's code for writes a collection
+// validator rejects
+const documentValidationFailure = 121
+
+type mongoItems struct {
+	coll *mongo.Collection
+}
+
+// itemDoc adds the _id, which Item leaves to the backend
+type itemDoc struct {
+	ID   interface{} `bson:"_id,omitempty"`
+	Item `bson:",inline"`
+}
+
+func (doc *itemDoc) item() Item {
+	item := doc.Item
+	item.ID = idString(doc.ID)
+	return item
+}
+
+func itemQuery(f ItemFilter) bson.M {
+	q := bson.M{"deletedAt": nil}
+	if f.Deleted {
+		q["deletedAt"] = bson.M{"$ne": nil}
+	}
+	if f.OwnerID != "" {
+		q["ownerId"] = f.OwnerID
+	}
+	if f.Tag != "" {
+		q["tags"] = f.Tag
+	}
+	if f.NameContains != "" {
+		q["name"] = primitive.Regex{Pattern: regexp.QuoteMeta(f.NameContains), Options: "i"}
+	}
+	price := bson.M{}
+	if f.MinPrice != nil {
+		price["$gte"] = *f.MinPrice
+	}
+	if f.MaxPrice != nil {
+		price["$lte"] = *f.MaxPrice
+	}
+	if len(price) > 0 {
+		q["price"] = price
+	}
+	if f.Reader != nil {
+		q["$or"] = readerQuery(f.Reader)
+	}
+	return q
+}
+
+// readerQuery matches the items p owns or is granted, for an $or
+func readerQuery(p *Principal) bson.A {
+	or := bson.A{bson.M{"ownerId": p.Subject}, bson.M{"acl.sub": p.Subject}}
+	if len(p.Groups) > 0 {
+		or = append(or, bson.M{"acl.group": bson.M{"$in": p.Groups}})
+	}
+	return or
+}
+
+// findOptions applies page; sort fields are bson names, with _id last as
+// the tie-breaker
+func findOptions(page Page) *options.FindOptions {
+	sort := bson.D{}
+	for _, s := range page.Sort {
+		dir := 1
+		if s.Desc {
+			dir = -1
+		}
+		sort = append(sort, bson.E{Key: s.Field, Value: dir})
+	}
+	sort = append(sort, bson.E{Key: "_id", Value: 1})
+	opts := options.Find().SetSort(sort).SetSkip(int64(page.Offset))
+	if page.Limit > 0 {
+		opts.SetLimit(int64(page.Limit))
+	}
+	return opts
+}
+
+func (m *mongoItems) Count(ctx context.Context, filter ItemFilter) (int64, error) {
+	return m.coll.CountDocuments(ctx, itemQuery(filter))
+}
+
+func (m *mongoItems) List(ctx context.Context, filter ItemFilter, page Page) ([]Item, string, error) {
+	query := itemQuery(filter)
+	if page.Cursor != "" {
+		after, err := afterCursor(page)
+		if err != nil {
+			return nil, "", err
+		}
+		query = bson.M{"$and": []bson.M{query, after}}
+		page.Offset = 0
+	}
+	cursor, err := m.coll.Find(ctx, query, findOptions(page))
+	if err != nil {
+		return nil, "", err
+	}
+	var raws []bson.Raw
+	if err := cursor.All(ctx, &raws); err != nil {
+		return nil, "", err
+	}
+	items := make([]Item, len(raws))
+	for i, raw := range raws {
+		var doc itemDoc
+		if err := bson.Unmarshal(raw, &doc); err != nil {
+			return nil, "", err
+		}
+		items[i] = doc.item()
+	}
+	next := ""
+	if page.Limit > 0 && len(raws) == page.Limit {
+		if next, err = encodeCursor(page.Sort, raws[len(raws)-1]); err != nil {
+			return nil, "", err
+		}
+	}
+	return items, next, nil
+}
+
+func (m *mongoItems) Near(ctx context.Context, q NearQuery) ([]NearItem, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$geoNear", Value: bson.M{
+			"near":          NewGeoPoint(q.Lat, q.Lng),
+			"distanceField": "distance",
+			"maxDistance":   q.Radius,
+			"spherical":     true,
+			"query":         itemQuery(q.Filter),
+		}}},
+		{{Key: "$skip", Value: q.Page.Offset}},
+		{{Key: "$limit", Value: q.Page.Limit}},
+	}
+	cur, err := m.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		Doc      itemDoc `bson:",inline"`
+		Distance float64 `bson:"distance"`
+	}
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	items := make([]NearItem, len(docs))
+	for i, doc := range docs {
+		items[i] = NearItem{Item: doc.Doc.item(), Distance: doc.Distance}
+	}
+	return items, nil
+}
+
+func (m *mongoItems) Get(ctx context.Context, id string) (*Item, error) {
+	var doc itemDoc
+	if err := m.coll.FindOne(ctx, byID(mongoID(id))).Decode(&doc); err != nil {
+		return nil, mongoErr(err)
+	}
+	item := doc.item()
+	return &item, nil
+}
+
+func (m *mongoItems) OwnerOf(ctx context.Context, id string) (string, error) {
+	var doc struct {
+		OwnerID string `bson:"ownerId"`
+	}
+	opts := options.FindOne().SetProjection(bson.M{"ownerId": 1})
+	if err := m.coll.FindOne(ctx, byID(mongoID(id)), opts).Decode(&doc); err != nil {
+		return "", mongoErr(err)
+	}
+	return doc.OwnerID, nil
+}
+
+func (m *mongoItems) Create(ctx context.Context, item *Item) error {
+	oid := primitive.NewObjectID()
+	item.Version = 1
+	if _, err := m.coll.InsertOne(ctx, itemDoc{ID: oid, Item: *item}); err != nil {
+		return mongoErr(err)
+	}
+	item.ID = oid.Hex()
+	return nil
+}
+
+func (m *mongoItems) CreateMany(ctx context.Context, items []*Item, ordered bool) ([]error, error) {
+	errs := make([]error, len(items))
+	if len(items) == 0 {
+		return errs, nil
+	}
+	ids := make([]primitive.ObjectID, len(items))
+	models := make([]mongo.WriteModel, len(items))
+	for i, item := range items {
+		ids[i] = primitive.NewObjectID()
+		item.Version = 1
+		models[i] = mongo.NewInsertOneModel().SetDocument(itemDoc{ID: ids[i], Item: *item})
+	}
+	_, err := m.coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(ordered))
+	var bulkErr mongo.BulkWriteException
+	if err != nil && (!errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) == 0) {
+		return nil, mongoErr(err)
+	}
+	for _, we := range bulkErr.WriteErrors {
+		switch we.Code {
+		case 11000:
+			errs[we.Index] = ErrDuplicate
+		case documentValidationFailure:
+			errs[we.Index] = fmt.Errorf("%w: %v", ErrSchemaViolation, we)
+		default:
+			errs[we.Index] = we
+		}
+		if ordered {
+			for i := we.Index + 1; i < len(items); i++ {
+				errs[i] = ErrNotAttempted
+			}
+		}
+	}
+	for i, item := range items {
+		if errs[i] == nil {
+			item.ID = ids[i].Hex()
+		}
+	}
+	return errs, nil
+}
+
+func (m *mongoItems) Update(ctx context.Context, item *Item) error {
+	query := byID(mongoID(item.ID))
+	query["version"] = item.Version
+	next := *item
+	next.Version++
+	res, err := m.coll.ReplaceOne(ctx, query, next)
+	if err != nil {
+		return mongoErr(err)
+	}
+	if res.MatchedCount == 0 {
+		// Tell a stale version from a missing item
+		n, err := m.coll.CountDocuments(ctx, byID(mongoID(item.ID)))
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrVersionConflict
+		}
+		return ErrNotFound
+	}
+	item.Version = next.Version
+	return nil
+}
+
+func (m *mongoItems) Delete(ctx context.Context, id string) error {
+	return softDelete(ctx, m.coll, mongoID(id))
+}
+
+func (m *mongoItems) Restore(ctx context.Context, id string) (*Item, error) {
+	var doc itemDoc
+	if err := restore(ctx, m.coll, mongoID(id), &doc); err != nil {
+		return nil, err
+	}
+	item := doc.item()
+	return &item, nil
+}
+
+type mongoUsers struct {
+	coll *mongo.Collection
+}
+
+func (m *mongoUsers) Get(ctx context.Context, id string) (*UserProfile, error) {
+	var user UserProfile
+	if err := m.coll.FindOne(ctx, byID(id)).Decode(&user); err != nil {
+		return nil, mongoErr(err)
+	}
+	return &user, nil
+}
+
+func (m *mongoUsers) Save(ctx context.Context, user *UserProfile) error {
+	_, err := m.coll.ReplaceOne(ctx, bson.M{"_id": user.ID}, user, options.Replace().SetUpsert(true))
+	return mongoErr(err)
+}
+
+func (m *mongoUsers) Provision(ctx context.Context, user *UserProfile) error {
+	update := bson.M{
+		"$set": bson.M{
+			"username":    user.Username,
+			"email":       user.Email,
+			"displayName": user.DisplayName,
+			"roles":       user.Roles,
+			"lastSeenAt":  user.LastSeenAt,
+		},
+		"$setOnInsert": bson.M{"createdAt": user.LastSeenAt},
+		// Sets firstSeenAt where it is missing
+		"$min": bson.M{"firstSeenAt": user.LastSeenAt},
+	}
+	_, err := m.coll.UpdateOne(ctx, bson.M{"_id": user.ID}, update, options.Update().SetUpsert(true))
+	return mongoErr(err)
+}
+
+func (m *mongoUsers) SetPreferences(ctx context.Context, id string, prefs map[string]interface{}, version int64) (int64, error) {
+	query := byID(id)
+	query["preferencesVersion"] = version
+	if version == 0 {
+		// Set before the field existed
+		query["preferencesVersion"] = bson.M{"$in": bson.A{int64(0), nil}}
+	}
+	update := bson.M{
+		"$set": bson.M{"preferences": prefs, "updatedAt": time.Now().UTC()},
+		"$inc": bson.M{"preferencesVersion": int64(1)},
+	}
+	res, err := m.coll.UpdateOne(ctx, query, update)
+	if err != nil {
+		return 0, mongoErr(err)
+	}
+	if res.MatchedCount == 0 {
+		// Tell a stale version from a missing profile
+		n, err := m.coll.CountDocuments(ctx, byID(id))
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			return 0, ErrVersionConflict
+		}
+		return 0, ErrNotFound
+	}
+	return version + 1, nil
+}
+
+func (m *mongoUsers) Count(ctx context.Context) (int64, error) {
+	return m.coll.CountDocuments(ctx, live)
+}
+
+func (m *mongoUsers) Delete(ctx context.Context, id string) error {
+	return softDelete(ctx, m.coll, id)
+}
+
+func (m *mongoUsers) ListDeleted(ctx context.Context, page Page) ([]UserProfile, int64, error) {
+	deleted := bson.M{"deletedAt": bson.M{"$ne": nil}}
+	total, err := m.coll.CountDocuments(ctx, deleted)
+	if err != nil {
+		return nil, 0, err
+	}
+	cursor, err := m.coll.Find(ctx, deleted, findOptions(page))
+	if err != nil {
+		return nil, 0, err
+	}
+	var users []UserProfile
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+func (m *mongoUsers) Restore(ctx context.Context, id string) (*UserProfile, error) {
+	var user UserProfile
+	if err := restore(ctx, m.coll, id, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+type mongoAudit struct {
+	coll *mongo.Collection
+}
+
+// auditDoc adds the _id, which AuditEntry leaves to the backend
+type auditDoc struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	AuditEntry `bson:",inline"`
+}
+
+func (m *mongoAudit) Record(ctx context.Context, entry *AuditEntry) error {
+	oid := primitive.NewObjectID()
+	if _, err := m.coll.InsertOne(ctx, auditDoc{ID: oid, AuditEntry: *entry}); err != nil {
+		return err
+	}
+	entry.ID = oid.Hex()
+	return nil
+}
+
+func auditQuery(f AuditFilter) bson.M {
+	q := bson.M{}
+	if f.Actor != "" {
+		q["actor.sub"] = f.Actor
+	}
+	if f.Method != "" {
+		q["method"] = f.Method
+	}
+	if f.Route != "" {
+		q["route"] = f.Route
+	}
+	if f.ResourceID != "" {
+		q["resourceId"] = f.ResourceID
+	}
+	at := bson.M{}
+	if !f.Since.IsZero() {
+		at["$gte"] = f.Since
+	}
+	if !f.Until.IsZero() {
+		at["$lt"] = f.Until
+	}
+	if len(at) > 0 {
+		q["at"] = at
+	}
+	return q
+}
+
+func (m *mongoAudit) List(ctx context.Context, filter AuditFilter, page Page) ([]AuditEntry, int64, error) {
+	query := auditQuery(filter)
+	total, err := m.coll.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(page.Sort) == 0 {
+		page.Sort = []SortField{{Field: "at", Desc: true}}
+	}
+	cursor, err := m.coll.Find(ctx, query, findOptions(page))
+	if err != nil {
+		return nil, 0, err
+	}
+	var docs []auditDoc
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, 0, err
+	}
+	entries := make([]AuditEntry, len(docs))
+	for i, doc := range docs {
+		entries[i] = doc.AuditEntry
+		entries[i].ID = doc.ID.Hex()
+	}
+	return entries, total, nil
+}
@@ -0,0 +1,114 @@
+package repository
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// mongoCursor is the decoded form of a Page.Cursor: the sort it was issued
+// for and the sort values and _id of the last record returned. It is BSON
+// so values keep their types (dates stay dates).
+type mongoCursor struct {
+	Sort   string        `bson:"s"`
+	Values []interface{} `bson:"v"`
+	ID     interface{}   `bson:"id"`
+}
+
+// sortKey identifies a sort order, so a cursor can't be replayed against
+// another one
+func sortKey(sort []SortField) string {
+	parts := make([]string, len(sort))
+	for i, s := range sort {
+		parts[i] = s.Field
+		if s.Desc {
+			parts[i] = "-" + s.Field
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// encodeCursor returns the cursor continuing after raw, the last document
+// of a page
+func encodeCursor(sort []SortField, raw bson.Raw) (string, error) {
+	c := mongoCursor{Sort: sortKey(sort), ID: lookup(raw, "_id")}
+	for _, s := range sort {
+		c.Values = append(c.Values, lookup(raw, s.Field))
+	}
+	data, err := bson.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// lookup returns the field of raw, or nil when it is missing or null
+func lookup(raw bson.Raw, key string) interface{} {
+	v, err := raw.LookupErr(key)
+	if err != nil || v.Type == bson.TypeNull {
+		return nil
+	}
+	return v
+}
+
+// decodeCursor decodes the cursor of page, checking it was issued for the
+// page's sort
+func decodeCursor(page Page) (*mongoCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(page.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c mongoCursor
+	if err := bson.Unmarshal(data, &c); err != nil || c.Sort != sortKey(page.Sort) || len(c.Values) != len(page.Sort) {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// afterCursor is the query matching the records after the cursor in the
+// page's order: for sort a, b those with a past the cursor's, or the same a
+// and b past it, and so on down to the _id tie-breaker.
+//
+// Fields can be missing, e.g. updatedAt of items never updated. Mongo sorts
+// them before every value, and $gt or $lt never match them, so: ascending,
+// every present value is past a missing one; descending, missing ones are
+// past every value, and nothing is past them.
+func afterCursor(page Page) (bson.M, error) {
+	c, err := decodeCursor(page)
+	if err != nil {
+		return nil, err
+	}
+	fields := append(append([]SortField{}, page.Sort...), SortField{Field: "_id"})
+	values := append(c.Values, c.ID)
+	var or []bson.M
+	for i, f := range fields {
+		// same returns the clause of the records tied with the cursor on
+		// the fields before f
+		same := func() bson.M {
+			clause := bson.M{}
+			for j := 0; j < i; j++ {
+				clause[fields[j].Field] = values[j]
+			}
+			return clause
+		}
+		switch {
+		case values[i] == nil && f.Desc:
+		case values[i] == nil:
+			clause := same()
+			clause[f.Field] = bson.M{"$ne": nil}
+			or = append(or, clause)
+		case f.Desc:
+			clause := same()
+			clause[f.Field] = bson.M{"$lt": values[i]}
+			missing := same()
+			missing[f.Field] = nil
+			or = append(or, clause, missing)
+		default:
+			clause := same()
+			clause[f.Field] = bson.M{"$gt": values[i]}
+			or = append(or, clause)
+		}
+	}
+	return bson.M{"$or": or}, nil
+}
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// cursorAfter returns the query of the records after doc in the order of
+// sort
+func cursorAfter(t *testing.T, sort []SortField, doc bson.M) bson.M {
+	t.Helper()
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor, err := encodeCursor(sort, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := afterCursor(Page{Sort: sort, Cursor: cursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func TestAfterCursorHandlesMissingValues(t *testing.T) {
+	id := primitive.NewObjectID()
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	never := bson.M{"_id": id}
+	updated := bson.M{"_id": id, "updatedAt": at}
+	idAfter := func(op string) bson.M { return bson.M{"updatedAt": nil, "_id": bson.M{op: id}} }
+
+	for _, tc := range []struct {
+		name string
+		sort []SortField
+		last bson.M
+		want []bson.M
+	}{
+		{"ascending after a missing value", []SortField{{Field: "updatedAt"}}, never,
+			[]bson.M{{"updatedAt": bson.M{"$ne": nil}}, idAfter("$gt")}},
+		{"descending after a missing value", []SortField{{Field: "updatedAt", Desc: true}}, never,
+			[]bson.M{idAfter("$gt")}},
+		{"descending after a value", []SortField{{Field: "updatedAt", Desc: true}}, updated,
+			[]bson.M{{"updatedAt": bson.M{"$lt": at}}, {"updatedAt": nil}, {"updatedAt": at, "_id": bson.M{"$gt": id}}}},
+	} {
+		query := cursorAfter(t, tc.sort, tc.last)
+		// Compared as extended JSON, as the cursor's values come back raw,
+		// and decoded again so key order doesn't matter
+		got, _ := bson.MarshalExtJSON(query, true, false)
+		want, _ := bson.MarshalExtJSON(bson.M{"$or": tc.want}, true, false)
+		var gotDoc, wantDoc interface{}
+		_ = json.Unmarshal(got, &gotDoc)
+		_ = json.Unmarshal(want, &wantDoc)
+		if !reflect.DeepEqual(gotDoc, wantDoc) {
+			t.Errorf("%s: got %s, want %s", tc.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package repository
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// mongoStat is an entry of the stats registry: the collection it reads and
+// the pipeline computing it. Adding a stat is adding an entry.
+type mongoStat struct {
+	StatInfo
+	collection string
+	pipeline   func(p StatParams) mongo.Pipeline
+}
+
+// itemsWindow matches the live items created in the window of p
+func itemsWindow(p StatParams) bson.D {
+	created := bson.M{}
+	if !p.Since.IsZero() {
+		created["$gte"] = p.Since
+	}
+	if !p.Until.IsZero() {
+		created["$lt"] = p.Until
+	}
+	match := bson.D{{Key: "deletedAt", Value: nil}}
+	if len(created) > 0 {
+		match = append(match, bson.E{Key: "createdAt", Value: created})
+	}
+	return bson.D{{Key: "$match", Value: match}}
+}
+
+func limitStage(p StatParams) bson.D {
+	return bson.D{{Key: "$limit", Value: p.Limit}}
+}
+
+var mongoStats = []mongoStat{
+	{
+		StatInfo:   StatInfo{Name: "items-by-tag", Description: "Items and their average price per tag, the most used first"},
+		collection: "items",
+		pipeline: func(p StatParams) mongo.Pipeline {
+			return mongo.Pipeline{
+				itemsWindow(p),
+				{{Key: "$unwind", Value: "$tags"}},
+				{{Key: "$group", Value: bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}, "avgPrice": bson.M{"$avg": "$price"}}}},
+				{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+				limitStage(p),
+				{{Key: "$project", Value: bson.M{"_id": 0, "tag": "$_id", "count": 1, "avgPrice": 1}}},
+			}
+		},
+	},
+	{
+		StatInfo:   StatInfo{Name: "items-by-owner", Description: "Items per owner, with their latest creation, the largest owners first"},
+		collection: "items",
+		pipeline: func(p StatParams) mongo.Pipeline {
+			return mongo.Pipeline{
+				itemsWindow(p),
+				{{Key: "$group", Value: bson.M{"_id": "$ownerId", "count": bson.M{"$sum": 1}, "lastCreatedAt": bson.M{"$max": "$createdAt"}}}},
+				{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+				limitStage(p),
+				{{Key: "$project", Value: bson.M{"_id": 0, "ownerId": "$_id", "count": 1, "lastCreatedAt": 1}}},
+			}
+		},
+	},
+	{
+		StatInfo:   StatInfo{Name: "items-created-daily", Description: "Items created per day (UTC), the latest days first"},
+		collection: "items",
+		pipeline: func(p StatParams) mongo.Pipeline {
+			day := bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$createdAt"}}
+			return mongo.Pipeline{
+				itemsWindow(p),
+				{{Key: "$group", Value: bson.M{"_id": day, "count": bson.M{"$sum": 1}}}},
+				{{Key: "$sort", Value: bson.M{"_id": -1}}},
+				limitStage(p),
+				{{Key: "$project", Value: bson.M{"_id": 0, "day": "$_id", "count": 1}}},
+			}
+		},
+	},
+}
+
+type mongoStatsRunner struct {
+	db *mongo.Database
+}
+
+func (m *mongoStatsRunner) Stats() []StatInfo {
+	infos := make([]StatInfo, len(mongoStats))
+	for i, s := range mongoStats {
+		infos[i] = s.StatInfo
+	}
+	return infos
+}
+
+func (m *mongoStatsRunner) Run(ctx context.Context, name string, params StatParams) ([]StatRow, error) {
+	for _, s := range mongoStats {
+		if s.Name != name {
+			continue
+		}
+		cur, err := m.db.Collection(s.collection).Aggregate(ctx, s.pipeline(params))
+		if err != nil {
+			return nil, err
+		}
+		var docs []bson.M
+		if err := cur.All(ctx, &docs); err != nil {
+			return nil, err
+		}
+		rows := make([]StatRow, len(docs))
+		for i, doc := range docs {
+			rows[i] = StatRow(doc)
+		}
+		return rows, nil
+	}
+	return nil, ErrNotFound
+}
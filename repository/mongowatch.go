@@ -0,0 +1,121 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Server codes of a change stream that can't resume: InvalidResumeToken,
+// ChangeStreamFatalError and ChangeStreamHistoryLost
+var staleTokenCodes = []int32{260, 280, 286}
+
+type mongoWatcher struct {
+	coll *mongo.Collection
+}
+
+func (m *mongoWatcher) WatchItems(ctx context.Context, token string) (ItemStream, error) {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+		"operationType": bson.M{"$in": bson.A{"insert", "update", "replace", "delete"}},
+	}}}}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if token != "" {
+		opts.SetResumeAfter(bson.M{"_data": token})
+	}
+	cs, err := m.coll.Watch(ctx, pipeline, opts)
+	if err != nil {
+		var cmdErr mongo.CommandError
+		if token != "" && errors.As(err, &cmdErr) {
+			for _, code := range staleTokenCodes {
+				if cmdErr.Code == code {
+					return nil, ErrStaleResumeToken
+				}
+			}
+		}
+		return nil, err
+	}
+	return &mongoItemStream{cs: cs}, nil
+}
+
+// changeEvent is the part of a change stream event ItemEvent needs
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		ID interface{} `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument      *itemDoc `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.Raw `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+type mongoItemStream struct {
+	cs    *mongo.ChangeStream
+	event ItemEvent
+	err   error
+}
+
+func (s *mongoItemStream) Next(ctx context.Context) bool {
+	for s.cs.Next(ctx) {
+		var ev changeEvent
+		if err := s.cs.Decode(&ev); err != nil {
+			s.err = err
+			return false
+		}
+		typ, ok := ev.itemEventType()
+		if !ok {
+			continue
+		}
+		s.event = ItemEvent{Type: typ, ID: idString(ev.DocumentKey.ID), Token: resumeToken(s.cs.ResumeToken())}
+		if typ != ItemDeleted {
+			item := ev.FullDocument.item()
+			s.event.Item = &item
+		}
+		return true
+	}
+	s.err = s.cs.Err()
+	return false
+}
+
+// itemEventType maps a change to the event clients see, false for changes
+// to items that are deleted already
+func (ev *changeEvent) itemEventType() (string, bool) {
+	switch {
+	case ev.OperationType == "insert":
+		return ItemCreated, true
+	case ev.OperationType == "delete" || ev.FullDocument == nil:
+		// Gone by the time the update was looked up
+		return ItemDeleted, true
+	case ev.FullDocument.DeletedAt != nil:
+		if _, err := ev.UpdateDescription.UpdatedFields.LookupErr("deletedAt"); err == nil {
+			return ItemDeleted, true
+		}
+		return "", false
+	}
+	for _, f := range ev.UpdateDescription.RemovedFields {
+		if f == "deletedAt" {
+			return ItemCreated, true
+		}
+	}
+	return ItemUpdated, true
+}
+
+// resumeToken is the opaque string form of a change stream resume token
+func resumeToken(raw bson.Raw) string {
+	v, err := raw.LookupErr("_data")
+	if err != nil {
+		return ""
+	}
+	s, _ := v.StringValueOK()
+	return s
+}
+
+func (s *mongoItemStream) Event() ItemEvent { return s.event }
+
+func (s *mongoItemStream) Err() error { return s.err }
+
+func (s *mongoItemStream) Close(ctx context.Context) error { return s.cs.Close(ctx) }
@@ -0,0 +1,79 @@
+package repository_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/example/fiber-demo/repository"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// pagingStores returns the stores to page through: memory, and MongoDB when
+// MONGO_TEST_URI names a server to create a scratch database in
+func pagingStores(t *testing.T) map[string]*repository.Repositories {
+	stores := map[string]*repository.Repositories{"memory": repository.NewMemory()}
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		return stores
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database(fmt.Sprintf("fiber_demo_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		_ = db.Drop(ctx)
+		_ = client.Disconnect(ctx)
+	})
+	stores["mongo"] = repository.NewMongo(db, false, nil)
+	return stores
+}
+
+func TestCursorsPageAcrossUpdatedAndNeverUpdatedItems(t *testing.T) {
+	for name, repos := range pagingStores(t) {
+		ctx := context.Background()
+		created := time.Now().UTC().Truncate(time.Millisecond)
+		for i := 0; i < 6; i++ {
+			item := &repository.Item{Name: fmt.Sprintf("item %d", i), Price: 1, OwnerID: "alice", CreatedAt: created}
+			if err := repos.Items.Create(ctx, item); err != nil {
+				t.Fatal(err)
+			}
+			// Every other item is updated, the others have no updatedAt
+			if i%2 == 0 {
+				item.UpdatedAt = created.Add(time.Duration(i) * time.Minute)
+				if err := repos.Items.Update(ctx, item); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		for _, sort := range [][]repository.SortField{{{Field: "updatedAt"}}, {{Field: "updatedAt", Desc: true}}} {
+			seen := map[string]bool{}
+			page := repository.Page{Sort: sort, Limit: 2}
+			for pages := 0; pages < 10; pages++ {
+				items, next, err := repos.Items.List(ctx, repository.ItemFilter{}, page)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				for _, item := range items {
+					if seen[item.ID] {
+						t.Errorf("%s, sort %+v: %s listed twice", name, sort, item.Name)
+					}
+					seen[item.ID] = true
+				}
+				if next == "" {
+					break
+				}
+				page.Cursor = next
+			}
+			if len(seen) != 6 {
+				t.Errorf("%s, sort %+v: paged through %d of 6 items", name, sort, len(seen))
+			}
+		}
+	}
+}
@@ -0,0 +1,812 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// NewPostgres returns repositories over the tables of pool, created by
+// MigratePostgres. IDs are generated like ObjectIDs, so they look the same
+// whatever the store, and times are kept to the millisecond, as in MongoDB.
+func NewPostgres(pool *pgxpool.Pool) *Repositories {
+	db := &postgresDB{pool: pool}
+	return &Repositories{
+		Items:  &postgresItems{db: db},
+		Users:  &postgresUsers{db: db},
+		Audit:  &postgresAudit{db: db},
+		Events: &postgresWatcher{db: db},
+		Files:  &postgresFiles{db: db},
+		Stats:  &postgresStats{db: db},
+		Search: &postgresSearch{db: db},
+		Tx:     &postgresTx{pool: pool},
+	}
+}
+
+// pgQuerier is what the repositories run statements on: the pool, or the
+// transaction of InTx
+type pgQuerier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// pgTxKey carries the transaction of InTx in the context
+type pgTxKey struct{}
+
+type postgresDB struct {
+	pool *pgxpool.Pool
+}
+
+// q returns the transaction of ctx, if any, or the pool
+func (db *postgresDB) q(ctx context.Context) pgQuerier {
+	if tx, ok := ctx.Value(pgTxKey{}).(pgx.Tx); ok {
+		return tx
+	}
+	return db.pool
+}
+
+// postgresTx runs InTx in a transaction carried by the context. Nested
+// calls join the outer transaction.
+type postgresTx struct {
+	pool *pgxpool.Pool
+}
+
+func (t *postgresTx) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(pgTxKey{}).(pgx.Tx); ok {
+		return fn(ctx)
+	}
+	return pgx.BeginFunc(ctx, t.pool, func(tx pgx.Tx) error {
+		return fn(context.WithValue(ctx, pgTxKey{}, tx))
+	})
+}
+
+// Server codes of constraint violations
+const (
+	pgUniqueViolation = "23505"
+	pgCheckViolation  = "23514"
+)
+
+// pgErr maps driver errors to the package's
+func pgErr(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	var pgError *pgconn.PgError
+	if errors.As(err, &pgError) {
+		switch pgError.Code {
+		case pgUniqueViolation:
+			return ErrDuplicate
+		case pgCheckViolation:
+			return fmt.Errorf("%w: %v", ErrSchemaViolation, err)
+		}
+	}
+	return err
+}
+
+// pgTime is t as stored: UTC, to the millisecond like BSON dates, so
+// cursors carry exact values
+func pgTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Millisecond)
+}
+
+func pgTimePtr(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	at := pgTime(*t)
+	return &at
+}
+
+// pgZeroNull stores the zero time, an unset optional time, as NULL
+func pgZeroNull(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return pgTimePtr(&t)
+}
+
+// pgWhere builds a WHERE clause; conditions take their arguments as ?,
+// numbered in order
+type pgWhere struct {
+	conds []string
+	args  []any
+}
+
+func (w *pgWhere) add(cond string, args ...any) {
+	for _, arg := range args {
+		w.args = append(w.args, arg)
+		cond = strings.Replace(cond, "?", "$"+strconv.Itoa(len(w.args)), 1)
+	}
+	w.conds = append(w.conds, cond)
+}
+
+func (w *pgWhere) String() string {
+	if len(w.conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(w.conds, " AND ")
+}
+
+// arg appends a positional argument and returns its placeholder
+func (w *pgWhere) arg(v any) string {
+	w.args = append(w.args, v)
+	return "$" + strconv.Itoa(len(w.args))
+}
+
+// orderBy orders by the columns of sort, then by id
+func orderBy(sort []SortField, columns map[string]string) string {
+	var parts []string
+	for _, s := range sort {
+		dir := " ASC"
+		if s.Desc {
+			dir = " DESC"
+		}
+		parts = append(parts, columns[s.Field]+dir)
+	}
+	return " ORDER BY " + strings.Join(append(parts, "id ASC"), ", ")
+}
+
+// limitOffset pages a query; Limit 0 means no limit
+func limitOffset(w *pgWhere, page Page) string {
+	sql := ""
+	if page.Limit > 0 {
+		sql += " LIMIT " + w.arg(page.Limit)
+	}
+	if page.Offset > 0 {
+		sql += " OFFSET " + w.arg(page.Offset)
+	}
+	return sql
+}
+
+// afterCursorSQL adds the condition matching the records after the cursor
+// of page, the keyset counterpart of afterCursor
+func afterCursorSQL(w *pgWhere, page Page, columns map[string]string) error {
+	c, err := decodeCursor(page)
+	if err != nil {
+		return err
+	}
+	fields := append(append([]SortField{}, page.Sort...), SortField{Field: "_id"})
+	values := append(c.Values, idString(c.ID))
+	var or []string
+	for i, f := range fields {
+		var and []string
+		for j := 0; j < i; j++ {
+			and = append(and, pgColumn(fields[j].Field, columns)+" = "+w.arg(pgValue(values[j])))
+		}
+		op := " > "
+		if f.Desc {
+			op = " < "
+		}
+		and = append(and, pgColumn(f.Field, columns)+op+w.arg(pgValue(values[i])))
+		or = append(or, "("+strings.Join(and, " AND ")+")")
+	}
+	w.conds = append(w.conds, "("+strings.Join(or, " OR ")+")")
+	return nil
+}
+
+func pgColumn(field string, columns map[string]string) string {
+	if field == "_id" {
+		return "id"
+	}
+	return columns[field]
+}
+
+// pgValue converts a value decoded from a cursor to its SQL argument
+func pgValue(v interface{}) interface{} {
+	if dt, ok := v.(primitive.DateTime); ok {
+		return dt.Time().UTC()
+	}
+	return v
+}
+
+// itemColumns are the columns of an Item, in the order scanItem reads them
+const itemColumns = "id, name, description, price, cost_price, internal_notes, tags, location_lng, location_lat, owner_id, created_at, updated_at, deleted_at, version, acl"
+
+// itemSortColumns map ItemSortFields, and deletedAt, to columns
+var itemSortColumns = map[string]string{
+	"name":      "name",
+	"price":     "price",
+	"createdAt": "created_at",
+	"updatedAt": "updated_at",
+	"deletedAt": "deleted_at",
+}
+
+// scanItem reads a row of itemColumns, followed by extra
+func scanItem(row pgx.Row, extra ...any) (Item, error) {
+	var item Item
+	var lng, lat *float64
+	dest := []any{&item.ID, &item.Name, &item.Description, &item.Price, &item.CostPrice, &item.InternalNotes, &item.Tags,
+		&lng, &lat, &item.OwnerID, &item.CreatedAt, &item.UpdatedAt, &item.DeletedAt, &item.Version, &item.ACL}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return item, err
+	}
+	if lng != nil && lat != nil {
+		item.Location = NewGeoPoint(*lat, *lng)
+	}
+	if len(item.Tags) == 0 {
+		item.Tags = nil
+	}
+	if len(item.ACL) == 0 {
+		item.ACL = nil
+	}
+	item.CreatedAt = item.CreatedAt.UTC()
+	item.UpdatedAt = item.UpdatedAt.UTC()
+	if item.DeletedAt != nil {
+		at := item.DeletedAt.UTC()
+		item.DeletedAt = &at
+	}
+	return item, nil
+}
+
+// scanItems reads every row of rows as an item
+func scanItems(rows pgx.Rows) ([]Item, error) {
+	defer rows.Close()
+	items := []Item{}
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// itemArgs are the values of itemColumns for item
+func itemArgs(item *Item) []any {
+	var lng, lat *float64
+	if loc := item.Location; loc != nil && len(loc.Coordinates) == 2 {
+		lng, lat = &loc.Coordinates[0], &loc.Coordinates[1]
+	}
+	tags := item.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	acl := item.ACL
+	if acl == nil {
+		acl = []Grant{}
+	}
+	return []any{item.ID, item.Name, item.Description, item.Price, item.CostPrice, item.InternalNotes, tags,
+		lng, lat, item.OwnerID, pgTime(item.CreatedAt), pgTime(item.UpdatedAt), pgTimePtr(item.DeletedAt), item.Version, acl}
+}
+
+// likeEscape escapes the wildcards of s for LIKE
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func itemWhere(f ItemFilter) *pgWhere {
+	w := &pgWhere{}
+	if f.Deleted {
+		w.add("deleted_at IS NOT NULL")
+	} else {
+		w.add("deleted_at IS NULL")
+	}
+	if f.OwnerID != "" {
+		w.add("owner_id = ?", f.OwnerID)
+	}
+	if f.Tag != "" {
+		w.add("? = ANY(tags)", f.Tag)
+	}
+	if f.NameContains != "" {
+		w.add("name ILIKE ?", "%"+likeEscape(f.NameContains)+"%")
+	}
+	if f.MinPrice != nil {
+		w.add("price >= ?", *f.MinPrice)
+	}
+	if f.MaxPrice != nil {
+		w.add("price <= ?", *f.MaxPrice)
+	}
+	if p := f.Reader; p != nil {
+		groups := p.Groups
+		if groups == nil {
+			groups = []string{}
+		}
+		w.add("(owner_id = ? OR EXISTS (SELECT 1 FROM jsonb_array_elements(acl) g WHERE g->>'sub' = ? OR g->>'group' = ANY(?)))",
+			p.Subject, p.Subject, groups)
+	}
+	return w
+}
+
+type postgresItems struct {
+	db *postgresDB
+}
+
+func (p *postgresItems) Count(ctx context.Context, filter ItemFilter) (int64, error) {
+	w := itemWhere(filter)
+	var n int64
+	err := p.db.q(ctx).QueryRow(ctx, "SELECT count(*) FROM items"+w.String(), w.args...).Scan(&n)
+	return n, err
+}
+
+// List pages with the cursors of the Mongo repository, so a cursor reads
+// the same whatever the store
+func (p *postgresItems) List(ctx context.Context, filter ItemFilter, page Page) ([]Item, string, error) {
+	w := itemWhere(filter)
+	if page.Cursor != "" {
+		if err := afterCursorSQL(w, page, itemSortColumns); err != nil {
+			return nil, "", err
+		}
+		page.Offset = 0
+	}
+	sql := "SELECT " + itemColumns + " FROM items" + w.String() + orderBy(page.Sort, itemSortColumns) + limitOffset(w, page)
+	rows, err := p.db.q(ctx).Query(ctx, sql, w.args...)
+	if err != nil {
+		return nil, "", err
+	}
+	items, err := scanItems(rows)
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if page.Limit > 0 && len(items) == page.Limit {
+		last := items[len(items)-1]
+		raw, err := bson.Marshal(itemDoc{ID: mongoID(last.ID), Item: last})
+		if err != nil {
+			return nil, "", err
+		}
+		if next, err = encodeCursor(page.Sort, raw); err != nil {
+			return nil, "", err
+		}
+	}
+	return items, next, nil
+}
+
+// Near computes great-circle distances with the haversine formula, so it
+// needs no PostGIS
+func (p *postgresItems) Near(ctx context.Context, q NearQuery) ([]NearItem, error) {
+	w := itemWhere(q.Filter)
+	w.add("location_lat IS NOT NULL")
+	lat, lng := w.arg(q.Lat), w.arg(q.Lng)
+	distance := fmt.Sprintf("2 * %d * asin(least(1, sqrt(power(sin(radians(location_lat - %s) / 2), 2) + cos(radians(%s)) * cos(radians(location_lat)) * power(sin(radians(location_lng - %s) / 2), 2))))",
+		earthRadius, lat, lat, lng)
+	sql := "SELECT * FROM (SELECT " + itemColumns + ", " + distance + " AS distance FROM items" + w.String() + ") near" +
+		" WHERE distance <= " + w.arg(q.Radius) + " ORDER BY distance, id" + limitOffset(w, q.Page)
+	rows, err := p.db.q(ctx).Query(ctx, sql, w.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []NearItem{}
+	for rows.Next() {
+		var d float64
+		item, err := scanItem(rows, &d)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, NearItem{Item: item, Distance: d})
+	}
+	return items, rows.Err()
+}
+
+func (p *postgresItems) Get(ctx context.Context, id string) (*Item, error) {
+	row := p.db.q(ctx).QueryRow(ctx, "SELECT "+itemColumns+" FROM items WHERE id = $1 AND deleted_at IS NULL", id)
+	item, err := scanItem(row)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	return &item, nil
+}
+
+func (p *postgresItems) OwnerOf(ctx context.Context, id string) (string, error) {
+	var owner string
+	err := p.db.q(ctx).QueryRow(ctx, "SELECT owner_id FROM items WHERE id = $1 AND deleted_at IS NULL", id).Scan(&owner)
+	return owner, pgErr(err)
+}
+
+const insertItem = "INSERT INTO items (" + itemColumns + ") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)"
+
+func (p *postgresItems) Create(ctx context.Context, item *Item) error {
+	next := *item
+	next.ID = primitive.NewObjectID().Hex()
+	next.Version = 1
+	if _, err := p.db.q(ctx).Exec(ctx, insertItem, itemArgs(&next)...); err != nil {
+		return pgErr(err)
+	}
+	item.ID, item.Version = next.ID, next.Version
+	return nil
+}
+
+// CreateMany inserts the items one by one, each in its own statement so
+// one failing doesn't undo the others
+func (p *postgresItems) CreateMany(ctx context.Context, items []*Item, ordered bool) ([]error, error) {
+	errs := make([]error, len(items))
+	for i, item := range items {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if errs[i] = p.Create(ctx, item); errs[i] != nil && ordered {
+			for j := i + 1; j < len(items); j++ {
+				errs[j] = ErrNotAttempted
+			}
+			break
+		}
+	}
+	return errs, nil
+}
+
+func (p *postgresItems) Update(ctx context.Context, item *Item) error {
+	args := itemArgs(item)
+	tag, err := p.db.q(ctx).Exec(ctx, `UPDATE items SET name = $2, description = $3, price = $4, cost_price = $5,
+		internal_notes = $6, tags = $7, location_lng = $8, location_lat = $9, owner_id = $10, created_at = $11,
+		updated_at = $12, acl = $14, version = version + 1
+		WHERE id = $1 AND deleted_at IS NULL AND version = $13`, append(args[:12], item.Version, args[14])...)
+	if err != nil {
+		return pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		// Tell a stale version from a missing item
+		if _, err := p.OwnerOf(ctx, item.ID); err != nil {
+			return err
+		}
+		return ErrVersionConflict
+	}
+	item.Version++
+	return nil
+}
+
+func (p *postgresItems) Delete(ctx context.Context, id string) error {
+	return pgSoftDelete(ctx, p.db.q(ctx), "items", id)
+}
+
+func (p *postgresItems) Restore(ctx context.Context, id string) (*Item, error) {
+	row := p.db.q(ctx).QueryRow(ctx, "UPDATE items SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL RETURNING "+itemColumns, id)
+	item, err := scanItem(row)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	return &item, nil
+}
+
+// pgSoftDelete stamps the live row of table with id as deleted
+func pgSoftDelete(ctx context.Context, q pgQuerier, table, id string) error {
+	tag, err := q.Exec(ctx, "UPDATE "+table+" SET deleted_at = $2 WHERE id = $1 AND deleted_at IS NULL", id, pgTime(time.Now()))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const userColumns = "id, username, email, display_name, created_at, updated_at, deleted_at, roles, first_seen_at, last_seen_at, avatar_url, bio, preferences, preferences_version"
+
+var userSortColumns = map[string]string{
+	"username":  "username",
+	"createdAt": "created_at",
+	"deletedAt": "deleted_at",
+}
+
+func scanUser(row pgx.Row) (UserProfile, error) {
+	var user UserProfile
+	var firstSeen, lastSeen *time.Time
+	if err := row.Scan(&user.ID, &user.Username, &user.Email, &user.DisplayName, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt,
+		&user.Roles, &firstSeen, &lastSeen, &user.AvatarURL, &user.Bio, &user.Preferences, &user.PreferencesVersion); err != nil {
+		return user, err
+	}
+	if len(user.Roles) == 0 {
+		user.Roles = nil
+	}
+	if len(user.Preferences) == 0 {
+		user.Preferences = nil
+	}
+	if firstSeen != nil {
+		user.FirstSeenAt = firstSeen.UTC()
+	}
+	if lastSeen != nil {
+		user.LastSeenAt = lastSeen.UTC()
+	}
+	user.CreatedAt = user.CreatedAt.UTC()
+	user.UpdatedAt = user.UpdatedAt.UTC()
+	if user.DeletedAt != nil {
+		at := user.DeletedAt.UTC()
+		user.DeletedAt = &at
+	}
+	return user, nil
+}
+
+type postgresUsers struct {
+	db *postgresDB
+}
+
+func (p *postgresUsers) Get(ctx context.Context, id string) (*UserProfile, error) {
+	user, err := scanUser(p.db.q(ctx).QueryRow(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1 AND deleted_at IS NULL", id))
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	return &user, nil
+}
+
+// Save replaces every column, deleted_at included, like ReplaceOne
+func (p *postgresUsers) Save(ctx context.Context, user *UserProfile) error {
+	roles, prefs := pgUserLists(user)
+	_, err := p.db.q(ctx).Exec(ctx, `INSERT INTO users (`+userColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		ON CONFLICT (id) DO UPDATE SET username = $2, email = $3, display_name = $4, created_at = $5, updated_at = $6, deleted_at = $7,
+		roles = $8, first_seen_at = $9, last_seen_at = $10, avatar_url = $11, bio = $12, preferences = $13, preferences_version = $14`,
+		user.ID, user.Username, user.Email, user.DisplayName, pgTime(user.CreatedAt), pgTime(user.UpdatedAt), pgTimePtr(user.DeletedAt),
+		roles, pgZeroNull(user.FirstSeenAt), pgZeroNull(user.LastSeenAt), user.AvatarURL, user.Bio, prefs, user.PreferencesVersion)
+	return pgErr(err)
+}
+
+func (p *postgresUsers) Provision(ctx context.Context, user *UserProfile) error {
+	roles, _ := pgUserLists(user)
+	_, err := p.db.q(ctx).Exec(ctx, `INSERT INTO users (id, username, email, display_name, roles, created_at, updated_at, first_seen_at, last_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6, $6, $6)
+		ON CONFLICT (id) DO UPDATE SET username = $2, email = $3, display_name = $4, roles = $5, last_seen_at = $6,
+			first_seen_at = COALESCE(users.first_seen_at, $6)`,
+		user.ID, user.Username, user.Email, user.DisplayName, roles, pgTime(user.LastSeenAt))
+	return pgErr(err)
+}
+
+func (p *postgresUsers) SetPreferences(ctx context.Context, id string, prefs map[string]interface{}, version int64) (int64, error) {
+	if prefs == nil {
+		prefs = map[string]interface{}{}
+	}
+	tag, err := p.db.q(ctx).Exec(ctx, `UPDATE users SET preferences = $2, preferences_version = preferences_version + 1, updated_at = $3
+		WHERE id = $1 AND deleted_at IS NULL AND preferences_version = $4`, id, prefs, pgTime(time.Now()), version)
+	if err != nil {
+		return 0, pgErr(err)
+	}
+	if tag.RowsAffected() == 0 {
+		// Tell a stale version from a missing profile
+		if _, err := p.Get(ctx, id); err != nil {
+			return 0, err
+		}
+		return 0, ErrVersionConflict
+	}
+	return version + 1, nil
+}
+
+// pgUserLists returns the roles and preferences of user, empty rather
+// than nil for the NOT NULL columns
+func pgUserLists(user *UserProfile) ([]string, map[string]interface{}) {
+	roles, prefs := user.Roles, user.Preferences
+	if roles == nil {
+		roles = []string{}
+	}
+	if prefs == nil {
+		prefs = map[string]interface{}{}
+	}
+	return roles, prefs
+}
+
+func (p *postgresUsers) Count(ctx context.Context) (int64, error) {
+	var n int64
+	err := p.db.q(ctx).QueryRow(ctx, "SELECT count(*) FROM users WHERE deleted_at IS NULL").Scan(&n)
+	return n, err
+}
+
+func (p *postgresUsers) Delete(ctx context.Context, id string) error {
+	return pgSoftDelete(ctx, p.db.q(ctx), "users", id)
+}
+
+func (p *postgresUsers) ListDeleted(ctx context.Context, page Page) ([]UserProfile, int64, error) {
+	var total int64
+	if err := p.db.q(ctx).QueryRow(ctx, "SELECT count(*) FROM users WHERE deleted_at IS NOT NULL").Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	w := &pgWhere{}
+	w.add("deleted_at IS NOT NULL")
+	sql := "SELECT " + userColumns + " FROM users" + w.String() + orderBy(page.Sort, userSortColumns) + limitOffset(w, page)
+	rows, err := p.db.q(ctx).Query(ctx, sql, w.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	users := []UserProfile{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, user)
+	}
+	return users, total, rows.Err()
+}
+
+func (p *postgresUsers) Restore(ctx context.Context, id string) (*UserProfile, error) {
+	row := p.db.q(ctx).QueryRow(ctx, "UPDATE users SET deleted_at = NULL WHERE id = $1 AND deleted_at IS NOT NULL RETURNING "+userColumns, id)
+	user, err := scanUser(row)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	return &user, nil
+}
+
+// pgSweepInterval spaces out the deletes of expired rows, which Postgres
+// has no TTL index for
+const pgSweepInterval = time.Minute
+
+// pgSweeper deletes the expired rows of a table at most once per
+// pgSweepInterval
+type pgSweeper struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (s *pgSweeper) sweep(ctx context.Context, q pgQuerier, sql string, args ...any) error {
+	s.mu.Lock()
+	due := time.Since(s.last) >= pgSweepInterval
+	if due {
+		s.last = time.Now()
+	}
+	s.mu.Unlock()
+	if !due {
+		return nil
+	}
+	_, err := q.Exec(ctx, sql, args...)
+	return err
+}
+
+const auditColumns = "id, at, actor, method, route, path, resource_id, status, changes, request_id, expires_at"
+
+type postgresAudit struct {
+	db      *postgresDB
+	sweeper pgSweeper
+}
+
+func (p *postgresAudit) Record(ctx context.Context, entry *AuditEntry) error {
+	q := p.db.q(ctx)
+	if err := p.sweeper.sweep(ctx, q, "DELETE FROM audit_logs WHERE expires_at <= now()"); err != nil {
+		return err
+	}
+	actor, err := json.Marshal(entry.Actor)
+	if err != nil {
+		return err
+	}
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return err
+	}
+	id := primitive.NewObjectID().Hex()
+	_, err = q.Exec(ctx, "INSERT INTO audit_logs ("+auditColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)",
+		id, pgTime(entry.At), actor, entry.Method, entry.Route, entry.Path, entry.ResourceID, entry.Status, changes, entry.RequestID, entry.ExpiresAt)
+	if err != nil {
+		return pgErr(err)
+	}
+	entry.ID = id
+	return nil
+}
+
+func auditWhere(f AuditFilter) *pgWhere {
+	w := &pgWhere{}
+	w.add("expires_at > now()")
+	if f.Actor != "" {
+		w.add("actor->>'sub' = ?", f.Actor)
+	}
+	if f.Method != "" {
+		w.add("method = ?", f.Method)
+	}
+	if f.Route != "" {
+		w.add("route = ?", f.Route)
+	}
+	if f.ResourceID != "" {
+		w.add("resource_id = ?", f.ResourceID)
+	}
+	if !f.Since.IsZero() {
+		w.add("at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		w.add("at < ?", f.Until)
+	}
+	return w
+}
+
+func (p *postgresAudit) List(ctx context.Context, filter AuditFilter, page Page) ([]AuditEntry, int64, error) {
+	w := auditWhere(filter)
+	var total int64
+	if err := p.db.q(ctx).QueryRow(ctx, "SELECT count(*) FROM audit_logs"+w.String(), w.args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	if len(page.Sort) == 0 {
+		page.Sort = []SortField{{Field: "at", Desc: true}}
+	}
+	sql := "SELECT " + auditColumns + " FROM audit_logs" + w.String() + orderBy(page.Sort, map[string]string{"at": "at"}) + limitOffset(w, page)
+	rows, err := p.db.q(ctx).Query(ctx, sql, w.args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var actor, changes []byte
+		if err := rows.Scan(&e.ID, &e.At, &actor, &e.Method, &e.Route, &e.Path, &e.ResourceID, &e.Status, &changes, &e.RequestID, &e.ExpiresAt); err != nil {
+			return nil, 0, err
+		}
+		if err := json.Unmarshal(actor, &e.Actor); err != nil {
+			return nil, 0, err
+		}
+		if err := json.Unmarshal(changes, &e.Changes); err != nil {
+			return nil, 0, err
+		}
+		e.At = e.At.UTC()
+		entries = append(entries, e)
+	}
+	return entries, total, rows.Err()
+}
+
+// postgresFiles keeps files in the files table, content included, which is
+// read whole: fine for uploads within FILES_MAX_SIZE
+type postgresFiles struct {
+	db *postgresDB
+}
+
+func (p *postgresFiles) Upload(ctx context.Context, info *FileInfo, content io.Reader) error {
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	id := primitive.NewObjectID().Hex()
+	at := pgTime(time.Now())
+	_, err = p.db.q(ctx).Exec(ctx, "INSERT INTO files (id, name, content_type, size, owner_id, uploaded_at, content) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		id, info.Name, info.ContentType, len(data), info.OwnerID, at, data)
+	if err != nil {
+		return pgErr(err)
+	}
+	info.ID, info.Size, info.UploadedAt = id, int64(len(data)), at
+	return nil
+}
+
+func (p *postgresFiles) Stat(ctx context.Context, id string) (*FileInfo, error) {
+	var f FileInfo
+	err := p.db.q(ctx).QueryRow(ctx, "SELECT id, name, content_type, size, owner_id, uploaded_at FROM files WHERE id = $1", id).
+		Scan(&f.ID, &f.Name, &f.ContentType, &f.Size, &f.OwnerID, &f.UploadedAt)
+	if err != nil {
+		return nil, pgErr(err)
+	}
+	f.UploadedAt = f.UploadedAt.UTC()
+	return &f, nil
+}
+
+func (p *postgresFiles) Open(ctx context.Context, id string) (*FileInfo, io.ReadCloser, error) {
+	var f FileInfo
+	var data []byte
+	err := p.db.q(ctx).QueryRow(ctx, "SELECT id, name, content_type, size, owner_id, uploaded_at, content FROM files WHERE id = $1", id).
+		Scan(&f.ID, &f.Name, &f.ContentType, &f.Size, &f.OwnerID, &f.UploadedAt, &data)
+	if err != nil {
+		return nil, nil, pgErr(err)
+	}
+	f.UploadedAt = f.UploadedAt.UTC()
+	return &f, io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (p *postgresFiles) OwnerOf(ctx context.Context, id string) (string, error) {
+	var owner string
+	if err := p.db.q(ctx).QueryRow(ctx, "SELECT owner_id FROM files WHERE id = $1", id).Scan(&owner); err != nil {
+		return "", pgErr(err)
+	}
+	return owner, nil
+}
+
+// PresignURL is unsupported: the content is only reachable through the
+// database
+func (p *postgresFiles) PresignURL(ctx context.Context, id string, ttl time.Duration) (string, error) {
+	return "", ErrPresignUnsupported
+}
+
+func (p *postgresFiles) Delete(ctx context.Context, id string) error {
+	tag, err := p.db.q(ctx).Exec(ctx, "DELETE FROM files WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
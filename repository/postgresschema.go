@@ -0,0 +1,212 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresMigration is a versioned change of the Postgres schema
+type postgresMigration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// postgresMigrations in version order; append new ones, never renumber.
+// The checks mirror CollectionSchemas.
+var postgresMigrations = []postgresMigration{
+	{
+		version: 1,
+		name:    "items, users and audit log",
+		sql: `
+CREATE TABLE items (
+	id             text PRIMARY KEY,
+	name           text NOT NULL CHECK (length(name) BETWEEN 1 AND 100),
+	description    text NOT NULL DEFAULT '' CHECK (length(description) <= 1000),
+	price          double precision NOT NULL CHECK (price >= 0),
+	cost_price     double precision NOT NULL DEFAULT 0 CHECK (cost_price >= 0),
+	internal_notes text NOT NULL DEFAULT '' CHECK (length(internal_notes) <= 1000),
+	tags           text[] NOT NULL DEFAULT '{}' CHECK (cardinality(tags) <= 20),
+	location_lng   double precision CHECK (location_lng BETWEEN -180 AND 180),
+	location_lat   double precision CHECK (location_lat BETWEEN -90 AND 90),
+	owner_id       text NOT NULL,
+	created_at     timestamptz NOT NULL,
+	updated_at     timestamptz NOT NULL,
+	deleted_at     timestamptz,
+	version        bigint NOT NULL CHECK (version >= 1),
+	CONSTRAINT name_unique UNIQUE (name),
+	CHECK ((location_lng IS NULL) = (location_lat IS NULL))
+);
+CREATE INDEX items_owner_id ON items (owner_id);
+CREATE INDEX items_deleted_at ON items (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX items_tags ON items USING gin (tags);
+
+CREATE TABLE users (
+	id           text PRIMARY KEY,
+	username     text NOT NULL CHECK (length(username) >= 1),
+	email        text NOT NULL DEFAULT '',
+	display_name text NOT NULL DEFAULT '',
+	created_at   timestamptz NOT NULL,
+	updated_at   timestamptz NOT NULL,
+	deleted_at   timestamptz
+);
+CREATE INDEX users_deleted_at ON users (deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE TABLE audit_logs (
+	id          text PRIMARY KEY,
+	at          timestamptz NOT NULL,
+	actor       jsonb NOT NULL,
+	method      text NOT NULL,
+	route       text NOT NULL,
+	path        text NOT NULL,
+	resource_id text NOT NULL DEFAULT '',
+	status      integer NOT NULL CHECK (status BETWEEN 100 AND 599),
+	changes     jsonb NOT NULL DEFAULT 'null',
+	request_id  text NOT NULL DEFAULT '',
+	expires_at  timestamptz NOT NULL
+);
+CREATE INDEX audit_logs_at ON audit_logs (at DESC);
+CREATE INDEX audit_logs_actor_at ON audit_logs ((actor->>'sub'), at DESC);
+CREATE INDEX audit_logs_resource_at ON audit_logs (resource_id, at DESC);
+CREATE INDEX audit_logs_expires_at ON audit_logs (expires_at);`,
+	},
+	{
+		version: 2,
+		name:    "files and ephemeral records",
+		sql: `
+CREATE TABLE files (
+	id           text PRIMARY KEY,
+	name         text NOT NULL,
+	content_type text NOT NULL,
+	size         bigint NOT NULL,
+	owner_id     text NOT NULL,
+	uploaded_at  timestamptz NOT NULL,
+	content      bytea NOT NULL
+);
+
+CREATE TABLE ephemeral (
+	collection text NOT NULL,
+	key        text NOT NULL,
+	record     bytea,
+	expires_at timestamptz NOT NULL,
+	PRIMARY KEY (collection, key)
+);
+CREATE INDEX ephemeral_expires_at ON ephemeral (collection, expires_at);`,
+	},
+	{
+		version: 3,
+		name:    "items full-text search",
+		// array_to_string isn't immutable, as a generated column needs, so
+		// the vector comes from a function declared immutable
+		sql: `
+CREATE FUNCTION item_search_vector(name text, description text, tags text[]) RETURNS tsvector
+	LANGUAGE sql IMMUTABLE AS
+	$$ SELECT to_tsvector('english', name || ' ' || description || ' ' || array_to_string(tags, ' ')) $$;
+ALTER TABLE items ADD COLUMN search tsvector GENERATED ALWAYS AS (item_search_vector(name, description, tags)) STORED;
+CREATE INDEX items_search ON items USING gin (search);`,
+	},
+	{
+		version: 4,
+		name:    "item events",
+		// Soft-deleting an item is a delete, restoring it a create, as in
+		// the Mongo change stream
+		sql: `
+CREATE TABLE item_events (
+	seq     bigserial PRIMARY KEY,
+	type    text NOT NULL,
+	item_id text NOT NULL,
+	at      timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX item_events_at ON item_events (at);
+
+CREATE FUNCTION record_item_event() RETURNS trigger LANGUAGE plpgsql AS $$
+DECLARE
+	kind text;
+BEGIN
+	IF TG_OP = 'INSERT' THEN
+		kind := 'created';
+	ELSIF TG_OP = 'DELETE' THEN
+		kind := 'deleted';
+	ELSIF OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL THEN
+		kind := 'deleted';
+	ELSIF OLD.deleted_at IS NOT NULL AND NEW.deleted_at IS NULL THEN
+		kind := 'created';
+	ELSIF NEW.deleted_at IS NULL THEN
+		kind := 'updated';
+	ELSE
+		RETURN NULL;
+	END IF;
+	INSERT INTO item_events (type, item_id) VALUES (kind, COALESCE(NEW.id, OLD.id));
+	PERFORM pg_notify('item_events', '');
+	RETURN NULL;
+END $$;
+CREATE TRIGGER items_events AFTER INSERT OR UPDATE OR DELETE ON items
+	FOR EACH ROW EXECUTE FUNCTION record_item_event();`,
+	},
+	{
+		version: 5,
+		name:    "item ACLs",
+		sql: `
+ALTER TABLE items ADD COLUMN acl jsonb NOT NULL DEFAULT '[]' CHECK (jsonb_typeof(acl) = 'array');`,
+	},
+	{
+		version: 6,
+		name:    "provisioned user profiles",
+		sql: `
+ALTER TABLE users
+	ADD COLUMN roles         text[] NOT NULL DEFAULT '{}',
+	ADD COLUMN first_seen_at timestamptz,
+	ADD COLUMN last_seen_at  timestamptz,
+	ADD COLUMN avatar_url    text NOT NULL DEFAULT '',
+	ADD COLUMN bio           text NOT NULL DEFAULT '' CHECK (length(bio) <= 1000),
+	ADD COLUMN preferences   jsonb NOT NULL DEFAULT '{}' CHECK (jsonb_typeof(preferences) = 'object');`,
+	},
+	{
+		version: 7,
+		name:    "user preferences version",
+		sql: `
+ALTER TABLE users ADD COLUMN preferences_version bigint NOT NULL DEFAULT 0 CHECK (preferences_version >= 0);`,
+	},
+}
+
+// pgMigrationLock serializes the migrations of replicas starting together
+const pgMigrationLock = 7340032
+
+// MigratePostgres applies the pending migrations of the Postgres schema in
+// one transaction, and returns how many ran
+func MigratePostgres(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	ran := 0
+	err := pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", pgMigrationLock); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS migrations (
+			version integer PRIMARY KEY, name text NOT NULL, applied_at timestamptz NOT NULL DEFAULT now())`); err != nil {
+			return err
+		}
+		var applied int
+		if err := tx.QueryRow(ctx, "SELECT COALESCE(max(version), 0) FROM migrations").Scan(&applied); err != nil {
+			return err
+		}
+		for _, m := range postgresMigrations {
+			if m.version <= applied {
+				continue
+			}
+			if _, err := tx.Exec(ctx, m.sql); err != nil {
+				return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+			}
+			if _, err := tx.Exec(ctx, "INSERT INTO migrations (version, name) VALUES ($1, $2)", m.version, m.name); err != nil {
+				return err
+			}
+			ran++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return ran, nil
+}
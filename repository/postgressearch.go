@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"context"
+	"strconv"
+)
+
+// postgresSearch matches the search column of items, the English text
+// search vector of searchPaths, ranking by ts_rank. Fuzzy is ignored;
+// autocomplete matches name prefixes.
+type postgresSearch struct {
+	db *postgresDB
+}
+
+func (s *postgresSearch) Provider() string { return "postgres" }
+
+func (s *postgresSearch) Search(ctx context.Context, q SearchQuery) (*SearchResult, error) {
+	w := itemWhere(ItemFilter{Tag: q.Tag, Reader: q.Reader})
+	var order string
+	if q.Autocomplete {
+		w.add("name ILIKE ?", likeEscape(q.Text)+"%")
+		order = " ORDER BY name, id"
+	} else {
+		query := w.arg(q.Text)
+		w.conds = append(w.conds, "search @@ websearch_to_tsquery('english', "+query+")")
+		order = " ORDER BY ts_rank(search, websearch_to_tsquery('english', " + query + ")) DESC, id"
+	}
+	db := s.db.q(ctx)
+	res := &SearchResult{Items: []Item{}}
+	if err := db.QueryRow(ctx, "SELECT count(*) FROM items"+w.String(), w.args...).Scan(&res.Total); err != nil {
+		return nil, err
+	}
+	if q.Facets {
+		rows, err := db.Query(ctx, "SELECT tag, count(*) AS count FROM items, unnest(tags) AS tag"+w.String()+
+			" GROUP BY tag ORDER BY count DESC, tag LIMIT "+strconv.Itoa(searchFacetLimit), w.args...)
+		if err != nil {
+			return nil, err
+		}
+		tags := []FacetCount{}
+		for rows.Next() {
+			var f FacetCount
+			if err := rows.Scan(&f.Value, &f.Count); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			tags = append(tags, f)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		res.Facets = map[string][]FacetCount{"tags": tags}
+	}
+	rows, err := db.Query(ctx, "SELECT "+itemColumns+" FROM items"+w.String()+order+limitOffset(w, q.Page), w.args...)
+	if err != nil {
+		return nil, err
+	}
+	if res.Items, err = scanItems(rows); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
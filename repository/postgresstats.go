@@ -0,0 +1,70 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// postgresStatQueries compute the statistics of mongoStats, by name. The
+// window is $1 and $2, each NULL when unbounded, the limit $3.
+var postgresStatQueries = map[string]string{
+	"items-by-tag": `SELECT tag, count(*) AS count, avg(price) AS "avgPrice"
+		FROM items, unnest(tags) AS tag` + pgStatsWindow + `
+		GROUP BY tag ORDER BY count DESC, tag LIMIT $3`,
+	"items-by-owner": `SELECT owner_id AS "ownerId", count(*) AS count, max(created_at) AS "lastCreatedAt"
+		FROM items` + pgStatsWindow + `
+		GROUP BY owner_id ORDER BY count DESC, owner_id LIMIT $3`,
+	"items-created-daily": `SELECT to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day, count(*) AS count
+		FROM items` + pgStatsWindow + `
+		GROUP BY day ORDER BY day DESC LIMIT $3`,
+}
+
+// pgStatsWindow keeps the live items created in the window of the params
+const pgStatsWindow = `
+		WHERE deleted_at IS NULL AND ($1::timestamptz IS NULL OR created_at >= $1) AND ($2::timestamptz IS NULL OR created_at < $2)`
+
+type postgresStats struct {
+	db *postgresDB
+}
+
+func (p *postgresStats) Stats() []StatInfo {
+	infos := make([]StatInfo, len(mongoStats))
+	for i, s := range mongoStats {
+		infos[i] = s.StatInfo
+	}
+	return infos
+}
+
+// pgBound is t as a bound of the stats window: NULL when zero
+func pgBound(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (p *postgresStats) Run(ctx context.Context, name string, params StatParams) ([]StatRow, error) {
+	sql, ok := postgresStatQueries[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	var limit *int
+	if params.Limit > 0 {
+		limit = &params.Limit
+	}
+	rows, err := p.db.q(ctx).Query(ctx, sql, pgBound(params.Since), pgBound(params.Until), limit)
+	if err != nil {
+		return nil, err
+	}
+	maps, err := pgx.CollectRows(rows, pgx.RowToMap)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]StatRow, len(maps))
+	for i, m := range maps {
+		out[i] = StatRow(m)
+	}
+	return out, nil
+}
@@ -0,0 +1,144 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Item events are kept this long for streams to resume from, and read in
+// batches of pgEventBatch
+const (
+	pgEventRetention = 24 * time.Hour
+	pgEventBatch     = 100
+)
+
+// postgresWatcher reads the item_events table the items trigger appends
+// to, woken by NOTIFY. Tokens are sequence numbers. Events of concurrent
+// transactions can commit out of sequence order, so a stream may miss one
+// committed just after it read past its number.
+type postgresWatcher struct {
+	db *postgresDB
+}
+
+func (w *postgresWatcher) WatchItems(ctx context.Context, token string) (ItemStream, error) {
+	if _, err := w.db.pool.Exec(ctx, "DELETE FROM item_events WHERE at < $1", time.Now().Add(-pgEventRetention)); err != nil {
+		return nil, err
+	}
+	conn, err := w.db.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s := &pgItemStream{db: w.db, conn: conn}
+	// Listen first, so no event slips between the start and the wait
+	if _, err := conn.Exec(ctx, "LISTEN item_events"); err != nil {
+		conn.Release()
+		return nil, err
+	}
+	if token == "" {
+		err = conn.QueryRow(ctx, "SELECT COALESCE(max(seq), 0) FROM item_events").Scan(&s.after)
+	} else if s.after, err = strconv.ParseInt(token, 10, 64); err != nil {
+		err = ErrStaleResumeToken
+	} else {
+		var kept bool
+		err = conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM item_events WHERE seq = $1)", s.after).Scan(&kept)
+		if err == nil && !kept {
+			err = ErrStaleResumeToken
+		}
+	}
+	if err != nil {
+		_ = s.Close(context.Background())
+		return nil, err
+	}
+	return s, nil
+}
+
+// pgItemStream holds a pool connection listening for item_events
+type pgItemStream struct {
+	db      *postgresDB
+	conn    *pgxpool.Conn
+	after   int64
+	pending []ItemEvent
+	event   ItemEvent
+	err     error
+}
+
+// fetch reads the next batch of events, with the items of creates and
+// updates as they are now, like the change stream's updateLookup
+func (s *pgItemStream) fetch(ctx context.Context) error {
+	rows, err := s.conn.Query(ctx, "SELECT seq, type, item_id FROM item_events WHERE seq > $1 ORDER BY seq LIMIT $2", s.after, pgEventBatch)
+	if err != nil {
+		return err
+	}
+	var events []ItemEvent
+	for rows.Next() {
+		var seq int64
+		var ev ItemEvent
+		if err := rows.Scan(&seq, &ev.Type, &ev.ID); err != nil {
+			rows.Close()
+			return err
+		}
+		ev.Token = strconv.FormatInt(seq, 10)
+		s.after = seq
+		events = append(events, ev)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	items := &postgresItems{db: s.db}
+	for _, ev := range events {
+		if ev.Type != ItemDeleted {
+			item, err := items.Get(ctx, ev.ID)
+			if errors.Is(err, ErrNotFound) {
+				// Deleted since; its delete event follows
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			ev.Item = item
+		}
+		s.pending = append(s.pending, ev)
+	}
+	return nil
+}
+
+func (s *pgItemStream) Next(ctx context.Context) bool {
+	for {
+		if len(s.pending) > 0 {
+			s.event, s.pending = s.pending[0], s.pending[1:]
+			return true
+		}
+		batch := s.after
+		if err := s.fetch(ctx); err != nil {
+			if ctx.Err() == nil {
+				s.err = err
+			}
+			return false
+		}
+		if s.after != batch {
+			continue
+		}
+		if _, err := s.conn.Conn().WaitForNotification(ctx); err != nil {
+			if ctx.Err() == nil {
+				s.err = err
+			}
+			return false
+		}
+	}
+}
+
+func (s *pgItemStream) Event() ItemEvent { return s.event }
+
+func (s *pgItemStream) Err() error { return s.err }
+
+// Close stops listening and hands the connection back to the pool
+func (s *pgItemStream) Close(ctx context.Context) error {
+	_, err := s.conn.Exec(ctx, "UNLISTEN *")
+	s.conn.Release()
+	return err
+}
@@ -0,0 +1,414 @@
+// Package repository is the data access layer. Handlers depend on the
+// interfaces here rather than on a database driver, so the storage can be
+// swapped, and replaced by fakes in tests. IDs are strings whatever the
+// backend stores.
+//
+// Deletes are soft: a record is stamped with DeletedAt and left in place.
+// Reads skip deleted records unless asked for them, and Restore brings one
+// back.
+package repository
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when no record has the requested ID
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicate is returned when a write would break a uniqueness
+	// constraint, e.g. two items with the same name
+	ErrDuplicate = errors.New("duplicate")
+	// ErrVersionConflict is returned when an update carries a version other
+	// than the stored one, i.e. someone else changed the record meanwhile
+	ErrVersionConflict = errors.New("version conflict")
+	// ErrStaleResumeToken is returned when a change stream can't resume
+	// from the token, because it is invalid or has left the oplog
+	ErrStaleResumeToken = errors.New("stale resume token")
+	// ErrPresignUnsupported is returned by stores that can't hand out
+	// download URLs
+	ErrPresignUnsupported = errors.New("presigned URLs not supported")
+	// ErrSchemaViolation is returned when the database's schema validator
+	// rejects a write
+	ErrSchemaViolation = errors.New("document fails schema validation")
+	// ErrNotAttempted is returned for the records of an ordered bulk write
+	// after the one that failed
+	ErrNotAttempted = errors.New("not attempted")
+	// ErrInvalidCursor is returned for a cursor that is malformed or was
+	// issued for a different sort order
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrNoTenant is returned by the repositories of a TenantRegistry for
+	// a context carrying no tenant, or one it doesn't serve
+	ErrNoTenant = errors.New("no such tenant")
+	// ErrForbidden is returned by the repositories of WithACL when the
+	// principal may read a record but not make the change
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Item is an entry of the items collection
+type Item struct {
+	ID          string  `json:"id" bson:"-"`
+	Name        string  `json:"name" bson:"name"`
+	Description string  `json:"description,omitempty" bson:"description,omitempty"`
+	Price       float64 `json:"price" bson:"price"`
+	// CostPrice and InternalNotes are for staff; responses strip them for
+	// other callers
+	CostPrice     float64    `json:"costPrice,omitempty" bson:"costPrice,omitempty"`
+	InternalNotes string     `json:"internalNotes,omitempty" bson:"internalNotes,omitempty"`
+	Tags          []string   `json:"tags,omitempty" bson:"tags,omitempty"`
+	Location      *GeoPoint  `json:"location,omitempty" bson:"location,omitempty"`
+	OwnerID       string     `json:"ownerId" bson:"ownerId"` // token sub of the creator
+	CreatedAt     time.Time  `json:"createdAt" bson:"createdAt"`
+	UpdatedAt     time.Time  `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+	DeletedAt     *time.Time `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	// Version counts the writes, starting at 1; Update only applies to the
+	// version it was given
+	Version int64 `json:"version" bson:"version"`
+	// ACL shares the item beyond its owner, see WithACL
+	ACL []Grant `json:"-" bson:"acl,omitempty"`
+}
+
+// GeoPoint is a GeoJSON point; Coordinates are longitude then latitude
+type GeoPoint struct {
+	Type        string    `json:"type" bson:"type"`
+	Coordinates []float64 `json:"coordinates" bson:"coordinates"`
+}
+
+// NewGeoPoint returns the point at lat, lng
+func NewGeoPoint(lat, lng float64) *GeoPoint {
+	return &GeoPoint{Type: "Point", Coordinates: []float64{lng, lat}}
+}
+
+// NearQuery selects the items matching Filter within Radius meters of Lat,
+// Lng, paged with the Offset and Limit of Page
+type NearQuery struct {
+	Lat, Lng float64
+	Radius   float64
+	Filter   ItemFilter
+	Page     Page
+}
+
+// NearItem is a result of ItemRepository.Near
+type NearItem struct {
+	Item
+	// Distance from the query point, in meters
+	Distance float64 `json:"distance" bson:"distance"`
+}
+
+// ItemFilter narrows Count and List; zero fields match everything
+type ItemFilter struct {
+	OwnerID      string
+	Tag          string
+	NameContains string // case-insensitive substring
+	MinPrice     *float64
+	MaxPrice     *float64
+	// Deleted selects the soft-deleted items instead of the live ones
+	Deleted bool
+	// Reader, when set, keeps the items it owns or is granted
+	Reader *Principal
+}
+
+// ItemSortFields are the fields items can be sorted by
+var ItemSortFields = []string{"name", "price", "createdAt", "updatedAt"}
+
+// SortField orders a listing by one field
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// Page selects a window of a listing. Records are ordered by Sort, then by
+// ID so pages are stable; Limit 0 means no limit. A Cursor returned by the
+// previous List continues right after its last record, which unlike Offset
+// costs the same however deep the page; Offset is ignored then.
+type Page struct {
+	Offset int
+	Limit  int
+	Sort   []SortField
+	Cursor string
+}
+
+// OwnerFinder resolves who owns a record, for requireOwnership
+type OwnerFinder interface {
+	// OwnerOf returns the owner's sub, or ErrNotFound
+	OwnerOf(ctx context.Context, id string) (string, error)
+}
+
+// ItemRepository stores items
+type ItemRepository interface {
+	OwnerFinder
+	Count(ctx context.Context, filter ItemFilter) (int64, error)
+	// List returns the page and the cursor of the next one, "" on the last
+	List(ctx context.Context, filter ItemFilter, page Page) ([]Item, string, error)
+	// Get returns the item or ErrNotFound
+	Get(ctx context.Context, id string) (*Item, error)
+	// Create assigns the item's ID
+	Create(ctx context.Context, item *Item) error
+	// CreateMany inserts items in one round trip and assigns the IDs of
+	// those stored. Ordered, it stops at the first failure. It returns an
+	// error per item, nil for those stored, and fails as a whole only when
+	// the write didn't run.
+	CreateMany(ctx context.Context, items []*Item, ordered bool) ([]error, error)
+	// Update replaces the stored item with the same ID and Version, and
+	// increments Version. It returns ErrNotFound, or ErrVersionConflict
+	// when the stored item has another version.
+	Update(ctx context.Context, item *Item) error
+	// Delete soft-deletes the item, or returns ErrNotFound
+	Delete(ctx context.Context, id string) error
+	// Restore undoes Delete, returning ErrNotFound unless the item is deleted
+	Restore(ctx context.Context, id string) (*Item, error)
+	// Near returns the located items of q, the closest first
+	Near(ctx context.Context, q NearQuery) ([]NearItem, error)
+}
+
+// Types of ItemEvent. Soft-deleting an item is a delete, restoring it a
+// create.
+const (
+	ItemCreated = "created"
+	ItemUpdated = "updated"
+	ItemDeleted = "deleted"
+)
+
+// ItemEvent is a change to an item
+type ItemEvent struct {
+	Type string
+	ID   string
+	Item *Item // nil for deletes
+	// Token resumes the stream right after this event
+	Token string
+}
+
+// ItemStream is an open feed of item changes
+type ItemStream interface {
+	// Next waits for the next event, returning false once ctx is done or
+	// the stream failed, see Err
+	Next(ctx context.Context) bool
+	Event() ItemEvent
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// ItemWatcher streams item changes as they are committed
+type ItemWatcher interface {
+	// WatchItems starts after the event with token, or from now when token
+	// is "". It returns ErrStaleResumeToken when it can't resume.
+	WatchItems(ctx context.Context, token string) (ItemStream, error)
+}
+
+// UserProfile is what the service stores about a Keycloak user; the ID is
+// the token sub
+type UserProfile struct {
+	ID          string     `json:"id" bson:"_id"`
+	Username    string     `json:"username" bson:"username"`
+	Email       string     `json:"email,omitempty" bson:"email,omitempty"`
+	DisplayName string     `json:"displayName,omitempty" bson:"displayName,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt" bson:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+	DeletedAt   *time.Time `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	// Roles is a snapshot of the token's roles, taken by Provision
+	Roles []string `json:"roles,omitempty" bson:"roles,omitempty"`
+	// FirstSeenAt and LastSeenAt bound the requests Provision saw
+	FirstSeenAt time.Time `json:"firstSeenAt,omitempty" bson:"firstSeenAt,omitempty"`
+	LastSeenAt  time.Time `json:"lastSeenAt,omitempty" bson:"lastSeenAt,omitempty"`
+	// The fields Keycloak doesn't own, which users edit themselves
+	AvatarURL   string                 `json:"avatarUrl,omitempty" bson:"avatarUrl,omitempty"`
+	Bio         string                 `json:"bio,omitempty" bson:"bio,omitempty"`
+	Preferences map[string]interface{} `json:"preferences,omitempty" bson:"preferences,omitempty"`
+	// PreferencesVersion counts the writes of Preferences, 0 before the
+	// first; SetPreferences only applies to the version it was given
+	PreferencesVersion int64 `json:"-" bson:"preferencesVersion,omitempty"`
+}
+
+// UserRepository stores user profiles
+type UserRepository interface {
+	// Get returns the profile or ErrNotFound
+	Get(ctx context.Context, id string) (*UserProfile, error)
+	// Save creates or replaces the profile
+	Save(ctx context.Context, user *UserProfile) error
+	// Provision creates or updates the profile from a token: it sets
+	// Username, Email, DisplayName, Roles and LastSeenAt, a new profile
+	// gets CreatedAt from LastSeenAt, and one without FirstSeenAt, new or
+	// made at registration, gets it too. The other fields are left as they
+	// are, a soft-deleted profile stays deleted.
+	Provision(ctx context.Context, user *UserProfile) error
+	// SetPreferences replaces the preferences of the profile id if they
+	// are at version, and returns their new version. It returns
+	// ErrNotFound, or ErrVersionConflict when they changed since.
+	SetPreferences(ctx context.Context, id string, prefs map[string]interface{}, version int64) (int64, error)
+	Count(ctx context.Context) (int64, error)
+	// Delete soft-deletes the profile, or returns ErrNotFound
+	Delete(ctx context.Context, id string) error
+	// ListDeleted returns a page of the soft-deleted profiles and how many
+	// there are in all
+	ListDeleted(ctx context.Context, page Page) ([]UserProfile, int64, error)
+	// Restore undoes Delete, returning ErrNotFound unless the profile is deleted
+	Restore(ctx context.Context, id string) (*UserProfile, error)
+}
+
+// AuditEntry records one mutating request
+type AuditEntry struct {
+	ID         string        `json:"id" bson:"-"`
+	At         time.Time     `json:"at" bson:"at"`
+	Actor      AuditActor    `json:"actor" bson:"actor"`
+	Method     string        `json:"method" bson:"method"`
+	Route      string        `json:"route" bson:"route"` // the route pattern, e.g. /items/:id
+	Path       string        `json:"path" bson:"path"`
+	ResourceID string        `json:"resourceId,omitempty" bson:"resourceId,omitempty"`
+	Status     int           `json:"status" bson:"status"`
+	Changes    []FieldChange `json:"changes,omitempty" bson:"changes,omitempty"`
+	RequestID  string        `json:"requestId,omitempty" bson:"requestId,omitempty"`
+	// ExpiresAt is when the entry is purged
+	ExpiresAt time.Time `json:"-" bson:"expiresAt"`
+}
+
+// AuditActor is who made an audited request; empty for anonymous callers
+type AuditActor struct {
+	Subject    string   `json:"sub,omitempty" bson:"sub,omitempty"`
+	Username   string   `json:"username,omitempty" bson:"username,omitempty"`
+	Roles      []string `json:"roles,omitempty" bson:"roles,omitempty"`
+	CallerType string   `json:"callerType,omitempty" bson:"callerType,omitempty"`
+}
+
+// FieldChange is one field an update changed
+type FieldChange struct {
+	Field string      `json:"field" bson:"field"`
+	From  interface{} `json:"from,omitempty" bson:"from,omitempty"`
+	To    interface{} `json:"to,omitempty" bson:"to,omitempty"`
+}
+
+// AuditFilter narrows AuditRepository.List; zero fields match everything
+type AuditFilter struct {
+	Actor      string // sub
+	Method     string
+	Route      string
+	ResourceID string
+	Since      time.Time
+	Until      time.Time
+}
+
+// AuditRepository stores the audit log, newest entries first
+type AuditRepository interface {
+	Record(ctx context.Context, entry *AuditEntry) error
+	// List returns a page of the matching entries and how many match
+	List(ctx context.Context, filter AuditFilter, page Page) ([]AuditEntry, int64, error)
+}
+
+// SearchQuery is a full-text search of items
+type SearchQuery struct {
+	Text string
+	// Autocomplete matches Text as the start of names, for search as you
+	// type
+	Autocomplete bool
+	// Fuzzy tolerates typos, where the provider supports it
+	Fuzzy bool
+	// Facets asks for match counts per tag
+	Facets bool
+	// Tag, when set, keeps the items with the tag
+	Tag string
+	// Reader, when set, keeps the items it owns or is granted
+	Reader *Principal
+	Page   Page
+}
+
+// FacetCount is a bucket of a search facet
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// SearchResult is a page of matches, best first, with how many match and
+// the facets asked for
+type SearchResult struct {
+	Items  []Item
+	Total  int64
+	Facets map[string][]FacetCount
+}
+
+// ItemSearcher runs full-text searches of items: with Atlas Search on
+// Atlas, a text index elsewhere
+type ItemSearcher interface {
+	// Provider names the backend, e.g. "atlas" or "text"
+	Provider() string
+	Search(ctx context.Context, q SearchQuery) (*SearchResult, error)
+}
+
+// StatInfo names a statistic of StatsRunner
+type StatInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// StatParams bound a statistic: records created in [Since, Until), zero
+// meaning unbounded, and at most Limit rows
+type StatParams struct {
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+// StatRow is a row of a statistic, its columns depending on the statistic
+type StatRow map[string]interface{}
+
+// StatsRunner computes the statistics of the admin dashboard
+type StatsRunner interface {
+	Stats() []StatInfo
+	// Run returns the rows of the statistic name, or ErrNotFound
+	Run(ctx context.Context, name string, params StatParams) ([]StatRow, error)
+}
+
+// EphemeralRepository stores records that expire, such as revoked tokens,
+// by key. A record is deleted some time after its expiry, and reads ignore
+// it from then on.
+type EphemeralRepository interface {
+	// Put stores record, replacing any under key, until expiresAt
+	Put(ctx context.Context, key string, record interface{}, expiresAt time.Time) error
+	// Get decodes the record of key into record, or returns ErrNotFound. A
+	// nil record only checks that it exists.
+	Get(ctx context.Context, key string, record interface{}) error
+	// Delete removes the record of key, or returns ErrNotFound
+	Delete(ctx context.Context, key string) error
+}
+
+// FileInfo describes a stored file
+type FileInfo struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	OwnerID     string    `json:"ownerId"`
+	UploadedAt  time.Time `json:"uploadedAt"`
+}
+
+// BlobStore stores files, in GridFS or an S3 bucket. Reads and writes of
+// content must finish by the deadline of ctx, if any, even after the call
+// returns.
+type BlobStore interface {
+	OwnerFinder
+	// Upload stores content under info, setting its ID, Size and UploadedAt
+	Upload(ctx context.Context, info *FileInfo, content io.Reader) error
+	// Stat returns the file without its content, or ErrNotFound
+	Stat(ctx context.Context, id string) (*FileInfo, error)
+	// Open returns the file and its content, to be closed, or ErrNotFound
+	Open(ctx context.Context, id string) (*FileInfo, io.ReadCloser, error)
+	// PresignURL returns a URL downloading the file without credentials
+	// until ttl passes, or ErrPresignUnsupported
+	PresignURL(ctx context.Context, id string, ttl time.Duration) (string, error)
+	// Delete removes the file, or returns ErrNotFound
+	Delete(ctx context.Context, id string) error
+}
+
+// Repositories bundles the repositories handlers are given
+type Repositories struct {
+	Items ItemRepository
+	Users UserRepository
+	Audit AuditRepository
+	// Events needs a replica set, like Tx
+	Events ItemWatcher
+	Files  BlobStore
+	Stats  StatsRunner
+	Search ItemSearcher
+	// Tx spans writes to several repositories
+	Tx Transactor
+}
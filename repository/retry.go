@@ -0,0 +1,266 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+// RetryPolicy bounds the retries of transient database errors: Attempts
+// calls in all, waiting BaseDelay, doubled each time up to MaxDelay, with
+// jitter, in between
+type RetryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// unavailableError is a transient error that outlasted the retries. Its
+// Temporary method lets the API answer 503 rather than 500.
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string   { return "database unavailable: " + e.err.Error() }
+func (e *unavailableError) Unwrap() error   { return e.err }
+func (e *unavailableError) Temporary() bool { return true }
+
+// Server error codes of a primary stepping down or a node shutting down;
+// the operation didn't run and can go to the next primary
+var transientCodes = []int32{
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// retryable tells whether err is worth another attempt. Writes are only
+// retried when they surely didn't apply: a network error may hide a write
+// that went through.
+func retryable(err error, write bool) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var selection topology.ServerSelectionError
+	if errors.As(err, &selection) {
+		return true
+	}
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		if serverErr.HasErrorLabel("RetryableWriteError") || serverErr.HasErrorLabel("TransientTransactionError") {
+			return true
+		}
+		for _, code := range transientCodes {
+			if serverErr.HasErrorCode(int(code)) {
+				return true
+			}
+		}
+	}
+	return !write && mongo.IsNetworkError(err)
+}
+
+// backoff is the wait before attempt+1: exponential, capped, and jittered
+// between half and all of it so replicas don't retry in step
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay << (attempt - 1)
+	if d > p.MaxDelay || d <= 0 {
+		d = p.MaxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// do runs fn until it succeeds, fails for good, or runs out of attempts.
+// Calls inside a transaction aren't retried: the transaction is aborted
+// and WithTransaction retries it as a whole.
+func (p RetryPolicy) do(ctx context.Context, write bool, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !retryable(err, write) || mongo.SessionFromContext(ctx) != nil {
+			return err
+		}
+		if attempt >= p.Attempts {
+			return &unavailableError{err: err}
+		}
+		timer := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return &unavailableError{err: err}
+		}
+	}
+}
+
+func retryValue[T any](ctx context.Context, p RetryPolicy, write bool, fn func() (T, error)) (T, error) {
+	var v T
+	err := p.do(ctx, write, func() error {
+		var err error
+		v, err = fn()
+		return err
+	})
+	return v, err
+}
+
+// WithRetry returns repos with the items, users, audit, stats and search
+// repositories retrying transient errors. Files and Events are left as
+// they are: streams can't be replayed, and change streams resume on their
+// own.
+func WithRetry(repos *Repositories, p RetryPolicy) *Repositories {
+	wrapped := *repos
+	wrapped.Items = &retryItems{next: repos.Items, p: p}
+	wrapped.Users = &retryUsers{next: repos.Users, p: p}
+	wrapped.Audit = &retryAudit{next: repos.Audit, p: p}
+	wrapped.Stats = &retryStats{next: repos.Stats, p: p}
+	wrapped.Search = &retrySearch{next: repos.Search, p: p}
+	return &wrapped
+}
+
+const (
+	readOp  = false
+	writeOp = true
+)
+
+type retryItems struct {
+	next ItemRepository
+	p    RetryPolicy
+}
+
+func (r *retryItems) OwnerOf(ctx context.Context, id string) (string, error) {
+	return retryValue(ctx, r.p, readOp, func() (string, error) { return r.next.OwnerOf(ctx, id) })
+}
+
+func (r *retryItems) Count(ctx context.Context, filter ItemFilter) (int64, error) {
+	return retryValue(ctx, r.p, readOp, func() (int64, error) { return r.next.Count(ctx, filter) })
+}
+
+func (r *retryItems) List(ctx context.Context, filter ItemFilter, page Page) ([]Item, string, error) {
+	var items []Item
+	var next string
+	err := r.p.do(ctx, readOp, func() error {
+		var err error
+		items, next, err = r.next.List(ctx, filter, page)
+		return err
+	})
+	return items, next, err
+}
+
+func (r *retryItems) Get(ctx context.Context, id string) (*Item, error) {
+	return retryValue(ctx, r.p, readOp, func() (*Item, error) { return r.next.Get(ctx, id) })
+}
+
+func (r *retryItems) Create(ctx context.Context, item *Item) error {
+	return r.p.do(ctx, writeOp, func() error { return r.next.Create(ctx, item) })
+}
+
+func (r *retryItems) CreateMany(ctx context.Context, items []*Item, ordered bool) ([]error, error) {
+	return retryValue(ctx, r.p, writeOp, func() ([]error, error) { return r.next.CreateMany(ctx, items, ordered) })
+}
+
+func (r *retryItems) Update(ctx context.Context, item *Item) error {
+	return r.p.do(ctx, writeOp, func() error { return r.next.Update(ctx, item) })
+}
+
+func (r *retryItems) Delete(ctx context.Context, id string) error {
+	return r.p.do(ctx, writeOp, func() error { return r.next.Delete(ctx, id) })
+}
+
+func (r *retryItems) Restore(ctx context.Context, id string) (*Item, error) {
+	return retryValue(ctx, r.p, writeOp, func() (*Item, error) { return r.next.Restore(ctx, id) })
+}
+
+func (r *retryItems) Near(ctx context.Context, q NearQuery) ([]NearItem, error) {
+	return retryValue(ctx, r.p, readOp, func() ([]NearItem, error) { return r.next.Near(ctx, q) })
+}
+
+type retryUsers struct {
+	next UserRepository
+	p    RetryPolicy
+}
+
+func (r *retryUsers) Get(ctx context.Context, id string) (*UserProfile, error) {
+	return retryValue(ctx, r.p, readOp, func() (*UserProfile, error) { return r.next.Get(ctx, id) })
+}
+
+func (r *retryUsers) Save(ctx context.Context, user *UserProfile) error {
+	return r.p.do(ctx, writeOp, func() error { return r.next.Save(ctx, user) })
+}
+
+func (r *retryUsers) Provision(ctx context.Context, user *UserProfile) error {
+	return r.p.do(ctx, writeOp, func() error { return r.next.Provision(ctx, user) })
+}
+
+func (r *retryUsers) SetPreferences(ctx context.Context, id string, prefs map[string]interface{}, version int64) (int64, error) {
+	return retryValue(ctx, r.p, writeOp, func() (int64, error) { return r.next.SetPreferences(ctx, id, prefs, version) })
+}
+
+func (r *retryUsers) Count(ctx context.Context) (int64, error) {
+	return retryValue(ctx, r.p, readOp, func() (int64, error) { return r.next.Count(ctx) })
+}
+
+func (r *retryUsers) Delete(ctx context.Context, id string) error {
+	return r.p.do(ctx, writeOp, func() error { return r.next.Delete(ctx, id) })
+}
+
+func (r *retryUsers) ListDeleted(ctx context.Context, page Page) ([]UserProfile, int64, error) {
+	var users []UserProfile
+	var total int64
+	err := r.p.do(ctx, readOp, func() error {
+		var err error
+		users, total, err = r.next.ListDeleted(ctx, page)
+		return err
+	})
+	return users, total, err
+}
+
+func (r *retryUsers) Restore(ctx context.Context, id string) (*UserProfile, error) {
+	return retryValue(ctx, r.p, writeOp, func() (*UserProfile, error) { return r.next.Restore(ctx, id) })
+}
+
+type retryAudit struct {
+	next AuditRepository
+	p    RetryPolicy
+}
+
+func (r *retryAudit) Record(ctx context.Context, entry *AuditEntry) error {
+	return r.p.do(ctx, writeOp, func() error { return r.next.Record(ctx, entry) })
+}
+
+func (r *retryAudit) List(ctx context.Context, filter AuditFilter, page Page) ([]AuditEntry, int64, error) {
+	var entries []AuditEntry
+	var total int64
+	err := r.p.do(ctx, readOp, func() error {
+		var err error
+		entries, total, err = r.next.List(ctx, filter, page)
+		return err
+	})
+	return entries, total, err
+}
+
+type retryStats struct {
+	next StatsRunner
+	p    RetryPolicy
+}
+
+func (r *retryStats) Stats() []StatInfo { return r.next.Stats() }
+
+func (r *retryStats) Run(ctx context.Context, name string, params StatParams) ([]StatRow, error) {
+	return retryValue(ctx, r.p, readOp, func() ([]StatRow, error) { return r.next.Run(ctx, name, params) })
+}
+
+type retrySearch struct {
+	next ItemSearcher
+	p    RetryPolicy
+}
+
+func (r *retrySearch) Provider() string { return r.next.Provider() }
+
+func (r *retrySearch) Search(ctx context.Context, q SearchQuery) (*SearchResult, error) {
+	return retryValue(ctx, r.p, readOp, func() (*SearchResult, error) { return r.next.Search(ctx, q) })
+}
@@ -0,0 +1,168 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// S3Config locates the bucket of an S3 or MinIO BlobStore
+type S3Config struct {
+	Endpoint  string // host:port, e.g. s3.eu-west-1.amazonaws.com or minio:9000
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+	// PublicEndpoint, when set, is the host presigned URLs point to, for a
+	// MinIO that clients reach under another name than the service
+	PublicEndpoint string
+}
+
+// s3Store keeps each file as an object named by its ID, with the owner and
+// file name in the object's user metadata
+type s3Store struct {
+	client  *minio.Client
+	presign *minio.Client
+	bucket  string
+}
+
+// NewS3 returns a BlobStore over the bucket of cfg, creating the bucket when
+// it doesn't exist
+func NewS3(ctx context.Context, cfg S3Config) (BlobStore, error) {
+	newClient := func(endpoint string) (*minio.Client, error) {
+		return minio.New(endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+			Secure: cfg.UseSSL,
+			Region: cfg.Region,
+		})
+	}
+	client, err := newClient(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	s := &s3Store{client: client, presign: client, bucket: cfg.Bucket}
+	if cfg.PublicEndpoint != "" {
+		// Presigning is local, given the region, so this client never dials
+		if s.presign, err = newClient(cfg.PublicEndpoint); err != nil {
+			return nil, err
+		}
+	}
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
+			return nil, fmt.Errorf("create bucket %s: %w", cfg.Bucket, err)
+		}
+	}
+	return s, nil
+}
+
+// s3Err maps client errors to the package's
+func s3Err(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return ErrNotFound
+	}
+	return err
+}
+
+// userMetadata reads a key of the user metadata, which comes back with its
+// case changed
+func userMetadata(info minio.ObjectInfo, key string) string {
+	for k, v := range info.UserMetadata {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+func (s *s3Store) Upload(ctx context.Context, info *FileInfo, content io.Reader) error {
+	id := primitive.NewObjectID().Hex()
+	opts := minio.PutObjectOptions{
+		ContentType: info.ContentType,
+		// Header values must be ASCII
+		UserMetadata: map[string]string{"owner": info.OwnerID, "filename": url.QueryEscape(info.Name)},
+	}
+	up, err := s.client.PutObject(ctx, s.bucket, id, content, -1, opts)
+	if err != nil {
+		return err
+	}
+	info.ID = id
+	info.Size = up.Size
+	info.UploadedAt = time.Now().UTC()
+	return nil
+}
+
+func (s *s3Store) Stat(ctx context.Context, id string) (*FileInfo, error) {
+	obj, err := s.client.StatObject(ctx, s.bucket, id, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s3Err(err)
+	}
+	name, err := url.QueryUnescape(userMetadata(obj, "filename"))
+	if err != nil || name == "" {
+		name = id
+	}
+	return &FileInfo{
+		ID:          id,
+		Name:        name,
+		ContentType: obj.ContentType,
+		Size:        obj.Size,
+		OwnerID:     userMetadata(obj, "owner"),
+		UploadedAt:  obj.LastModified.UTC(),
+	}, nil
+}
+
+func (s *s3Store) Open(ctx context.Context, id string) (*FileInfo, io.ReadCloser, error) {
+	info, err := s.Stat(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, id, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, s3Err(err)
+	}
+	return info, obj, nil
+}
+
+func (s *s3Store) OwnerOf(ctx context.Context, id string) (string, error) {
+	info, err := s.Stat(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return info.OwnerID, nil
+}
+
+// PresignURL signs a GET that downloads the file under its name
+func (s *s3Store) PresignURL(ctx context.Context, id string, ttl time.Duration) (string, error) {
+	info, err := s.Stat(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{}
+	params.Set("response-content-disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name}))
+	u, err := s.presign.PresignedGetObject(ctx, s.bucket, id, ttl, params)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// Delete checks the object exists first, since S3 deletes succeed either way
+func (s *s3Store) Delete(ctx context.Context, id string) error {
+	if _, err := s.Stat(ctx, id); err != nil {
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.bucket, id, minio.RemoveObjectOptions{})
+}
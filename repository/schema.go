@@ -0,0 +1,112 @@
+package repository
+
+import "go.mongodb.org/mongo-driver/bson"
+
+// CollectionSchema is the $jsonSchema validator of a collection, checked by
+// MongoDB on every write so malformed documents are rejected even when they
+// bypass the API's validation
+type CollectionSchema struct {
+	Collection string
+	Schema     bson.M
+}
+
+// Shorthands of the schemas below
+var (
+	schemaString = bson.M{"bsonType": "string"}
+	schemaDate   = bson.M{"bsonType": "date"}
+	// number covers int, long, double and decimal, so seeded integers pass
+	schemaNumber = bson.M{"bsonType": "number"}
+)
+
+func schemaObject(required []string, properties bson.M) bson.M {
+	return bson.M{"bsonType": "object", "required": required, "properties": properties}
+}
+
+// CollectionSchemas are attached by the migrations. They check types and
+// the bounds the API also enforces, and leave out fields they don't list,
+// so old documents and new optional fields keep working.
+var CollectionSchemas = []CollectionSchema{
+	{
+		Collection: "items",
+		Schema: schemaObject([]string{"name", "price", "ownerId", "createdAt", "version"}, bson.M{
+			"name":          bson.M{"bsonType": "string", "minLength": 1, "maxLength": 100},
+			"description":   bson.M{"bsonType": "string", "maxLength": 1000},
+			"price":         bson.M{"bsonType": "number", "minimum": 0},
+			"costPrice":     bson.M{"bsonType": "number", "minimum": 0},
+			"internalNotes": bson.M{"bsonType": "string", "maxLength": 1000},
+			"tags":          bson.M{"bsonType": "array", "maxItems": 20, "items": bson.M{"bsonType": "string", "minLength": 1, "maxLength": 30}},
+			"ownerId":       schemaString,
+			"createdAt":     schemaDate,
+			"updatedAt":     schemaDate,
+			"deletedAt":     schemaDate,
+			"version":       bson.M{"bsonType": "number", "minimum": 1},
+			"acl": bson.M{"bsonType": "array", "items": schemaObject([]string{"access"}, bson.M{
+				"sub":    schemaString,
+				"group":  schemaString,
+				"access": bson.M{"enum": bson.A{AccessRead, AccessWrite}},
+			})},
+			"location": schemaObject([]string{"type", "coordinates"}, bson.M{
+				"type":        bson.M{"enum": bson.A{"Point"}},
+				"coordinates": bson.M{"bsonType": "array", "minItems": 2, "maxItems": 2, "items": schemaNumber},
+			}),
+		}),
+	},
+	{
+		Collection: "users",
+		Schema: schemaObject([]string{"_id", "username", "createdAt"}, bson.M{
+			"_id":      schemaString,
+			"username": bson.M{"bsonType": "string", "minLength": 1},
+			// binData when encrypted with CSFLE
+			"email":              bson.M{"bsonType": bson.A{"string", "binData"}},
+			"displayName":        schemaString,
+			"createdAt":          schemaDate,
+			"updatedAt":          schemaDate,
+			"deletedAt":          schemaDate,
+			"roles":              bson.M{"bsonType": "array", "items": schemaString},
+			"firstSeenAt":        schemaDate,
+			"lastSeenAt":         schemaDate,
+			"avatarUrl":          bson.M{"bsonType": "string", "maxLength": 2048},
+			"bio":                bson.M{"bsonType": "string", "maxLength": 1000},
+			"preferences":        bson.M{"bsonType": "object"},
+			"preferencesVersion": bson.M{"bsonType": "number", "minimum": 0},
+		}),
+	},
+	{
+		Collection: "audit_logs",
+		Schema: schemaObject([]string{"at", "actor", "method", "route", "path", "status", "expiresAt"}, bson.M{
+			"at":         schemaDate,
+			"actor":      bson.M{"bsonType": "object"},
+			"method":     schemaString,
+			"route":      schemaString,
+			"path":       schemaString,
+			"resourceId": schemaString,
+			"status":     bson.M{"bsonType": "number", "minimum": 100, "maximum": 599},
+			"changes":    bson.M{"bsonType": "array"},
+			"requestId":  schemaString,
+			"expiresAt":  schemaDate,
+		}),
+	},
+}
+
+// EncryptableField tells whether the schema of collection lets field hold
+// an encrypted value, binData: fields it leaves out, or whose bsonType
+// lists binData
+func EncryptableField(collection, field string) bool {
+	for _, s := range CollectionSchemas {
+		if s.Collection != collection {
+			continue
+		}
+		prop, ok := s.Schema["properties"].(bson.M)[field].(bson.M)
+		if !ok {
+			return true
+		}
+		types, _ := prop["bsonType"].(bson.A)
+		for _, t := range types {
+			if t == "binData" {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
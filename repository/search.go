@@ -0,0 +1,163 @@
+package repository
+
+import (
+	"context"
+	"regexp"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// searchFacetLimit caps the buckets of a facet
+const searchFacetLimit = 20
+
+// searchPaths are the fields full-text search matches
+var searchPaths = []string{"name", "description", "tags"}
+
+// searchTail pages the matches of a search pipeline and, when asked,
+// counts them per tag, in one round trip
+func searchTail(q SearchQuery) bson.D {
+	facets := bson.M{
+		"items": bson.A{bson.M{"$skip": q.Page.Offset}, bson.M{"$limit": q.Page.Limit}},
+		"total": bson.A{bson.M{"$count": "n"}},
+	}
+	if q.Facets {
+		facets["tags"] = bson.A{
+			bson.M{"$unwind": "$tags"},
+			bson.M{"$group": bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}}},
+			bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+			bson.M{"$limit": searchFacetLimit},
+		}
+	}
+	return bson.D{{Key: "$facet", Value: facets}}
+}
+
+// liveMatch keeps the live items with the tag of q, if any
+func liveMatch(q SearchQuery, extra bson.M) bson.D {
+	match := bson.M{"deletedAt": nil}
+	if q.Tag != "" {
+		match["tags"] = q.Tag
+	}
+	if q.Reader != nil {
+		match["$or"] = readerQuery(q.Reader)
+	}
+	for k, v := range extra {
+		match[k] = v
+	}
+	return bson.D{{Key: "$match", Value: match}}
+}
+
+// runSearch runs pipeline, ending with searchTail, and decodes its result
+func runSearch(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline) (*SearchResult, error) {
+	cur, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var out []struct {
+		Items []itemDoc `bson:"items"`
+		Total []struct {
+			N int64 `bson:"n"`
+		} `bson:"total"`
+		Tags []struct {
+			Value string `bson:"_id"`
+			Count int64  `bson:"count"`
+		} `bson:"tags"`
+	}
+	if err := cur.All(ctx, &out); err != nil {
+		return nil, err
+	}
+	res := &SearchResult{Items: []Item{}}
+	if len(out) == 0 {
+		return res, nil
+	}
+	for _, doc := range out[0].Items {
+		res.Items = append(res.Items, doc.item())
+	}
+	if len(out[0].Total) > 0 {
+		res.Total = out[0].Total[0].N
+	}
+	if out[0].Tags != nil {
+		res.Facets = map[string][]FacetCount{"tags": {}}
+		for _, t := range out[0].Tags {
+			res.Facets["tags"] = append(res.Facets["tags"], FacetCount{Value: t.Value, Count: t.Count})
+		}
+	}
+	return res, nil
+}
+
+// textSearch uses the items text index, which any MongoDB has. Fuzzy is
+// ignored; autocomplete matches name prefixes.
+type textSearch struct {
+	coll *mongo.Collection
+}
+
+func (s *textSearch) Provider() string { return "text" }
+
+func (s *textSearch) Search(ctx context.Context, q SearchQuery) (*SearchResult, error) {
+	var pipeline mongo.Pipeline
+	if q.Autocomplete {
+		prefix := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(q.Text), Options: "i"}
+		pipeline = mongo.Pipeline{
+			liveMatch(q, bson.M{"name": prefix}),
+			{{Key: "$sort", Value: bson.M{"name": 1}}},
+		}
+	} else {
+		pipeline = mongo.Pipeline{
+			liveMatch(q, bson.M{"$text": bson.M{"$search": q.Text}}),
+			{{Key: "$sort", Value: bson.M{"score": bson.M{"$meta": "textScore"}}}},
+		}
+	}
+	return runSearch(ctx, s.coll, append(pipeline, searchTail(q)))
+}
+
+// atlasSearch uses an Atlas Search index, which maps name as autocomplete
+// besides the default dynamic mapping
+type atlasSearch struct {
+	coll  *mongo.Collection
+	index string
+}
+
+// NewAtlasSearch returns an ItemSearcher over the Atlas Search index of the
+// items collection of db
+func NewAtlasSearch(db *mongo.Database, index string) ItemSearcher {
+	return &atlasSearch{coll: db.Collection("items"), index: index}
+}
+
+// HasAtlasSearchIndex tells whether the items collection of db has the
+// Atlas Search index. Servers without Atlas Search reject the query, which
+// also answers false.
+func HasAtlasSearchIndex(ctx context.Context, db *mongo.Database, index string) bool {
+	cur, err := db.Collection("items").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$listSearchIndexes", Value: bson.M{"name": index}}},
+	})
+	if err != nil {
+		return false
+	}
+	defer cur.Close(ctx)
+	return cur.Next(ctx)
+}
+
+func (s *atlasSearch) Provider() string { return "atlas" }
+
+func (s *atlasSearch) Search(ctx context.Context, q SearchQuery) (*SearchResult, error) {
+	op := bson.M{"query": q.Text}
+	if q.Fuzzy {
+		op["fuzzy"] = bson.M{"maxEdits": 1}
+	}
+	search := bson.M{"index": s.index}
+	if q.Autocomplete {
+		op["path"] = "name"
+		search["autocomplete"] = op
+	} else {
+		op["path"] = searchPaths
+		search["text"] = op
+	}
+	// $search returns the best matches first
+	pipeline := mongo.Pipeline{
+		{{Key: "$search", Value: search}},
+		liveMatch(q, nil),
+		searchTail(q),
+	}
+	return runSearch(ctx, s.coll, pipeline)
+}
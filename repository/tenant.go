@@ -0,0 +1,290 @@
+package repository
+
+import (
+	"context"
+	"io"
+	"sort"
+	"time"
+)
+
+// tenantKey carries the tenant of WithTenant in the context
+type tenantKey struct{}
+
+// WithTenant returns ctx routing the calls of a TenantRegistry's
+// repositories to the data of tenant
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantOf returns the tenant of ctx, or ""
+func TenantOf(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// TenantRegistry holds the repositories of each tenant of a deployment
+// serving several, each with its own database. Its Repositories route
+// every call by the tenant of the context, and fail with ErrNoTenant
+// without one, so no code path reaches data without naming its tenant.
+type TenantRegistry struct {
+	tenants map[string]*Repositories
+	names   []string
+}
+
+// NewTenantRegistry opens the repositories of each of tenants
+func NewTenantRegistry(tenants []string, open func(tenant string) (*Repositories, error)) (*TenantRegistry, error) {
+	r := &TenantRegistry{tenants: map[string]*Repositories{}}
+	for _, tenant := range tenants {
+		if _, ok := r.tenants[tenant]; ok {
+			continue
+		}
+		repos, err := open(tenant)
+		if err != nil {
+			return nil, err
+		}
+		r.tenants[tenant] = repos
+		r.names = append(r.names, tenant)
+	}
+	sort.Strings(r.names)
+	return r, nil
+}
+
+// Tenants lists the tenants served, sorted
+func (r *TenantRegistry) Tenants() []string {
+	return append([]string(nil), r.names...)
+}
+
+// Has tells whether tenant is served
+func (r *TenantRegistry) Has(tenant string) bool {
+	_, ok := r.tenants[tenant]
+	return ok
+}
+
+// For returns the repositories of the tenant of ctx, or ErrNoTenant
+func (r *TenantRegistry) For(ctx context.Context) (*Repositories, error) {
+	repos, ok := r.tenants[TenantOf(ctx)]
+	if !ok {
+		return nil, ErrNoTenant
+	}
+	return repos, nil
+}
+
+// Repositories returns repositories routing each call to those of the
+// tenant of its context. Search reports the provider of the first tenant,
+// all being opened alike.
+func (r *TenantRegistry) Repositories() *Repositories {
+	provider := ""
+	if len(r.names) > 0 {
+		provider = r.tenants[r.names[0]].Search.Provider()
+	}
+	return &Repositories{
+		Items:  &tenantItems{r: r},
+		Users:  &tenantUsers{r: r},
+		Audit:  &tenantAudit{r: r},
+		Events: &tenantEvents{r: r},
+		Files:  &tenantFiles{r: r},
+		Stats:  &tenantStats{r: r},
+		Search: &tenantSearch{r: r, provider: provider},
+		Tx:     &tenantTx{r: r},
+	}
+}
+
+// tenantValue calls fn with the repositories of the tenant of ctx
+func tenantValue[T any](ctx context.Context, r *TenantRegistry, fn func(repos *Repositories) (T, error)) (T, error) {
+	repos, err := r.For(ctx)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return fn(repos)
+}
+
+func tenantDo(ctx context.Context, r *TenantRegistry, fn func(repos *Repositories) error) error {
+	repos, err := r.For(ctx)
+	if err != nil {
+		return err
+	}
+	return fn(repos)
+}
+
+type tenantItems struct {
+	r *TenantRegistry
+}
+
+func (t *tenantItems) OwnerOf(ctx context.Context, id string) (string, error) {
+	return tenantValue(ctx, t.r, func(repos *Repositories) (string, error) { return repos.Items.OwnerOf(ctx, id) })
+}
+
+func (t *tenantItems) Count(ctx context.Context, filter ItemFilter) (int64, error) {
+	return tenantValue(ctx, t.r, func(repos *Repositories) (int64, error) { return repos.Items.Count(ctx, filter) })
+}
+
+func (t *tenantItems) List(ctx context.Context, filter ItemFilter, page Page) ([]Item, string, error) {
+	repos, err := t.r.For(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	return repos.Items.List(ctx, filter, page)
+}
+
+func (t *tenantItems) Get(ctx context.Context, id string) (*Item, error) {
+	return tenantValue(ctx, t.r, func(repos *Repositories) (*Item, error) { return repos.Items.Get(ctx, id) })
+}
+
+func (t *tenantItems) Create(ctx context.Context, item *Item) error {
+	return tenantDo(ctx, t.r, func(repos *Repositories) error { return repos.Items.Create(ctx, item) })
+}
+
+func (t *tenantItems) CreateMany(ctx context.Context, items []*Item, ordered bool) ([]error, error) {
+	return tenantValue(ctx, t.r, func(repos *Repositories) ([]error, error) { return repos.Items.CreateMany(ctx, items, ordered) })
+}
+
+func (t *tenantItems) Update(ctx context.Context, item *Item) error {
+	return tenantDo(ctx, t.r, func(repos *Repositories) error { return repos.Items.Update(ctx, item) })
+}
+
+func (t *tenantItems) Delete(ctx context.Context, id string) error {
+	return tenantDo(ctx, t.r, func(repos *Repositories) error { return repos.Items.Delete(ctx, id) })
+}
+
+func (t *tenantItems) Restore(ctx context.Context, id string) (*Item, error) {
+	return tenantValue(ctx, t.r, func(repos *Repositories) (*Item, error) { return repos.Items.Restore(ctx, id) })
+}
+
+func (t *tenantItems) Near(ctx context.Context, q NearQuery) ([]NearItem, error) {
+	return tenantValue(ctx, t.r, func(repos *Repositories) ([]NearItem, error) { return repos.Items.Near(ctx, q) })
+}
+
+type tenantUsers struct {
+	r *TenantRegistry
+}
+
+func (t *tenantUsers) Get(ctx context.Context, id string) (*UserProfile, error) {
+	return tenantValue(ctx, t.r, func(repos *Repositories) (*UserProfile, error) { return repos.Users.Get(ctx, id) })
+}
+
+func (t *tenantUsers) Save(ctx context.Context, user *UserProfile) error {
+	return tenantDo(ctx, t.r, func(repos *Repositories) error { return repos.Users.Save(ctx, user) })
+}
+
+func (t *tenantUsers) Provision(ctx context.Context, user *UserProfile) error {
+	return tenantDo(ctx, t.r, func(repos *Repositories) error { return repos.Users.Provision(ctx, user) })
+}
+
+func (t *tenantUsers) SetPreferences(ctx context.Context, id string, prefs map[string]interface{}, version int64) (int64, error) {
+	return tenantValue(ctx, t.r, func(repos *Repositories) (int64, error) {
+		return repos.Users.SetPreferences(ctx, id, prefs, version)
+	})
+}
+
+func (t *tenantUsers) Count(ctx context.Context) (int64, error) {
+	return tenantValue(ctx, t.r, func(repos *Repositories) (int64, error) { return repos.Users.Count(ctx) })
+}
+
+func (t *tenantUsers) Delete(ctx context.Context, id string) error {
+	return tenantDo(ctx, t.r, func(repos *Repositories) error { return repos.Users.Delete(ctx, id) })
+}
+
+func (t *tenantUsers) ListDeleted(ctx context.Context, page Page) ([]UserProfile, int64, error) {
+	repos, err := t.r.For(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return repos.Users.ListDeleted(ctx, page)
+}
+
+func (t *tenantUsers) Restore(ctx context.Context, id string) (*UserProfile, error) {
+	return tenantValue(ctx, t.r, func(repos *Repositories) (*UserProfile, error) { return repos.Users.Restore(ctx, id) })
+}
+
+type tenantAudit struct {
+	r *TenantRegistry
+}
+
+func (t *tenantAudit) Record(ctx context.Context, entry *AuditEntry) error {
+	return tenantDo(ctx, t.r, func(repos *Repositories) error { return repos.Audit.Record(ctx, entry) })
+}
+
+func (t *tenantAudit) List(ctx context.Context, filter AuditFilter, page Page) ([]AuditEntry, int64, error) {
+	repos, err := t.r.For(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return repos.Audit.List(ctx, filter, page)
+}
+
+type tenantEvents struct {
+	r *TenantRegistry
+}
+
+func (t *tenantEvents) WatchItems(ctx context.Context, token string) (ItemStream, error) {
+	return tenantValue(ctx, t.r, func(repos *Repositories) (ItemStream, error) { return repos.Events.WatchItems(ctx, token) })
+}
+
+type tenantFiles struct {
+	r *TenantRegistry
+}
+
+func (t *tenantFiles) OwnerOf(ctx context.Context, id string) (string, error) {
+	return tenantValue(ctx, t.r, func(repos *Repositories) (string, error) { return repos.Files.OwnerOf(ctx, id) })
+}
+
+func (t *tenantFiles) Upload(ctx context.Context, info *FileInfo, content io.Reader) error {
+	return tenantDo(ctx, t.r, func(repos *Repositories) error { return repos.Files.Upload(ctx, info, content) })
+}
+
+func (t *tenantFiles) Stat(ctx context.Context, id string) (*FileInfo, error) {
+	return tenantValue(ctx, t.r, func(repos *Repositories) (*FileInfo, error) { return repos.Files.Stat(ctx, id) })
+}
+
+func (t *tenantFiles) Open(ctx context.Context, id string) (*FileInfo, io.ReadCloser, error) {
+	repos, err := t.r.For(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return repos.Files.Open(ctx, id)
+}
+
+func (t *tenantFiles) PresignURL(ctx context.Context, id string, ttl time.Duration) (string, error) {
+	return tenantValue(ctx, t.r, func(repos *Repositories) (string, error) { return repos.Files.PresignURL(ctx, id, ttl) })
+}
+
+func (t *tenantFiles) Delete(ctx context.Context, id string) error {
+	return tenantDo(ctx, t.r, func(repos *Repositories) error { return repos.Files.Delete(ctx, id) })
+}
+
+type tenantStats struct {
+	r *TenantRegistry
+}
+
+// Stats lists the statistics every store computes
+func (t *tenantStats) Stats() []StatInfo {
+	infos := make([]StatInfo, len(mongoStats))
+	for i, s := range mongoStats {
+		infos[i] = s.StatInfo
+	}
+	return infos
+}
+
+func (t *tenantStats) Run(ctx context.Context, name string, params StatParams) ([]StatRow, error) {
+	return tenantValue(ctx, t.r, func(repos *Repositories) ([]StatRow, error) { return repos.Stats.Run(ctx, name, params) })
+}
+
+type tenantSearch struct {
+	r        *TenantRegistry
+	provider string
+}
+
+func (t *tenantSearch) Provider() string { return t.provider }
+
+func (t *tenantSearch) Search(ctx context.Context, q SearchQuery) (*SearchResult, error) {
+	return tenantValue(ctx, t.r, func(repos *Repositories) (*SearchResult, error) { return repos.Search.Search(ctx, q) })
+}
+
+type tenantTx struct {
+	r *TenantRegistry
+}
+
+func (t *tenantTx) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	return tenantDo(ctx, t.r, func(repos *Repositories) error { return repos.Tx.InTx(ctx, fn) })
+}
@@ -0,0 +1,177 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/example/fiber-demo/repository"
+)
+
+// newTenants returns the routing repositories of a registry serving
+// tenants a and b from memory stores
+func newTenants(t *testing.T) *repository.Repositories {
+	t.Helper()
+	reg, err := repository.NewTenantRegistry([]string{"a", "b"}, func(string) (*repository.Repositories, error) {
+		return repository.NewMemory(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reg.Repositories()
+}
+
+// tenantBData is what seedTenantB stores in tenant b
+type tenantBData struct {
+	item, user, file string
+}
+
+func seedTenantB(t *testing.T, repos *repository.Repositories) tenantBData {
+	t.Helper()
+	ctx := repository.WithTenant(context.Background(), "b")
+	item := &repository.Item{Name: "secret plan", Price: 1, OwnerID: "bob", CreatedAt: time.Now().UTC()}
+	if err := repos.Items.Create(ctx, item); err != nil {
+		t.Fatal(err)
+	}
+	user := &repository.UserProfile{ID: "bob", Username: "bob", CreatedAt: time.Now().UTC()}
+	if err := repos.Users.Save(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	entry := &repository.AuditEntry{At: time.Now().UTC(), Method: "POST", Route: "/items", Path: "/items", Status: 201,
+		Actor: repository.AuditActor{Subject: "bob"}, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := repos.Audit.Record(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+	file := &repository.FileInfo{Name: "plan.txt", ContentType: "text/plain", OwnerID: "bob"}
+	if err := repos.Files.Upload(ctx, file, strings.NewReader("top secret")); err != nil {
+		t.Fatal(err)
+	}
+	return tenantBData{item: item.ID, user: user.ID, file: file.ID}
+}
+
+func wantNotFound(t *testing.T, what string, err error) {
+	t.Helper()
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("%s from tenant a: got %v, want ErrNotFound", what, err)
+	}
+}
+
+func TestTenantCannotReachAnotherTenantsData(t *testing.T) {
+	repos := newTenants(t)
+	b := seedTenantB(t, repos)
+	ctx := repository.WithTenant(context.Background(), "a")
+
+	_, err := repos.Items.Get(ctx, b.item)
+	wantNotFound(t, "Items.Get", err)
+	_, err = repos.Items.OwnerOf(ctx, b.item)
+	wantNotFound(t, "Items.OwnerOf", err)
+	wantNotFound(t, "Items.Update", repos.Items.Update(ctx, &repository.Item{ID: b.item, Name: "taken", Version: 1}))
+	wantNotFound(t, "Items.Delete", repos.Items.Delete(ctx, b.item))
+	items, _, err := repos.Items.List(ctx, repository.ItemFilter{}, repository.Page{Limit: 10})
+	if err != nil || len(items) != 0 {
+		t.Errorf("Items.List from tenant a: got %d items, %v", len(items), err)
+	}
+	if n, err := repos.Items.Count(ctx, repository.ItemFilter{}); err != nil || n != 0 {
+		t.Errorf("Items.Count from tenant a: got %d, %v", n, err)
+	}
+	res, err := repos.Search.Search(ctx, repository.SearchQuery{Text: "secret", Page: repository.Page{Limit: 10}})
+	if err != nil || res.Total != 0 || len(res.Items) != 0 {
+		t.Errorf("Search from tenant a: got %+v, %v", res, err)
+	}
+
+	_, err = repos.Users.Get(ctx, b.user)
+	wantNotFound(t, "Users.Get", err)
+	wantNotFound(t, "Users.Delete", repos.Users.Delete(ctx, b.user))
+	if n, err := repos.Users.Count(ctx); err != nil || n != 0 {
+		t.Errorf("Users.Count from tenant a: got %d, %v", n, err)
+	}
+
+	entries, total, err := repos.Audit.List(ctx, repository.AuditFilter{}, repository.Page{Limit: 10})
+	if err != nil || total != 0 || len(entries) != 0 {
+		t.Errorf("Audit.List from tenant a: got %d entries, %v", total, err)
+	}
+
+	_, err = repos.Files.Stat(ctx, b.file)
+	wantNotFound(t, "Files.Stat", err)
+	_, _, err = repos.Files.Open(ctx, b.file)
+	wantNotFound(t, "Files.Open", err)
+	wantNotFound(t, "Files.Delete", repos.Files.Delete(ctx, b.file))
+
+	// Tenant b still has it all
+	ctxB := repository.WithTenant(context.Background(), "b")
+	if _, err := repos.Items.Get(ctxB, b.item); err != nil {
+		t.Errorf("Items.Get from tenant b: %v", err)
+	}
+	if res, err := repos.Search.Search(ctxB, repository.SearchQuery{Text: "secret", Page: repository.Page{Limit: 10}}); err != nil || res.Total != 1 {
+		t.Errorf("Search from tenant b: got %+v, %v", res, err)
+	}
+	if _, err := repos.Users.Get(ctxB, b.user); err != nil {
+		t.Errorf("Users.Get from tenant b: %v", err)
+	}
+	if _, total, err := repos.Audit.List(ctxB, repository.AuditFilter{}, repository.Page{Limit: 10}); err != nil || total != 1 {
+		t.Errorf("Audit.List from tenant b: got %d entries, %v", total, err)
+	}
+	_, content, err := repos.Files.Open(ctxB, b.file)
+	if err != nil {
+		t.Fatalf("Files.Open from tenant b: %v", err)
+	}
+	defer content.Close()
+	if data, _ := io.ReadAll(content); string(data) != "top secret" {
+		t.Errorf("Files.Open from tenant b: got %q", data)
+	}
+}
+
+func TestCallsWithoutTenantFail(t *testing.T) {
+	repos := newTenants(t)
+	b := seedTenantB(t, repos)
+
+	for name, ctx := range map[string]context.Context{
+		"no tenant":      context.Background(),
+		"unknown tenant": repository.WithTenant(context.Background(), "c"),
+	} {
+		calls := map[string]error{}
+		_, calls["Items.Get"] = repos.Items.Get(ctx, b.item)
+		_, calls["Items.OwnerOf"] = repos.Items.OwnerOf(ctx, b.item)
+		_, _, calls["Items.List"] = repos.Items.List(ctx, repository.ItemFilter{}, repository.Page{Limit: 10})
+		_, calls["Items.Count"] = repos.Items.Count(ctx, repository.ItemFilter{})
+		calls["Items.Create"] = repos.Items.Create(ctx, &repository.Item{Name: "x"})
+		_, calls["Items.CreateMany"] = repos.Items.CreateMany(ctx, []*repository.Item{{Name: "y"}}, true)
+		calls["Items.Update"] = repos.Items.Update(ctx, &repository.Item{ID: b.item, Name: "x", Version: 1})
+		calls["Items.Delete"] = repos.Items.Delete(ctx, b.item)
+		_, calls["Items.Restore"] = repos.Items.Restore(ctx, b.item)
+		_, calls["Items.Near"] = repos.Items.Near(ctx, repository.NearQuery{Radius: 1000, Page: repository.Page{Limit: 1}})
+		_, calls["Search"] = repos.Search.Search(ctx, repository.SearchQuery{Text: "secret", Page: repository.Page{Limit: 10}})
+
+		_, calls["Users.Get"] = repos.Users.Get(ctx, b.user)
+		calls["Users.Save"] = repos.Users.Save(ctx, &repository.UserProfile{ID: "x"})
+		calls["Users.Provision"] = repos.Users.Provision(ctx, &repository.UserProfile{ID: "x"})
+		_, calls["Users.SetPreferences"] = repos.Users.SetPreferences(ctx, b.user, map[string]interface{}{}, 0)
+		_, calls["Users.Count"] = repos.Users.Count(ctx)
+		calls["Users.Delete"] = repos.Users.Delete(ctx, b.user)
+		_, _, calls["Users.ListDeleted"] = repos.Users.ListDeleted(ctx, repository.Page{Limit: 10})
+		_, calls["Users.Restore"] = repos.Users.Restore(ctx, b.user)
+
+		calls["Audit.Record"] = repos.Audit.Record(ctx, &repository.AuditEntry{At: time.Now()})
+		_, _, calls["Audit.List"] = repos.Audit.List(ctx, repository.AuditFilter{}, repository.Page{Limit: 10})
+
+		calls["Files.Upload"] = repos.Files.Upload(ctx, &repository.FileInfo{Name: "x"}, strings.NewReader("x"))
+		_, calls["Files.Stat"] = repos.Files.Stat(ctx, b.file)
+		_, _, calls["Files.Open"] = repos.Files.Open(ctx, b.file)
+		_, calls["Files.OwnerOf"] = repos.Files.OwnerOf(ctx, b.file)
+		_, calls["Files.PresignURL"] = repos.Files.PresignURL(ctx, b.file, time.Minute)
+		calls["Files.Delete"] = repos.Files.Delete(ctx, b.file)
+
+		_, calls["Events.WatchItems"] = repos.Events.WatchItems(ctx, "")
+		_, calls["Stats.Run"] = repos.Stats.Run(ctx, "items-by-tag", repository.StatParams{})
+		calls["Tx.InTx"] = repos.Tx.InTx(ctx, func(context.Context) error { return nil })
+
+		for call, err := range calls {
+			if !errors.Is(err, repository.ErrNoTenant) {
+				t.Errorf("%s with %s: got %v, want ErrNoTenant", call, name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Transactor runs compound writes atomically
+type Transactor interface {
+	// InTx runs fn in a transaction and commits when it returns nil. fn must
+	// do its reads and writes with the ctx it is given, and may be called
+	// again when the transaction hits a transient error, so it must not
+	// have effects outside the database.
+	InTx(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// SupportsTransactions reports whether the deployment behind db is a replica
+// set or a sharded cluster, the topologies with multi-document transactions
+func SupportsTransactions(ctx context.Context, db *mongo.Database) (bool, error) {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := db.Client().Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return false, err
+	}
+	return hello.SetName != "" || hello.Msg == "isdbgrid", nil
+}
+
+// mongoTx runs InTx in a session transaction, or runs fn directly when the
+// deployment can't do transactions
+type mongoTx struct {
+	client  *mongo.Client
+	enabled bool
+}
+
+func (t *mongoTx) InTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !t.enabled {
+		return fn(ctx)
+	}
+	session, err := t.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	// WithTransaction retries fn on TransientTransactionError and the commit
+	// on UnknownTransactionCommitResult, for up to two minutes
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// headerRequestID is forwarded by KrakenD or generated here, and echoed on
+// every response
+const headerRequestID = fiber.HeaderXRequestID
+
+type requestIDKey struct{}
+
+// Middleware taking the request ID from X-Request-ID, or generating one when
+// it is missing or unusable, and storing it in locals and the user context,
+// along with a logger tagged with it
+func requestIDMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Get(headerRequestID)
+		if !validRequestID(id) {
+			id = utils.UUIDv4()
+		}
+		c.Locals("requestId", id)
+		ctx := context.WithValue(c.UserContext(), requestIDKey{}, id)
+		c.SetUserContext(log.With().Str("request_id", id).Logger().WithContext(ctx))
+		c.Set(headerRequestID, id)
+		return c.Next()
+	}
+}
+
+// validRequestID accepts up to 128 printable ASCII characters, so a client
+// can't inject log lines or oversized headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the ID of the request c is serving
+func requestID(c *fiber.Ctx) string {
+	id, _ := c.Locals("requestId").(string)
+	return id
+}
+
+// requestIDFrom returns the request ID stored in ctx, for code holding only
+// the user context
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns the logger of the request serving ctx, tagged with
+// its request ID and, once authenticated, the caller; the global logger
+// outside requests
+func requestLogger(ctx context.Context) *zerolog.Logger {
+	return zerolog.Ctx(ctx)
+}
+
+// errorJSON writes an error body that handlers build themselves, adding the
+// request ID as apperror.Handler does
+func errorJSON(c *fiber.Ctx, status int, body fiber.Map) error {
+	if id := requestID(c); id != "" {
+		body["requestId"] = id
+	}
+	return c.Status(status).JSON(body)
+}
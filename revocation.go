@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// revocations is set when REVOCATION=true
+var revocations revocationStore
+
+// revocationStore records killed tokens until they would have expired anyway
+type revocationStore interface {
+	// revokeToken denylists one token by jti until expiresAt
+	revokeToken(ctx context.Context, jti, sub string, expiresAt time.Time) error
+	// revokeSubject rejects every token of sub issued at or before now
+	revokeSubject(ctx context.Context, sub string) error
+	// isRevoked reports whether claims belong to a revoked token or subject
+	isRevoked(ctx context.Context, claims *KeycloakClaims) (bool, error)
+}
+
+// ephemeralRevocationStore keeps revocations in ephemeral collections so
+// entries disappear once no matching token can still be valid
+type ephemeralRevocationStore struct {
+	tokens   repository.EphemeralRepository // {sub} by jti
+	subjects repository.EphemeralRepository // {revokedAt} by sub
+
+	// maxTokenLifetime bounds how long a subject revocation must be kept
+	maxTokenLifetime time.Duration
+}
+
+// revokedToken is a record of revoked_tokens
+type revokedToken struct {
+	Sub string `bson:"sub"`
+}
+
+// revokedSubject is a record of revoked_subjects
+type revokedSubject struct {
+	RevokedAt time.Time `bson:"revokedAt"`
+}
+
+func newEphemeralRevocationStore(maxTokenLifetime time.Duration) *ephemeralRevocationStore {
+	return &ephemeralRevocationStore{
+		tokens:           ephemeralStore("revoked_tokens"),
+		subjects:         ephemeralStore("revoked_subjects"),
+		maxTokenLifetime: maxTokenLifetime,
+	}
+}
+
+func (s *ephemeralRevocationStore) revokeToken(ctx context.Context, jti, sub string, expiresAt time.Time) error {
+	return s.tokens.Put(ctx, jti, revokedToken{Sub: sub}, expiresAt)
+}
+
+func (s *ephemeralRevocationStore) revokeSubject(ctx context.Context, sub string) error {
+	now := time.Now()
+	return s.subjects.Put(ctx, sub, revokedSubject{RevokedAt: now}, now.Add(s.maxTokenLifetime))
+}
+
+func (s *ephemeralRevocationStore) isRevoked(ctx context.Context, claims *KeycloakClaims) (bool, error) {
+	if claims.ID != "" {
+		err := s.tokens.Get(ctx, claims.ID, nil)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, repository.ErrNotFound) {
+			return false, err
+		}
+	}
+
+	var subject revokedSubject
+	err := s.subjects.Get(ctx, claims.Subject, &subject)
+	if errors.Is(err, repository.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// Tokens without iat can't prove they were issued after the revocation
+	if claims.IssuedAt == nil {
+		return true, nil
+	}
+	return !claims.IssuedAt.After(subject.RevokedAt), nil
+}
+
+// checkRevoked rejects tokens that were revoked before they expired
+func checkRevoked(ctx context.Context, claims *KeycloakClaims) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	revoked, err := revocations.isRevoked(ctx, claims)
+	if err != nil {
+		requestLogger(ctx).Error().Err(err).Msg("Revocation check error")
+		return fmt.Errorf("cannot check token revocation")
+	}
+	if revoked {
+		return fmt.Errorf("token has been revoked")
+	}
+	return nil
+}
+
+// Admin endpoints to revoke a single token or every token of a subject
+func registerRevocationRoutes(app *fiber.App) {
+	// Body: {"token": "<jwt>"} or {"jti": "...", "sub": "...", "expiresAt": <unix seconds>}
+	app.Post("/admin/revocations/tokens", requireRole("admin"), func(c *fiber.Ctx) error {
+		var body struct {
+			Token     string `json:"token"`
+			JTI       string `json:"jti"`
+			Sub       string `json:"sub"`
+			ExpiresAt int64  `json:"expiresAt"`
+		}
+		if err := c.BodyParser(&body); err != nil {
+			return apperror.Validation("Invalid body")
+		}
+		expiresAt := time.Unix(body.ExpiresAt, 0)
+		if body.Token != "" {
+			claims, err := parseUnverified(body.Token)
+			if err != nil {
+				return apperror.Validation(err.Error())
+			}
+			body.JTI, body.Sub = claims.ID, claims.Subject
+			if claims.ExpiresAt != nil {
+				expiresAt = claims.ExpiresAt.Time
+			}
+		}
+		if body.JTI == "" {
+			return apperror.Validation("jti or token is required")
+		}
+		if body.ExpiresAt == 0 && body.Token == "" {
+			expiresAt = time.Now().Add(cfg.Auth.RevocationMaxTokenLifetime)
+		}
+		// Keep the entry for the clock skew too, as validation tolerates it
+		if err := revocations.revokeToken(c.UserContext(), body.JTI, body.Sub, expiresAt.Add(clockSkew)); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"revoked": body.JTI, "until": expiresAt})
+	})
+
+	app.Post("/admin/revocations/subjects/:sub", requireRole("admin"), func(c *fiber.Ctx) error {
+		if err := revocations.revokeSubject(c.UserContext(), c.Params("sub")); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"revoked": c.Params("sub")})
+	})
+}
+
+// Enable the token denylist when REVOCATION=true
+func initRevocation() {
+	if !cfg.Auth.Revocation {
+		return
+	}
+	revocations = newEphemeralRevocationStore(cfg.Auth.RevocationMaxTokenLifetime)
+	log.Info().Msg("Token revocation checks enabled")
+}
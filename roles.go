@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RoleExtractor turns validated claims into the role names checked by
+// requireRole and friends. Deployments with custom token layouts register
+// their own implementation instead of forking extractRoles.
+type RoleExtractor interface {
+	ExtractRoles(claims *KeycloakClaims) ([]string, error)
+}
+
+// RoleExtractorFunc adapts a plain function to RoleExtractor
+type RoleExtractorFunc func(claims *KeycloakClaims) ([]string, error)
+
+func (f RoleExtractorFunc) ExtractRoles(claims *KeycloakClaims) ([]string, error) {
+	return f(claims)
+}
+
+// roleExtractors holds the extractors selectable with ROLE_EXTRACTOR
+var roleExtractors = map[string]RoleExtractor{}
+
+// activeRoleExtractor is the extractor used for every request
+var activeRoleExtractor RoleExtractor = newKeycloakRoleExtractor()
+
+// registerRoleExtractor makes an extractor selectable by name. Call it from
+// an init function so it is available before initAuth runs.
+func registerRoleExtractor(name string, e RoleExtractor) {
+	if _, dup := roleExtractors[name]; dup {
+		panic(fmt.Sprintf("role extractor %q registered twice", name))
+	}
+	roleExtractors[name] = e
+}
+
+func init() {
+	registerRoleExtractor("keycloak", activeRoleExtractor)
+}
+
+// --- MODIFIED HELPER ---
+// extract roles from parsed claims using the token realm's rules, or the
+// configured extractor
+func extractRoles(claims *KeycloakClaims) ([]string, error) {
+	if serviceAccountRoles != nil && claims.IsServiceAccount() {
+		return expandRoles(serviceAccountRoles[claims.ServiceAccountClient()]), nil
+	}
+	extractor := activeRoleExtractor
+	if realm := realmFor(claims.Issuer); realm != nil && realm.roles != nil {
+		extractor = realm.roles
+	}
+	roles, err := extractor.ExtractRoles(claims)
+	if err != nil {
+		return nil, err
+	}
+	return expandRoles(roles), nil
+}
+
+// roleImplications maps a role to the roles it directly implies, from
+// ROLE_HIERARCHY, e.g. "admin>editor,editor>user"
+var roleImplications map[string][]string
+
+// expandRoles adds every role implied, directly or transitively, by roles
+func expandRoles(roles []string) []string {
+	if len(roleImplications) == 0 {
+		return roles
+	}
+	seen := map[string]bool{}
+	out := make([]string, 0, len(roles))
+	queue := append([]string(nil), roles...)
+	for len(queue) > 0 {
+		role := queue[0]
+		queue = queue[1:]
+		if seen[role] {
+			continue
+		}
+		seen[role] = true
+		out = append(out, role)
+		queue = append(queue, roleImplications[role]...)
+	}
+	return out
+}
+
+// parseRoleHierarchy reads rules of the form "senior>junior"; chains like
+// "admin>editor>user" are accepted as shorthand
+func parseRoleHierarchy(v string) (map[string][]string, error) {
+	implications := map[string][]string{}
+	for _, rule := range splitList(v) {
+		parts := strings.Split(rule, ">")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid rule %q, expected senior>junior", rule)
+		}
+		for i := 0; i < len(parts)-1; i++ {
+			senior, junior := strings.TrimSpace(parts[i]), strings.TrimSpace(parts[i+1])
+			if senior == "" || junior == "" {
+				return nil, fmt.Errorf("invalid rule %q, expected senior>junior", rule)
+			}
+			implications[senior] = append(implications[senior], junior)
+		}
+	}
+	return implications, nil
+}
+
+// keycloakRoleExtractor reads the role claims Keycloak emits; the first
+// configured source that is present in the token wins
+type keycloakRoleExtractor struct {
+	// Claim locations roles can be read from, in order of precedence.
+	// Overridable with ROLE_SOURCES, e.g. "realm_access,resource_access".
+	sources []string
+
+	// clientID selects which resource_access.<client> entry to read. When
+	// empty the token's azp (the client it was issued to) is used.
+	clientID string
+}
+
+func newKeycloakRoleExtractor() *keycloakRoleExtractor {
+	return &keycloakRoleExtractor{sources: []string{"roles", "realm_access", "resource_access"}}
+}
+
+func (e *keycloakRoleExtractor) ExtractRoles(claims *KeycloakClaims) ([]string, error) {
+	for _, source := range e.sources {
+		if roles, ok := e.rolesFromSource(claims, source); ok {
+			return roles, nil
+		}
+	}
+	return nil, fmt.Errorf("no roles in token")
+}
+
+func (e *keycloakRoleExtractor) rolesFromSource(claims *KeycloakClaims, source string) ([]string, bool) {
+	switch source {
+	case "roles":
+		// Custom realm-role mapper putting roles in a top-level "roles" claim
+		return claims.Roles, claims.Roles != nil
+	case "realm_access":
+		// Stock Keycloak: {"realm_access": {"roles": [...]}}
+		return claims.RealmRoles(), claims.RealmAccess != nil
+	case "resource_access":
+		// Stock Keycloak: {"resource_access": {"<client>": {"roles": [...]}}}
+		clientID := e.clientID
+		if clientID == "" {
+			clientID = claims.AuthorizedParty
+		}
+		client, ok := claims.ResourceAccess[clientID]
+		return client.Roles, ok
+	}
+	return nil, false
+}
+
+// Select the role extractor (ROLE_EXTRACTOR), configure the built-in
+// Keycloak one (ROLE_SOURCES, ROLE_CLIENT_ID) and load ROLE_HIERARCHY
+func initRoleExtractor() {
+	kc := roleExtractors["keycloak"].(*keycloakRoleExtractor)
+	kc.sources = cfg.Auth.RoleSources
+	kc.clientID = cfg.Auth.RoleClientID
+
+	implications, err := parseRoleHierarchy(cfg.Auth.RoleHierarchy)
+	if err != nil {
+		log.Fatal().Err(err).Msg("ROLE_HIERARCHY error")
+	}
+	roleImplications = implications
+	if len(implications) > 0 {
+		log.Info().Str("hierarchy", cfg.Auth.RoleHierarchy).Msg("Role hierarchy")
+	}
+
+	if path := cfg.Auth.ServiceAccountRolesFile; path != "" {
+		table, err := loadServiceAccountRoles(path)
+		if err != nil {
+			log.Fatal().Err(err).Msg("SERVICE_ACCOUNT_ROLES_FILE error")
+		}
+		serviceAccountRoles = table
+		log.Info().Int("clients", len(table)).Str("file", path).Msg("Mapping service-account roles")
+	}
+
+	name := cfg.Auth.RoleExtractor
+	e, ok := roleExtractors[name]
+	if !ok {
+		var names []string
+		for n := range roleExtractors {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		log.Fatal().Msgf("ROLE_EXTRACTOR: unknown extractor %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	activeRoleExtractor = e
+	if name == "keycloak" {
+		log.Info().Strs("sources", kc.sources).Msg("Reading roles")
+	} else {
+		log.Info().Str("extractor", name).Msg("Using role extractor")
+	}
+}
+
+// serviceAccountRoles maps client IDs to the roles their service accounts
+// hold (SERVICE_ACCOUNT_ROLES_FILE). When set, service-account tokens are
+// authorized by this table only, never by the roles in the token, and
+// unlisted clients get none.
+var serviceAccountRoles map[string][]string
+
+// loadServiceAccountRoles reads {"<clientId>": ["role", ...]}
+func loadServiceAccountRoles(path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	table := map[string][]string{}
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
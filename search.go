@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxSearchText caps ?q of GET /items/search
+const maxSearchText = 200
+
+// registerSearchRoutes mounts GET /items/search, full-text search of items
+// on whichever provider the deployment has. ?q is the text; ?autocomplete,
+// ?fuzzy and ?facets switch the options of repository.SearchQuery, and
+// ?filter=tag:<tag> narrows to a facet. Matches come best first.
+func registerSearchRoutes(app *fiber.App, search repository.ItemSearcher) {
+	app.Get("/items/search", requireAnyRole("user", "admin"), func(c *fiber.Ctx) error {
+		params, err := parseListParams(c, nil, []string{"tag"})
+		if err != nil {
+			return err
+		}
+		if params.cursor != "" || len(params.sort) > 0 {
+			return apperror.Validation("Invalid list parameters", fiber.Map{"page": "search results are by relevance, paged with page"})
+		}
+		text := strings.TrimSpace(c.Query("q"))
+		if text == "" || len(text) > maxSearchText {
+			return apperror.Validation("Invalid search", fiber.Map{"q": "must be 1-" + strconv.Itoa(maxSearchText) + " characters"})
+		}
+		q := repository.SearchQuery{
+			Text:         text,
+			Autocomplete: c.QueryBool("autocomplete"),
+			Fuzzy:        c.QueryBool("fuzzy"),
+			Facets:       c.QueryBool("facets"),
+			Tag:          params.filter["tag"],
+			Page:         params.repoPage(),
+		}
+		res, err := search.Search(c.UserContext(), q)
+		if err != nil {
+			return apperror.Internal("Search failed", err)
+		}
+		resp := listEnvelope("items", res.Items, params, res.Total, "")
+		resp["provider"] = search.Provider()
+		if res.Facets != nil {
+			resp["facets"] = res.Facets
+		}
+		return c.JSON(resp)
+	})
+}
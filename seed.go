@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// seedFixtures are the fixture files of SEED_DIR: each holds a JSON array
+// of documents in MongoDB Extended JSON (e.g. {"$date": "..."}), upserted
+// by key so seeding twice leaves the same data
+var seedFixtures = []struct {
+	file, collection, key string
+}{
+	{"users.json", "users", "_id"},
+	{"items.json", "items", "name"},
+}
+
+// seedDir holds the fixture files, SEED_DIR or ./fixtures
+func seedDir() string {
+	return cfg.SeedDir
+}
+
+// readFixture decodes the documents of a fixture file of dir, checking
+// each has the key
+func readFixture(dir, file, key string) ([]bson.M, error) {
+	data, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return nil, err
+	}
+	var raws []json.RawMessage
+	if err := json.Unmarshal(data, &raws); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	docs := make([]bson.M, len(raws))
+	for i, raw := range raws {
+		if err := bson.UnmarshalExtJSON(raw, false, &docs[i]); err != nil {
+			return nil, fmt.Errorf("%s: document %d: %v", file, i, err)
+		}
+		if _, ok := docs[i][key]; !ok {
+			return nil, fmt.Errorf("%s: document %d has no %s", file, i, key)
+		}
+	}
+	return docs, nil
+}
+
+// seedDatabase loads the fixtures in dir, first emptying their collections
+// when reset is set, and returns the number of documents per collection
+func seedDatabase(ctx context.Context, db *mongo.Database, dir string, reset bool) (map[string]int, error) {
+	counts := map[string]int{}
+	for _, f := range seedFixtures {
+		docs, err := readFixture(dir, f.file, f.key)
+		if err != nil {
+			return counts, err
+		}
+		coll := db.Collection(f.collection)
+		if reset {
+			if _, err := coll.DeleteMany(ctx, bson.M{}); err != nil {
+				return counts, err
+			}
+		}
+		for i, doc := range docs {
+			if _, err := coll.ReplaceOne(ctx, bson.M{f.key: doc[f.key]}, doc, options.Replace().SetUpsert(true)); err != nil {
+				return counts, fmt.Errorf("%s: document %d: %v", f.file, i, err)
+			}
+		}
+		counts[f.collection] = len(docs)
+	}
+	return counts, nil
+}
+
+// seedRepositories loads the fixtures in dir through repos, for the memory
+// store. Items already there by name are kept, so seeding twice leaves the
+// same data.
+func seedRepositories(ctx context.Context, repos *repository.Repositories, dir string) (map[string]int, error) {
+	counts := map[string]int{}
+	for _, f := range seedFixtures {
+		docs, err := readFixture(dir, f.file, f.key)
+		if err != nil {
+			return counts, err
+		}
+		for i, doc := range docs {
+			raw, err := bson.Marshal(doc)
+			if err == nil {
+				switch f.collection {
+				case "users":
+					var user repository.UserProfile
+					if err = bson.Unmarshal(raw, &user); err == nil {
+						err = repos.Users.Save(ctx, &user)
+					}
+				case "items":
+					var item repository.Item
+					if err = bson.Unmarshal(raw, &item); err == nil {
+						if err = repos.Items.Create(ctx, &item); errors.Is(err, repository.ErrDuplicate) {
+							err = nil
+						}
+					}
+				}
+			}
+			if err != nil {
+				return counts, fmt.Errorf("%s: document %d: %v", f.file, i, err)
+			}
+		}
+		counts[f.collection] = len(docs)
+	}
+	return counts, nil
+}
+
+// runSeed implements `seed [-reset] [config flags]`: it loads the fixtures
+// into the database, refusing with APP_ENV=production
+func runSeed(args []string) int {
+	reset := false
+	var rest []string
+	for _, arg := range args {
+		if arg == "-reset" || arg == "--reset" {
+			reset = true
+		} else {
+			rest = append(rest, arg)
+		}
+	}
+	if productionMode() {
+		fmt.Fprintln(os.Stderr, "seed: refusing to seed with APP_ENV=production")
+		return 1
+	}
+
+	loadConfig(rest)
+	initTenancy()
+	if memoryStore() {
+		fmt.Fprintln(os.Stderr, "seed: STORE=memory is seeded when the service starts")
+		return 1
+	}
+	if postgresStore() {
+		return runSeedPostgres(reset)
+	}
+	initVault()
+	initMongo()
+	defer mongoClient.Disconnect(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	// Fixtures rely on the migrated schema, e.g. the unique item names
+	for _, db := range migrationDatabases() {
+		if _, err := migrateUp(ctx, db, 0); err != nil {
+			log.Error().Err(err).Str("db", db.Name()).Msg("Migration failed")
+			return 1
+		}
+	}
+	// Every tenant gets the fixtures
+	for _, name := range dataDatabases() {
+		counts, err := seedDatabase(ctx, mongoClient.Database(name), seedDir(), reset)
+		if err != nil {
+			log.Error().Err(err).Str("db", name).Msg("Seeding failed")
+			return 1
+		}
+		log.Info().Str("db", name).Interface("documents", counts).Bool("reset", reset).Msg("Database seeded")
+	}
+	return 0
+}
+
+// runSeedPostgres loads the fixtures into STORE=postgres, through the
+// repositories, so records already there are kept
+func runSeedPostgres(reset bool) int {
+	if reset {
+		fmt.Fprintln(os.Stderr, "seed: -reset needs STORE=mongo")
+		return 2
+	}
+	initVault()
+	initPostgres()
+	defer pgPool.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := repository.MigratePostgres(ctx, pgPool); err != nil {
+		log.Error().Err(err).Msg("Migration failed")
+		return 1
+	}
+	counts, err := seedRepositories(ctx, repository.NewPostgres(pgPool), seedDir())
+	if err != nil {
+		log.Error().Err(err).Msg("Seeding failed")
+		return 1
+	}
+	log.Info().Interface("documents", counts).Msg("Database seeded")
+	return 0
+}
+
+// registerSeedRoutes mounts POST /admin/seed outside production, loading
+// the fixtures; ?reset=true empties their collections first, with
+// STORE=mongo only
+func registerSeedRoutes(app *fiber.App, repos *repository.Repositories) {
+	if productionMode() {
+		return
+	}
+	app.Post("/admin/seed", requireRole("admin"), func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(c.UserContext(), time.Minute)
+		defer cancel()
+		var counts map[string]int
+		var err error
+		switch {
+		case mongoStore():
+			// The caller's tenant's database, with TENANTS
+			db := mongoClient.Database(tenantDatabase(repository.TenantOf(ctx)))
+			counts, err = seedDatabase(ctx, db, seedDir(), c.QueryBool("reset"))
+		case c.QueryBool("reset"):
+			return apperror.Validation("Invalid parameters", fiber.Map{"reset": "needs STORE=mongo"})
+		default:
+			counts, err = seedRepositories(ctx, repos, seedDir())
+		}
+		if err != nil {
+			return apperror.Internal("Seeding failed", err)
+		}
+		requestLogger(ctx).Info().Interface("documents", counts).Msg("Database seeded")
+		return c.JSON(fiber.Map{"seeded": counts})
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// sessions is set when SESSION_TRACKING=true
+var sessions *sessionStore
+
+// sessionStore remembers Keycloak sessions (sid) that were logged out, so
+// their still-unexpired tokens are rejected. A logout of every session of a
+// subject is kept under "sub:<sub>" and ends the sessions it issued until then.
+type sessionStore struct {
+	terminated repository.EphemeralRepository // by sid, or "sub:<sub>"
+
+	// maxLifetime bounds how long a terminated session must be remembered,
+	// i.e. Keycloak's SSO Session Max
+	maxLifetime time.Duration
+
+	// cache spares a database round trip per request; terminated sids are
+	// cached until they expire, live ones briefly
+	cache *ttlCache[bool]
+	// subjects caches when each subject last had all its sessions ended,
+	// the zero time if never, on the same terms
+	subjects *ttlCache[time.Time]
+}
+
+// liveSessionCacheTTL is how long a sid found live is trusted without re-checking,
+// i.e. the worst-case delay before a logout performed by another replica applies
+const liveSessionCacheTTL = 5 * time.Second
+
+// terminatedSession is a record of terminated_sessions
+type terminatedSession struct {
+	Sub          string    `bson:"sub"`
+	TerminatedAt time.Time `bson:"terminatedAt"`
+}
+
+func newSessionStore(maxLifetime time.Duration) *sessionStore {
+	return &sessionStore{
+		terminated:  ephemeralStore("terminated_sessions"),
+		maxLifetime: maxLifetime,
+		cache:       newTTLCache[bool](10000),
+		subjects:    newTTLCache[time.Time](10000),
+	}
+}
+
+func subjectSessionsKey(sub string) string {
+	return "sub:" + sub
+}
+
+func (s *sessionStore) terminate(ctx context.Context, sid, sub string) error {
+	now := time.Now()
+	if err := s.terminated.Put(ctx, sid, terminatedSession{Sub: sub, TerminatedAt: now}, now.Add(s.maxLifetime)); err != nil {
+		return err
+	}
+	s.cache.set(sid, true, now.Add(s.maxLifetime))
+	return nil
+}
+
+// terminateSubject ends every session of sub started at or before now
+func (s *sessionStore) terminateSubject(ctx context.Context, sub string) error {
+	now := time.Now()
+	if err := s.terminated.Put(ctx, subjectSessionsKey(sub), terminatedSession{Sub: sub, TerminatedAt: now}, now.Add(s.maxLifetime)); err != nil {
+		return err
+	}
+	s.subjects.set(sub, now, now.Add(s.maxLifetime))
+	return nil
+}
+
+// isTerminated reports whether the session of claims was logged out on its
+// own or along with every other session of its subject
+func (s *sessionStore) isTerminated(ctx context.Context, claims *KeycloakClaims) (bool, error) {
+	terminated, err := s.isSessionTerminated(ctx, claims.SessionID)
+	if terminated || err != nil {
+		return terminated, err
+	}
+	terminatedAt, err := s.subjectTerminatedAt(ctx, claims.Subject)
+	if err != nil || terminatedAt.IsZero() {
+		return false, err
+	}
+	// Tokens without iat can't prove they were issued after the logout
+	if claims.IssuedAt == nil {
+		return true, nil
+	}
+	return !claims.IssuedAt.After(terminatedAt), nil
+}
+
+func (s *sessionStore) isSessionTerminated(ctx context.Context, sid string) (bool, error) {
+	if terminated, ok := s.cache.get(sid); ok {
+		return terminated, nil
+	}
+	err := s.terminated.Get(ctx, sid, nil)
+	switch {
+	case err == nil:
+		s.cache.set(sid, true, time.Now().Add(s.maxLifetime))
+		return true, nil
+	case errors.Is(err, repository.ErrNotFound):
+		s.cache.set(sid, false, time.Now().Add(liveSessionCacheTTL))
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// subjectTerminatedAt returns when all sessions of sub were last ended, or
+// the zero time
+func (s *sessionStore) subjectTerminatedAt(ctx context.Context, sub string) (time.Time, error) {
+	if terminatedAt, ok := s.subjects.get(sub); ok {
+		return terminatedAt, nil
+	}
+	var record terminatedSession
+	err := s.terminated.Get(ctx, subjectSessionsKey(sub), &record)
+	switch {
+	case err == nil:
+		s.subjects.set(sub, record.TerminatedAt, record.TerminatedAt.Add(s.maxLifetime))
+		return record.TerminatedAt, nil
+	case errors.Is(err, repository.ErrNotFound):
+		s.subjects.set(sub, time.Time{}, time.Now().Add(liveSessionCacheTTL))
+		return time.Time{}, nil
+	default:
+		return time.Time{}, err
+	}
+}
+
+// checkSession rejects tokens whose Keycloak session has been logged out
+func checkSession(ctx context.Context, claims *KeycloakClaims) error {
+	if claims.SessionID == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	terminated, err := sessions.isTerminated(ctx, claims)
+	if err != nil {
+		requestLogger(ctx).Error().Err(err).Msg("Session check error")
+		return fmt.Errorf("cannot check session")
+	}
+	if terminated {
+		return fmt.Errorf("session has been logged out")
+	}
+	return nil
+}
+
+// Admin endpoint to end a session without going through Keycloak
+func registerSessionRoutes(app *fiber.App) {
+	app.Post("/admin/sessions/:sid/terminate", requireRole("admin"), func(c *fiber.Ctx) error {
+		if err := sessions.terminate(c.UserContext(), c.Params("sid"), ""); err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.JSON(fiber.Map{"terminated": c.Params("sid")})
+	})
+}
+
+// endSessions records a back-channel logout; one without sid ends every
+// session of sub
+func endSessions(sid, sub string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if sid == "" {
+		if err := sessions.terminateSubject(ctx, sub); err != nil {
+			log.Error().Err(err).Str("sub", sub).Msg("Session terminate error")
+		}
+		return
+	}
+	if err := sessions.terminate(ctx, sid, sub); err != nil {
+		log.Error().Err(err).Str("sid", sid).Msg("Session terminate error")
+	}
+}
+
+// Enable terminated-session checks when SESSION_TRACKING=true
+func initSessions() {
+	if !cfg.Auth.SessionTracking {
+		return
+	}
+	sessions = newSessionStore(cfg.Auth.SessionMaxLifetime)
+	onBackchannelLogout(endSessions)
+	log.Info().Msg("Session tracking enabled")
+}
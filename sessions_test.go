@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// trackSessions enables session tracking for the duration of t
+func trackSessions(t *testing.T) {
+	t.Helper()
+	saved, savedHandlers := sessions, logoutHandlers
+	t.Cleanup(func() { sessions, logoutHandlers = saved, savedHandlers })
+	sessions = newSessionStore(time.Hour)
+	onBackchannelLogout(endSessions)
+}
+
+func TestLogoutWithoutSidEndsEverySessionOfTheSubject(t *testing.T) {
+	trackSessions(t)
+	app := authApp()
+	registerLogoutRoutes(app)
+	earlier := time.Now().Add(-time.Minute)
+	sessionToken := func(sub, sid string, iat time.Time) string {
+		return sign(t, map[string]interface{}{
+			"sub": sub, "sid": sid, "preferred_username": sub,
+			"iat": iat.Unix(), "exp": iat.Add(time.Hour).Unix(),
+		})
+	}
+	first := sessionToken("tokentest-dave", "dave-1", earlier)
+	second := sessionToken("tokentest-dave", "dave-2", earlier)
+	other := sessionToken("tokentest-erin", "erin-1", earlier)
+	for _, tok := range []string{first, second, other} {
+		if resp := call(t, app, http.MethodGet, "/me", tok); resp.StatusCode != http.StatusOK {
+			t.Fatalf("before logout: got %d, want 200", resp.StatusCode)
+		}
+	}
+
+	logout := sign(t, map[string]interface{}{
+		"sub":    "tokentest-dave",
+		"jti":    "logout-dave",
+		"events": map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+	})
+	form := url.Values{"logout_token": {logout}}
+	req := httptest.NewRequest(http.MethodPost, "/auth/backchannel-logout", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("logout: got %d, want 200", resp.StatusCode)
+	}
+
+	for _, tc := range []struct {
+		name, token string
+		want        int
+	}{
+		{"first session", first, http.StatusUnauthorized},
+		{"second session", second, http.StatusUnauthorized},
+		{"session started after the logout", sessionToken("tokentest-dave", "dave-3", time.Now().Add(time.Second)), http.StatusOK},
+		{"another subject", other, http.StatusOK},
+	} {
+		if resp := call(t, app, http.MethodGet, "/me", tc.token); resp.StatusCode != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// serve runs app on addr until SIGINT or SIGTERM, then stops accepting
+// connections and drains in-flight requests for up to SHUTDOWN_TIMEOUT
+// before closing Mongo and flushing traces. It exits non-zero
+// only when the drain times out or a second signal forces the exit.
+func serve(app *fiber.App, addr string) {
+	timeout := cfg.Server.ShutdownTimeout
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- listen(app, addr)
+	}()
+
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		log.Fatal().Err(err).Msg("Server error")
+	case s := <-sig:
+		log.Info().Str("signal", s.String()).Dur("timeout", timeout).Msg("Shutting down, draining requests")
+	}
+	go func() {
+		<-sig
+		log.Error().Msg("Second signal, exiting without draining")
+		os.Exit(1)
+	}()
+
+	stopEventStreams()
+	stopUserSync()
+	forced := false
+	if err := shutdownServer(app, timeout); err != nil {
+		log.Error().Err(err).Msg("Drain timed out, dropping remaining requests")
+		forced = true
+	}
+	if internalApp != nil {
+		_ = internalApp.ShutdownWithTimeout(5 * time.Second)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if tracerProvider != nil {
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			log.Error().Err(err).Msg("Trace flush error")
+		}
+	}
+	if mongoClient != nil {
+		if err := mongoClient.Disconnect(ctx); err != nil {
+			log.Error().Err(err).Msg("Mongo disconnect error")
+		}
+	}
+	if pgPool != nil {
+		pgPool.Close()
+	}
+
+	if forced {
+		os.Exit(1)
+	}
+	log.Info().Msg("Shutdown complete")
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Row limits of GET /admin/stats/:name
+const (
+	defaultStatRows = 50
+	maxStatRows     = 500
+)
+
+// statParams reads ?since and ?until, RFC 3339 times, and ?limit
+func statParams(c *fiber.Ctx) (repository.StatParams, error) {
+	p := repository.StatParams{Limit: defaultStatRows}
+	errs := fiber.Map{}
+	for _, bound := range []struct {
+		name string
+		dest *time.Time
+	}{{"since", &p.Since}, {"until", &p.Until}} {
+		v := c.Query(bound.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			errs[bound.name] = "must be an RFC 3339 time"
+			continue
+		}
+		*bound.dest = t
+	}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxStatRows {
+			errs["limit"] = "must be 1-" + strconv.Itoa(maxStatRows)
+		}
+		p.Limit = n
+	}
+	if len(errs) > 0 {
+		return p, apperror.Validation("Invalid stats parameters", errs)
+	}
+	return p, nil
+}
+
+// registerStatsRoutes mounts the admin statistics: GET /admin/stats lists
+// them, GET /admin/stats/<name> computes one
+func registerStatsRoutes(app *fiber.App, stats repository.StatsRunner) {
+	admin := requireRole("admin")
+
+	app.Get("/admin/stats", admin, func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"stats": stats.Stats()})
+	})
+
+	app.Get("/admin/stats/:name", admin, func(c *fiber.Ctx) error {
+		params, err := statParams(c)
+		if err != nil {
+			return err
+		}
+		rows, err := stats.Run(c.UserContext(), c.Params("name"), params)
+		if errors.Is(err, repository.ErrNotFound) {
+			return apperror.NotFound("Unknown statistic; GET /admin/stats lists them")
+		}
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.JSON(fiber.Map{"stat": c.Params("name"), "rows": rows})
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	// tenantClaim names the token claim holding the caller's tenant
+	tenantClaim = "tenant"
+	// tenants are the tenants served, from TENANTS; empty serves one, with
+	// no tenant routing
+	tenants []string
+	// servedTenants indexes tenants
+	servedTenants = map[string]bool{}
+	// tenantHeader, from TENANT_HEADER, names the header the gateway sets
+	// to the tenant it routed to, e.g. X-Tenant-ID; empty ignores it
+	tenantHeader string
+	// tenantGroupPrefix, from TENANT_GROUP_PREFIX, prefixes the groups
+	// whose members belong to a tenant: /tenants/acme for acme
+	tenantGroupPrefix = "/tenants/"
+)
+
+// tenantOf returns the caller's tenant from tenantClaim, or "". Besides a
+// string, the claim can be a Keycloak organization claim: a list of one
+// organization, or an object keyed by it.
+func tenantOf(user *User) string {
+	switch v := user.Claims.Raw[tenantClaim].(type) {
+	case string:
+		return v
+	case []interface{}:
+		if len(v) == 1 {
+			tenant, _ := v[0].(string)
+			return tenant
+		}
+	case map[string]interface{}:
+		if len(v) == 1 {
+			for tenant := range v {
+				return tenant
+			}
+		}
+	}
+	return ""
+}
+
+// multiTenant tells whether TENANTS is set
+func multiTenant() bool {
+	return len(tenants) > 0
+}
+
+// memberOf tells whether the token of user names tenant, by TENANT_CLAIM
+// or a group of TENANT_GROUP_PREFIX
+func memberOf(user *User, tenant string) bool {
+	return tenantOf(user) == tenant || user.Claims.InGroup(tenantGroupPrefix+tenant)
+}
+
+// checkTenant returns the tenant of the request: that of TENANT_HEADER when
+// the gateway sent it, provided the token belongs to it, else that of
+// TENANT_CLAIM. It fails with an authentication error when the tenant
+// isn't served or the header and the token disagree.
+func checkTenant(c *fiber.Ctx, user *User) (string, error) {
+	tenant := tenantOf(user)
+	if tenantHeader != "" {
+		if routed := c.Get(tenantHeader); routed != "" {
+			if !memberOf(user, routed) {
+				return "", failure("tenant_mismatch", fmt.Errorf("%s %q doesn't match the token's tenant", tenantHeader, routed))
+			}
+			tenant = routed
+		}
+	}
+	switch {
+	case tenant == "":
+		return "", failure("missing_tenant", fmt.Errorf("token has no %s claim", tenantClaim))
+	case !servedTenants[tenant]:
+		return "", failure("unknown_tenant", fmt.Errorf("tenant %q is not served here", tenant))
+	}
+	return tenant, nil
+}
+
+// withRequestTenant carries the tenant of c's request into ctx, for work
+// outliving the handler
+func withRequestTenant(ctx context.Context, c *fiber.Ctx) context.Context {
+	return repository.WithTenant(ctx, repository.TenantOf(c.UserContext()))
+}
+
+// tenantDatabase names the Mongo database of tenant: MONGO_DB, suffixed
+// with the tenant when several are served
+func tenantDatabase(tenant string) string {
+	if tenant == "" {
+		return cfg.Mongo.Database
+	}
+	return cfg.Mongo.Database + "_" + tenant
+}
+
+// dataDatabases names the Mongo databases holding repository data: one per
+// tenant, or MONGO_DB
+func dataDatabases() []string {
+	if !multiTenant() {
+		return []string{cfg.Mongo.Database}
+	}
+	names := make([]string, len(tenants))
+	for i, tenant := range tenants {
+		names[i] = tenantDatabase(tenant)
+	}
+	return names
+}
+
+// Load TENANT_CLAIM and TENANTS, the comma-separated tenants served. Each
+// tenant then has its own data: a database named MONGO_DB_<tenant>, or its
+// own memory store. Requests must carry a served tenant in TENANT_CLAIM, or
+// in TENANT_HEADER with a token belonging to it.
+func initTenancy() {
+	tenantClaim = cfg.Tenancy.Claim
+	tenantHeader = cfg.Tenancy.Header
+	tenantGroupPrefix = cfg.Tenancy.GroupPrefix
+	tenants = cfg.Tenancy.Tenants
+	if !multiTenant() {
+		return
+	}
+	for _, tenant := range tenants {
+		servedTenants[tenant] = true
+	}
+	log.Info().Strs("tenants", tenants).Str("claim", tenantClaim).Str("header", tenantHeader).Msg("Multi-tenancy enabled")
+}
+
+// migrationDatabases are the Mongo databases migrations apply to: MONGO_DB,
+// which keeps the collections shared by tenants, then each tenant's
+func migrationDatabases() []*mongo.Database {
+	dbs := []*mongo.Database{mongoDB}
+	if multiTenant() {
+		for _, name := range dataDatabases() {
+			dbs = append(dbs, mongoClient.Database(name))
+		}
+	}
+	return dbs
+}
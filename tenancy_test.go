@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+)
+
+// serveTenants serves tenants a and b, routed by X-Tenant-ID, until the
+// test ends
+func serveTenants(t *testing.T) {
+	saved, savedServed, savedHeader := tenants, servedTenants, tenantHeader
+	t.Cleanup(func() {
+		tenants, servedTenants, tenantHeader = saved, savedServed, savedHeader
+	})
+	tenants = []string{"a", "b"}
+	servedTenants = map[string]bool{"a": true, "b": true}
+	tenantHeader = "X-Tenant-ID"
+}
+
+// tenantApp answers GET /tenant with the tenant repository calls go to
+func tenantApp() *fiber.App {
+	app := newTestApp()
+	app.Get("/tenant", authenticate(), func(c *fiber.Ctx) error {
+		return c.SendString(repository.TenantOf(c.UserContext()))
+	})
+	return app
+}
+
+func TestTenantClaimRoutesRequests(t *testing.T) {
+	serveTenants(t)
+	app := tenantApp()
+
+	for _, tc := range []struct {
+		name   string
+		claim  interface{}
+		status int
+		tenant string
+	}{
+		{"string", "a", http.StatusOK, "a"},
+		{"organization list", []string{"b"}, http.StatusOK, "b"},
+		{"organization object", map[string]interface{}{"a": map[string]interface{}{}}, http.StatusOK, "a"},
+		{"missing", nil, http.StatusUnauthorized, ""},
+		{"several organizations", []string{"a", "b"}, http.StatusUnauthorized, ""},
+		{"not served", "c", http.StatusUnauthorized, ""},
+	} {
+		claims := map[string]interface{}{"sub": "alice"}
+		if tc.claim != nil {
+			claims["tenant"] = tc.claim
+		}
+		resp := call(t, app, http.MethodGet, "/tenant", sign(t, claims))
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got %d %s, want %d", tc.name, resp.StatusCode, body, tc.status)
+			continue
+		}
+		if tc.tenant != "" && string(body) != tc.tenant {
+			t.Errorf("%s: routed to tenant %q, want %q", tc.name, body, tc.tenant)
+		}
+	}
+}
+
+func TestTenantHeaderMustMatchToken(t *testing.T) {
+	serveTenants(t)
+	app := tenantApp()
+	token := sign(t, map[string]interface{}{"sub": "alice", "tenant": "a"})
+	member := sign(t, map[string]interface{}{"sub": "bob", "tenant": "a", "groups": []string{"/tenants/b"}})
+
+	for _, tc := range []struct {
+		name, token, header string
+		status              int
+		tenant              string
+	}{
+		{"claim only", token, "", http.StatusOK, "a"},
+		{"header of the token", token, "a", http.StatusOK, "a"},
+		{"header of another tenant", token, "b", http.StatusUnauthorized, ""},
+		{"header of a group", member, "b", http.StatusOK, "b"},
+		{"header not served", token, "c", http.StatusUnauthorized, ""},
+	} {
+		var headers []string
+		if tc.header != "" {
+			headers = []string{"X-Tenant-ID", tc.header}
+		}
+		resp := call(t, app, http.MethodGet, "/tenant", tc.token, headers...)
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got %d %s, want %d", tc.name, resp.StatusCode, body, tc.status)
+			continue
+		}
+		if tc.tenant != "" && string(body) != tc.tenant {
+			t.Errorf("%s: routed to tenant %q, want %q", tc.name, body, tc.tenant)
+		}
+	}
+}
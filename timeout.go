@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// requestBaseContextKey holds a request's user context before its deadline
+const requestBaseContextKey = "requestBaseContext"
+
+// Middleware bounding c.UserContext() by timeout, so database calls and
+// outgoing requests of a handler give up together rather than holding a
+// connection forever
+func requestTimeoutMiddleware(timeout time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		base := c.UserContext()
+		ctx, cancel := context.WithTimeout(base, timeout)
+		defer cancel()
+		c.Locals(requestBaseContextKey, base)
+		c.SetUserContext(ctx)
+		return c.Next()
+	}
+}
+
+// requestContext is the request's user context with timeout in place of
+// the request timeout, for the few handlers that need longer, e.g. uploads
+func requestContext(c *fiber.Ctx, timeout time.Duration) (context.Context, context.CancelFunc) {
+	base, ok := c.Locals(requestBaseContextKey).(context.Context)
+	if !ok {
+		base = c.UserContext()
+	}
+	return context.WithTimeout(base, timeout)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// certReloader serves the certificate in TLS_CERT_FILE/TLS_KEY_FILE and
+// reloads it when either file changes, so renewed certificates (cert-manager,
+// certbot) are picked up without a restart
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// tlsCerts is set when TLS_CERT_FILE is; the server then speaks HTTPS
+var tlsCerts *certReloader
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload loads the key pair if either file is newer than the one in use. A
+// pair that fails to load, e.g. mid-rotation, keeps the previous one serving.
+func (r *certReloader) reload() (bool, error) {
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	r.mu.RLock()
+	current := r.cert != nil && !modTime.After(r.modTime)
+	r.mu.RUnlock()
+	if current {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	r.cert, r.modTime = &cert, modTime
+	r.mu.Unlock()
+	return true, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// watch polls the files; polling also follows the symlink swaps Kubernetes
+// uses to update mounted secrets
+func (r *certReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, err := r.reload()
+		if err != nil {
+			log.Error().Err(err).Str("file", r.certFile).Msg("TLS certificate reload error")
+		} else if reloaded {
+			log.Info().Str("file", r.certFile).Msg("TLS certificate reloaded")
+		}
+	}
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// tlsListener wraps a TCP listener on addr in TLS with the reloading
+// certificate, offering protos via ALPN and requiring client certificates
+// from GATEWAY_CLIENT_CA when gateway mTLS is on
+func tlsListener(addr string, protos ...string) (net.Listener, error) {
+	conf := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: tlsCerts.getCertificate,
+		NextProtos:     protos,
+	}
+	if gatewayMTLS {
+		pem, err := os.ReadFile(cfg.Gateway.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("GATEWAY_CLIENT_CA: no certificates found")
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tls.Listen("tcp", addr, conf)
+}
+
+// Load the certificate of tls.certFile and tls.keyFile, checking for changes
+// every tls.reloadInterval (0 disables reloading)
+func initTLS() {
+	certFile, keyFile := cfg.TLS.CertFile, cfg.TLS.KeyFile
+	if certFile == "" && keyFile == "" {
+		return
+	}
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("TLS certificate error")
+	}
+	tlsCerts = r
+	if interval := cfg.TLS.ReloadInterval; interval > 0 {
+		go r.watch(interval)
+	}
+	log.Info().Str("cert", certFile).Msg("Serving HTTPS")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// exchangedTokens caches downstream tokens by subject token hash and audience
+var exchangedTokens = newTTLCache[string](10000)
+
+// downstreamHTTP is used for calls to other services on behalf of the caller
+var downstreamHTTP = &http.Client{Timeout: 10 * time.Second}
+
+// exchangeToken trades subjectToken for an access token minted for audience
+// (RFC 8693 token exchange). The client needs token exchange permission on
+// the target client in Keycloak.
+func (k *keycloakClient) exchangeToken(subjectToken, audience string) (string, error) {
+	sum := sha256.Sum256([]byte(subjectToken))
+	key := hex.EncodeToString(sum[:]) + "|" + audience
+	if tok, ok := exchangedTokens.get(key); ok {
+		return tok, nil
+	}
+
+	tok, err := k.requestToken(url.Values{
+		"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"subject_token":        {subjectToken},
+		"subject_token_type":   {"urn:ietf:params:oauth:token-type:access_token"},
+		"requested_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
+		"audience":             {audience},
+	})
+	if err != nil {
+		return "", err
+	}
+	// Renew 30s early so a token never expires in flight
+	exchangedTokens.set(key, tok.AccessToken, time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second-30*time.Second))
+	return tok.AccessToken, nil
+}
+
+// callDownstream sends req to another service with the caller's identity:
+// the request's bearer token is exchanged for one for audience
+func callDownstream(c *fiber.Ctx, audience string, req *http.Request) (*http.Response, error) {
+	kc := keycloak()
+	if kc == nil {
+		return nil, fmt.Errorf("token exchange requires KEYCLOAK_CLIENT_ID/KEYCLOAK_CLIENT_SECRET")
+	}
+	subjectToken, err := bearerToken(c)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := kc.exchangeToken(subjectToken, audience)
+	if err != nil {
+		return nil, fmt.Errorf("token exchange for %s failed: %v", audience, err)
+	}
+	req = req.WithContext(c.UserContext())
+	req.Header.Set("Authorization", "Bearer "+tok)
+	if id := requestID(c); id != "" {
+		req.Header.Set(headerRequestID, id)
+	}
+	injectTrace(req.Context(), req)
+	return downstreamHTTP.Do(req)
+}
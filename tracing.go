@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerProvider is set when OTEL_EXPORTER_OTLP_ENDPOINT is; spans are
+// batched to the OTLP/HTTP collector
+var tracerProvider *sdktrace.TracerProvider
+
+var tracer = otel.Tracer("github.com/example/fiber-demo")
+
+// Middleware starting a server span per request, continuing the trace of a
+// W3C traceparent header forwarded by KrakenD. The span context is put in
+// the user context, so Mongo calls and downstream requests made with
+// c.UserContext() join the trace, and log lines carry trace_id.
+func tracingMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), fiberCarrier{c})
+		ctx, span := tracer.Start(ctx, c.Method()+" "+c.Path(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Method()),
+				semconv.URLPath(c.Path()),
+				semconv.ClientAddress(c.IP()),
+			))
+		defer span.End()
+
+		if sc := span.SpanContext(); sc.HasTraceID() {
+			logger := requestLogger(ctx).With().Str("trace_id", sc.TraceID().String()).Logger()
+			ctx = logger.WithContext(ctx)
+		}
+		c.SetUserContext(ctx)
+
+		err := c.Next()
+		if err != nil {
+			// Render the error now so the recorded status is the one sent
+			if herr := c.App().ErrorHandler(c, err); herr != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+		status := c.Response().StatusCode()
+		span.SetName(c.Method() + " " + c.Route().Path)
+		span.SetAttributes(semconv.HTTPRoute(c.Route().Path), semconv.HTTPResponseStatusCode(status))
+		if user := userFromCtx(c); user != nil {
+			span.SetAttributes(attribute.String("enduser.id", user.Subject))
+		}
+		if status >= fiber.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		return nil
+	}
+}
+
+// fiberCarrier adapts request headers to propagation.TextMapCarrier
+type fiberCarrier struct{ c *fiber.Ctx }
+
+func (f fiberCarrier) Get(key string) string { return f.c.Get(key) }
+
+func (f fiberCarrier) Set(key, value string) { f.c.Request().Header.Set(key, value) }
+
+func (f fiberCarrier) Keys() []string {
+	var keys []string
+	f.c.Request().Header.VisitAll(func(k, _ []byte) {
+		keys = append(keys, string(k))
+	})
+	return keys
+}
+
+// injectTrace adds the traceparent of ctx to an outgoing request
+func injectTrace(ctx context.Context, req *http.Request) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+}
+
+// mongoMonitors combines the metrics monitor with otelmongo spans when
+// tracing is enabled; the driver accepts a single monitor
+func mongoMonitors() *event.CommandMonitor {
+	metrics := mongoMonitor()
+	if tracerProvider == nil {
+		return metrics
+	}
+	spans := otelmongo.NewMonitor(otelmongo.WithTracerProvider(tracerProvider))
+	return &event.CommandMonitor{
+		Started: spans.Started,
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			spans.Succeeded(ctx, e)
+			metrics.Succeeded(ctx, e)
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			spans.Failed(ctx, e)
+			metrics.Failed(ctx, e)
+		},
+	}
+}
+
+// Set up OTLP export to tracing.endpoint or tracing.tracesEndpoint, the
+// standard OTEL_EXPORTER_OTLP_* variables; the other OTEL_* ones apply too:
+// OTEL_SERVICE_NAME names the service and OTEL_TRACES_SAMPLER picks the
+// sampler
+func initTracing() {
+	// W3C trace context is always propagated, so a trace continues through
+	// this service even when it exports nothing itself
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	endpoint := cfg.Tracing.TracesEndpoint
+	if endpoint == "" && cfg.Tracing.Endpoint != "" {
+		endpoint = strings.TrimSuffix(cfg.Tracing.Endpoint, "/") + "/v1/traces"
+	}
+	if endpoint == "" {
+		return
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		log.Fatal().Err(err).Msg("OTLP exporter error")
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the default name
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(semconv.ServiceName("fiber-demo")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		log.Fatal().Err(err).Msg("OTel resource error")
+	}
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tracerProvider)
+	log.Info().Msg("OpenTelemetry tracing enabled")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Sort fields of the trash listings
+var (
+	itemTrashSortFields = append([]string{"deletedAt"}, repository.ItemSortFields...)
+	userTrashSortFields = []string{"username", "deletedAt"}
+)
+
+// registerTrashRoutes mounts the admin endpoints listing and restoring
+// soft-deleted records; the list params are the same as the live listings'
+func registerTrashRoutes(app *fiber.App, repos *repository.Repositories) {
+	admin := requireRole("admin")
+
+	app.Get("/admin/trash/items", admin, func(c *fiber.Ctx) error {
+		params, err := parseListParams(c, itemTrashSortFields, itemFilterFields)
+		if err != nil {
+			return err
+		}
+		filter, err := itemFilter(params.filter)
+		if err != nil {
+			return err
+		}
+		filter.Deleted = true
+		var total int64
+		if params.cursor == "" {
+			if total, err = repos.Items.Count(c.UserContext(), filter); err != nil {
+				return itemError(err)
+			}
+		}
+		list, next, err := repos.Items.List(c.UserContext(), filter, params.repoPage())
+		if err != nil {
+			return itemError(err)
+		}
+		return c.JSON(listEnvelope("items", list, params, total, next))
+	})
+
+	app.Post("/admin/trash/items/:id/restore", admin, func(c *fiber.Ctx) error {
+		item, err := repos.Items.Restore(c.UserContext(), c.Params("id"))
+		if errors.Is(err, repository.ErrNotFound) {
+			return apperror.NotFound("No deleted item with this ID")
+		}
+		if err != nil {
+			return itemError(err)
+		}
+		setItemETag(c, item)
+		return c.JSON(item)
+	})
+
+	app.Get("/admin/trash/users", admin, func(c *fiber.Ctx) error {
+		params, err := parseListParams(c, userTrashSortFields, nil)
+		if err != nil {
+			return err
+		}
+		if params.cursor != "" {
+			return apperror.Validation("Invalid list parameters", fiber.Map{"cursor": "not supported here, use page"})
+		}
+		list, total, err := repos.Users.ListDeleted(c.UserContext(), params.repoPage())
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.JSON(listEnvelope("users", list, params, total, ""))
+	})
+
+	app.Post("/admin/trash/users/:id/restore", admin, func(c *fiber.Ctx) error {
+		user, err := repos.Users.Restore(c.UserContext(), c.Params("id"))
+		if errors.Is(err, repository.ErrNotFound) {
+			return apperror.NotFound("No deleted user with this ID")
+		}
+		if errors.Is(err, repository.ErrSchemaViolation) {
+			return apperror.Unprocessable("The user fails the database's schema validation")
+		}
+		if err != nil {
+			return apperror.Internal("Database error", err)
+		}
+		return c.JSON(user)
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// umaTickets is set when UMA_TICKETS=true: callers lacking a permission get a
+// 401 with a permission ticket they can exchange for an RPT
+var umaTickets bool
+
+// umaResourceIDs caches resource name -> Keycloak resource ID lookups
+var umaResourceIDs = newTTLCache[string](1000)
+
+// Middleware to allow only RPTs granting scope on resource (Keycloak
+// Authorization Services). An empty scope only requires the resource.
+func requirePermission(resource, scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claims, err := requestClaims(c)
+		if err != nil {
+			return unauthorized(c, err)
+		}
+		if claims.HasPermission(resource, scope) {
+			return c.Next()
+		}
+
+		msg := fmt.Sprintf("Missing permission: %s", resource)
+		if scope != "" {
+			msg = fmt.Sprintf("Missing permission: %s#%s", resource, scope)
+		}
+		if umaTickets {
+			ticket, err := umaPermissionTicket(resource, scope)
+			if err != nil {
+				requestLogger(c.UserContext()).Error().Err(err).Msg("UMA ticket error")
+			} else {
+				c.Set(fiber.HeaderWWWAuthenticate, fmt.Sprintf(`UMA realm=%q, as_uri=%q, ticket=%q`,
+					keycloak().clientID, oidcEndpoints().Issuer, ticket))
+				recordAuthFailure(c, fiber.StatusUnauthorized, "uma_ticket")
+				return errorJSON(c, fiber.StatusUnauthorized, fiber.Map{"error": msg, "ticket": ticket})
+			}
+		}
+		return forbidden(c, "missing_permission", msg)
+	}
+}
+
+// umaPermissionTicket asks Keycloak's protection API for a ticket covering
+// resource/scope, authenticating with this service's client credentials (PAT)
+func umaPermissionTicket(resource, scope string) (string, error) {
+	kc := keycloak()
+	if kc == nil {
+		return "", fmt.Errorf("KEYCLOAK_CLIENT_ID is not configured")
+	}
+	pat, err := kc.accessToken()
+	if err != nil {
+		return "", err
+	}
+	resourceID, err := umaResourceID(kc, pat, resource)
+	if err != nil {
+		return "", err
+	}
+
+	request := map[string]interface{}{"resource_id": resourceID}
+	if scope != "" {
+		request["resource_scopes"] = []string{scope}
+	}
+	body, _ := json.Marshal([]interface{}{request})
+	req, err := http.NewRequest(http.MethodPost, oidcEndpoints().Issuer+"/authz/protection/permission", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+pat)
+	var out struct {
+		Ticket string `json:"ticket"`
+	}
+	if err := kc.do(req, &out); err != nil {
+		return "", err
+	}
+	return out.Ticket, nil
+}
+
+// umaResourceID resolves a resource name registered in Keycloak to its ID
+func umaResourceID(kc *keycloakClient, pat, name string) (string, error) {
+	if id, ok := umaResourceIDs.get(name); ok {
+		return id, nil
+	}
+	q := url.Values{"name": {name}, "exactName": {"true"}}
+	req, err := http.NewRequest(http.MethodGet, oidcEndpoints().Issuer+"/authz/protection/resource_set?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+pat)
+	var ids []string
+	if err := kc.do(req, &ids); err != nil {
+		return "", err
+	}
+	if len(ids) == 0 {
+		return "", fmt.Errorf("unknown resource %q", name)
+	}
+	umaResourceIDs.set(name, ids[0], time.Now().Add(time.Hour))
+	return ids[0], nil
+}
+
+// Enable permission tickets when UMA_TICKETS=true
+func initUMA() {
+	if !cfg.Authz.UMATickets {
+		return
+	}
+	if keycloak() == nil || oidcEndpoints().Issuer == "" {
+		log.Fatal().Msg("UMA_TICKETS=true requires KEYCLOAK_ISSUER and KEYCLOAK_CLIENT_ID/KEYCLOAK_CLIENT_SECRET")
+	}
+	umaTickets = true
+	log.Info().Msg("UMA permission tickets enabled")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/fiber/v2"
+)
+
+// User is the authenticated caller of a request. It is built once per
+// request, so stacked guards (policy, casbin, route) share one token parse.
+type User struct {
+	Subject  string
+	Username string
+	// Roles are the extracted and hierarchy-expanded roles; nil when
+	// extraction failed
+	Roles  []string
+	Claims *KeycloakClaims
+
+	rolesErr error
+}
+
+func newUser(claims *KeycloakClaims) *User {
+	roles, err := extractRoles(claims)
+	return &User{
+		Subject:  claims.Subject,
+		Username: claims.Username(),
+		Roles:    roles,
+		Claims:   claims,
+		rolesErr: err,
+	}
+}
+
+// HasRole reports whether the user holds role
+func (u *User) HasRole(role string) bool {
+	return containsString(u.Roles, role)
+}
+
+// userFromCtx returns the user stored by authenticate, or nil
+func userFromCtx(c *fiber.Ctx) *User {
+	user, _ := c.Locals("user").(*User)
+	return user
+}
+
+// currentUser returns the request's user, parsing the token on first use.
+// The claims are stored under "claims" too for claimsFromCtx.
+func currentUser(c *fiber.Ctx) (*User, error) {
+	if user := userFromCtx(c); user != nil {
+		return user, nil
+	}
+	claims, err := parseToken(c)
+	if err != nil {
+		return nil, err
+	}
+	user := newUser(claims)
+	ctx := c.UserContext()
+	logContext := requestLogger(ctx).With().Str("sub", user.Subject).Strs("roles", user.Roles)
+	if multiTenant() {
+		// Repository calls go to the tenant's data, and fail without one
+		tenant, err := checkTenant(c, user)
+		if err != nil {
+			return nil, err
+		}
+		ctx = repository.WithTenant(ctx, tenant)
+		logContext = logContext.Str("tenant", tenant)
+	}
+	if itemACL {
+		ctx = repository.WithPrincipal(ctx, principalOf(user))
+	}
+	c.Locals("user", user)
+	c.Locals("claims", claims)
+	// Later log lines of the request name the caller, and feature flags
+	// target them
+	logger := logContext.Logger()
+	c.SetUserContext(withFlagSubject(logger.WithContext(ctx), user))
+	return user, nil
+}
+
+// requestClaims returns the caller's claims via currentUser
+func requestClaims(c *fiber.Ctx) (*KeycloakClaims, error) {
+	user, err := currentUser(c)
+	if err != nil {
+		return nil, err
+	}
+	return user.Claims, nil
+}
+
+// Middleware authenticating the caller and storing the User in
+// c.Locals("user"); guards further down the chain reuse it
+func authenticate() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if _, err := currentUser(c); err != nil {
+			return unauthorized(c, err)
+		}
+		return c.Next()
+	}
+}
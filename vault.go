@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// vaultClient talks to the Vault HTTP API with a client token
+type vaultClient struct {
+	addr  string
+	token string
+	http  *http.Client
+}
+
+// vaultSecret is the envelope of Vault responses
+type vaultSecret struct {
+	LeaseID       string          `json:"lease_id"`
+	LeaseDuration int             `json:"lease_duration"`
+	Renewable     bool            `json:"renewable"`
+	Data          json.RawMessage `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// vaultEnabled adds the "vault" readiness check
+var vaultEnabled bool
+
+// vaultStatus is reported by /readyz: nil while every lease is renewed
+var vaultStatus struct {
+	mu  sync.Mutex
+	err error
+}
+
+func setVaultError(err error) {
+	vaultStatus.mu.Lock()
+	vaultStatus.err = err
+	vaultStatus.mu.Unlock()
+}
+
+func vaultError() error {
+	vaultStatus.mu.Lock()
+	defer vaultStatus.mu.Unlock()
+	return vaultStatus.err
+}
+
+func (v *vaultClient) do(ctx context.Context, method, path string, body interface{}) (*vaultSecret, error) {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, v.addr+"/v1/"+strings.TrimPrefix(path, "/"), payload)
+	if err != nil {
+		return nil, err
+	}
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vault %s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	var secret vaultSecret
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil && resp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("vault %s %s: status %d", method, path, resp.StatusCode)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("vault %s %s: status %d: %s", method, path, resp.StatusCode, strings.Join(secret.Errors, "; "))
+	}
+	return &secret, nil
+}
+
+// loginKubernetes exchanges the pod's service account token for a Vault token
+func (v *vaultClient) loginKubernetes(ctx context.Context, role string) (*vaultSecret, error) {
+	jwt, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/token")
+	if err != nil {
+		return nil, err
+	}
+	secret, err := v.do(ctx, http.MethodPost, "auth/kubernetes/login", map[string]string{"role": role, "jwt": string(jwt)})
+	if err != nil {
+		return nil, err
+	}
+	if secret.Auth == nil {
+		return nil, fmt.Errorf("vault kubernetes login returned no token")
+	}
+	v.token = secret.Auth.ClientToken
+	return secret, nil
+}
+
+// renewEvery keeps a lease alive, renewing it when two thirds of its
+// duration have passed. Once Vault stops extending it (max TTL reached) or
+// renewal fails, the error is reported by /readyz so the pod gets replaced
+// before the credentials expire.
+func (v *vaultClient) renewEvery(name string, duration time.Duration, renew func(ctx context.Context) (time.Duration, error)) {
+	for {
+		time.Sleep(duration * 2 / 3)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		next, err := renew(ctx)
+		cancel()
+		if err != nil {
+			log.Error().Err(err).Str("lease", name).Msg("Vault lease renewal failed")
+			setVaultError(fmt.Errorf("%s lease not renewed: %v", name, err))
+			return
+		}
+		if next < duration/2 {
+			log.Warn().Str("lease", name).Dur("remaining", next).Msg("Vault lease reaching its max TTL")
+			setVaultError(fmt.Errorf("%s lease expires in %s", name, next))
+		}
+		if next <= 0 {
+			return
+		}
+		duration = next
+	}
+}
+
+func (v *vaultClient) renewLease(leaseID string, increment int) func(ctx context.Context) (time.Duration, error) {
+	return func(ctx context.Context) (time.Duration, error) {
+		secret, err := v.do(ctx, http.MethodPut, "sys/leases/renew", map[string]interface{}{"lease_id": leaseID, "increment": increment})
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(secret.LeaseDuration) * time.Second, nil
+	}
+}
+
+func (v *vaultClient) renewToken(ctx context.Context) (time.Duration, error) {
+	secret, err := v.do(ctx, http.MethodPost, "auth/token/renew-self", nil)
+	if err != nil {
+		return 0, err
+	}
+	if secret.Auth == nil {
+		return 0, fmt.Errorf("vault token renewal returned no auth")
+	}
+	return time.Duration(secret.Auth.LeaseDuration) * time.Second, nil
+}
+
+// mongoCredentials issues dynamic database credentials and writes them into
+// cfg.Mongo.URI
+func (v *vaultClient) mongoCredentials(ctx context.Context) error {
+	vc := cfg.Vault
+	secret, err := v.do(ctx, http.MethodGet, vc.MongoMount+"/creds/"+vc.MongoRole, nil)
+	if err != nil {
+		return err
+	}
+	var creds struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal(secret.Data, &creds); err != nil {
+		return fmt.Errorf("vault mongo credentials: %v", err)
+	}
+	u, err := url.Parse(cfg.Mongo.URI)
+	if err != nil {
+		return err
+	}
+	u.User = url.UserPassword(creds.Username, creds.Password)
+	cfg.Mongo.URI = u.String()
+	log.Info().Str("user", creds.Username).Dur("lease", time.Duration(secret.LeaseDuration)*time.Second).Msg("Using Mongo credentials from Vault")
+	if secret.Renewable && secret.LeaseDuration > 0 {
+		go v.renewEvery("mongo", time.Duration(secret.LeaseDuration)*time.Second, v.renewLease(secret.LeaseID, secret.LeaseDuration))
+	}
+	return nil
+}
+
+// keycloakSecret reads the client secret from a KV v2 secret into
+// cfg.Keycloak.ClientSecret
+func (v *vaultClient) keycloakSecret(ctx context.Context) error {
+	vc := cfg.Vault
+	secret, err := v.do(ctx, http.MethodGet, vc.KeycloakSecretPath, nil)
+	if err != nil {
+		return err
+	}
+	var kv struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(secret.Data, &kv); err != nil {
+		return fmt.Errorf("vault %s: %v", vc.KeycloakSecretPath, err)
+	}
+	value := kv.Data[vc.KeycloakSecretKey]
+	if value == "" {
+		return fmt.Errorf("vault %s: no %q field", vc.KeycloakSecretPath, vc.KeycloakSecretKey)
+	}
+	cfg.Keycloak.ClientSecret = value
+	log.Info().Str("path", vc.KeycloakSecretPath).Msg("Using Keycloak client secret from Vault")
+	return nil
+}
+
+// Fetch secrets from Vault when VAULT_ADDR is set; runs before anything
+// uses the Mongo URI or the Keycloak client secret
+func initVault() {
+	vc := cfg.Vault
+	if vc.Addr == "" {
+		return
+	}
+	client := &vaultClient{addr: strings.TrimSuffix(vc.Addr, "/"), token: vc.Token, http: &http.Client{Timeout: 10 * time.Second}}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if vc.KubernetesRole != "" {
+		login, err := client.loginKubernetes(ctx, vc.KubernetesRole)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Vault login error")
+		}
+		if login.Auth.Renewable && login.Auth.LeaseDuration > 0 {
+			go client.renewEvery("token", time.Duration(login.Auth.LeaseDuration)*time.Second, client.renewToken)
+		}
+	} else if self, err := client.do(ctx, http.MethodGet, "auth/token/lookup-self", nil); err != nil {
+		log.Fatal().Err(err).Msg("Vault token error")
+	} else {
+		var info struct {
+			TTL       int  `json:"ttl"`
+			Renewable bool `json:"renewable"`
+		}
+		if err := json.Unmarshal(self.Data, &info); err == nil && info.Renewable && info.TTL > 0 {
+			go client.renewEvery("token", time.Duration(info.TTL)*time.Second, client.renewToken)
+		}
+	}
+
+	if vc.MongoRole != "" {
+		if err := client.mongoCredentials(ctx); err != nil {
+			log.Fatal().Err(err).Msg("Vault Mongo credentials error")
+		}
+	}
+	if vc.KeycloakSecretPath != "" {
+		if err := client.keycloakSecret(ctx); err != nil {
+			log.Fatal().Err(err).Msg("Vault Keycloak secret error")
+		}
+	}
+	vaultEnabled = true
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/example/fiber-demo/apperror"
+	"github.com/example/fiber-demo/repository"
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+// WebSocket timings and limits
+const (
+	wsTicketTTL    = 30 * time.Second
+	wsPingInterval = 30 * time.Second
+	wsWriteTimeout = 10 * time.Second
+	wsReadLimit    = 4096
+	wsSendBuffer   = 16
+)
+
+// wsTickets are one-time tickets for browsers, which can't set an
+// Authorization header on the upgrade request. They live in memory, so a
+// ticket only works on the replica that issued it.
+var wsTickets = newTTLCache[wsTicket](10000)
+
+// wsTicket is who a ticket was issued to, and the tenant their request
+// was routed to
+type wsTicket struct {
+	user   *User
+	tenant string
+}
+
+// wsMessage is what the server pushes to clients
+type wsMessage struct {
+	Type    string      `json:"type"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	At      time.Time   `json:"at"`
+}
+
+// wsClient is one open connection, of the tenant its upgrade was checked
+// against; writes go through send so only the connection's writer
+// goroutine touches it
+type wsClient struct {
+	user   *User
+	tenant string
+	send   chan []byte
+}
+
+// wsHub tracks open connections by subject
+type wsHub struct {
+	mu      sync.Mutex
+	clients map[string]map[*wsClient]struct{}
+}
+
+var websockets = &wsHub{clients: map[string]map[*wsClient]struct{}{}}
+
+func (h *wsHub) add(cl *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[cl.user.Subject] == nil {
+		h.clients[cl.user.Subject] = map[*wsClient]struct{}{}
+	}
+	h.clients[cl.user.Subject][cl] = struct{}{}
+}
+
+func (h *wsHub) remove(cl *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients[cl.user.Subject], cl)
+	if len(h.clients[cl.user.Subject]) == 0 {
+		delete(h.clients, cl.user.Subject)
+	}
+}
+
+// push sends msg to the connections of tenant match accepts and returns
+// how many got it. A client whose buffer is full misses the message rather
+// than stalling the others.
+func (h *wsHub) push(msg wsMessage, tenant string, match func(*User) bool) int {
+	msg.At = time.Now().UTC()
+	data, _ := json.Marshal(msg)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sent := 0
+	for _, conns := range h.clients {
+		for cl := range conns {
+			if cl.tenant != tenant || !match(cl.user) {
+				continue
+			}
+			select {
+			case cl.send <- data:
+				sent++
+			default:
+			}
+		}
+	}
+	return sent
+}
+
+// notifyUser pushes a notification to every connection of sub in tenant
+func notifyUser(tenant, sub string, msg wsMessage) int {
+	return websockets.push(msg, tenant, func(u *User) bool { return u.Subject == sub })
+}
+
+// notifyRole pushes a notification to every connection of tenant holding
+// role
+func notifyRole(tenant, role string, msg wsMessage) int {
+	return websockets.push(msg, tenant, func(u *User) bool { return u.HasRole(role) })
+}
+
+// wsAuthorize authenticates the upgrade request with ?ticket= or, failing
+// that, the usual credentials, and stores the user and their tenant for
+// the connection
+func wsAuthorize() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !websocket.IsWebSocketUpgrade(c) {
+			return fiber.ErrUpgradeRequired
+		}
+		if ticket := c.Query("ticket"); ticket != "" {
+			t, ok := wsTickets.get(ticket)
+			if !ok {
+				return unauthorized(c, errors.New("invalid or expired WebSocket ticket"))
+			}
+			wsTickets.delete(ticket)
+			c.Locals("user", t.user)
+			c.Locals("tenant", t.tenant)
+			return c.Next()
+		}
+		if _, err := currentUser(c); err != nil {
+			return unauthorized(c, err)
+		}
+		c.Locals("tenant", repository.TenantOf(c.UserContext()))
+		return c.Next()
+	}
+}
+
+// serveWebSocket runs one connection: it writes pushed messages and pings,
+// discards what the client sends, and closes when the token expires, the
+// client goes away or the server shuts down
+func serveWebSocket(conn *websocket.Conn) {
+	user, _ := conn.Locals("user").(*User)
+	tenant, _ := conn.Locals("tenant").(string)
+	cl := &wsClient{user: user, tenant: tenant, send: make(chan []byte, wsSendBuffer)}
+	websockets.add(cl)
+	defer websockets.remove(cl)
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(wsReadLimit)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var expiry <-chan time.Time
+	if exp := user.Claims.ExpiresAt; exp != nil {
+		timer := time.NewTimer(time.Until(exp.Time))
+		defer timer.Stop()
+		expiry = timer.C
+	}
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	write := func(typ int, data []byte) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return conn.WriteMessage(typ, data)
+	}
+	hello, _ := json.Marshal(wsMessage{Type: "welcome", Data: fiber.Map{"sub": user.Subject, "roles": user.Roles}, At: time.Now().UTC()})
+	if write(websocket.TextMessage, hello) != nil {
+		return
+	}
+	for {
+		var err error
+		select {
+		case data := <-cl.send:
+			err = write(websocket.TextMessage, data)
+		case <-ping.C:
+			err = write(websocket.PingMessage, nil)
+		case <-expiry:
+			_ = write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token expired"))
+			return
+		case <-eventStreams.Done():
+			_ = write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+			return
+		case <-closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// registerWebSocketRoutes mounts /ws, its ticket endpoint and the admin
+// endpoint pushing notifications
+func registerWebSocketRoutes(app *fiber.App) {
+	// Tickets carry the caller's identity and tenant to the upgrade, once,
+	// for 30s
+	app.Post("/ws/ticket", authenticate(), func(c *fiber.Ctx) error {
+		b := make([]byte, 24)
+		if _, err := rand.Read(b); err != nil {
+			return apperror.Internal("Cannot issue ticket", err)
+		}
+		ticket := base64.RawURLEncoding.EncodeToString(b)
+		t := wsTicket{user: userFromCtx(c), tenant: repository.TenantOf(c.UserContext())}
+		if wsTickets.add(ticket, t, time.Now().Add(wsTicketTTL)) != nil {
+			return apperror.RateLimited("Too many pending WebSocket tickets, retry later")
+		}
+		return c.JSON(fiber.Map{"ticket": ticket, "expiresIn": int(wsTicketTTL / time.Second)})
+	})
+
+	app.Get("/ws", wsAuthorize(), websocket.New(serveWebSocket))
+
+	// Push a notification to one user (sub) or everyone with a role, of the
+	// admin's tenant
+	app.Post("/admin/notifications", requireRole("admin"), func(c *fiber.Ctx) error {
+		var body struct {
+			Sub     string      `json:"sub"`
+			Role    string      `json:"role"`
+			Message string      `json:"message"`
+			Data    interface{} `json:"data"`
+		}
+		if err := c.BodyParser(&body); err != nil {
+			return apperror.Validation("Invalid body", fiber.Map{"body": err.Error()})
+		}
+		if body.Message == "" || (body.Sub == "") == (body.Role == "") {
+			return apperror.Validation("Send a message and exactly one of sub or role")
+		}
+		msg := wsMessage{Type: "notification", Message: body.Message, Data: body.Data}
+		tenant := repository.TenantOf(c.UserContext())
+		var sent int
+		if body.Sub != "" {
+			sent = notifyUser(tenant, body.Sub, msg)
+		} else {
+			sent = notifyRole(tenant, body.Role, msg)
+		}
+		return c.JSON(fiber.Map{"delivered": sent})
+	})
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+// connect registers a connection of sub in tenant until the test ends
+func connect(t *testing.T, sub, tenant string, roles ...string) *wsClient {
+	cl := &wsClient{user: &User{Subject: sub, Roles: roles}, tenant: tenant, send: make(chan []byte, 4)}
+	websockets.add(cl)
+	t.Cleanup(func() { websockets.remove(cl) })
+	return cl
+}
+
+func TestNotificationsStayInTheirTenant(t *testing.T) {
+	aliceA := connect(t, "alice", "a", "admin")
+	aliceB := connect(t, "alice", "b", "admin")
+	bobB := connect(t, "bob", "b", "admin")
+
+	if n := notifyUser("a", "alice", wsMessage{Type: "item.shared"}); n != 1 {
+		t.Errorf("notifyUser in tenant a reached %d connections, want 1", n)
+	}
+	if len(aliceA.send) != 1 || len(aliceB.send) != 0 {
+		t.Errorf("notifyUser in tenant a: alice got %d in a and %d in b", len(aliceA.send), len(aliceB.send))
+	}
+	if n := notifyRole("b", "admin", wsMessage{Type: "admin.alert"}); n != 2 {
+		t.Errorf("notifyRole in tenant b reached %d connections, want 2", n)
+	}
+	if len(aliceA.send) != 1 || len(aliceB.send) != 1 || len(bobB.send) != 1 {
+		t.Errorf("notifyRole in tenant b: got %d, %d and %d messages", len(aliceA.send), len(aliceB.send), len(bobB.send))
+	}
+}